@@ -5,15 +5,26 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/kpfaulkner/collablite/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
+// ErrResyncRequired is returned by Listen when the client fell so far behind the server stopped
+// sending it changes. Get the object again (GetObject) and reconnect.
+var ErrResyncRequired = errors.New("resync required")
+
+// ErrReconnect is returned by Listen when the server has gone away (eg. it's shutting down). Any
+// changes not yet confirmed should be sent again once reconnected.
+var ErrReconnect = errors.New("server unavailable, reconnect")
+
 // Client is the client API for CollabLite service.
 type Client struct {
 	client proto.CollabLiteClient
@@ -33,8 +44,10 @@ type Client struct {
 	// and associated lock
 	unconfirmedLock sync.Mutex
 
-	// clientID used to help identify traffic from this client
-	clientID string
+	// clientID used to help identify traffic from this client. Only changed with both sendLock and
+	// clientIDLock held, so either is enough to read it.
+	clientID     string
+	clientIDLock sync.Mutex
 
 	// number of conflicts, purely for stats collecting.
 	numConflicts int
@@ -43,6 +56,23 @@ type Client struct {
 	object *ClientObject
 
 	sendCount int
+
+	// gRPC streams do not allow concurrent sends, so all sending goes through this lock.
+	sendLock sync.Mutex
+
+	// optional scheduler used to coalesce high frequency changes. nil if not enabled.
+	scheduler     *sendScheduler
+	schedulerLock sync.Mutex
+
+	// typed watchers for incoming changes to specific properties.
+	watchers propertyWatchers
+
+	// optional end to end encryption. nil if not enabled.
+	encryption     *encryptor
+	encryptionLock sync.Mutex
+
+	// optional signing/verification of changes. nil if not enabled. Protected by sendLock.
+	signer *signer
 }
 
 // NewClient creates a new client, configured to connect to serverAddr (host:port)
@@ -90,21 +120,50 @@ func (c *Client) SendObject(objectID string, clientObject any) error {
 		return err
 	}
 
+	return c.sendDirtyProperties()
+}
+
+// Object returns the internal object for the currently registered object ID. Can be used with
+// Set/Get to modify properties directly (instead of registering converters), followed by SendProperties.
+func (c *Client) Object() *ClientObject {
+	return c.object
+}
+
+// SendProperties sends any properties of the internal object that have been modified (eg. via Set)
+func (c *Client) SendProperties() error {
+	if c.object == nil {
+		return errors.New("not registered to an object")
+	}
+	c.sendCount++
+	return c.sendDirtyProperties()
+}
+
+// sendDirtyProperties sends all dirty properties of c.object and clears their dirty flag.
+func (c *Client) sendDirtyProperties() error {
 	// get clone of properties... used for iterating over properties.
 	// Just to avoid lock issues.
 	properties := c.object.GetProperties()
 	for k, v := range properties {
 		if v.Dirty {
 			outgoingChange := &OutgoingChange{
-				ObjectID:   objectID,
+				ObjectID:   c.object.ObjectID,
 				PropertyID: k,
 				Data:       v.Data,
 			}
-			err := c.sendChange(outgoingChange)
+
+			// if the scheduler is enabled the change will be sent on the next flush.
+			queued, err := c.queueChange(outgoingChange)
 			if err != nil {
-				log.Errorf("failed to send change: %v", err)
+				log.Errorf("failed to send pending changes: %v", err)
 				return err
 			}
+			if !queued {
+				err := c.sendChange(outgoingChange)
+				if err != nil {
+					log.Errorf("failed to send change: %v", err)
+					return err
+				}
+			}
 
 			// no longer dirty.
 			//c.object.AdjustProperty(k, v.Data, false, false)
@@ -115,19 +174,68 @@ func (c *Client) SendObject(objectID string, clientObject any) error {
 	return nil
 }
 
+// SendChanges sends changes that have already been generated (eg. from a JSON patch) rather
+// than going through a converter. Uses the send scheduler if enabled.
+func (c *Client) SendChanges(changes []OutgoingChange) error {
+	for i := range changes {
+		change := changes[i]
+		queued, err := c.queueChange(&change)
+		if err != nil {
+			log.Errorf("failed to send pending changes: %v", err)
+			return err
+		}
+		if !queued {
+			if err := c.sendChange(&change); err != nil {
+				log.Errorf("failed to send change: %v", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // sendChange sends the change to the server for processing
 func (c *Client) sendChange(outgoingChange *OutgoingChange) error {
-	// convert to proto struct
-	objChange := convertOutgoingChangeToProto(outgoingChange, c.clientID)
 	// store change details for comparison with incoming confirmation
-	objectProperty := fmt.Sprintf("%s-%s", objChange.ObjectId, objChange.PropertyId)
+	c.trackLocalChange(outgoingChange.ObjectID, outgoingChange.PropertyID)
+	return c.sendToStream(outgoingChange)
+}
+
+// trackLocalChange records that a change for the object/property has been sent (or is about to be)
+// and is waiting on confirmation from the server.
+func (c *Client) trackLocalChange(objectID string, propertyID string) {
+	objectProperty := objectPropertyKey(objectID, propertyID)
 	c.unconfirmedLock.Lock()
-	if _, ok := c.unconfirmedLocalChanges[objectProperty]; ok {
-		c.unconfirmedLocalChanges[objectProperty] = 1
-	} else {
-		c.unconfirmedLocalChanges[objectProperty] = c.unconfirmedLocalChanges[objectProperty] + 1
+	c.unconfirmedLocalChanges[objectProperty]++
+	c.unconfirmedLock.Unlock()
+}
+
+// untrackLocalChange undoes trackLocalChange for a change that was never sent.
+func (c *Client) untrackLocalChange(objectID string, propertyID string) {
+	objectProperty := objectPropertyKey(objectID, propertyID)
+	c.unconfirmedLock.Lock()
+	if c.unconfirmedLocalChanges[objectProperty]--; c.unconfirmedLocalChanges[objectProperty] <= 0 {
+		delete(c.unconfirmedLocalChanges, objectProperty)
 	}
 	c.unconfirmedLock.Unlock()
+}
+
+// sendToStream converts the change to the proto struct and sends it over the stream.
+// Does not do any tracking of unconfirmed changes.
+func (c *Client) sendToStream(outgoingChange *OutgoingChange) error {
+	// locked first so the client ID matches what it's signed with.
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	// convert to proto struct
+	objChange := convertOutgoingChangeToProto(outgoingChange, c.clientID)
+	if err := c.encryptChange(objChange); err != nil {
+		log.Errorf("unable to encrypt change: %v", err)
+		return err
+	}
+
+	// signed over the encrypted data, so the server can verify without the keys.
+	c.signChange(objChange)
 	if err := c.stream.Send(objChange); err != nil {
 		log.Errorf("%v.Send(%v) = %v", c.stream, objChange, err)
 		return err
@@ -156,20 +264,33 @@ func (c *Client) GetObject(objectID string) ([]ChangeConfirmation, error) {
 		ObjectId: objectID,
 	})
 
+	// nobody has written to the object yet.
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
 	if err != nil {
 		log.Errorf("failed to get object: %v", err)
 		return nil, err
 	}
 
-	changes := make([]ChangeConfirmation, len(resp.Properties))
-	i := 0
+	changes := make([]ChangeConfirmation, 0, len(resp.Properties))
 	for k, v := range resp.Properties {
-		changes[i] = ChangeConfirmation{
+		propertyID, data, err := c.decryptProperty(resp.ObjectId, k, v)
+		if err != nil {
+			log.Errorf("failed to decrypt object: %v", err)
+			return nil, err
+		}
+
+		change := ChangeConfirmation{
 			ObjectID:   resp.ObjectId,
-			PropertyID: k,
-			Data:       v,
+			PropertyID: propertyID,
+			Data:       data,
 		}
-		i++
+		if meta, ok := resp.Metadata[k]; ok {
+			change.LastModified = fromUnixNanos(meta.LastModified)
+			change.Author = meta.Author
+		}
+		changes = append(changes, change)
 	}
 
 	return changes, nil
@@ -186,6 +307,12 @@ func (c *Client) RegisterToObject(ctx context.Context, objectID string) error {
 		Data:       nil,
 	}
 
+	// anything still waiting in the scheduler belongs to the previous object, get it out first.
+	if err := c.Flush(); err != nil {
+		log.Errorf("failed to flush pending changes: %v", err)
+		return err
+	}
+
 	// brand new internal object.
 	c.object = &ClientObject{
 		ObjectID:   objectID,
@@ -223,6 +350,12 @@ func (c *Client) Listen(ctx context.Context) error {
 	for {
 
 		objectConfirmation, err := c.stream.Recv()
+		if status.Code(err) == codes.ResourceExhausted {
+			return fmt.Errorf("%w: %v", ErrResyncRequired, err)
+		}
+		if status.Code(err) == codes.Unavailable {
+			return fmt.Errorf("%w: %v", ErrReconnect, err)
+		}
 		if err != nil {
 			log.Errorf("%v.Recv() got error %v, want %v", c.stream, err, nil)
 			return err
@@ -231,7 +364,18 @@ func (c *Client) Listen(ctx context.Context) error {
 		if count%100 == 0 {
 			log.Debugf("Received %d", count)
 		}
-		objectProperty := fmt.Sprintf("%s-%s", objectConfirmation.ObjectId, objectConfirmation.PropertyId)
+
+		if err := c.verifyConfirmation(objectConfirmation); err != nil {
+			log.Errorf("dropping change that failed verification: %v", err)
+			continue
+		}
+
+		// can't do anything with a change we can't read (different key, tampered with etc)
+		if err := c.decryptConfirmation(objectConfirmation); err != nil {
+			log.Errorf("dropping change: %v", err)
+			continue
+		}
+		objectProperty := objectPropertyKey(objectConfirmation.ObjectId, objectConfirmation.PropertyId)
 		// way too much happening in this lock. FIXME(kpfaulkner)
 		c.unconfirmedLock.Lock()
 		confirmedLocalChange := false
@@ -247,7 +391,7 @@ func (c *Client) Listen(ctx context.Context) error {
 			}
 		} else {
 			// check if change is from this client. If so, modify unconfirmedLocalChanges
-			if objectConfirmation.UniqueId == c.clientID {
+			if objectConfirmation.UniqueId == c.getClientID() {
 				if c.unconfirmedLocalChanges[objectProperty] > 0 {
 
 					// does have local changes.. decrement count of changes.
@@ -275,8 +419,6 @@ func (c *Client) Listen(ctx context.Context) error {
 		// so it means that we drop this. Our unconfirmed local change is still yet to arrive which
 		// means it was generated after...  so this change will get wiped over anyway.
 	}
-
-	return nil
 }
 
 // convertAndExecuteCallback convert the proto object to the internal ClientObject, but then also calls
@@ -292,12 +434,18 @@ func (c *Client) convertAndExecuteCallback(objectConfirmation *proto.ObjectConfi
 	if confirmation.PropertyID != "" {
 		// indicate its been updated from the server.
 		c.object.AdjustProperty(confirmation.PropertyID, confirmation.Data, false, true)
+		c.object.SetPropertyMetadata(confirmation.PropertyID, confirmation.LastModified, confirmation.Author)
 
-		err := c.convertFromObject(c.object)
-		if err != nil {
-			log.Errorf("unable to convert incoming change to object: %v", err)
-			return err
+		// converters are optional if only using the typed API.
+		if c.convertFromObject != nil {
+			err := c.convertFromObject(c.object)
+			if err != nil {
+				log.Errorf("unable to convert incoming change to object: %v", err)
+				return err
+			}
 		}
+
+		c.watchers.notify(confirmation.PropertyID, confirmation.Data)
 	}
 	return nil
 }
@@ -319,6 +467,17 @@ func (c *Client) GetChangeCount() int {
 	return count
 }
 
+func (c *Client) getClientID() string {
+	c.clientIDLock.Lock()
+	defer c.clientIDLock.Unlock()
+	return c.clientID
+}
+
+// objectPropertyKey is the key used for tracking changes to a property of an object.
+func objectPropertyKey(objectID string, propertyID string) string {
+	return fmt.Sprintf("%s-%s", objectID, propertyID)
+}
+
 // convert models to proto structs
 func convertOutgoingChangeToProto(outgoingChange *OutgoingChange, clientID string) *proto.ObjectChange {
 	return &proto.ObjectChange{
@@ -331,8 +490,18 @@ func convertOutgoingChangeToProto(outgoingChange *OutgoingChange, clientID strin
 
 func convertProtoToChangeConfirmation(confirmedChange *proto.ObjectConfirmation) *ChangeConfirmation {
 	return &ChangeConfirmation{
-		ObjectID:   confirmedChange.ObjectId,
-		PropertyID: confirmedChange.PropertyId,
-		Data:       confirmedChange.Data,
+		ObjectID:     confirmedChange.ObjectId,
+		PropertyID:   confirmedChange.PropertyId,
+		Data:         confirmedChange.Data,
+		LastModified: fromUnixNanos(confirmedChange.LastModified),
+		Author:       confirmedChange.Author,
+	}
+}
+
+// fromUnixNanos converts the timestamps sent by the server. 0 is no timestamp.
+func fromUnixNanos(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
 	}
+	return time.Unix(0, nanos).UTC()
 }
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncomingChangeMetadata(t *testing.T) {
+	c, _ := newTestClient()
+	c.object = NewObject("object1", "TEST")
+	c.convertFromObject = func(object *ClientObject) error { return nil }
+
+	now := time.Now().UTC()
+	assert.Nil(t, c.convertAndExecuteCallback(&proto.ObjectConfirmation{
+		ObjectId:     "object1",
+		PropertyId:   "colour",
+		Data:         []byte("red"),
+		LastModified: now.UnixNano(),
+		Author:       "alice",
+	}))
+
+	p := c.Object().GetProperties()["colour"]
+	assert.EqualValues(t, "alice", p.Author)
+	assert.True(t, now.Equal(p.LastModified), "Should have last modified from server")
+
+	conf := convertProtoToChangeConfirmation(&proto.ObjectConfirmation{ObjectId: "object1", PropertyId: "colour"})
+	assert.True(t, conf.LastModified.IsZero(), "Missing timestamp should be zero time")
+}
@@ -13,7 +13,7 @@ type Converter interface {
 	// Instead of just passing the specific change we pass the updated internal object.
 	// This might be a waste since the client callback will need to determine what has changed.
 	// Possible revisit this.  TODO(kpfaulkner)
-	ConvertFromObject(object client.ClientObject) error
+	ConvertFromObject(object *client.ClientObject) error
 
 	// ConvertToObject converts a clients object TO the internal object.
 	// It takes in an existing internal object (if one exists) and updates it with the new data.
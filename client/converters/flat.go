@@ -0,0 +1,143 @@
+package converters
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/kpfaulkner/collablite/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// FlatObject keeps track of what has changed for converters that flatten a whole value into
+// properties (eg. structs, protobuf messages). The converter supplies how to flatten the value and
+// how to apply a single incoming property to it, FlatObject works out what to send and keeps the
+// last known properties up to date.
+type FlatObject struct {
+	// Lock must be held by the caller while modifying the value. Incoming changes are applied to
+	// the value from the client Listen goroutine.
+	Lock sync.Mutex
+
+	flatten func() (map[string][]byte, error)
+	set     func(path []PathSegment, data []byte) error
+
+	// flattened properties as of the last send or incoming change. Used to determine what has changed.
+	lastKnown map[string][]byte
+}
+
+// NewFlatObject creates a FlatObject. flatten returns every property of the value, set applies one
+// property (no data meaning it was removed). Both are called with Lock held.
+func NewFlatObject(flatten func() (map[string][]byte, error), set func(path []PathSegment, data []byte) error) *FlatObject {
+	f := FlatObject{
+		flatten:   flatten,
+		set:       set,
+		lastKnown: make(map[string][]byte),
+	}
+	return &f
+}
+
+// ChangedFields returns the property IDs that have changed (or been removed) since the last send.
+func (f *FlatObject) ChangedFields() ([]string, error) {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+
+	changes, err := f.changes()
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0, len(changes))
+	for k := range changes {
+		changed = append(changed, k)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// changes returns the properties that differ from lastKnown. Removed properties have nil data.
+// Lock must be held.
+func (f *FlatObject) changes() (map[string][]byte, error) {
+	current, err := f.flatten()
+	if err != nil {
+		return nil, err
+	}
+	return Diff(f.lastKnown, current), nil
+}
+
+// ConvertFromObject applies properties updated by the server to the value. Properties with no data
+// have been removed by another client.
+func (f *FlatObject) ConvertFromObject(object *client.ClientObject) error {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+
+	properties := object.GetProperties()
+	keys := make([]string, 0, len(properties))
+	for k, v := range properties {
+		if v.Updated {
+			keys = append(keys, k)
+		}
+	}
+
+	// sorted so containers and lengths are applied before what's within them.
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		data := properties[k].Data
+		if err := f.set(SplitPath(k), data); err != nil {
+			log.Errorf("unable to apply property %s : %v", k, err)
+			return err
+		}
+
+		if len(data) == 0 {
+			delete(f.lastKnown, k)
+		} else {
+			f.lastKnown[k] = data
+		}
+		object.ClearPropertyUpdatedFlag(k)
+	}
+	return nil
+}
+
+// UpdateObject marks any property that has changed since the last send as dirty on existingObject,
+// or a new object of objectType if nil.
+func (f *FlatObject) UpdateObject(objectID string, existingObject *client.ClientObject, objectType string) (*client.ClientObject, error) {
+	obj := existingObject
+	if obj == nil {
+		obj = client.NewObject(objectID, objectType)
+	}
+
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+
+	changes, err := f.changes()
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range changes {
+		obj.AdjustProperty(k, v, true, false)
+		if v == nil {
+			delete(f.lastKnown, k)
+		} else {
+			f.lastKnown[k] = v
+		}
+	}
+	return obj, nil
+}
+
+// Diff returns the properties in current that differ from previous, plus properties in previous
+// that no longer exist (with nil data).
+func Diff(previous map[string][]byte, current map[string][]byte) map[string][]byte {
+	changes := make(map[string][]byte)
+	for k, v := range current {
+		if old, ok := previous[k]; !ok || !bytes.Equal(old, v) {
+			changes[k] = v
+		}
+	}
+	for k := range previous {
+		if _, ok := current[k]; !ok {
+			changes[k] = nil
+		}
+	}
+	return changes
+}
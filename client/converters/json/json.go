@@ -1,46 +1,151 @@
 package json
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
 
 	"github.com/kpfaulkner/collablite/client"
+	"github.com/kpfaulkner/collablite/client/converters"
 	log "github.com/sirupsen/logrus"
-	"github.com/tidwall/gjson"
-	"github.com/tidwall/sjson"
 )
 
+// JSONObject converts between a JSON document and the ClientObject.
+//
+// Every leaf value in the document is stored as a property, named by the dotted path to the value
+// (eg. "features.0.attributes.field1") with the data being the JSON for that value. Arrays also have
+// a length property ("features.#") and empty objects are stored as "{}" so they are not lost.
+// If the document itself is not an object or array (eg. just a string) it is stored against
+// converters.RootPath.
+//
+// Removed values are sent as properties with no data.
 type JSONObject struct {
-	json string
+	ObjectID string
+
+	// lock for the document and lastKnown
+	lock sync.Mutex
+
+	// current document (compact)
+	document []byte
+
+	// flattened properties as of the last send or incoming change. Used to determine what has changed.
+	lastKnown map[string][]byte
 }
 
-// ObjectToJSON converts an object to JSON representation
+// NewJSONObject creates a JSONObject with an empty document ({})
+func NewJSONObject(objectID string) *JSONObject {
+	j := JSONObject{
+		ObjectID:  objectID,
+		document:  []byte("{}"),
+		lastKnown: make(map[string][]byte),
+	}
+	return &j
+}
+
+// JSON returns the current document.
+func (j *JSONObject) JSON() []byte {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return append([]byte{}, j.document...)
+}
+
+// SetJSON replaces the document. The changes will be sent to the server on the next SendObject.
+func (j *JSONObject) SetJSON(document []byte) error {
+	v, err := decode(document)
+	if err != nil {
+		return err
+	}
+
+	doc, err := encode(v)
+	if err != nil {
+		return err
+	}
+
+	j.lock.Lock()
+	j.document = doc
+	j.lock.Unlock()
+	return nil
+}
+
+// ChangedProperties returns the property IDs that have changed (or been removed) since the last send.
+func (j *JSONObject) ChangedProperties() ([]string, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	changes, err := j.changes()
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0, len(changes))
+	for k := range changes {
+		changed = append(changed, k)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// changes returns the properties that differ from lastKnown. Removed properties have nil data.
+// lock must be held.
+func (j *JSONObject) changes() (map[string][]byte, error) {
+	current, err := Flatten(j.document)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(j.lastKnown, current), nil
+}
+
+// ConvertFromObject applies properties updated by the server to the document.
 // Currently it is really up to the caller to know if they're really dealing with JSON
 // or not. If this is called and the object is not JSON, there is no guarantee what will result.
 // The object has a "hint" of the type, but this is not enforced.
-func (j *JSONObject) ConvertFromObject(object client.ClientObject) error {
+func (j *JSONObject) ConvertFromObject(object *client.ClientObject) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
 
-	var newJson string
-	for k, v := range object.Properties {
-		var a any
-		err := json.Unmarshal(v.Data, &a)
-		if err != nil {
-			log.Errorf("Error unmarshalling JSON: %v", err)
-			return err
+	// start from the current document so any local changes not yet sent are kept.
+	current, err := Flatten(j.document)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range object.GetProperties() {
+		if !v.Updated {
+			continue
 		}
-		newJson, _ = sjson.Set(newJson, k, a)
+
+		if len(v.Data) == 0 {
+			delete(current, k)
+			delete(j.lastKnown, k)
+		} else {
+			current[k] = v.Data
+			j.lastKnown[k] = v.Data
+		}
+		object.ClearPropertyUpdatedFlag(k)
 	}
-	j.json = newJson
-	return nil
 
+	doc, err := Build(current)
+	if err != nil {
+		log.Errorf("unable to build JSON document: %v", err)
+		return err
+	}
+	j.document = doc
+	return nil
 }
 
+// ConvertToObject flattens the document and marks any property that has changed since the last send
+// as dirty.
 func (j *JSONObject) ConvertToObject(objectID string, existingObject *client.ClientObject, clientObject any) (*client.ClientObject, error) {
 
-	clientJson := clientObject.(JSONObject)
-	res := gjson.Parse(clientJson.json)
-
-	allProperties := processKey("", res)
+	jsonObject, ok := clientObject.(*JSONObject)
+	if !ok {
+		return nil, fmt.Errorf("expected *JSONObject, got %T", clientObject)
+	}
 
 	var obj *client.ClientObject
 	if existingObject == nil {
@@ -49,57 +154,220 @@ func (j *JSONObject) ConvertToObject(objectID string, existingObject *client.Cli
 		obj = existingObject
 	}
 
-	var a any
-	for k, v := range allProperties {
-
-		switch v.Type {
-		case gjson.String:
-			a = v.String()
-		case gjson.Number:
-			a = v.Num
-		case gjson.True:
-			a = true
-		case gjson.False:
-			a = false
-		default:
-			panic("NO IDEA")
+	jsonObject.lock.Lock()
+	defer jsonObject.lock.Unlock()
+
+	changes, err := jsonObject.changes()
+	if err != nil {
+		log.Errorf("unable to flatten JSON document: %v", err)
+		return nil, err
+	}
+
+	for k, v := range changes {
+		obj.AdjustProperty(k, v, true, false)
+		if v == nil {
+			delete(jsonObject.lastKnown, k)
+		} else {
+			jsonObject.lastKnown[k] = v
 		}
+	}
+
+	return obj, nil
+}
+
+// Diff returns the properties in current that differ from previous, plus properties in previous
+// that no longer exist (with nil data).
+func Diff(previous map[string][]byte, current map[string][]byte) map[string][]byte {
+	return converters.Diff(previous, current)
+}
+
+// Flatten converts a JSON document into a map of property ID to (compact) JSON value.
+func Flatten(document []byte) (map[string][]byte, error) {
+	v, err := decode(document)
+	if err != nil {
+		return nil, err
+	}
+	return flattenValue(v)
+}
+
+func flattenValue(v any) (map[string][]byte, error) {
+	out := make(map[string][]byte)
 
-		bytes, err := json.Marshal(a)
+	// root object is the common case, it doesn't need a property of its own unless empty
+	if m, ok := v.(map[string]any); ok && len(m) == 0 {
+		return out, nil
+	}
+
+	switch v.(type) {
+	case map[string]any, []any:
+		if err := flatten(v, "", out); err != nil {
+			return nil, err
+		}
+	default:
+		data, err := encode(v)
 		if err != nil {
-			log.Errorf("Error marshalling JSON: %v", err)
 			return nil, err
 		}
-		obj.AdjustProperty(k, bytes)
+		out[converters.RootPath] = data
 	}
+	return out, nil
+}
 
-	return obj, nil
+func flatten(v any, path string, out map[string][]byte) error {
+	switch vv := v.(type) {
+	case map[string]any:
+		if len(vv) == 0 && path != "" {
+			out[path] = []byte("{}")
+			return nil
+		}
+		for k, child := range vv {
+			if err := flatten(child, converters.AppendPath(path, k), out); err != nil {
+				return err
+			}
+		}
+	case []any:
+		out[converters.LengthPath(path)] = []byte(strconv.Itoa(len(vv)))
+		for i, child := range vv {
+			if err := flatten(child, converters.AppendPath(path, strconv.Itoa(i)), out); err != nil {
+				return err
+			}
+		}
+	default:
+		data, err := encode(v)
+		if err != nil {
+			return err
+		}
+		out[path] = data
+	}
+	return nil
 }
 
-func processKey(keyPrefix string, parsedJson gjson.Result) map[string]gjson.Result {
-	allKeys := make(map[string]gjson.Result)
-	parsedJson.ForEach(func(k, v gjson.Result) bool {
-		var newKey string
+// node is used to rebuild a document from properties.
+type node struct {
+	value    []byte
+	isArray  bool
+	length   int
+	children map[string]*node
+}
 
-		if keyPrefix != "" {
-			newKey = fmt.Sprintf("%s.%s", keyPrefix, k.String())
-		} else {
-			newKey = k.String()
+func (n *node) child(name string) *node {
+	if n.children == nil {
+		n.children = make(map[string]*node)
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &node{}
+		n.children[name] = c
+	}
+	return c
+}
+
+// Build creates a JSON document from a map of property ID to JSON value.
+// This is the reverse of Flatten.
+func Build(properties map[string][]byte) ([]byte, error) {
+	v, err := build(properties)
+	if err != nil {
+		return nil, err
+	}
+	return encode(v)
+}
+
+func build(properties map[string][]byte) (any, error) {
+	root := &node{}
+	for k, data := range properties {
+		if len(data) == 0 {
+			continue
 		}
 
-		if v.Type == gjson.JSON {
-			res := gjson.Parse(v.Raw)
-			m := processKey(newKey, res)
-			for kk, vv := range m {
-				allKeys[kk] = vv
+		if k == converters.RootPath {
+			root.value = data
+			continue
+		}
+
+		n := root
+		segments := converters.SplitPath(k)
+		for i, segment := range segments {
+			if segment.IsLength && i == len(segments)-1 {
+				// from other clients, so limited before anything is allocated for it.
+				length, err := converters.ParseLength(data)
+				if err != nil {
+					return nil, fmt.Errorf("length for %s: %w", k, err)
+				}
+				n.isArray = true
+				n.length = length
+				break
 			}
-			return true
-		} else {
-			allKeys[newKey] = v
-			return true
+			n = n.child(segment.Name)
+			if i == len(segments)-1 {
+				n.value = data
+			}
+		}
+	}
+
+	// nothing at all is an empty document.
+	if !root.isArray && len(root.children) == 0 && root.value == nil {
+		return map[string]any{}, nil
+	}
+	return root.toValue()
+}
+
+func (n *node) toValue() (any, error) {
+	switch {
+	case n.isArray:
+		arr := make([]any, n.length)
+		for k, c := range n.children {
+			i, err := converters.ParseIndex(k)
+			if err != nil {
+				return nil, err
+			}
+
+			// elements beyond the length have been removed, but the removal hasn't arrived yet.
+			if i >= n.length {
+				continue
+			}
+			if arr[i], err = c.toValue(); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case len(n.children) > 0:
+		m := make(map[string]any, len(n.children))
+		for k, c := range n.children {
+			v, err := c.toValue()
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
 		}
-		return true
-	})
+		return m, nil
+	case n.value != nil:
+		return decode(n.value)
+	}
+	return nil, nil
+}
 
-	return allKeys
+// decode parses a JSON document. Numbers are kept as json.Number so they round trip exactly.
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: unexpected data after value")
+	}
+	return v, nil
+}
+
+// encode generates compact JSON for v. Object keys are sorted so the output is predictable.
+func encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
 }
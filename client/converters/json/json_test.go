@@ -0,0 +1,159 @@
+package json
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/kpfaulkner/collablite/client"
+	"github.com/kpfaulkner/collablite/client/converters"
+	"github.com/stretchr/testify/assert"
+)
+
+// ensure JSONObject satisfies the Converter interface
+var _ converters.Converter = &JSONObject{}
+
+func TestRoundTrip(t *testing.T) {
+	for _, doc := range []string{
+		`{}`,
+		`[]`,
+		`null`,
+		`"just a string"`,
+		`12.50`,
+		`{"a":1,"b":"two","c":true,"d":false,"e":null}`,
+		`{"nested":{"deeper":{"x":[1,2,{"y":null}]}}}`,
+		`{"arrayOfEmpty":[{},[]],"empty":{},"emptyArray":[]}`,
+		`[[1,2],[3,[4,5]],"x"]`,
+		`{"0":"zero","odd.key":{"#":1,"$":2,"back\\slash":3}}`,
+		`{"big":12345678901234567890123,"exp":1e400,"html":"<b>&amp;</b>"}`,
+	} {
+		props, err := Flatten([]byte(doc))
+		assert.Nil(t, err, "Should flatten %s", doc)
+
+		// keys are sorted in the test documents, so should get back exactly the same.
+		rebuilt, err := Build(props)
+		assert.Nil(t, err, "Should build %s", doc)
+		assert.EqualValues(t, doc, string(rebuilt), "Should round trip exactly")
+	}
+}
+
+func TestFlattenProperties(t *testing.T) {
+	props, err := Flatten([]byte(`{"features":[{"attributes":{"field1":123}}],"empty":{},"none":null}`))
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string][]byte{
+		"features.#":                   []byte("1"),
+		"features.0.attributes.field1": []byte("123"),
+		"empty":                        []byte("{}"),
+		"none":                         []byte("null"),
+	}, props)
+}
+
+func TestInvalidJSON(t *testing.T) {
+	j := NewJSONObject("object1")
+	assert.NotNil(t, j.SetJSON([]byte(`{"a":`)), "Should reject invalid JSON")
+	assert.NotNil(t, j.SetJSON([]byte(`{"a":1} {"b":2}`)), "Should reject multiple values")
+	assert.EqualValues(t, `{}`, string(j.JSON()), "Document should be unchanged")
+}
+
+func TestOnlyChangedLeavesAreDirty(t *testing.T) {
+	j := NewJSONObject("object1")
+	assert.Nil(t, j.SetJSON([]byte(`{"a":1,"b":{"c":"x","d":[1,2,3]},"e":null}`)))
+
+	obj, err := j.ConvertToObject("object1", nil, j)
+	assert.Nil(t, err)
+	for k := range obj.GetProperties() {
+		obj.ClearPropertyDirtyFlag(k)
+	}
+
+	// reformatting the same document isn't a change
+	assert.Nil(t, j.SetJSON([]byte(`{ "e": null, "b": { "d": [1, 2, 3], "c": "x" }, "a": 1 }`)))
+	changed, err := j.ChangedProperties()
+	assert.Nil(t, err)
+	assert.Empty(t, changed, "Formatting should not count as a change")
+
+	// change a leaf, remove a key and shrink an array
+	assert.Nil(t, j.SetJSON([]byte(`{"a":2,"b":{"d":[1]},"e":null}`)))
+	changed, err = j.ChangedProperties()
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"a", "b.c", "b.d.#", "b.d.1", "b.d.2"}, changed)
+
+	obj, err = j.ConvertToObject("object1", obj, j)
+	assert.Nil(t, err)
+	props := obj.GetProperties()
+	assert.True(t, props["a"].Dirty)
+	assert.False(t, props["e"].Dirty, "Unchanged null should not be dirty")
+	assert.True(t, props["b.d.2"].Dirty, "Removed element should be dirty")
+	assert.Nil(t, props["b.d.2"].Data, "Removed element should have no data")
+	assert.Nil(t, props["b.c"].Data, "Removed key should have no data")
+
+	changed, _ = j.ChangedProperties()
+	assert.Empty(t, changed, "Nothing should have changed after send")
+}
+
+func TestConvertFromObject(t *testing.T) {
+	j := NewJSONObject("object1")
+	assert.Nil(t, j.SetJSON([]byte(`{"a":1,"list":[1,2,3],"obj":{"x":1}}`)))
+	obj, _ := j.ConvertToObject("object1", nil, j)
+
+	// local change not yet sent.
+	assert.Nil(t, j.SetJSON([]byte(`{"a":1,"list":[1,2,3],"obj":{"x":1},"local":true}`)))
+
+	// changes from the server.
+	obj.AdjustProperty("a", []byte(`"changed"`), false, true)
+	obj.AdjustProperty("list.#", []byte(`1`), false, true)
+	obj.AdjustProperty("list.1", nil, false, true)
+	obj.AdjustProperty("list.2", nil, false, true)
+	obj.AdjustProperty("obj.x", nil, false, true)
+	obj.AdjustProperty("obj", []byte(`{}`), false, true)
+	obj.AdjustProperty("new", []byte(`null`), false, true)
+
+	assert.Nil(t, j.ConvertFromObject(obj), "Should apply changes")
+	assert.JSONEq(t, `{"a":"changed","list":[1],"obj":{},"new":null,"local":true}`, string(j.JSON()))
+
+	changed, _ := j.ChangedProperties()
+	assert.EqualValues(t, []string{"local"}, changed, "Only the local change should be pending")
+
+	for k, v := range obj.GetProperties() {
+		assert.False(t, v.Updated, "Updated flag should be cleared for %s", k)
+	}
+}
+
+func TestConvertFromObjectPartialArray(t *testing.T) {
+	// array length arriving before the elements should fill with null.
+	j := NewJSONObject("object1")
+	obj := client.NewObject("object1", "JSON")
+	obj.AdjustProperty("list.#", []byte(`3`), false, true)
+	obj.AdjustProperty("list.2", []byte(`"c"`), false, true)
+	assert.Nil(t, j.ConvertFromObject(obj))
+	assert.JSONEq(t, `{"list":[null,null,"c"]}`, string(j.JSON()))
+}
+
+func TestHugeLengthRejected(t *testing.T) {
+	for _, prop := range [][2]string{{"list.#", "100000000000"}, {"list.100000000000", `"x"`}} {
+		j := NewJSONObject("object1")
+		obj := client.NewObject("object1", "JSON")
+		obj.AdjustProperty("list.#", []byte(`1`), false, true)
+		obj.AdjustProperty(prop[0], []byte(prop[1]), false, true)
+		assert.ErrorIs(t, j.ConvertFromObject(obj), converters.ErrTooLong, "Should refuse %s", prop[0])
+		assert.JSONEq(t, `{}`, string(j.JSON()), "Document should be unchanged")
+	}
+}
+
+func TestTwoClientsConverge(t *testing.T) {
+	src := NewJSONObject("object1")
+	doc := `{"features":[{"geometry":{"x":1.5,"y":-2},"attributes":{"field1":123}}],"hasZ":true,"sr":null}`
+	assert.Nil(t, src.SetJSON([]byte(doc)))
+	srcObj, err := src.ConvertToObject("object1", nil, src)
+	assert.Nil(t, err)
+
+	dst := NewJSONObject("object1")
+	dstObj := client.NewObject("object1", "JSON")
+	for k, v := range srcObj.GetProperties() {
+		dstObj.AdjustProperty(k, v.Data, false, true)
+	}
+	assert.Nil(t, dst.ConvertFromObject(dstObj))
+
+	var a, b any
+	json.Unmarshal(src.JSON(), &a)
+	json.Unmarshal(dst.JSON(), &b)
+	assert.EqualValues(t, a, b, "Both clients should have the same document")
+}
@@ -0,0 +1,496 @@
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kpfaulkner/collablite/client"
+)
+
+// patchOperation is a single RFC 6902 operation.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	From  string          `json:"from,omitempty"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// PatchToChanges applies an RFC 6902 JSON Patch to the document held in object and returns the
+// changes that need to be sent to the server. object itself is not modified.
+// If any operation fails (including a "test" operation) an error is returned and no changes.
+func PatchToChanges(object *client.ClientObject, patch []byte) ([]client.OutgoingChange, error) {
+	var operations []patchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, fmt.Errorf("invalid JSON patch: %w", err)
+	}
+
+	return changesFor(object, func(doc any) (any, error) {
+		var err error
+		for i, op := range operations {
+			if doc, err = applyOperation(doc, op); err != nil {
+				return nil, fmt.Errorf("patch operation %d (%s %s): %w", i, op.Op, op.Path, err)
+			}
+		}
+		return doc, nil
+	})
+}
+
+// MergePatchToChanges applies an RFC 7386 JSON Merge Patch to the document held in object and returns
+// the changes that need to be sent to the server. object itself is not modified.
+func MergePatchToChanges(object *client.ClientObject, mergePatch []byte) ([]client.OutgoingChange, error) {
+	patch, err := decode(mergePatch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %w", err)
+	}
+
+	return changesFor(object, func(doc any) (any, error) {
+		return applyMergePatch(doc, patch), nil
+	})
+}
+
+// ConfirmationsToPatch generates an RFC 6902 JSON Patch that takes the document held in object to the
+// document after the confirmations have been applied. object should be the state before the
+// confirmations and is not modified.
+func ConfirmationsToPatch(object *client.ClientObject, confirmations []client.ChangeConfirmation) ([]byte, error) {
+	before := objectProperties(object)
+	after := make(map[string][]byte, len(before))
+	for k, v := range before {
+		after[k] = v
+	}
+
+	for _, c := range confirmations {
+		if c.ObjectID != object.ObjectID {
+			return nil, fmt.Errorf("confirmation for object %s does not match %s", c.ObjectID, object.ObjectID)
+		}
+
+		// empty property is just registering interest in the object.
+		if c.PropertyID == "" {
+			continue
+		}
+		if len(c.Data) == 0 {
+			delete(after, c.PropertyID)
+		} else {
+			after[c.PropertyID] = c.Data
+		}
+	}
+
+	beforeDoc, err := build(before)
+	if err != nil {
+		return nil, err
+	}
+	afterDoc, err := build(after)
+	if err != nil {
+		return nil, err
+	}
+
+	operations := []patchOperation{}
+	if err := diffDocuments("", beforeDoc, afterDoc, &operations); err != nil {
+		return nil, err
+	}
+	return json.Marshal(operations)
+}
+
+// objectProperties returns the properties of the object that have data.
+func objectProperties(object *client.ClientObject) map[string][]byte {
+	properties := make(map[string][]byte)
+	for k, v := range object.GetProperties() {
+		if len(v.Data) > 0 {
+			properties[k] = v.Data
+		}
+	}
+	return properties
+}
+
+// changesFor builds the document from object, modifies it with fn and returns the changes
+// between the two in property ID order.
+func changesFor(object *client.ClientObject, fn func(doc any) (any, error)) ([]client.OutgoingChange, error) {
+	before := objectProperties(object)
+	doc, err := build(before)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err = fn(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := flattenValue(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := Diff(before, after)
+	keys := make([]string, 0, len(diff))
+	for k := range diff {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	changes := make([]client.OutgoingChange, len(keys))
+	for i, k := range keys {
+		changes[i] = client.OutgoingChange{
+			ObjectID:   object.ObjectID,
+			PropertyID: k,
+			Data:       diff[k],
+		}
+	}
+	return changes, nil
+}
+
+// applyMergePatch is straight from RFC 7386 section 2.
+func applyMergePatch(target any, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = make(map[string]any)
+	}
+
+	for k, v := range patchObject {
+		if v == nil {
+			delete(targetObject, k)
+		} else {
+			targetObject[k] = applyMergePatch(targetObject[k], v)
+		}
+	}
+	return targetObject
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func formatPointer(parent string, token string) string {
+	return parent + "/" + strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// arrayIndex parses an array index token. Allows an index one past the end (or "-") when adding.
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if adding && token == "-" {
+		return length, nil
+	}
+
+	// no leading zeros, signs etc.
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.TrimLeft(token, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	max := length - 1
+	if adding {
+		max = length
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+// getValue returns the value at tokens.
+func getValue(doc any, tokens []string) (any, error) {
+	for _, t := range tokens {
+		switch d := doc.(type) {
+		case map[string]any:
+			v, ok := d[t]
+			if !ok {
+				return nil, fmt.Errorf("member %q does not exist", t)
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(t, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("cannot reference %q in a value", t)
+		}
+	}
+	return doc, nil
+}
+
+// modifyParent calls fn with the container holding the last token and replaces the container with
+// whatever fn returns. Returns the (possibly new) document.
+func modifyParent(doc any, tokens []string, fn func(container any, token string) (any, error)) (any, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+
+	child, err := getValue(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	newChild, err := modifyParent(child, tokens[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch d := doc.(type) {
+	case map[string]any:
+		d[tokens[0]] = newChild
+	case []any:
+		i, _ := arrayIndex(tokens[0], len(d), false)
+		d[i] = newChild
+	}
+	return doc, nil
+}
+
+func addValue(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return modifyParent(doc, tokens, func(container any, token string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			c[token] = value
+			return c, nil
+		case []any:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a value", token)
+	})
+}
+
+func removeValue(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return modifyParent(doc, tokens, func(container any, token string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			if _, ok := c[token]; !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			delete(c, token)
+			return c, nil
+		case []any:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %q from a value", token)
+	})
+}
+
+func replaceValue(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return modifyParent(doc, tokens, func(container any, token string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			if _, ok := c[token]; !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			c[token] = value
+			return c, nil
+		case []any:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot replace %q in a value", token)
+	})
+}
+
+// applyOperation applies a single RFC 6902 operation, returning the new document.
+func applyOperation(doc any, op patchOperation) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		if value, err = decode(op.Value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = getValue(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if op.Path == op.From {
+				return doc, nil
+			}
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, errors.New("cannot move a value into itself")
+			}
+			if doc, err = removeValue(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			// copies must not share maps/slices with the original
+			if value, err = deepCopy(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return addValue(doc, path, value)
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		return replaceValue(doc, path, value)
+	case "test":
+		current, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		equal, err := jsonEqual(current, value)
+		if err != nil {
+			return nil, err
+		}
+		if !equal {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+func deepCopy(v any) (any, error) {
+	data, err := encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// jsonEqual compares two values. Object key order doesn't matter since encode sorts keys.
+func jsonEqual(a any, b any) (bool, error) {
+	aa, err := encode(a)
+	if err != nil {
+		return false, err
+	}
+	bb, err := encode(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aa, bb), nil
+}
+
+// diffDocuments generates the operations required to turn a into b.
+func diffDocuments(pointer string, a any, b any, operations *[]patchOperation) error {
+	switch aa := a.(type) {
+	case map[string]any:
+		if bb, ok := b.(map[string]any); ok {
+			keys := make([]string, 0, len(aa)+len(bb))
+			for k := range aa {
+				keys = append(keys, k)
+			}
+			for k := range bb {
+				if _, ok := aa[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				av, inA := aa[k]
+				bv, inB := bb[k]
+				childPointer := formatPointer(pointer, k)
+				switch {
+				case !inB:
+					*operations = append(*operations, patchOperation{Op: "remove", Path: childPointer})
+				case !inA:
+					if err := appendValueOperation("add", childPointer, bv, operations); err != nil {
+						return err
+					}
+				default:
+					if err := diffDocuments(childPointer, av, bv, operations); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+	case []any:
+		if bb, ok := b.([]any); ok {
+			common := len(aa)
+			if len(bb) < common {
+				common = len(bb)
+			}
+			for i := 0; i < common; i++ {
+				if err := diffDocuments(formatPointer(pointer, strconv.Itoa(i)), aa[i], bb[i], operations); err != nil {
+					return err
+				}
+			}
+
+			// remove from the end so the indexes don't shift.
+			for i := len(aa) - 1; i >= len(bb); i-- {
+				*operations = append(*operations, patchOperation{Op: "remove", Path: formatPointer(pointer, strconv.Itoa(i))})
+			}
+			for i := len(aa); i < len(bb); i++ {
+				if err := appendValueOperation("add", formatPointer(pointer, strconv.Itoa(i)), bb[i], operations); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	equal, err := jsonEqual(a, b)
+	if err != nil {
+		return err
+	}
+	if !equal {
+		return appendValueOperation("replace", pointer, b, operations)
+	}
+	return nil
+}
+
+func appendValueOperation(op string, pointer string, value any, operations *[]patchOperation) error {
+	data, err := encode(value)
+	if err != nil {
+		return err
+	}
+	*operations = append(*operations, patchOperation{Op: op, Path: pointer, Value: data})
+	return nil
+}
@@ -0,0 +1,157 @@
+package json
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/kpfaulkner/collablite/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// objectFromJSON creates a ClientObject holding the flattened document.
+func objectFromJSON(t *testing.T, doc string) *client.ClientObject {
+	props, err := Flatten([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := client.NewObject("object1", "JSON")
+	for k, v := range props {
+		obj.AdjustProperty(k, v, false, false)
+	}
+	return obj
+}
+
+// applyChanges applies outgoing changes to the object and returns the resulting document.
+func applyChanges(t *testing.T, obj *client.ClientObject, changes []client.OutgoingChange) string {
+	for _, c := range changes {
+		obj.AdjustProperty(c.PropertyID, c.Data, false, false)
+	}
+	doc, err := Build(objectProperties(obj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(doc)
+}
+
+func TestPatchToChanges(t *testing.T) {
+	// mostly from RFC 6902 appendix A
+	for _, tc := range []struct {
+		doc      string
+		patch    string
+		expected string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"a":1}}`, `[{"op":"copy","from":"/foo","path":"/bar"},{"op":"replace","path":"/bar/a","value":2}]`, `{"bar":{"a":2},"foo":{"a":1}}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"replace","path":"/~01","value":11},{"op":"remove","path":"/~1"}]`, `{"~1":11}`},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[1,2]}]`, `[1,2]`},
+	} {
+		obj := objectFromJSON(t, tc.doc)
+		changes, err := PatchToChanges(obj, []byte(tc.patch))
+		assert.Nil(t, err, "Should apply %s", tc.patch)
+		assert.EqualValues(t, tc.expected, applyChanges(t, obj, changes), "Should apply %s", tc.patch)
+	}
+}
+
+func TestPatchToChangesOnlyChanged(t *testing.T) {
+	obj := objectFromJSON(t, `{"a":1,"b":{"c":[1,2,3]}}`)
+	changes, err := PatchToChanges(obj, []byte(`[{"op":"remove","path":"/b/c/2"},{"op":"replace","path":"/a","value":1}]`))
+	assert.Nil(t, err)
+
+	changed := make(map[string]string)
+	for _, c := range changes {
+		changed[c.PropertyID] = string(c.Data)
+	}
+	assert.EqualValues(t, map[string]string{"b.c.#": "2", "b.c.2": ""}, changed, "Should only change the array")
+}
+
+func TestPatchToChangesErrors(t *testing.T) {
+	for _, patch := range []string{
+		`{"op":"add"}`,
+		`[{"op":"remove","path":"/missing"}]`,
+		`[{"op":"replace","path":"/missing","value":1}]`,
+		`[{"op":"add","path":"/list/5","value":1}]`,
+		`[{"op":"add","path":"/list/01","value":1}]`,
+		`[{"op":"add","path":"/a"}]`,
+		`[{"op":"test","path":"/a","value":2}]`,
+		`[{"op":"move","from":"/obj","path":"/obj/child"}]`,
+		`[{"op":"unknown","path":"/a"}]`,
+		`[{"op":"add","path":"a","value":1}]`,
+	} {
+		obj := objectFromJSON(t, `{"a":1,"list":[1],"obj":{"x":1}}`)
+		changes, err := PatchToChanges(obj, []byte(patch))
+		assert.NotNil(t, err, "Should fail %s", patch)
+		assert.Nil(t, changes, "Should have no changes for %s", patch)
+	}
+}
+
+func TestMergePatchToChanges(t *testing.T) {
+	// from RFC 7386 appendix A
+	for _, tc := range []struct {
+		doc      string
+		patch    string
+		expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		obj := objectFromJSON(t, tc.doc)
+		changes, err := MergePatchToChanges(obj, []byte(tc.patch))
+		assert.Nil(t, err, "Should apply %s", tc.patch)
+		assert.EqualValues(t, tc.expected, applyChanges(t, obj, changes), "Should apply %s to %s", tc.patch, tc.doc)
+	}
+}
+
+func TestConfirmationsToPatch(t *testing.T) {
+	base := `{"a":1,"b":{"c":"x","d":[1,2,3]},"e":"gone","k/~":true}`
+	obj := objectFromJSON(t, base)
+
+	confirmations := []client.ChangeConfirmation{
+		{ObjectID: "object1", PropertyID: "a", Data: []byte(`2`)},
+		{ObjectID: "object1", PropertyID: "b.d.#", Data: []byte(`1`)},
+		{ObjectID: "object1", PropertyID: "b.d.1", Data: nil},
+		{ObjectID: "object1", PropertyID: "b.d.2", Data: nil},
+		{ObjectID: "object1", PropertyID: "e", Data: nil},
+		{ObjectID: "object1", PropertyID: "f", Data: []byte(`{}`)},
+		{ObjectID: "object1", PropertyID: "k/~", Data: []byte(`false`)},
+		{ObjectID: "object1", PropertyID: ""},
+	}
+
+	patch, err := ConfirmationsToPatch(obj, confirmations)
+	assert.Nil(t, err)
+	assert.EqualValues(t, `[{"op":"replace","path":"/a","value":2},{"op":"remove","path":"/b/d/2"},{"op":"remove","path":"/b/d/1"},{"op":"remove","path":"/e"},{"op":"add","path":"/f","value":{}},{"op":"replace","path":"/k~1~0","value":false}]`, string(patch))
+
+	// applying the generated patch to the base should give the same result as the confirmations.
+	changes, err := PatchToChanges(obj, patch)
+	assert.Nil(t, err)
+	var expected, actual any
+	json.Unmarshal([]byte(`{"a":2,"b":{"c":"x","d":[1]},"f":{},"k/~":false}`), &expected)
+	json.Unmarshal([]byte(applyChanges(t, obj, changes)), &actual)
+	assert.EqualValues(t, expected, actual)
+}
+
+func TestConfirmationsToPatchWrongObject(t *testing.T) {
+	obj := objectFromJSON(t, `{"a":1}`)
+	_, err := ConfirmationsToPatch(obj, []client.ChangeConfirmation{{ObjectID: "other", PropertyID: "a", Data: []byte(`2`)}})
+	assert.NotNil(t, err, "Should reject confirmation for another object")
+}
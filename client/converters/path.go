@@ -0,0 +1,134 @@
+package converters
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LengthSegment is the last segment of a property ID that holds the length of a slice/array.
+// eg. "items.#" holds the number of elements in "items", the elements being "items.0", "items.1" etc.
+const LengthSegment = "#"
+
+// MaxLength is the most elements a slice/array can have. Lengths and indexes come from other
+// clients, without a limit one bad value would have every client allocating more than it has.
+const MaxLength = 1 << 20
+
+// ErrTooLong is returned for a length or index of MaxLength or more.
+var ErrTooLong = errors.New("length too large")
+
+// RootPath is the property ID for the value of the whole object, for converters where the root itself
+// can be a single value (eg. a JSON document that is just a string).
+const RootPath = "$"
+
+// JoinPath builds a dotted property ID from the path segments. Each segment is escaped so any
+// characters that have a special meaning in a property ID ('.', '\' and segments of just "#" or "$")
+// survive the round trip through SplitPath.
+func JoinPath(segments ...string) string {
+	escaped := make([]string, len(segments))
+	for i, s := range segments {
+		escaped[i] = EscapeSegment(s)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// AppendPath adds an (unescaped) segment to an existing property ID.
+func AppendPath(propertyID string, segment string) string {
+	if propertyID == "" {
+		return EscapeSegment(segment)
+	}
+	return propertyID + "." + EscapeSegment(segment)
+}
+
+// LengthPath returns the property ID used to hold the length of the slice/array at propertyID.
+func LengthPath(propertyID string) string {
+	if propertyID == "" {
+		return LengthSegment
+	}
+	return propertyID + "." + LengthSegment
+}
+
+// EscapeSegment escapes a single path segment.
+func EscapeSegment(segment string) string {
+	if segment == LengthSegment || segment == RootPath {
+		return `\` + segment
+	}
+	if !strings.ContainsAny(segment, `.\`) {
+		return segment
+	}
+	var sb strings.Builder
+	for _, r := range segment {
+		if r == '.' || r == '\\' {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// SplitPath splits a property ID into its unescaped segments.
+func SplitPath(propertyID string) []PathSegment {
+	var segments []PathSegment
+	var sb strings.Builder
+	escaped := false
+	wasEscaped := false
+	for _, r := range propertyID {
+		switch {
+		case escaped:
+			sb.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			wasEscaped = true
+		case r == '.':
+			segments = append(segments, newPathSegment(sb.String(), wasEscaped))
+			sb.Reset()
+			wasEscaped = false
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	segments = append(segments, newPathSegment(sb.String(), wasEscaped))
+	return segments
+}
+
+// PathSegment is a single unescaped segment of a property ID.
+type PathSegment struct {
+	Name string
+
+	// IsLength is true if the segment is the length marker for a slice/array (and not a
+	// map key or field that happens to be called "#")
+	IsLength bool
+}
+
+func newPathSegment(name string, wasEscaped bool) PathSegment {
+	return PathSegment{Name: name, IsLength: name == LengthSegment && !wasEscaped}
+}
+
+// ParseLength parses the value of a length property. No data (removed) is 0.
+func ParseLength(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(string(data))
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid length")
+	}
+	if n > MaxLength {
+		return 0, fmt.Errorf("%w: %d", ErrTooLong, n)
+	}
+	return n, nil
+}
+
+// ParseIndex parses a path segment that's an index into a slice/array.
+func ParseIndex(segment string) (int, error) {
+	i, err := strconv.Atoi(segment)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid index %s", segment)
+	}
+	if i >= MaxLength {
+		return 0, fmt.Errorf("%w: index %d", ErrTooLong, i)
+	}
+	return i, nil
+}
@@ -0,0 +1,63 @@
+package converters
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinSplitPath(t *testing.T) {
+	for _, segments := range [][]string{
+		{"a"},
+		{"a", "b", "c"},
+		{"a.b", `c\d`, "e"},
+		{"", "x"},
+		{"#"},
+		{"$"},
+		{"list", "0"},
+	} {
+		path := JoinPath(segments...)
+		split := SplitPath(path)
+		names := make([]string, len(split))
+		for i, s := range split {
+			names[i] = s.Name
+			assert.False(t, s.IsLength, "Escaped # should not be a length segment")
+		}
+		assert.EqualValues(t, segments, names, "Should round trip %s", path)
+	}
+}
+
+func TestRootPathIsReserved(t *testing.T) {
+	assert.NotEqual(t, RootPath, JoinPath("$"), "Segment named $ should not be the root")
+}
+
+func TestLengthPath(t *testing.T) {
+	split := SplitPath(LengthPath(AppendPath("", "list")))
+	assert.EqualValues(t, 2, len(split))
+	assert.EqualValues(t, "list", split[0].Name)
+	assert.True(t, split[1].IsLength, "Should be length segment")
+}
+
+func TestParseLengthAndIndexLimits(t *testing.T) {
+	n, err := ParseLength(nil)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, n, "Removed length should be 0")
+
+	n, err = ParseLength([]byte("3"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, n)
+
+	_, err = ParseLength([]byte("-1"))
+	assert.NotNil(t, err)
+	_, err = ParseLength([]byte("100000000000"))
+	assert.ErrorIs(t, err, ErrTooLong)
+
+	i, err := ParseIndex("2")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, i)
+	_, err = ParseIndex("x")
+	assert.NotNil(t, err)
+	_, err = ParseIndex(strconv.Itoa(MaxLength))
+	assert.ErrorIs(t, err, ErrTooLong)
+}
@@ -0,0 +1,441 @@
+package protobuf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/kpfaulkner/collablite/client"
+	"github.com/kpfaulkner/collablite/client/converters"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// messageMarker is stored against the property for a (sub)message that is set. Needed so a message
+// that is set but has no populated fields survives the round trip.
+var messageMarker = []byte("{}")
+
+// ProtoObject converts between a protobuf message and the ClientObject.
+// Every populated field becomes a property named by the dotted path of proto field names. eg.
+// "options.java_package", "message_type.0.field.1.name". Repeated fields also have a length
+// property ("message_type.#") and map entries are keyed by the map key ("labels.colour").
+// Scalar values are stored as JSON.
+type ProtoObject struct {
+	ObjectID string
+
+	// change tracking, and the Lock that must be held by the caller while modifying the message.
+	*converters.FlatObject
+
+	message proto.Message
+}
+
+// NewProtoObject creates a ProtoObject that keeps message in sync.
+func NewProtoObject(objectID string, message proto.Message) (*ProtoObject, error) {
+	if message == nil || !message.ProtoReflect().IsValid() {
+		return nil, fmt.Errorf("message must be a non-nil protobuf message")
+	}
+
+	p := ProtoObject{
+		ObjectID: objectID,
+		message:  message,
+	}
+	p.FlatObject = converters.NewFlatObject(
+		func() (map[string][]byte, error) {
+			return Flatten(message)
+		},
+		func(path []converters.PathSegment, data []byte) error {
+			// removed properties clear the field.
+			return setPath(message.ProtoReflect(), path, data)
+		})
+	return &p, nil
+}
+
+// Message returns the message being synced.
+func (p *ProtoObject) Message() proto.Message {
+	return p.message
+}
+
+// ConvertToObject flattens the message and marks any property that has changed since the last
+// send as dirty.
+func (p *ProtoObject) ConvertToObject(objectID string, existingObject *client.ClientObject, clientObject any) (*client.ClientObject, error) {
+	protoObject, ok := clientObject.(*ProtoObject)
+	if !ok {
+		return nil, fmt.Errorf("expected *ProtoObject, got %T", clientObject)
+	}
+	return protoObject.UpdateObject(objectID, existingObject, "PROTOBUF")
+}
+
+// Flatten converts the message into a map of property ID to data.
+func Flatten(message proto.Message) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	if err := flattenMessage(message.ProtoReflect(), "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Rebuild resets message and populates it from every property in object.
+func Rebuild(object *client.ClientObject, message proto.Message) error {
+	proto.Reset(message)
+
+	properties := object.GetProperties()
+	keys := make([]string, 0, len(properties))
+	for k, v := range properties {
+		if len(v.Data) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := setPath(message.ProtoReflect(), converters.SplitPath(k), properties[k].Data); err != nil {
+			return fmt.Errorf("unable to apply property %s : %w", k, err)
+		}
+	}
+	return nil
+}
+
+func flattenMessage(m protoreflect.Message, path string, out map[string][]byte) error {
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		fieldPath := converters.AppendPath(path, string(fd.Name()))
+		switch {
+		case fd.IsList():
+			list := v.List()
+			out[converters.LengthPath(fieldPath)] = []byte(strconv.Itoa(list.Len()))
+			for i := 0; i < list.Len(); i++ {
+				if err = flattenValue(fd, list.Get(i), converters.AppendPath(fieldPath, strconv.Itoa(i)), out); err != nil {
+					return false
+				}
+			}
+		case fd.IsMap():
+			v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				err = flattenValue(fd.MapValue(), mv, converters.AppendPath(fieldPath, k.String()), out)
+				return err == nil
+			})
+		default:
+			err = flattenValue(fd, v, fieldPath, out)
+		}
+		return err == nil
+	})
+	return err
+}
+
+func flattenValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, path string, out map[string][]byte) error {
+	if isMessage(fd) {
+		out[path] = messageMarker
+		return flattenMessage(v.Message(), path, out)
+	}
+
+	data, err := encodeScalar(fd, v)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s : %w", path, err)
+	}
+	out[path] = data
+	return nil
+}
+
+func isMessage(fd protoreflect.FieldDescriptor) bool {
+	return fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind
+}
+
+// setPath sets the field at path (relative to m) to data. Empty data means the property was removed.
+func setPath(m protoreflect.Message, path []converters.PathSegment, data []byte) error {
+	if len(path) == 0 {
+		return fmt.Errorf("empty path")
+	}
+
+	fd := m.Descriptor().Fields().ByName(protoreflect.Name(path[0].Name))
+	if fd == nil {
+		return fmt.Errorf("%s has no field %s", m.Descriptor().FullName(), path[0].Name)
+	}
+	rest := path[1:]
+	removed := len(data) == 0
+
+	switch {
+	case fd.IsList():
+		if len(rest) == 0 {
+			if removed {
+				m.Clear(fd)
+				return nil
+			}
+			return fmt.Errorf("repeated field %s requires an index", fd.Name())
+		}
+
+		if rest[0].IsLength {
+			n, err := converters.ParseLength(data)
+			if err != nil {
+				return err
+			}
+			resizeList(m.Mutable(fd).List(), n)
+			return nil
+		}
+
+		i, err := converters.ParseIndex(rest[0].Name)
+		if err != nil {
+			return err
+		}
+		if !m.Has(fd) || i >= m.Get(fd).List().Len() {
+			if removed {
+				// element already gone (list shrunk)
+				return nil
+			}
+			resizeList(m.Mutable(fd).List(), i+1)
+		}
+		list := m.Mutable(fd).List()
+
+		if isMessage(fd) {
+			if len(rest) == 1 {
+				if removed {
+					list.Set(i, list.NewElement())
+				}
+				return nil
+			}
+			return setPath(list.Get(i).Message(), rest[1:], data)
+		}
+
+		if len(rest) != 1 {
+			return fmt.Errorf("%s is a single value", fd.Name())
+		}
+		if removed {
+			list.Set(i, list.NewElement())
+			return nil
+		}
+		v, err := decodeScalar(fd, data)
+		if err != nil {
+			return err
+		}
+		list.Set(i, v)
+		return nil
+
+	case fd.IsMap():
+		if len(rest) == 0 {
+			if removed {
+				m.Clear(fd)
+				return nil
+			}
+			return fmt.Errorf("map field %s requires a key", fd.Name())
+		}
+
+		key, err := parseMapKey(fd.MapKey(), rest[0].Name)
+		if err != nil {
+			return err
+		}
+
+		if removed && len(rest) == 1 {
+			if m.Has(fd) {
+				m.Mutable(fd).Map().Clear(key)
+			}
+			return nil
+		}
+
+		if isMessage(fd.MapValue()) {
+			if removed && (!m.Has(fd) || !m.Get(fd).Map().Has(key)) {
+				return nil
+			}
+			entry := m.Mutable(fd).Map().Mutable(key).Message()
+			if len(rest) == 1 {
+				return nil
+			}
+			return setPath(entry, rest[1:], data)
+		}
+
+		if len(rest) != 1 {
+			return fmt.Errorf("%s is a single value", fd.Name())
+		}
+		v, err := decodeScalar(fd.MapValue(), data)
+		if err != nil {
+			return err
+		}
+		m.Mutable(fd).Map().Set(key, v)
+		return nil
+
+	case isMessage(fd):
+		if len(rest) == 0 {
+			if removed {
+				m.Clear(fd)
+			} else {
+				// marker for message being set.
+				m.Mutable(fd)
+			}
+			return nil
+		}
+		if removed && !m.Has(fd) {
+			return nil
+		}
+		return setPath(m.Mutable(fd).Message(), rest, data)
+	}
+
+	if len(rest) != 0 {
+		return fmt.Errorf("%s is a single value", fd.Name())
+	}
+	if removed {
+		m.Clear(fd)
+		return nil
+	}
+	v, err := decodeScalar(fd, data)
+	if err != nil {
+		return err
+	}
+	m.Set(fd, v)
+	return nil
+}
+
+// resizeList grows or shrinks the list to n elements. n has been checked against
+// converters.MaxLength.
+func resizeList(list protoreflect.List, n int) {
+	if n < list.Len() {
+		list.Truncate(n)
+		return
+	}
+	for list.Len() < n {
+		list.Append(list.NewElement())
+	}
+}
+
+func parseMapKey(fd protoreflect.FieldDescriptor, s string) (protoreflect.MapKey, error) {
+	var v protoreflect.Value
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		v = protoreflect.ValueOfString(s)
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return protoreflect.MapKey{}, err
+		}
+		v = protoreflect.ValueOfBool(b)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return protoreflect.MapKey{}, err
+		}
+		v = protoreflect.ValueOfInt32(int32(n))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return protoreflect.MapKey{}, err
+		}
+		v = protoreflect.ValueOfInt64(n)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return protoreflect.MapKey{}, err
+		}
+		v = protoreflect.ValueOfUint32(uint32(n))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return protoreflect.MapKey{}, err
+		}
+		v = protoreflect.ValueOfUint64(n)
+	default:
+		return protoreflect.MapKey{}, fmt.Errorf("unsupported map key kind %s", fd.Kind())
+	}
+	return v.MapKey(), nil
+}
+
+// encodeScalar encodes a non message value as JSON. Similar to protojson, enums are stored by name
+// and non finite floats are stored as strings.
+func encodeScalar(fd protoreflect.FieldDescriptor, v protoreflect.Value) ([]byte, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return json.Marshal(v.Bool())
+	case protoreflect.StringKind:
+		return json.Marshal(v.String())
+	case protoreflect.BytesKind:
+		return json.Marshal(v.Bytes())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return json.Marshal(string(ev.Name()))
+		}
+		return json.Marshal(int32(v.Enum()))
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return []byte(strconv.FormatInt(v.Int(), 10)), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return []byte(strconv.FormatUint(v.Uint(), 10)), nil
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		f := v.Float()
+		switch {
+		case math.IsNaN(f):
+			return []byte(`"NaN"`), nil
+		case math.IsInf(f, 1):
+			return []byte(`"Infinity"`), nil
+		case math.IsInf(f, -1):
+			return []byte(`"-Infinity"`), nil
+		}
+		bitSize := 64
+		if fd.Kind() == protoreflect.FloatKind {
+			bitSize = 32
+		}
+		return []byte(strconv.FormatFloat(f, 'g', -1, bitSize)), nil
+	}
+	return nil, fmt.Errorf("unsupported kind %s", fd.Kind())
+}
+
+// decodeScalar is the reverse of encodeScalar
+func decodeScalar(fd protoreflect.FieldDescriptor, data []byte) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		var b bool
+		err := json.Unmarshal(data, &b)
+		return protoreflect.ValueOfBool(b), err
+	case protoreflect.StringKind:
+		var s string
+		err := json.Unmarshal(data, &s)
+		return protoreflect.ValueOfString(s), err
+	case protoreflect.BytesKind:
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return protoreflect.Value{}, err
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		return protoreflect.ValueOfBytes(b), err
+	case protoreflect.EnumKind:
+		var name string
+		if err := json.Unmarshal(data, &name); err == nil {
+			ev := fd.Enum().Values().ByName(protoreflect.Name(name))
+			if ev == nil {
+				return protoreflect.Value{}, fmt.Errorf("unknown enum value %s", name)
+			}
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		n, err := strconv.ParseInt(string(data), 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		n, err := strconv.ParseInt(string(data), 10, 32)
+		return protoreflect.ValueOfInt32(int32(n)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		n, err := strconv.ParseInt(string(data), 10, 64)
+		return protoreflect.ValueOfInt64(n), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		n, err := strconv.ParseUint(string(data), 10, 32)
+		return protoreflect.ValueOfUint32(uint32(n)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		n, err := strconv.ParseUint(string(data), 10, 64)
+		return protoreflect.ValueOfUint64(n), err
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		var f float64
+		switch string(data) {
+		case `"NaN"`:
+			f = math.NaN()
+		case `"Infinity"`:
+			f = math.Inf(1)
+		case `"-Infinity"`:
+			f = math.Inf(-1)
+		default:
+			var err error
+			if f, err = strconv.ParseFloat(string(data), 64); err != nil {
+				return protoreflect.Value{}, err
+			}
+		}
+		if fd.Kind() == protoreflect.FloatKind {
+			return protoreflect.ValueOfFloat32(float32(f)), nil
+		}
+		return protoreflect.ValueOfFloat64(f), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported kind %s", fd.Kind())
+}
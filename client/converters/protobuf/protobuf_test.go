@@ -0,0 +1,184 @@
+package protobuf
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kpfaulkner/collablite/client"
+	"github.com/kpfaulkner/collablite/client/converters"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ensure ProtoObject satisfies the Converter interface
+var _ converters.Converter = &ProtoObject{}
+
+// testMessage uses a descriptor as a handy message with nested messages, repeated fields and enums.
+func testMessage() *descriptorpb.FileDescriptorProto {
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Options: &descriptorpb.FileOptions{
+			JavaPackage:    proto.String("dev.test"),
+			OptimizeFor:    descriptorpb.FileOptions_CODE_SIZE.Enum(),
+			CcEnableArenas: proto.Bool(false),
+		},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("First"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("a"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+					{Name: proto.String("b"), Number: proto.Int32(2), DefaultValue: proto.String("x.y")},
+				},
+			},
+			{Name: proto.String("Second"), Options: &descriptorpb.MessageOptions{}},
+		},
+		Dependency: []string{"a.proto", "b.proto"},
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	props, err := Flatten(testMessage())
+	assert.Nil(t, err, "Should not have error flattening")
+
+	assert.EqualValues(t, `"test.proto"`, string(props["name"]))
+	assert.EqualValues(t, `{}`, string(props["options"]), "Should mark message as set")
+	assert.EqualValues(t, `"dev.test"`, string(props["options.java_package"]))
+	assert.EqualValues(t, `"CODE_SIZE"`, string(props["options.optimize_for"]), "Should store enum by name")
+	assert.EqualValues(t, `false`, string(props["options.cc_enable_arenas"]), "Should keep explicitly set zero value")
+	assert.EqualValues(t, `2`, string(props["message_type.#"]), "Should store list length")
+	assert.EqualValues(t, `"a"`, string(props["message_type.0.field.0.name"]))
+	assert.EqualValues(t, `2`, string(props["message_type.0.field.1.number"]))
+	assert.EqualValues(t, `{}`, string(props["message_type.1.options"]), "Should mark empty message as set")
+	assert.EqualValues(t, `"b.proto"`, string(props["dependency.1"]))
+	_, ok := props["syntax"]
+	assert.False(t, ok, "Unset fields should not be stored")
+}
+
+func TestRebuild(t *testing.T) {
+	for _, msg := range []proto.Message{
+		testMessage(),
+		mustStruct(t, map[string]any{
+			"name":   "box",
+			"size":   10.5,
+			"tags":   []any{"a", "b"},
+			"nested": map[string]any{"ok": true, "nothing": nil},
+		}),
+		&descriptorpb.UninterpretedOption{DoubleValue: proto.Float64(math.Inf(-1)), StringValue: []byte{0, 1, 2}},
+	} {
+		props, err := Flatten(msg)
+		assert.Nil(t, err)
+
+		obj := client.NewObject("object1", "PROTOBUF")
+		for k, v := range props {
+			obj.AdjustProperty(k, v, false, true)
+		}
+
+		rebuilt := msg.ProtoReflect().New().Interface()
+		assert.Nil(t, Rebuild(obj, rebuilt), "Should not have error rebuilding")
+		assert.True(t, proto.Equal(msg, rebuilt), "Should round trip %v", msg)
+	}
+}
+
+func TestChangedFields(t *testing.T) {
+	msg := testMessage()
+	p, _ := NewProtoObject("object1", msg)
+	obj, err := p.ConvertToObject("object1", nil, p)
+	assert.Nil(t, err)
+	for k := range obj.GetProperties() {
+		obj.ClearPropertyDirtyFlag(k)
+	}
+
+	p.Lock.Lock()
+	msg.Options.JavaPackage = proto.String("dev.other")
+	msg.Dependency = msg.Dependency[:1]
+	p.Lock.Unlock()
+
+	changed, err := p.ChangedFields()
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"dependency.#", "dependency.1", "options.java_package"}, changed)
+
+	obj, err = p.ConvertToObject("object1", obj, p)
+	assert.Nil(t, err)
+	props := obj.GetProperties()
+	assert.True(t, props["options.java_package"].Dirty, "Changed field should be dirty")
+	assert.False(t, props["name"].Dirty, "Unchanged field should not be dirty")
+	assert.Nil(t, props["dependency.1"].Data, "Removed element should have no data")
+
+	changed, _ = p.ChangedFields()
+	assert.Empty(t, changed, "Nothing should have changed after send")
+}
+
+func TestConvertFromObject(t *testing.T) {
+	msg := testMessage()
+	p, _ := NewProtoObject("object1", msg)
+	obj, _ := p.ConvertToObject("object1", nil, p)
+
+	// changes from the server
+	obj.AdjustProperty("package", []byte(`"other"`), false, true)
+	obj.AdjustProperty("options.optimize_for", []byte(`"SPEED"`), false, true)
+	obj.AdjustProperty("message_type.#", []byte(`1`), false, true)
+	obj.AdjustProperty("message_type.1", nil, false, true)
+	obj.AdjustProperty("message_type.1.name", nil, false, true)
+	obj.AdjustProperty("message_type.1.options", nil, false, true)
+	obj.AdjustProperty("message_type.0.field.0.name", []byte(`"renamed"`), false, true)
+	obj.AdjustProperty("source_code_info", []byte(`{}`), false, true)
+	obj.AdjustProperty("options.java_package", nil, false, true)
+
+	assert.Nil(t, p.ConvertFromObject(obj), "Should not have error applying changes")
+	assert.EqualValues(t, "other", msg.GetPackage())
+	assert.EqualValues(t, descriptorpb.FileOptions_SPEED, msg.GetOptions().GetOptimizeFor())
+	assert.EqualValues(t, 1, len(msg.MessageType), "Should shrink list")
+	assert.EqualValues(t, "renamed", msg.MessageType[0].Field[0].GetName())
+	assert.NotNil(t, msg.SourceCodeInfo, "Should set empty message")
+	assert.Nil(t, msg.Options.JavaPackage, "Should clear removed field")
+
+	changed, _ := p.ChangedFields()
+	assert.Empty(t, changed, "Incoming changes should not be sent back")
+}
+
+func TestMapFields(t *testing.T) {
+	msg := mustStruct(t, map[string]any{"colour": "red", "size": 10})
+	p, _ := NewProtoObject("object1", msg)
+	obj, _ := p.ConvertToObject("object1", nil, p)
+
+	props := obj.GetProperties()
+	assert.EqualValues(t, `"red"`, string(props["fields.colour.string_value"].Data), "Should key map entries")
+
+	obj.AdjustProperty("fields.size.number_value", nil, false, true)
+	obj.AdjustProperty("fields.size", nil, false, true)
+	obj.AdjustProperty("fields.weight.bool_value", []byte(`true`), false, true)
+	assert.Nil(t, p.ConvertFromObject(obj))
+
+	assert.EqualValues(t, map[string]any{"colour": "red", "weight": true}, msg.AsMap())
+}
+
+func TestUnknownField(t *testing.T) {
+	msg := testMessage()
+	p, _ := NewProtoObject("object1", msg)
+	obj := client.NewObject("object1", "PROTOBUF")
+	obj.AdjustProperty("nosuchfield", []byte(`1`), false, true)
+	assert.NotNil(t, p.ConvertFromObject(obj), "Should error on unknown field")
+}
+
+func mustStruct(t *testing.T, m map[string]any) *structpb.Struct {
+	s, err := structpb.NewStruct(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestHugeLengthRejected(t *testing.T) {
+	for _, prop := range [][2]string{{"dependency.#", "100000000000"}, {"dependency.100000000000", `"x"`}, {"message_type.2000000.name", `"x"`}} {
+		msg := &descriptorpb.FileDescriptorProto{}
+		p, _ := NewProtoObject("object1", msg)
+		obj := client.NewObject("object1", "PROTOBUF")
+		obj.AdjustProperty(prop[0], []byte(prop[1]), false, true)
+		assert.ErrorIs(t, p.ConvertFromObject(obj), converters.ErrTooLong, "Should refuse %s", prop[0])
+		assert.Empty(t, msg.Dependency)
+		assert.Empty(t, msg.MessageType)
+	}
+}
@@ -0,0 +1,372 @@
+package structs
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/kpfaulkner/collablite/client"
+	"github.com/kpfaulkner/collablite/client/converters"
+)
+
+// TagName is the struct tag used to name the property for a field.
+// `collab:"name"` names the property, `collab:"-"` skips the field. Fields without a tag use the Go field name.
+const TagName = "collab"
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// StructObject converts between an arbitrary Go struct and the ClientObject.
+// Every leaf field becomes a property named by the dotted path to that field. Nested structs,
+// pointers, slices, arrays and maps are all walked. eg.
+//
+//	type Shape struct {
+//		Position Point             `collab:"pos"`
+//		Tags     []string          `collab:"tags"`
+//		Attrs    map[string]string `collab:"attrs"`
+//	}
+//
+// gives properties "pos.x", "pos.y", "tags.#" (number of tags), "tags.0", "attrs.colour" etc.
+// Leaf values are stored as JSON.
+type StructObject struct {
+	ObjectID string
+
+	// change tracking, and the Lock that must be held by the caller while modifying the target
+	// struct.
+	*converters.FlatObject
+
+	// pointer to the users struct.
+	target reflect.Value
+}
+
+// NewStructObject creates a StructObject for target, which must be a non-nil pointer to a struct.
+func NewStructObject(objectID string, target any) (*StructObject, error) {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("target must be a non-nil pointer to a struct, got %T", target)
+	}
+
+	s := StructObject{
+		ObjectID: objectID,
+		target:   v,
+	}
+	s.FlatObject = converters.NewFlatObject(
+		func() (map[string][]byte, error) {
+			current := make(map[string][]byte)
+			err := flatten(v.Elem(), "", current)
+			return current, err
+		},
+		func(path []converters.PathSegment, data []byte) error {
+			// removed properties set the field back to its zero value (or remove the element/key
+			// for slices and maps).
+			return setPath(v.Elem(), path, data)
+		})
+	return &s, nil
+}
+
+// Target returns the struct being synced (the pointer passed to NewStructObject)
+func (s *StructObject) Target() any {
+	return s.target.Interface()
+}
+
+// ConvertToObject flattens the struct and marks any property that has changed since the last
+// send as dirty.
+func (s *StructObject) ConvertToObject(objectID string, existingObject *client.ClientObject, clientObject any) (*client.ClientObject, error) {
+	structObject, ok := clientObject.(*StructObject)
+	if !ok {
+		return nil, fmt.Errorf("expected *StructObject, got %T", clientObject)
+	}
+	return structObject.UpdateObject(objectID, existingObject, "STRUCT")
+}
+
+// fieldName returns the property name for a struct field, or false if the field is skipped.
+func fieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" {
+		// unexported
+		return "", false
+	}
+
+	tag := f.Tag.Get(TagName)
+	if tag == "-" {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name, true
+}
+
+// fieldByName finds the struct field with the given property name.
+func fieldByName(t reflect.Type, name string) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if n, ok := fieldName(t.Field(i)); ok && n == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// isLeaf determines if values of type t are stored as a single property.
+func isLeaf(t reflect.Type) bool {
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) ||
+		reflect.PtrTo(t).Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Interface,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		// []byte is stored as a single (base64) value, same as encoding/json.
+		return t.Elem().Kind() == reflect.Uint8
+	}
+	return false
+}
+
+// flatten walks v and adds a property for every leaf value to out.
+func flatten(v reflect.Value, path string, out map[string][]byte) error {
+
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			out[path] = []byte("null")
+			return nil
+		}
+		if v.Kind() == reflect.Ptr {
+			return flatten(v.Elem(), path, out)
+		}
+	}
+
+	if isLeaf(v.Type()) {
+		var value any
+		if v.CanAddr() {
+			value = v.Addr().Interface()
+		} else {
+			value = v.Interface()
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("unable to marshal %s : %w", path, err)
+		}
+		out[path] = data
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name, ok := fieldName(v.Type().Field(i))
+			if !ok {
+				continue
+			}
+			if err := flatten(v.Field(i), converters.AppendPath(path, name), out); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		out[converters.LengthPath(path)] = []byte(strconv.Itoa(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := flatten(v.Index(i), converters.AppendPath(path, strconv.Itoa(i)), out); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := formatMapKey(iter.Key())
+			if err != nil {
+				return err
+			}
+			if err := flatten(iter.Value(), converters.AppendPath(path, key), out); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %s at %s", v.Type(), path)
+	}
+	return nil
+}
+
+// formatMapKey converts a map key to a path segment.
+func formatMapKey(k reflect.Value) (string, error) {
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+
+	switch k.Kind() {
+	case reflect.String:
+		return k.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type %s", k.Type())
+}
+
+// parseMapKey converts a path segment back to a map key of type t.
+func parseMapKey(t reflect.Type, s string) (reflect.Value, error) {
+	key := reflect.New(t)
+	if tu, ok := key.Interface().(encoding.TextUnmarshaler); ok {
+		err := tu.UnmarshalText([]byte(s))
+		return key.Elem(), err
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		key.Elem().SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		key.Elem().SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		key.Elem().SetUint(n)
+	default:
+		return reflect.Value{}, fmt.Errorf("unsupported map key type %s", t)
+	}
+	return key.Elem(), nil
+}
+
+// setPath sets the value at path (relative to v) to data. Empty data means the property was removed.
+// v must be settable.
+func setPath(v reflect.Value, path []converters.PathSegment, data []byte) error {
+
+	if v.Kind() == reflect.Ptr {
+		if len(path) == 0 && (len(data) == 0 || string(data) == "null") {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			if len(data) == 0 {
+				// removing something from a struct that doesn't exist. Nothing to do.
+				return nil
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setPath(v.Elem(), path, data)
+	}
+
+	if len(path) == 0 {
+		if len(data) == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+
+	if isLeaf(v.Type()) {
+		return fmt.Errorf("%s is a single value and has no %s", v.Type(), path[0].Name)
+	}
+
+	segment := path[0]
+	switch v.Kind() {
+	case reflect.Struct:
+		i, ok := fieldByName(v.Type(), segment.Name)
+		if !ok {
+			return fmt.Errorf("%s has no field %s", v.Type(), segment.Name)
+		}
+		return setPath(v.Field(i), path[1:], data)
+
+	case reflect.Slice:
+		if segment.IsLength {
+			n, err := converters.ParseLength(data)
+			if err != nil {
+				return err
+			}
+			resizeSlice(v, n)
+			return nil
+		}
+		i, err := converters.ParseIndex(segment.Name)
+		if err != nil {
+			return err
+		}
+		if i >= v.Len() {
+			if len(data) == 0 {
+				// element already gone (slice shrunk)
+				return nil
+			}
+			resizeSlice(v, i+1)
+		}
+		return setPath(v.Index(i), path[1:], data)
+
+	case reflect.Array:
+		if segment.IsLength {
+			// fixed size, nothing to do.
+			return nil
+		}
+		i, err := converters.ParseIndex(segment.Name)
+		if err != nil {
+			return err
+		}
+		if i >= v.Len() {
+			return fmt.Errorf("invalid index %s", segment.Name)
+		}
+		return setPath(v.Index(i), path[1:], data)
+
+	case reflect.Map:
+		key, err := parseMapKey(v.Type().Key(), segment.Name)
+		if err != nil {
+			return err
+		}
+
+		if len(data) == 0 && len(path) == 1 {
+			if !v.IsNil() {
+				v.SetMapIndex(key, reflect.Value{})
+			}
+			return nil
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+		// map values are not addressable, so modify a copy and put it back.
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			elem.Set(existing)
+		}
+		if err := setPath(elem, path[1:], data); err != nil {
+			return err
+		}
+
+		// if everything within the entry has been removed, then remove the entry.
+		if len(data) == 0 && elem.IsZero() {
+			v.SetMapIndex(key, reflect.Value{})
+		} else {
+			v.SetMapIndex(key, elem)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unable to set %s on %s", segment.Name, v.Type())
+}
+
+// resizeSlice grows or shrinks the slice to n elements. n has been checked against
+// converters.MaxLength.
+func resizeSlice(v reflect.Value, n int) {
+	if n <= v.Len() {
+		v.Set(v.Slice(0, n))
+		return
+	}
+
+	// new backing array so any elements previously truncated do not reappear.
+	newSlice := reflect.MakeSlice(v.Type(), n, n)
+	reflect.Copy(newSlice, v)
+	v.Set(newSlice)
+}
@@ -0,0 +1,192 @@
+package structs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/client"
+	"github.com/kpfaulkner/collablite/client/converters"
+	"github.com/stretchr/testify/assert"
+)
+
+type point struct {
+	X int `collab:"x"`
+	Y int `collab:"y"`
+}
+
+type shape struct {
+	Name     string            `collab:"name"`
+	Position point             `collab:"pos"`
+	Anchor   *point            `collab:"anchor"`
+	Tags     []string          `collab:"tags"`
+	Attrs    map[string]string `collab:"attrs"`
+	Points   []point           `collab:"points"`
+	Created  time.Time         `collab:"created"`
+	Ignored  string            `collab:"-"`
+	Untagged bool
+	internal int
+}
+
+// ensure StructObject satisfies the Converter interface
+var _ converters.Converter = &StructObject{}
+
+func TestNewStructObjectRequiresStructPointer(t *testing.T) {
+	_, err := NewStructObject("object1", shape{})
+	assert.NotNil(t, err, "Should not accept non pointer")
+
+	var s *shape
+	_, err = NewStructObject("object1", s)
+	assert.NotNil(t, err, "Should not accept nil pointer")
+
+	_, err = NewStructObject("object1", &shape{})
+	assert.Nil(t, err, "Should accept pointer to struct")
+}
+
+func TestConvertToObjectProperties(t *testing.T) {
+	s := shape{
+		Name:     "box",
+		Position: point{X: 1, Y: 2},
+		Tags:     []string{"a", "b"},
+		Attrs:    map[string]string{"colour": "red", "odd.key": "x"},
+		Points:   []point{{X: 5, Y: 6}},
+		Created:  time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Ignored:  "ignored",
+		Untagged: true,
+	}
+	so, _ := NewStructObject("object1", &s)
+
+	obj, err := so.ConvertToObject("object1", nil, so)
+	assert.Nil(t, err, "Should not have error converting")
+
+	props := obj.GetProperties()
+	assert.EqualValues(t, `"box"`, string(props["name"].Data))
+	assert.EqualValues(t, "1", string(props["pos.x"].Data))
+	assert.EqualValues(t, "2", string(props["pos.y"].Data))
+	assert.EqualValues(t, "null", string(props["anchor"].Data), "nil pointer should be null")
+	assert.EqualValues(t, "2", string(props["tags.#"].Data), "Should store slice length")
+	assert.EqualValues(t, `"b"`, string(props["tags.1"].Data))
+	assert.EqualValues(t, `"red"`, string(props["attrs.colour"].Data))
+	assert.EqualValues(t, `"x"`, string(props[`attrs.odd\.key`].Data), "Should escape dots in map keys")
+	assert.EqualValues(t, "6", string(props["points.0.y"].Data))
+	assert.EqualValues(t, `"2023-01-02T03:04:05Z"`, string(props["created"].Data))
+	assert.EqualValues(t, "true", string(props["Untagged"].Data), "Should use field name without tag")
+	_, ok := props["Ignored"]
+	assert.False(t, ok, "Should skip fields tagged -")
+	assert.True(t, props["name"].Dirty, "Should be dirty")
+}
+
+func TestChangedFields(t *testing.T) {
+	s := shape{Name: "box", Tags: []string{"a", "b", "c"}}
+	so, _ := NewStructObject("object1", &s)
+	obj, _ := so.ConvertToObject("object1", nil, so)
+	for k := range obj.GetProperties() {
+		obj.ClearPropertyDirtyFlag(k)
+	}
+
+	changed, err := so.ChangedFields()
+	assert.Nil(t, err)
+	assert.Empty(t, changed, "Nothing should have changed since send")
+
+	so.Lock.Lock()
+	s.Position.X = 10
+	s.Tags = s.Tags[:1]
+	so.Lock.Unlock()
+
+	changed, err = so.ChangedFields()
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"pos.x", "tags.#", "tags.1", "tags.2"}, changed)
+
+	obj, err = so.ConvertToObject("object1", obj, so)
+	assert.Nil(t, err)
+	props := obj.GetProperties()
+	assert.True(t, props["pos.x"].Dirty, "Changed field should be dirty")
+	assert.False(t, props["name"].Dirty, "Unchanged field should not be dirty")
+	assert.True(t, props["tags.2"].Dirty, "Removed element should be dirty")
+	assert.Nil(t, props["tags.2"].Data, "Removed element should have no data")
+
+	changed, _ = so.ChangedFields()
+	assert.Empty(t, changed, "Nothing should have changed after send")
+}
+
+func TestConvertFromObject(t *testing.T) {
+	s := shape{Tags: []string{"a", "b", "c"}, Attrs: map[string]string{"colour": "red", "size": "10"}}
+	so, _ := NewStructObject("object1", &s)
+	obj, _ := so.ConvertToObject("object1", nil, so)
+
+	// changes coming from the server.
+	obj.AdjustProperty("name", []byte(`"circle"`), false, true)
+	obj.AdjustProperty("anchor.x", []byte(`7`), false, true)
+	obj.AdjustProperty("tags.#", []byte(`1`), false, true)
+	obj.AdjustProperty("tags.1", nil, false, true)
+	obj.AdjustProperty("tags.2", nil, false, true)
+	obj.AdjustProperty("attrs.size", nil, false, true)
+	obj.AdjustProperty(`attrs.new\.key`, []byte(`"v"`), false, true)
+	obj.AdjustProperty("points.1.x", []byte(`3`), false, true)
+
+	err := so.ConvertFromObject(obj)
+	assert.Nil(t, err, "Should not have error applying changes")
+
+	assert.EqualValues(t, "circle", s.Name)
+	assert.NotNil(t, s.Anchor, "Should allocate pointer")
+	assert.EqualValues(t, 7, s.Anchor.X)
+	assert.EqualValues(t, []string{"a"}, s.Tags, "Should shrink slice")
+	assert.EqualValues(t, map[string]string{"colour": "red", "new.key": "v"}, s.Attrs)
+	assert.EqualValues(t, []point{{}, {X: 3}}, s.Points, "Should grow slice")
+
+	for k, v := range obj.GetProperties() {
+		assert.False(t, v.Updated, "Updated flag should be cleared for %s", k)
+	}
+
+	// fields derived from the partial update (eg. anchor.y) are new, but the incoming properties
+	// themselves should not be sent back.
+	changed, _ := so.ChangedFields()
+	for _, k := range []string{"name", "anchor.x", "tags.#", "tags.1", "attrs.size", `attrs.new\.key`, "points.1.x"} {
+		assert.NotContains(t, changed, k, "Incoming change should not be sent back")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	src := shape{
+		Name:     "box",
+		Anchor:   &point{X: 1},
+		Tags:     []string{"x", "y"},
+		Attrs:    map[string]string{"a.b": "c"},
+		Points:   []point{{X: 1, Y: 2}, {X: 3, Y: 4}},
+		Created:  time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Untagged: true,
+	}
+	srcObject, _ := NewStructObject("object1", &src)
+	obj, err := srcObject.ConvertToObject("object1", nil, srcObject)
+	assert.Nil(t, err)
+
+	// pretend everything arrived from the server for a second client.
+	incoming := client.NewObject("object1", "STRUCT")
+	for k, v := range obj.GetProperties() {
+		incoming.AdjustProperty(k, v.Data, false, true)
+	}
+
+	var dst shape
+	dstObject, _ := NewStructObject("object1", &dst)
+	assert.Nil(t, dstObject.ConvertFromObject(incoming))
+	assert.EqualValues(t, src, dst)
+}
+
+func TestUnknownFieldErrors(t *testing.T) {
+	var s shape
+	so, _ := NewStructObject("object1", &s)
+	obj := client.NewObject("object1", "STRUCT")
+	obj.AdjustProperty("nosuchfield", []byte(`1`), false, true)
+	assert.NotNil(t, so.ConvertFromObject(obj), "Should error on unknown field")
+}
+
+func TestHugeLengthRejected(t *testing.T) {
+	for _, prop := range [][2]string{{"tags.#", "100000000000"}, {"tags.100000000000", `"x"`}, {"points.2000000.x", "1"}} {
+		var s shape
+		so, _ := NewStructObject("object1", &s)
+		obj := client.NewObject("object1", "STRUCT")
+		obj.AdjustProperty(prop[0], []byte(prop[1]), false, true)
+		assert.ErrorIs(t, so.ConvertFromObject(obj), converters.ErrTooLong, "Should refuse %s", prop[0])
+		assert.Empty(t, s.Tags)
+		assert.Empty(t, s.Points)
+	}
+}
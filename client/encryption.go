@@ -0,0 +1,262 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/kpfaulkner/collablite/proto"
+)
+
+// ErrDecryption is returned when incoming data cannot be decrypted (wrong key, tampered data etc)
+var ErrDecryption = errors.New("unable to decrypt property")
+
+const (
+	// first byte of all encrypted data, so the format can change later.
+	encryptionVersion byte = 1
+
+	// flag in the plaintext indicating the property was removed. Removals are encrypted like
+	// any other change so the server can't tell them apart.
+	flagRemoved byte = 1
+)
+
+// KeyProvider supplies the AES key (16, 24 or 32 bytes) for an object.
+// Every client sharing the object must get the same key.
+type KeyProvider interface {
+	GetKey(objectID string) ([]byte, error)
+}
+
+// KeyProviderFunc allows a function to be used as a KeyProvider
+type KeyProviderFunc func(objectID string) ([]byte, error)
+
+func (f KeyProviderFunc) GetKey(objectID string) ([]byte, error) {
+	return f(objectID)
+}
+
+// EncryptionOptions configures end to end encryption of property data.
+type EncryptionOptions struct {
+	KeyProvider KeyProvider
+
+	// HashPropertyIDs replaces property IDs with a keyed hash so the server doesn't see the structure
+	// of the object either. The real property ID is carried inside the encrypted data.
+	HashPropertyIDs bool
+}
+
+// objectKeys are the keys derived from the key supplied for an object.
+type objectKeys struct {
+	aead    cipher.AEAD
+	hashKey []byte
+}
+
+// encryptor encrypts outgoing and decrypts incoming changes.
+type encryptor struct {
+	opts EncryptionOptions
+
+	lock sync.Mutex
+	keys map[string]*objectKeys
+}
+
+func newEncryptor(opts EncryptionOptions) (*encryptor, error) {
+	if opts.KeyProvider == nil {
+		return nil, errors.New("encryption requires a KeyProvider")
+	}
+	return &encryptor{opts: opts, keys: make(map[string]*objectKeys)}, nil
+}
+
+// deriveKey generates separate keys for encryption and hashing from the supplied key.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)[:len(key)]
+}
+
+func (e *encryptor) getKeys(objectID string) (*objectKeys, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if k, ok := e.keys[objectID]; ok {
+		return k, nil
+	}
+
+	key, err := e.opts.KeyProvider.GetKey(objectID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get key for object %s: %w", objectID, err)
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, fmt.Errorf("invalid key for object %s: must be 16, 24 or 32 bytes", objectID)
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, "collablite-data"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &objectKeys{aead: aead, hashKey: deriveKey(key, "collablite-property-id")}
+	e.keys[objectID] = k
+	return k, nil
+}
+
+// storedPropertyID is the property ID as seen by the server.
+func (e *encryptor) storedPropertyID(keys *objectKeys, propertyID string) string {
+	if !e.opts.HashPropertyIDs {
+		return propertyID
+	}
+	mac := hmac.New(sha256.New, keys.hashKey)
+	mac.Write([]byte(propertyID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// additionalData binds the ciphertext to the object and property so the server can't move data around.
+func additionalData(objectID string, storedPropertyID string) []byte {
+	return []byte(objectID + "\x00" + storedPropertyID)
+}
+
+// encrypt returns the property ID and data to send to the server.
+// Format is version | nonce | sealed(flags | uvarint len(propertyID) | propertyID | data)
+func (e *encryptor) encrypt(objectID string, propertyID string, data []byte) (string, []byte, error) {
+	keys, err := e.getKeys(objectID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var flags byte
+	if len(data) == 0 {
+		flags |= flagRemoved
+	}
+
+	plaintext := make([]byte, 0, 1+binary.MaxVarintLen64+len(propertyID)+len(data))
+	plaintext = append(plaintext, flags)
+	plaintext = binary.AppendUvarint(plaintext, uint64(len(propertyID)))
+	plaintext = append(plaintext, propertyID...)
+	plaintext = append(plaintext, data...)
+
+	out := make([]byte, 1+keys.aead.NonceSize(), 1+keys.aead.NonceSize()+len(plaintext)+keys.aead.Overhead())
+	out[0] = encryptionVersion
+	nonce := out[1:]
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	stored := e.storedPropertyID(keys, propertyID)
+	out = keys.aead.Seal(out, nonce, plaintext, additionalData(objectID, stored))
+	return stored, out, nil
+}
+
+// decrypt returns the real property ID and data. Removed properties have nil data.
+func (e *encryptor) decrypt(objectID string, storedPropertyID string, ciphertext []byte) (string, []byte, error) {
+	keys, err := e.getKeys(objectID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonceSize := keys.aead.NonceSize()
+	if len(ciphertext) < 1+nonceSize || ciphertext[0] != encryptionVersion {
+		return "", nil, fmt.Errorf("%w %s: unknown format", ErrDecryption, storedPropertyID)
+	}
+
+	plaintext, err := keys.aead.Open(nil, ciphertext[1:1+nonceSize], ciphertext[1+nonceSize:], additionalData(objectID, storedPropertyID))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w %s: %v", ErrDecryption, storedPropertyID, err)
+	}
+
+	if len(plaintext) < 1 {
+		return "", nil, fmt.Errorf("%w %s: truncated", ErrDecryption, storedPropertyID)
+	}
+	flags := plaintext[0]
+	length, n := binary.Uvarint(plaintext[1:])
+	if n <= 0 || uint64(len(plaintext)-1-n) < length {
+		return "", nil, fmt.Errorf("%w %s: truncated", ErrDecryption, storedPropertyID)
+	}
+	propertyID := string(plaintext[1+n : 1+n+int(length)])
+
+	// AAD already covers the stored ID, but make sure the embedded one matches it too.
+	if e.storedPropertyID(keys, propertyID) != storedPropertyID {
+		return "", nil, fmt.Errorf("%w %s: property ID mismatch", ErrDecryption, storedPropertyID)
+	}
+
+	if flags&flagRemoved != 0 {
+		return propertyID, nil, nil
+	}
+	return propertyID, plaintext[1+n+int(length):], nil
+}
+
+// EnableEncryption turns on end to end encryption of property data (and optionally property IDs).
+// The server only ever sees ciphertext. All clients sharing an object need encryption enabled with the
+// same key, changes that can't be decrypted are logged and dropped.
+// Should be called before Connect.
+func (c *Client) EnableEncryption(opts EncryptionOptions) error {
+	e, err := newEncryptor(opts)
+	if err != nil {
+		return err
+	}
+	c.encryptionLock.Lock()
+	c.encryption = e
+	c.encryptionLock.Unlock()
+	return nil
+}
+
+// DisableEncryption turns off encryption.
+func (c *Client) DisableEncryption() {
+	c.encryptionLock.Lock()
+	c.encryption = nil
+	c.encryptionLock.Unlock()
+}
+
+func (c *Client) getEncryption() *encryptor {
+	c.encryptionLock.Lock()
+	defer c.encryptionLock.Unlock()
+	return c.encryption
+}
+
+// encryptChange encrypts the change in place. The empty registration property is left alone.
+func (c *Client) encryptChange(change *proto.ObjectChange) error {
+	e := c.getEncryption()
+	if e == nil || change.PropertyId == "" {
+		return nil
+	}
+
+	propertyID, data, err := e.encrypt(change.ObjectId, change.PropertyId, change.Data)
+	if err != nil {
+		return err
+	}
+	change.PropertyId = propertyID
+	change.Data = data
+	return nil
+}
+
+// decryptConfirmation decrypts the confirmation in place.
+func (c *Client) decryptConfirmation(confirmation *proto.ObjectConfirmation) error {
+	e := c.getEncryption()
+	if e == nil || confirmation.PropertyId == "" {
+		return nil
+	}
+
+	propertyID, data, err := e.decrypt(confirmation.ObjectId, confirmation.PropertyId, confirmation.Data)
+	if err != nil {
+		return err
+	}
+	confirmation.PropertyId = propertyID
+	confirmation.Data = data
+	return nil
+}
+
+// decryptProperty decrypts a single stored property (from GetObject). The empty property is what
+// registering with the object stores, it was never encrypted.
+func (c *Client) decryptProperty(objectID string, storedPropertyID string, data []byte) (string, []byte, error) {
+	e := c.getEncryption()
+	if e == nil || storedPropertyID == "" {
+		return storedPropertyID, data, nil
+	}
+	return e.decrypt(objectID, storedPropertyID, data)
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kpfaulkner/collablite/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func staticKey(key string) KeyProvider {
+	return KeyProviderFunc(func(objectID string) ([]byte, error) {
+		return []byte(key), nil
+	})
+}
+
+// confirmationFor turns a sent change into what the server would send back.
+func confirmationFor(change *proto.ObjectChange) *proto.ObjectConfirmation {
+	return &proto.ObjectConfirmation{
+		ObjectId:   change.ObjectId,
+		PropertyId: change.PropertyId,
+		Data:       change.Data,
+		UniqueId:   change.UniqueId,
+	}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	for _, hash := range []bool{false, true} {
+		c, stream := newTestClient()
+		assert.Nil(t, c.EnableEncryption(EncryptionOptions{KeyProvider: staticKey("0123456789abcdef"), HashPropertyIDs: hash}))
+
+		assert.Nil(t, c.SendChanges([]OutgoingChange{
+			{ObjectID: "object1", PropertyID: "colour", Data: []byte("red")},
+			{ObjectID: "object1", PropertyID: "size", Data: nil},
+			{ObjectID: "object1", PropertyID: "", Data: nil},
+		}))
+
+		sent := stream.getSent()
+		assert.False(t, bytes.Contains(sent[0].Data, []byte("red")), "Server should not see plaintext")
+		assert.NotEmpty(t, sent[1].Data, "Removals should be encrypted too")
+		assert.EqualValues(t, "", sent[2].PropertyId, "Registration should be left alone")
+		if hash {
+			assert.NotEqual(t, "colour", sent[0].PropertyId, "Property ID should be hashed")
+		} else {
+			assert.EqualValues(t, "colour", sent[0].PropertyId)
+		}
+
+		conf := confirmationFor(sent[0])
+		assert.Nil(t, c.decryptConfirmation(conf))
+		assert.EqualValues(t, "colour", conf.PropertyId)
+		assert.EqualValues(t, "red", string(conf.Data))
+
+		conf = confirmationFor(sent[1])
+		assert.Nil(t, c.decryptConfirmation(conf))
+		assert.EqualValues(t, "size", conf.PropertyId)
+		assert.Nil(t, conf.Data, "Removal should decrypt to no data")
+
+		propertyID, data, err := c.decryptProperty("object1", sent[0].PropertyId, sent[0].Data)
+		assert.Nil(t, err)
+		assert.EqualValues(t, "colour", propertyID)
+		assert.EqualValues(t, "red", string(data))
+	}
+}
+
+// storedObjectClient returns everything sent on the stream as the stored object, like the server.
+type storedObjectClient struct {
+	proto.CollabLiteClient
+	stream *fakeStream
+}
+
+func (s *storedObjectClient) GetObject(ctx context.Context, req *proto.GetRequest, opts ...grpc.CallOption) (*proto.GetResponse, error) {
+	resp := &proto.GetResponse{ObjectId: req.ObjectId, Properties: make(map[string][]byte)}
+	for _, change := range s.stream.getSent() {
+		resp.Properties[change.PropertyId] = change.Data
+	}
+	return resp, nil
+}
+
+func TestEncryptedGetObjectAfterRegistration(t *testing.T) {
+	c, stream := newTestClient()
+	c.client = &storedObjectClient{stream: stream}
+	assert.Nil(t, c.EnableEncryption(EncryptionOptions{KeyProvider: staticKey("0123456789abcdef"), HashPropertyIDs: true}))
+
+	assert.Nil(t, c.RegisterToObject(context.Background(), "object1"))
+	assert.Nil(t, c.SendChanges([]OutgoingChange{{ObjectID: "object1", PropertyID: "colour", Data: []byte("red")}}))
+
+	changes, err := c.GetObject("object1")
+	assert.Nil(t, err, "Registration property shouldn't need decrypting")
+	properties := make(map[string]string)
+	for _, change := range changes {
+		properties[change.PropertyID] = string(change.Data)
+	}
+	assert.EqualValues(t, "red", properties["colour"])
+}
+
+func TestEncryptionRejectsTampering(t *testing.T) {
+	c, stream := newTestClient()
+	assert.Nil(t, c.EnableEncryption(EncryptionOptions{KeyProvider: staticKey("0123456789abcdef")}))
+	assert.Nil(t, c.SendChanges([]OutgoingChange{
+		{ObjectID: "object1", PropertyID: "colour", Data: []byte("red")},
+		{ObjectID: "object1", PropertyID: "size", Data: []byte("10")},
+	}))
+	sent := stream.getSent()
+
+	// data moved to another property
+	conf := confirmationFor(sent[0])
+	conf.PropertyId = "size"
+	assert.True(t, errors.Is(c.decryptConfirmation(conf), ErrDecryption), "Should not allow data to be moved")
+
+	// data moved to another object
+	conf = confirmationFor(sent[0])
+	conf.ObjectId = "object2"
+	assert.True(t, errors.Is(c.decryptConfirmation(conf), ErrDecryption), "Should not allow data to be moved between objects")
+
+	// flipped bit
+	conf = confirmationFor(sent[0])
+	conf.Data[len(conf.Data)-1] ^= 1
+	assert.True(t, errors.Is(c.decryptConfirmation(conf), ErrDecryption), "Should detect modified data")
+
+	// unencrypted data
+	conf = &proto.ObjectConfirmation{ObjectId: "object1", PropertyId: "colour", Data: []byte("red")}
+	assert.True(t, errors.Is(c.decryptConfirmation(conf), ErrDecryption), "Should reject plaintext")
+
+	// different key
+	other, _ := newTestClient()
+	assert.Nil(t, other.EnableEncryption(EncryptionOptions{KeyProvider: staticKey("fedcba9876543210")}))
+	assert.True(t, errors.Is(other.decryptConfirmation(confirmationFor(sent[1])), ErrDecryption), "Should not decrypt with other key")
+}
+
+func TestEncryptionInvalidKey(t *testing.T) {
+	assert.NotNil(t, (&Client{}).EnableEncryption(EncryptionOptions{}), "Should require key provider")
+
+	c, _ := newTestClient()
+	assert.Nil(t, c.EnableEncryption(EncryptionOptions{KeyProvider: staticKey("short")}))
+	assert.NotNil(t, c.SendChanges([]OutgoingChange{{ObjectID: "object1", PropertyID: "colour", Data: []byte("red")}}), "Should fail with bad key")
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"bytes"
 	"sync"
+	"time"
 )
 
 // OutgoingChange is the change the client is sending to the server.
@@ -23,6 +24,10 @@ type ChangeConfirmation struct {
 	ObjectID   string
 	PropertyID string
 	Data       []byte
+
+	// when the server processed the change and who made it. Zero/empty if the server doesn't supply them.
+	LastModified time.Time
+	Author       string
 }
 
 // ClientObject is a simple object used to represent an object in the system.
@@ -51,6 +56,10 @@ type Property struct {
 
 	// indicates that its been updated from the server... and needs to be used by the client.
 	Updated bool
+
+	// LastModified and Author of the last change confirmed by the server. Local changes don't update these.
+	LastModified time.Time
+	Author       string
 }
 
 func NewObject(objectID string, objectType string) *ClientObject {
@@ -80,6 +89,17 @@ func (o *ClientObject) AdjustProperty(propertyID string, data []byte, dirty bool
 	}
 }
 
+// SetPropertyMetadata records who/when last modified the property (as reported by the server).
+func (o *ClientObject) SetPropertyMetadata(propertyID string, lastModified time.Time, author string) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	if p, ok := o.Properties[propertyID]; ok {
+		p.LastModified = lastModified
+		p.Author = author
+		o.Properties[propertyID] = p
+	}
+}
+
 // ClearPropertyDirtyFlag is used to adjust dirty flag
 // This smells of a design issue
 func (o *ClientObject) ClearPropertyDirtyFlag(propertyID string) {
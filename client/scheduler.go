@@ -0,0 +1,275 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SchedulerOptions configures the optional send scheduler.
+// High frequency edits (eg. dragging something around the screen) will call SendObject many times a second.
+// Instead of sending every single change to the server, the scheduler holds changes for a short period and
+// if the same property is written again only the latest value is sent.
+type SchedulerOptions struct {
+
+	// Window is how long changes are held before being flushed to the server. Repeated writes to the
+	// same property within the window replace each other.
+	Window time.Duration
+
+	// MaxFlushesPerSecond caps how often pending changes are flushed. 0 means no cap other than Window.
+	MaxFlushesPerSecond int
+}
+
+// sendScheduler collects outgoing changes and periodically flushes them to the server.
+type sendScheduler struct {
+	lock sync.Mutex
+
+	// held for a whole flush, so two flushes can't send different values of a property out of order.
+	flushLock sync.Mutex
+
+	// pending changes keyed by object/property
+	pending map[string]*OutgoingChange
+
+	// order the object/properties were first written, so changes are flushed in a predictable order.
+	order []string
+
+	// number of changes that were replaced by a later change before being sent. Purely for stats.
+	numCoalesced int
+
+	// error from the last background flush, returned by the next SendObject/SendChanges.
+	err error
+
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newSendScheduler(opts SchedulerOptions) (*sendScheduler, error) {
+	if opts.Window < 0 || opts.MaxFlushesPerSecond < 0 {
+		return nil, errors.New("scheduler window and max flushes must not be negative")
+	}
+
+	interval := opts.Window
+	if opts.MaxFlushesPerSecond > 0 {
+		minInterval := time.Second / time.Duration(opts.MaxFlushesPerSecond)
+		if interval < minInterval {
+			interval = minInterval
+		}
+	}
+
+	if interval == 0 {
+		return nil, errors.New("scheduler requires a window or max flushes per second")
+	}
+
+	s := sendScheduler{
+		pending:  make(map[string]*OutgoingChange),
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	return &s, nil
+}
+
+// enqueue stores the change to be sent on the next flush. If this is the first pending change for
+// the object/property then onFirst is called before the change can be picked up by a flush.
+func (s *sendScheduler) enqueue(outgoingChange *OutgoingChange, onFirst func()) {
+	objectProperty := objectPropertyKey(outgoingChange.ObjectID, outgoingChange.PropertyID)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.pending[objectProperty]; ok {
+		s.pending[objectProperty] = outgoingChange
+		s.numCoalesced++
+		return
+	}
+
+	onFirst()
+	s.pending[objectProperty] = outgoingChange
+	s.order = append(s.order, objectProperty)
+}
+
+// take removes and returns all pending changes, in the order they were first written.
+func (s *sendScheduler) take() []*OutgoingChange {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	changes := make([]*OutgoingChange, 0, len(s.order))
+	for _, objectProperty := range s.order {
+		changes = append(changes, s.pending[objectProperty])
+	}
+	s.pending = make(map[string]*OutgoingChange)
+	s.order = nil
+	return changes
+}
+
+// requeue puts changes that couldn't be sent back in front of anything queued since. Returns the
+// ones that have already been replaced by a later change, which were counted as unconfirmed twice.
+func (s *sendScheduler) requeue(changes []*OutgoingChange) []*OutgoingChange {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var replaced []*OutgoingChange
+	order := make([]string, 0, len(changes)+len(s.order))
+	for _, outgoingChange := range changes {
+		objectProperty := objectPropertyKey(outgoingChange.ObjectID, outgoingChange.PropertyID)
+		if _, ok := s.pending[objectProperty]; ok {
+			replaced = append(replaced, outgoingChange)
+			s.numCoalesced++
+			continue
+		}
+		s.pending[objectProperty] = outgoingChange
+		order = append(order, objectProperty)
+	}
+	s.order = append(order, s.order...)
+	return replaced
+}
+
+// setErr records the error from a background flush.
+func (s *sendScheduler) setErr(err error) {
+	s.lock.Lock()
+	s.err = err
+	s.lock.Unlock()
+}
+
+// takeErr returns and clears the error from the last background flush.
+func (s *sendScheduler) takeErr() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// run flushes pending changes every interval until stopped.
+func (s *sendScheduler) run(c *Client) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// unsent changes are kept for the next flush.
+			if err := c.flushScheduler(s); err != nil {
+				log.Errorf("failed to flush pending changes: %v", err)
+				s.setErr(err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// EnableSendScheduler turns on coalescing of outgoing changes. Once enabled SendObject no longer sends
+// changes immediately, they are sent by a background goroutine at most once per window/rate.
+func (c *Client) EnableSendScheduler(opts SchedulerOptions) error {
+	s, err := newSendScheduler(opts)
+	if err != nil {
+		return err
+	}
+
+	if err := c.DisableSendScheduler(); err != nil {
+		return err
+	}
+
+	c.schedulerLock.Lock()
+	c.scheduler = s
+	c.schedulerLock.Unlock()
+
+	go s.run(c)
+	return nil
+}
+
+// DisableSendScheduler stops the send scheduler (if running) and sends any pending changes.
+// After this SendObject will send changes immediately again.
+func (c *Client) DisableSendScheduler() error {
+
+	// detach first so no new changes are queued against the scheduler being stopped.
+	c.schedulerLock.Lock()
+	s := c.scheduler
+	c.scheduler = nil
+	c.schedulerLock.Unlock()
+
+	if s == nil {
+		return nil
+	}
+
+	close(s.stop)
+	<-s.done
+	if err := c.flushScheduler(s); err != nil {
+		// nothing will send what's left, so it's not waiting on confirmation either.
+		for _, outgoingChange := range s.take() {
+			c.untrackLocalChange(outgoingChange.ObjectID, outgoingChange.PropertyID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Flush sends all changes held by the send scheduler to the server.
+// Does nothing if the scheduler is not enabled.
+func (c *Client) Flush() error {
+	return c.flushScheduler(c.getScheduler())
+}
+
+func (c *Client) flushScheduler(s *sendScheduler) error {
+	if s == nil {
+		return nil
+	}
+
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	changes := s.take()
+	for i, outgoingChange := range changes {
+		// already tracked as unconfirmed when first queued.
+		if err := c.sendToStream(outgoingChange); err != nil {
+			for _, replaced := range s.requeue(changes[i:]) {
+				c.untrackLocalChange(replaced.ObjectID, replaced.PropertyID)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCoalescedCount returns the number of changes that were replaced by a later change to the same
+// property before being sent.
+func (c *Client) GetCoalescedCount() int {
+	s := c.getScheduler()
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.numCoalesced
+}
+
+// queueChange queues the change with the scheduler if enabled. Returns false if there is no
+// scheduler and the caller should send the change immediately. If the last background flush
+// failed its error is returned instead, and the change isn't queued.
+func (c *Client) queueChange(outgoingChange *OutgoingChange) (bool, error) {
+	c.schedulerLock.Lock()
+	defer c.schedulerLock.Unlock()
+	if c.scheduler == nil {
+		return false, nil
+	}
+	if err := c.scheduler.takeErr(); err != nil {
+		return false, err
+	}
+
+	// only the first queued write for a property counts as an unconfirmed change, since only
+	// one message will be sent for it regardless of how many writes are coalesced.
+	c.scheduler.enqueue(outgoingChange, func() {
+		c.trackLocalChange(outgoingChange.ObjectID, outgoingChange.PropertyID)
+	})
+	return true, nil
+}
+
+func (c *Client) getScheduler() *sendScheduler {
+	c.schedulerLock.Lock()
+	defer c.schedulerLock.Unlock()
+	return c.scheduler
+}
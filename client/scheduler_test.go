@@ -0,0 +1,238 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// fakeStream records everything sent by the client.
+type fakeStream struct {
+	grpc.ClientStream
+
+	lock sync.Mutex
+	sent []*proto.ObjectChange
+
+	// sends fail once this many have been sent, -1 for never.
+	failAfter int
+
+	// how long each send takes.
+	delay time.Duration
+}
+
+func (f *fakeStream) Send(change *proto.ObjectChange) error {
+	time.Sleep(f.delay)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failAfter >= 0 && len(f.sent) >= f.failAfter {
+		return errors.New("stream broken")
+	}
+	f.sent = append(f.sent, change)
+	return nil
+}
+
+func (f *fakeStream) setFailAfter(n int) {
+	f.lock.Lock()
+	f.failAfter = n
+	f.lock.Unlock()
+}
+
+func (f *fakeStream) Recv() (*proto.ObjectConfirmation, error) {
+	select {}
+}
+
+func (f *fakeStream) getSent() []*proto.ObjectChange {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*proto.ObjectChange{}, f.sent...)
+}
+
+// newTestClient creates a client with a fake stream. The "user object" is just a map of properties.
+func newTestClient() (*Client, *fakeStream) {
+	stream := &fakeStream{failAfter: -1}
+	c := &Client{
+		stream:                  stream,
+		unconfirmedLocalChanges: make(map[string]int),
+		clientID:                "client1",
+	}
+	c.convertToObject = func(objectID string, existingObject *ClientObject, clientObject any) (*ClientObject, error) {
+		obj := existingObject
+		if obj == nil {
+			obj = NewObject(objectID, "TEST")
+		}
+		for k, v := range clientObject.(map[string]string) {
+			obj.AdjustProperty(k, []byte(v), true, false)
+		}
+		return obj, nil
+	}
+	return c, stream
+}
+
+func TestSendObjectWithoutScheduler(t *testing.T) {
+	c, stream := newTestClient()
+
+	assert.Nil(t, c.SendObject("object1", map[string]string{"x": "1"}))
+	assert.Nil(t, c.SendObject("object1", map[string]string{"x": "2"}))
+
+	assert.EqualValues(t, 2, len(stream.getSent()), "Should send every change")
+	assert.EqualValues(t, 2, c.GetChangeCount(), "Should have 2 unconfirmed changes")
+}
+
+func TestSendChangesUsesScheduler(t *testing.T) {
+	c, stream := newTestClient()
+	assert.Nil(t, c.EnableSendScheduler(SchedulerOptions{Window: time.Hour}))
+	defer c.DisableSendScheduler()
+
+	assert.Nil(t, c.SendChanges([]OutgoingChange{
+		{ObjectID: "object1", PropertyID: "x", Data: []byte("1")},
+		{ObjectID: "object1", PropertyID: "x", Data: []byte("2")},
+	}))
+	assert.Empty(t, stream.getSent(), "Should not send until flushed")
+
+	c.Flush()
+	sent := stream.getSent()
+	assert.EqualValues(t, 1, len(sent), "Should coalesce changes")
+	assert.EqualValues(t, "2", string(sent[0].Data))
+}
+
+func TestSendSchedulerCoalesces(t *testing.T) {
+	c, stream := newTestClient()
+
+	// long window so the test controls when the flush happens.
+	err := c.EnableSendScheduler(SchedulerOptions{Window: time.Hour})
+	assert.Nil(t, err, "Should not have error enabling scheduler")
+
+	for _, v := range []string{"1", "2", "3"} {
+		assert.Nil(t, c.SendObject("object1", map[string]string{"x": v, "y": "a"}))
+	}
+
+	assert.EqualValues(t, 0, len(stream.getSent()), "Nothing should be sent before flush")
+	assert.EqualValues(t, 2, c.GetChangeCount(), "Should track one unconfirmed change per property")
+	assert.EqualValues(t, 2, c.GetCoalescedCount(), "Should have coalesced 2 writes of x")
+
+	assert.Nil(t, c.Flush())
+	sent := stream.getSent()
+	assert.EqualValues(t, 2, len(sent), "Should send one change per property")
+	sentData := make(map[string]string)
+	for _, change := range sent {
+		sentData[change.PropertyId] = string(change.Data)
+	}
+	assert.EqualValues(t, "3", sentData["x"], "Should send latest value")
+	assert.EqualValues(t, "a", sentData["y"])
+
+	// change after the flush is a new unconfirmed change.
+	assert.Nil(t, c.SendObject("object1", map[string]string{"x": "4", "y": "a"}))
+	assert.EqualValues(t, 3, c.GetChangeCount(), "Should track the new change")
+
+	assert.Nil(t, c.DisableSendScheduler())
+	assert.EqualValues(t, 3, len(stream.getSent()), "Disabling should flush pending changes")
+}
+
+func TestSendSchedulerFlushesOnInterval(t *testing.T) {
+	c, stream := newTestClient()
+
+	err := c.EnableSendScheduler(SchedulerOptions{Window: time.Millisecond, MaxFlushesPerSecond: 100})
+	assert.Nil(t, err, "Should not have error enabling scheduler")
+	defer c.DisableSendScheduler()
+
+	assert.Nil(t, c.SendObject("object1", map[string]string{"x": "1"}))
+
+	assert.Eventually(t, func() bool { return len(stream.getSent()) == 1 }, time.Second, 5*time.Millisecond,
+		"Scheduler should flush without explicit call")
+}
+
+func TestSendSchedulerKeepsUnsentChanges(t *testing.T) {
+	c, stream := newTestClient()
+	assert.Nil(t, c.EnableSendScheduler(SchedulerOptions{Window: time.Hour}))
+
+	stream.setFailAfter(1)
+	assert.Nil(t, c.SendChanges([]OutgoingChange{
+		{ObjectID: "object1", PropertyID: "x", Data: []byte("1")},
+		{ObjectID: "object1", PropertyID: "y", Data: []byte("1")},
+		{ObjectID: "object1", PropertyID: "z", Data: []byte("1")},
+	}))
+	assert.NotNil(t, c.Flush(), "Should return the send error")
+	assert.EqualValues(t, 1, len(stream.getSent()))
+	assert.EqualValues(t, 3, c.GetChangeCount(), "Unsent changes should still be waiting")
+
+	// a newer write to y replaces the unsent one, and is only counted once.
+	assert.Nil(t, c.SendChanges([]OutgoingChange{{ObjectID: "object1", PropertyID: "y", Data: []byte("2")}}))
+	assert.EqualValues(t, 3, c.GetChangeCount())
+
+	stream.setFailAfter(-1)
+	assert.Nil(t, c.Flush())
+	sent := stream.getSent()
+	assert.EqualValues(t, 3, len(sent), "Unsent changes should go on the next flush")
+	assert.EqualValues(t, "y", sent[1].PropertyId)
+	assert.EqualValues(t, "2", string(sent[1].Data))
+
+	// disabling with a broken stream drops what's left, so nothing waits on it being confirmed.
+	assert.Nil(t, c.SendChanges([]OutgoingChange{{ObjectID: "object1", PropertyID: "w", Data: []byte("1")}}))
+	stream.setFailAfter(3)
+	assert.NotNil(t, c.DisableSendScheduler())
+	assert.EqualValues(t, 3, c.GetChangeCount())
+}
+
+func TestSendSchedulerReportsBackgroundErrors(t *testing.T) {
+	c, stream := newTestClient()
+	stream.setFailAfter(0)
+	assert.Nil(t, c.EnableSendScheduler(SchedulerOptions{Window: time.Millisecond}))
+	defer c.DisableSendScheduler()
+
+	assert.Nil(t, c.SendObject("object1", map[string]string{"x": "1"}))
+	assert.Eventually(t, func() bool {
+		return c.SendObject("object1", map[string]string{"x": "2"}) != nil
+	}, time.Second, 5*time.Millisecond, "Failed flush should be reported")
+}
+
+func TestSendSchedulerConcurrentFlushesKeepOrder(t *testing.T) {
+	c, stream := newTestClient()
+	stream.delay = time.Millisecond
+	assert.Nil(t, c.EnableSendScheduler(SchedulerOptions{Window: time.Hour}))
+
+	// flushing from several places at once while the property keeps changing.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					c.Flush()
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 200; i++ {
+		assert.Nil(t, c.SendChanges([]OutgoingChange{{ObjectID: "object1", PropertyID: "x", Data: []byte(strconv.Itoa(i))}}))
+		time.Sleep(100 * time.Microsecond)
+	}
+	close(stop)
+	wg.Wait()
+	assert.Nil(t, c.Flush())
+
+	last := 0
+	for _, change := range stream.getSent() {
+		v, _ := strconv.Atoi(string(change.Data))
+		assert.Greater(t, v, last, "Older value sent after a newer one")
+		last = v
+	}
+	assert.EqualValues(t, 200, last, "Latest value should be sent last")
+}
+
+func TestSendSchedulerInvalidOptions(t *testing.T) {
+	c, _ := newTestClient()
+
+	assert.NotNil(t, c.EnableSendScheduler(SchedulerOptions{}), "Should require window or rate")
+	assert.NotNil(t, c.EnableSendScheduler(SchedulerOptions{Window: -time.Second}), "Should reject negative window")
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/signing"
+	"github.com/kpfaulkner/collablite/proto"
+)
+
+// SigningOptions configures signing of outgoing changes and verification of incoming ones.
+type SigningOptions struct {
+	// ClientID replaces the randomly generated client ID. The server (and other clients) look up
+	// the public key by this ID, so it needs to be stable.
+	ClientID string
+
+	// PrivateKey used to sign outgoing changes. If nil, changes are not signed.
+	PrivateKey ed25519.PrivateKey
+
+	// Keys used to verify incoming changes. If nil, incoming changes are not verified.
+	Keys *signing.KeyRegistry
+}
+
+// signer holds the signing state for the client.
+type signer struct {
+	opts SigningOptions
+
+	// last sequence used. Only accessed with the client sendLock held.
+	sequence uint64
+}
+
+// EnableSigning turns on signing of outgoing changes and/or verification of incoming changes.
+// Should be called before Connect.
+func (c *Client) EnableSigning(opts SigningOptions) error {
+	if opts.PrivateKey != nil {
+		if len(opts.PrivateKey) != ed25519.PrivateKeySize {
+			return errors.New("invalid ed25519 private key")
+		}
+		if opts.ClientID == "" {
+			return errors.New("signing requires a ClientID")
+		}
+	}
+
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	if opts.ClientID != "" {
+		c.clientIDLock.Lock()
+		c.clientID = opts.ClientID
+		c.clientIDLock.Unlock()
+	}
+
+	// sequence has to keep increasing even if the client restarts, so start from the current time.
+	c.signer = &signer{opts: opts, sequence: uint64(time.Now().UnixNano())}
+	return nil
+}
+
+// signChange signs the change (if enabled). sendLock must be held so sequences are sent in order.
+func (c *Client) signChange(change *proto.ObjectChange) {
+	if c.signer == nil || c.signer.opts.PrivateKey == nil {
+		return
+	}
+	c.signer.sequence++
+	signing.Sign(c.signer.opts.PrivateKey, change, c.signer.sequence)
+}
+
+// verifyConfirmation checks the signature of an incoming change (if enabled).
+func (c *Client) verifyConfirmation(confirmation *proto.ObjectConfirmation) error {
+	c.sendLock.Lock()
+	s := c.signer
+	c.sendLock.Unlock()
+
+	if s == nil || s.opts.Keys == nil {
+		return nil
+	}
+	return s.opts.Keys.VerifyConfirmation(confirmation)
+}
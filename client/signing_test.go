@@ -0,0 +1,75 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/kpfaulkner/collablite/pkg/signing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedChangesVerify(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	keys := signing.NewKeyRegistry(true)
+	assert.Nil(t, keys.Register("alice", pub))
+
+	c, stream := newTestClient()
+	assert.Nil(t, c.EnableSigning(SigningOptions{ClientID: "alice", PrivateKey: priv}))
+	assert.Nil(t, c.EnableEncryption(EncryptionOptions{KeyProvider: staticKey("0123456789abcdef")}))
+	assert.Nil(t, c.SendChanges([]OutgoingChange{
+		{ObjectID: "object1", PropertyID: "colour", Data: []byte("red")},
+		{ObjectID: "object1", PropertyID: "size", Data: []byte("10")},
+	}))
+
+	sent := stream.getSent()
+	assert.EqualValues(t, "alice", sent[0].UniqueId, "Should use configured client ID")
+	assert.True(t, sent[1].Sequence > sent[0].Sequence, "Sequence should increase")
+
+	// server can verify the encrypted change without the encryption key.
+	assert.Nil(t, keys.VerifyChange(sent[0]))
+	assert.Nil(t, keys.VerifyChange(sent[1]))
+
+	// receiving client
+	receiver, _ := newTestClient()
+	assert.Nil(t, receiver.EnableSigning(SigningOptions{Keys: keys}))
+	conf := confirmationFor(sent[0])
+	conf.Sequence = sent[0].Sequence
+	conf.Signature = sent[0].Signature
+	assert.Nil(t, receiver.verifyConfirmation(conf))
+
+	conf.Data = append([]byte{}, sent[1].Data...)
+	assert.NotNil(t, receiver.verifyConfirmation(conf), "Should reject swapped data")
+}
+
+func TestEnableSigningInvalid(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	c, _ := newTestClient()
+	assert.NotNil(t, c.EnableSigning(SigningOptions{PrivateKey: priv}), "Should require client ID")
+	assert.NotNil(t, c.EnableSigning(SigningOptions{ClientID: "alice", PrivateKey: priv[:10]}), "Should reject bad key")
+}
+
+func TestEnableSigningWhileSending(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	keys := signing.NewKeyRegistry(false)
+	assert.Nil(t, keys.Register("alice", pub))
+
+	c, stream := newTestClient()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.SendChanges([]OutgoingChange{{ObjectID: "object1", PropertyID: "colour", Data: []byte("red")}})
+		}
+	}()
+	assert.Nil(t, c.EnableSigning(SigningOptions{ClientID: "alice", PrivateKey: priv}))
+	<-done
+
+	// every change is either from the old ID unsigned, or from the new one signed by it.
+	for _, change := range stream.getSent() {
+		if change.UniqueId == "alice" {
+			assert.Nil(t, keys.Verify(change.UniqueId, change.ObjectId, change.PropertyId, change.Data, change.Sequence, change.Signature))
+		} else {
+			assert.Empty(t, change.Signature)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrPropertyNotFound is returned by Get when the object doesn't have the property (or it has been removed)
+var ErrPropertyNotFound = errors.New("property not found")
+
+// Codec converts between a Go type and the raw bytes stored in a Property.
+// Users can provide their own for custom formats.
+type Codec[T any] interface {
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// CodecFuncs allows a Codec to be built from a pair of functions.
+type CodecFuncs[T any] struct {
+	EncodeFunc func(value T) ([]byte, error)
+	DecodeFunc func(data []byte) (T, error)
+}
+
+func (c CodecFuncs[T]) Encode(value T) ([]byte, error) { return c.EncodeFunc(value) }
+func (c CodecFuncs[T]) Decode(data []byte) (T, error)  { return c.DecodeFunc(data) }
+
+// emptyTag starts the encoding of an empty string (and escapes strings that start with it), since
+// a property with no data means it has been removed.
+const emptyTag = 0
+
+// StringCodec stores strings as is. The empty string is stored as a single zero byte and strings
+// starting with a zero byte get an extra one in front.
+type StringCodec struct{}
+
+func (StringCodec) Encode(value string) ([]byte, error) {
+	if len(value) == 0 || value[0] == emptyTag {
+		return append([]byte{emptyTag}, value...), nil
+	}
+	return []byte(value), nil
+}
+
+func (StringCodec) Decode(data []byte) (string, error) {
+	if len(data) > 0 && data[0] == emptyTag {
+		return string(data[1:]), nil
+	}
+	return string(data), nil
+}
+
+// Integer is any of the integer types.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// IntCodec stores integers as base 10 text.
+type IntCodec[T Integer] struct{}
+
+// isSigned is true for signed integer types, where 0-1 doesn't wrap.
+func isSigned[T Integer]() bool {
+	var zero T
+	return zero-1 < zero
+}
+
+func (IntCodec[T]) Encode(value T) ([]byte, error) {
+	if isSigned[T]() {
+		return []byte(strconv.FormatInt(int64(value), 10)), nil
+	}
+	return []byte(strconv.FormatUint(uint64(value), 10)), nil
+}
+
+func (IntCodec[T]) Decode(data []byte) (T, error) {
+	var zero T
+	if isSigned[T]() {
+		i, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil || int64(T(i)) != i {
+			return zero, fmt.Errorf("invalid integer %q for %T", data, zero)
+		}
+		return T(i), nil
+	}
+	i, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil || uint64(T(i)) != i {
+		return zero, fmt.Errorf("invalid integer %q for %T", data, zero)
+	}
+	return T(i), nil
+}
+
+// Float is either of the float types.
+type Float interface {
+	~float32 | ~float64
+}
+
+// FloatCodec stores floats as the shortest text that round trips.
+type FloatCodec[T Float] struct{}
+
+func (FloatCodec[T]) Encode(value T) ([]byte, error) {
+	var zero T
+	bits := 64
+	if _, ok := any(zero).(float32); ok {
+		bits = 32
+	}
+	return []byte(strconv.FormatFloat(float64(value), 'g', -1, bits)), nil
+}
+
+func (FloatCodec[T]) Decode(data []byte) (T, error) {
+	f, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid float %q: %w", data, err)
+	}
+	return T(f), nil
+}
+
+// BoolCodec stores bools as "true" or "false".
+type BoolCodec struct{}
+
+func (BoolCodec) Encode(value bool) ([]byte, error) { return []byte(strconv.FormatBool(value)), nil }
+func (BoolCodec) Decode(data []byte) (bool, error) {
+	b, err := strconv.ParseBool(string(data))
+	if err != nil {
+		return false, fmt.Errorf("invalid bool %q", data)
+	}
+	return b, nil
+}
+
+// TimeCodec stores times as RFC3339 with nanoseconds.
+type TimeCodec struct{}
+
+func (TimeCodec) Encode(value time.Time) ([]byte, error) {
+	return []byte(value.Format(time.RFC3339Nano)), nil
+}
+
+func (TimeCodec) Decode(data []byte) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, string(data))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %w", data, err)
+	}
+	return t, nil
+}
+
+// JSONCodec stores any value as JSON.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(value T) ([]byte, error) { return json.Marshal(value) }
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// DefaultCodec returns the codec used for T by Set/Get. Basic types get their own codec
+// everything else is JSON.
+func DefaultCodec[T any]() Codec[T] {
+	var zero T
+	var codec any
+	switch any(zero).(type) {
+	case string:
+		codec = StringCodec{}
+	case bool:
+		codec = BoolCodec{}
+	case int:
+		codec = IntCodec[int]{}
+	case int8:
+		codec = IntCodec[int8]{}
+	case int16:
+		codec = IntCodec[int16]{}
+	case int32:
+		codec = IntCodec[int32]{}
+	case int64:
+		codec = IntCodec[int64]{}
+	case uint:
+		codec = IntCodec[uint]{}
+	case uint8:
+		codec = IntCodec[uint8]{}
+	case uint16:
+		codec = IntCodec[uint16]{}
+	case uint32:
+		codec = IntCodec[uint32]{}
+	case uint64:
+		codec = IntCodec[uint64]{}
+	case float32:
+		codec = FloatCodec[float32]{}
+	case float64:
+		codec = FloatCodec[float64]{}
+	case time.Time:
+		codec = TimeCodec{}
+	default:
+		return JSONCodec[T]{}
+	}
+	return codec.(Codec[T])
+}
+
+// Set encodes value with the default codec for T and sets the property (marked dirty).
+func Set[T any](obj *ClientObject, propertyID string, value T) error {
+	return SetWith(obj, propertyID, value, DefaultCodec[T]())
+}
+
+// SetWith encodes value with codec and sets the property (marked dirty).
+func SetWith[T any](obj *ClientObject, propertyID string, value T, codec Codec[T]) error {
+	data, err := codec.Encode(value)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s: %w", propertyID, err)
+	}
+	if len(data) == 0 {
+		// no data would be treated as the property being removed.
+		return fmt.Errorf("unable to encode %s: codec returned no data", propertyID)
+	}
+	obj.AdjustProperty(propertyID, data, true, false)
+	return nil
+}
+
+// Get decodes the property with the default codec for T.
+// Returns ErrPropertyNotFound if the property doesn't exist.
+func Get[T any](obj *ClientObject, propertyID string) (T, error) {
+	return GetWith(obj, propertyID, DefaultCodec[T]())
+}
+
+// GetWith decodes the property with codec.
+func GetWith[T any](obj *ClientObject, propertyID string, codec Codec[T]) (T, error) {
+	obj.Lock.Lock()
+	p, ok := obj.Properties[propertyID]
+	obj.Lock.Unlock()
+
+	if !ok || len(p.Data) == 0 {
+		var zero T
+		return zero, fmt.Errorf("%s: %w", propertyID, ErrPropertyNotFound)
+	}
+
+	value, err := codec.Decode(p.Data)
+	if err != nil {
+		return value, fmt.Errorf("unable to decode %s: %w", propertyID, err)
+	}
+	return value, nil
+}
+
+// TypedProperty is a handle to a single property of an object with a fixed type and codec.
+type TypedProperty[T any] struct {
+	obj        *ClientObject
+	propertyID string
+	codec      Codec[T]
+}
+
+// NewTypedProperty creates a handle for propertyID. If codec is nil the default codec for T is used.
+func NewTypedProperty[T any](obj *ClientObject, propertyID string, codec Codec[T]) *TypedProperty[T] {
+	if codec == nil {
+		codec = DefaultCodec[T]()
+	}
+	return &TypedProperty[T]{obj: obj, propertyID: propertyID, codec: codec}
+}
+
+func (p *TypedProperty[T]) PropertyID() string {
+	return p.propertyID
+}
+
+func (p *TypedProperty[T]) Set(value T) error {
+	return SetWith(p.obj, p.propertyID, value, p.codec)
+}
+
+func (p *TypedProperty[T]) Get() (T, error) {
+	return GetWith(p.obj, p.propertyID, p.codec)
+}
+
+// Watch calls fn whenever the property is changed by the server.
+func (p *TypedProperty[T]) Watch(c *Client, fn func(value T, removed bool)) func() {
+	return WatchWith(c, p.propertyID, p.codec, fn)
+}
+
+// propertyWatchers holds the callbacks for incoming changes to specific properties.
+type propertyWatchers struct {
+	lock     sync.Mutex
+	nextID   int
+	watchers map[string]map[int]func(data []byte)
+}
+
+// Watch calls fn whenever propertyID is changed by the server, decoded with the default codec for T.
+// removed is true if the property was removed (value will be the zero value).
+// Returns a function to stop watching.
+func Watch[T any](c *Client, propertyID string, fn func(value T, removed bool)) func() {
+	return WatchWith(c, propertyID, DefaultCodec[T](), fn)
+}
+
+// WatchWith is Watch with a specific codec. Changes that can't be decoded are logged and skipped.
+func WatchWith[T any](c *Client, propertyID string, codec Codec[T], fn func(value T, removed bool)) func() {
+	return c.watchers.add(propertyID, func(data []byte) {
+		var value T
+		if len(data) == 0 {
+			fn(value, true)
+			return
+		}
+
+		value, err := codec.Decode(data)
+		if err != nil {
+			log.Errorf("unable to decode %s for watcher: %v", propertyID, err)
+			return
+		}
+		fn(value, false)
+	})
+}
+
+func (w *propertyWatchers) add(propertyID string, fn func(data []byte)) func() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.watchers == nil {
+		w.watchers = make(map[string]map[int]func(data []byte))
+	}
+	if w.watchers[propertyID] == nil {
+		w.watchers[propertyID] = make(map[int]func(data []byte))
+	}
+	id := w.nextID
+	w.nextID++
+	w.watchers[propertyID][id] = fn
+
+	return func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		delete(w.watchers[propertyID], id)
+		if len(w.watchers[propertyID]) == 0 {
+			delete(w.watchers, propertyID)
+		}
+	}
+}
+
+// notify calls the watchers for the property. Watchers are called without the lock held so they're
+// free to add/remove watchers.
+func (w *propertyWatchers) notify(propertyID string, data []byte) {
+	w.lock.Lock()
+	fns := make([]func(data []byte), 0, len(w.watchers[propertyID]))
+	for _, fn := range w.watchers[propertyID] {
+		fns = append(fns, fn)
+	}
+	w.lock.Unlock()
+
+	for _, fn := range fns {
+		fn(data)
+	}
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+type size struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func TestSetGet(t *testing.T) {
+	obj := NewObject("object1", "TEST")
+	now := time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	assert.Nil(t, Set(obj, "width", 10))
+	assert.Nil(t, Set(obj, "neg", int8(-5)))
+	assert.Nil(t, Set(obj, "big", uint64(math.MaxUint64)))
+	assert.Nil(t, Set(obj, "ratio", 1.5))
+	assert.Nil(t, Set(obj, "name", "box"))
+	assert.Nil(t, Set(obj, "visible", true))
+	assert.Nil(t, Set(obj, "created", now))
+	assert.Nil(t, Set(obj, "size", size{Width: 1, Height: 2}))
+
+	props := obj.GetProperties()
+	assert.EqualValues(t, "10", string(props["width"].Data))
+	assert.EqualValues(t, "18446744073709551615", string(props["big"].Data))
+	assert.EqualValues(t, `{"width":1,"height":2}`, string(props["size"].Data), "Structs should be JSON")
+	assert.True(t, props["width"].Dirty, "Set should mark property dirty")
+
+	width, err := Get[int](obj, "width")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 10, width)
+
+	neg, _ := Get[int8](obj, "neg")
+	assert.EqualValues(t, -5, neg)
+	big, _ := Get[uint64](obj, "big")
+	assert.EqualValues(t, uint64(math.MaxUint64), big)
+	ratio, _ := Get[float64](obj, "ratio")
+	assert.EqualValues(t, 1.5, ratio)
+	name, _ := Get[string](obj, "name")
+	assert.EqualValues(t, "box", name)
+	visible, _ := Get[bool](obj, "visible")
+	assert.True(t, visible)
+	created, _ := Get[time.Time](obj, "created")
+	assert.True(t, now.Equal(created))
+	s, _ := Get[size](obj, "size")
+	assert.EqualValues(t, size{Width: 1, Height: 2}, s)
+}
+
+func TestGetErrors(t *testing.T) {
+	obj := NewObject("object1", "TEST")
+	_, err := Get[int](obj, "missing")
+	assert.True(t, errors.Is(err, ErrPropertyNotFound), "Should be not found")
+
+	obj.AdjustProperty("removed", nil, false, true)
+	_, err = Get[int](obj, "removed")
+	assert.True(t, errors.Is(err, ErrPropertyNotFound), "Removed property should be not found")
+
+	assert.Nil(t, Set(obj, "width", 300))
+	_, err = Get[uint8](obj, "width")
+	assert.NotNil(t, err, "Should not overflow")
+}
+
+func TestEmptyString(t *testing.T) {
+	obj := NewObject("object1", "TEST")
+	for _, value := range []string{"", "\x00", "\x00box"} {
+		assert.Nil(t, Set(obj, "name", value))
+		assert.NotEmpty(t, obj.GetProperties()["name"].Data, "Should not look removed")
+
+		name, err := Get[string](obj, "name")
+		assert.Nil(t, err)
+		assert.EqualValues(t, value, name)
+	}
+
+	c, _ := newTestClient()
+	c.object = NewObject("object1", "TEST")
+	removed := true
+	Watch(c, "name", func(value string, r bool) {
+		assert.EqualValues(t, "", value)
+		removed = r
+	})
+	data, _ := StringCodec{}.Encode("")
+	assert.Nil(t, c.convertAndExecuteCallback(&proto.ObjectConfirmation{ObjectId: "object1", PropertyId: "name", Data: data}))
+	assert.False(t, removed, "Empty string should not be reported as removed")
+
+	empty := CodecFuncs[string]{
+		EncodeFunc: func(value string) ([]byte, error) { return nil, nil },
+		DecodeFunc: func(data []byte) (string, error) { return string(data), nil },
+	}
+	assert.NotNil(t, SetWith[string](obj, "name", "box", empty), "Codec returning no data should fail")
+}
+
+func TestCustomCodec(t *testing.T) {
+	upper := CodecFuncs[string]{
+		EncodeFunc: func(value string) ([]byte, error) { return []byte(strings.ToUpper(value)), nil },
+		DecodeFunc: func(data []byte) (string, error) { return strings.ToLower(string(data)), nil },
+	}
+
+	obj := NewObject("object1", "TEST")
+	p := NewTypedProperty[string](obj, "name", upper)
+	assert.Nil(t, p.Set("box"))
+	assert.EqualValues(t, "BOX", string(obj.GetProperties()["name"].Data))
+
+	name, err := p.Get()
+	assert.Nil(t, err)
+	assert.EqualValues(t, "box", name)
+}
+
+func TestWatch(t *testing.T) {
+	c, _ := newTestClient()
+	c.object = NewObject("object1", "TEST")
+
+	var widths []int
+	var removed bool
+	unwatch := Watch(c, "width", func(value int, r bool) {
+		widths = append(widths, value)
+		removed = r
+	})
+
+	for _, data := range [][]byte{[]byte("10"), []byte("not a number"), []byte("20")} {
+		assert.Nil(t, c.convertAndExecuteCallback(&proto.ObjectConfirmation{ObjectId: "object1", PropertyId: "width", Data: data}))
+	}
+	assert.Nil(t, c.convertAndExecuteCallback(&proto.ObjectConfirmation{ObjectId: "object1", PropertyId: "height", Data: []byte("5")}))
+	assert.EqualValues(t, []int{10, 20}, widths, "Should only get decodable changes for the property")
+
+	assert.Nil(t, c.convertAndExecuteCallback(&proto.ObjectConfirmation{ObjectId: "object1", PropertyId: "width"}))
+	assert.True(t, removed, "Should be notified of removal")
+
+	unwatch()
+	assert.Nil(t, c.convertAndExecuteCallback(&proto.ObjectConfirmation{ObjectId: "object1", PropertyId: "width", Data: []byte("30")}))
+	assert.EqualValues(t, 3, len(widths), "Should not be notified after unwatch")
+
+	width, _ := Get[int](c.Object(), "width")
+	assert.EqualValues(t, 30, width, "Object should still be updated")
+}
+
+func TestSendProperties(t *testing.T) {
+	c, stream := newTestClient()
+	assert.NotNil(t, c.SendProperties(), "Should fail when not registered to an object")
+
+	c.object = NewObject("object1", "TEST")
+	assert.Nil(t, Set(c.Object(), "width", 10))
+	assert.Nil(t, c.SendProperties())
+	assert.Nil(t, c.SendProperties())
+
+	sent := stream.getSent()
+	assert.EqualValues(t, 1, len(sent), "Should only send dirty properties")
+	assert.EqualValues(t, "10", string(sent[0].Data))
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"math/rand"
@@ -10,9 +9,10 @@ import (
 	"time"
 
 	"github.com/kpfaulkner/collablite/client"
-	"github.com/kpfaulkner/collablite/client/converters"
+	"github.com/kpfaulkner/collablite/client/converters/json"
 	"github.com/kpfaulkner/collablite/cmd/common"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/sjson"
 )
 
 const (
@@ -25,7 +25,7 @@ const (
 						"geometryType" : "<geometryType>",
 						"hasZ" : true,  
 						"hasM" : false,   
-						"spatialReference" : "spatialReference"",
+						"spatialReference" : "spatialReference",
 						"fields": [
 									{
 										"name": "field1",
@@ -41,7 +41,7 @@ const (
 						 "features": [
 									{
 										"geometry": {
-											"geo1"
+											"x": 1.5, "y": 2.5
 										},
 										"attributes": {
 											"field1": 123,
@@ -50,7 +50,7 @@ const (
 									},
 									{
 										"geometry": {
-											"geo2"
+											"x": 3.5, "y": 4.5
 										},
 										"attributes": {
 											"field1": 345,
@@ -61,23 +61,6 @@ const (
 						}`
 )
 
-var obj *client.ClientObject
-
-func processObjectConfirmation(change *client.ChangeConfirmation) error {
-	log.Debugf("confirmation: %v", change)
-
-	// if propertyID empty (need to confirm why!!!) then skip it.
-	if change.PropertyID != "" {
-		obj.Properties[change.PropertyID] = change.Data
-		j, err := converters.ObjectToJson(*obj)
-		if err != nil {
-			log.Errorf("error converting object to json: %v", err)
-			return err
-		}
-	}
-	return nil
-}
-
 func main() {
 	fmt.Printf("So it begins...\n")
 	host := flag.String("host", "localhost:50051", "host:port of server")
@@ -90,6 +73,10 @@ func main() {
 
 	cli := client.NewClient(*host)
 
+	// JSON document we're going to sync/manipulate
+	doc := json.NewJSONObject(*objectID)
+	cli.RegisterConverters(doc.ConvertFromObject, doc.ConvertToObject)
+
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 
@@ -97,54 +84,56 @@ func main() {
 	cli.Connect(ctx)
 	go cli.Listen(ctx)
 
-	var err error
+	cli.RegisterToObject(nil, *objectID)
+
 	if *send {
 
-		obj, err = converters.JsonToObject(*objectID, jsonTemplate)
-		if err != nil {
-			log.Errorf("error converting json to object: %v", err)
+		if err := doc.SetJSON([]byte(jsonTemplate)); err != nil {
+			log.Errorf("error setting json: %v", err)
 			return
 		}
 
 		go func() {
 			for i := 0; i < 1000000000; i++ {
 
-				req, err := generateRandomChange(obj)
-				if err != nil {
+				if err := generateRandomChange(doc); err != nil {
 					log.Errorf("failed to generate change: %v", err)
 					return
 				}
 
-				if err := cli.SendChange(req); err != nil {
+				if err := cli.SendObject(*objectID, doc); err != nil {
 					log.Errorf("failed to send change: %v", err)
 					return
 				}
 				time.Sleep(50 * time.Millisecond)
 			}
 		}()
+	} else {
+		go func() {
+			for {
+				log.Infof("document: %s", doc.JSON())
+				time.Sleep(1 * time.Second)
+			}
+		}()
 	}
 
-	cli.RegisterToObject(nil, *objectID)
-
 	wg.Wait()
 }
 
 // does some random changes against the existing JSON
 // This is VERY specific to our existing JSON format obviously
-func generateRandomChange(obj *client.ClientObject) (*client.OutgoingChange, error) {
+func generateRandomChange(doc *json.JSONObject) error {
 
 	var property string
-	var data []byte
-	var err error
 	var a any
 	rnd := rand.Intn(5)
 	switch rnd {
 	case 0:
 		property = "features.0.attributes.field1"
-		a = fmt.Sprintf("%d", rand.Intn(100000))
+		a = rand.Intn(100000)
 	case 1:
 		property = "features.1.attributes.field2"
-		a = fmt.Sprintf("%d", rand.Intn(100000))
+		a = rand.Intn(100000)
 	case 2:
 		property = "fieldAliases.fieldName1"
 		a = fmt.Sprintf("alias-%d", rand.Intn(100000))
@@ -152,21 +141,15 @@ func generateRandomChange(obj *client.ClientObject) (*client.OutgoingChange, err
 		property = "spatialReference"
 		a = fmt.Sprintf("sr-%d", rand.Intn(100000))
 	case 4:
-		property = "spatialReference"
-		a = fmt.Sprintf("sr-%d", rand.Intn(100000))
+		property = "features.0.geometry.x"
+		a = rand.Float64() * 100
 	}
 
-	data, err = json.Marshal(a)
+	newDoc, err := sjson.SetBytes(doc.JSON(), property, a)
 	if err != nil {
-		log.Errorf("Error marshalling JSON: %v", err)
-		return nil, err
-	}
-
-	req := client.OutgoingChange{
-		ObjectID:   obj.ObjectID,
-		PropertyID: property,
-		Data:       data,
+		log.Errorf("Error modifying JSON: %v", err)
+		return err
 	}
 
-	return &req, nil
+	return doc.SetJSON(newDoc)
 }
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the start of every environment variable the server reads its config from. The rest
+// is the path to the setting in the config file, eg. COLLABLITE_PROCESSOR_IDLETIMEOUT.
+const envPrefix = "COLLABLITE"
+
+// Config is everything the server can be configured with. Settings come from (later wins) the
+// defaults, the -config YAML file, COLLABLITE_* environment variables and then command line flags.
+type Config struct {
+	Port      int             `yaml:"port"`
+	Log       LogConfig       `yaml:"log"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Signing   SigningConfig   `yaml:"signing"`
+	Writer    WriterConfig    `yaml:"writer"`
+	Processor ProcessorConfig `yaml:"processor"`
+	GRPC      GRPCConfig      `yaml:"grpc"`
+	TLS       TLSConfig       `yaml:"tls"`
+
+	// ReloadInterval is how often the config file is checked for changes, 0 to only reload on
+	// SIGHUP. Changes that need a restart are logged and otherwise ignored.
+	ReloadInterval time.Duration `yaml:"reloadinterval"`
+
+	// ShutdownTimeout is how long to wait, on SIGINT/SIGTERM, for changes already received to be
+	// stored before giving up and exiting anyway.
+	ShutdownTimeout time.Duration `yaml:"shutdowntimeout"`
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error.
+	Level string `yaml:"level"`
+
+	// Format is text or json.
+	Format string `yaml:"format"`
+}
+
+type StorageConfig struct {
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"`
+
+	// Options are backend specific settings, eg. sync: "false" for pebble or badger. In the environment
+	// they're comma separated key=value.
+	Options map[string]string `yaml:"options"`
+
+	// WAL is the directory for the write ahead log, empty for none.
+	WAL string `yaml:"wal"`
+
+	Compress       string `yaml:"compress"`
+	CompressMin    int    `yaml:"compressmin"`
+	EncryptionKeys string `yaml:"encryptionkeys"`
+
+	// CacheSize is in MB, 0 to not cache.
+	CacheSize int64 `yaml:"cachesize"`
+}
+
+type SigningConfig struct {
+	Keys          string `yaml:"keys"`
+	RequireSigned bool   `yaml:"requiresigned"`
+
+	// Sequences is the file the last sequence from each signed client is kept in, so changes can't
+	// be replayed after a restart. Empty to only keep them in memory.
+	Sequences string `yaml:"sequences"`
+}
+
+type WriterConfig struct {
+	MaxBatch        int           `yaml:"maxbatch"`
+	MaxBatchLatency time.Duration `yaml:"maxbatchlatency"`
+}
+
+type ProcessorConfig struct {
+	IdleTimeout  time.Duration `yaml:"idletimeout"`
+	ChangeBuffer int           `yaml:"changebuffer"`
+	MaxPending   int           `yaml:"maxpending"`
+}
+
+type GRPCConfig struct {
+	// MaxRecvMsgSize is the biggest message (in bytes) accepted from a client.
+	MaxRecvMsgSize int `yaml:"maxrecvmsgsize"`
+
+	// MaxConcurrentStreams per connection, 0 for no limit.
+	MaxConcurrentStreams uint32 `yaml:"maxconcurrentstreams"`
+}
+
+// TLSConfig turns on TLS if Cert and Key are set. With ClientCA as well clients have to present a
+// certificate signed by it, and that's who their changes are recorded as being from.
+type TLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"clientca"`
+}
+
+// defaultConfig is what the server runs with if nothing is configured.
+func defaultConfig() Config {
+	return Config{
+		Port: 50051,
+		Log:  LogConfig{Level: "info", Format: "text"},
+		Storage: StorageConfig{
+			Backend:     "null",
+			Path:        ".",
+			Options:     map[string]string{},
+			Compress:    "none",
+			CompressMin: 512,
+		},
+		Writer:    WriterConfig{MaxBatch: 512},
+		Processor: ProcessorConfig{IdleTimeout: time.Minute, ChangeBuffer: 100000, MaxPending: 100000},
+		GRPC:      GRPCConfig{MaxRecvMsgSize: 4 << 20},
+
+		ReloadInterval:  5 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// loadConfig works out the config from the config file, environment and flags. printConfig is
+// true if -print-config was given.
+func loadConfig(fs *flag.FlagSet, args []string, getenv func(string) string) (cfg Config, printConfig bool, err error) {
+	cfg = defaultConfig()
+
+	configFile := fs.String("config", "", "YAML config file. Environment variables (COLLABLITE_<SECTION>_<SETTING>) override it, flags override both")
+	fs.BoolVar(&printConfig, "print-config", false, "Print the config the server would run with and exit")
+	store := fs.Bool("store", false, "Store data to disk (same as -backend pebble)")
+	registerFlags(fs, &cfg)
+
+	// parsed twice. Once to find the config file, then again once it's loaded so flags win.
+	if err := fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+	if *configFile != "" {
+		if err := readConfigFile(*configFile, &cfg); err != nil {
+			return cfg, false, err
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), envPrefix, getenv); err != nil {
+		return cfg, false, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+	if *store {
+		cfg.Storage.Backend = "pebble"
+	}
+
+	return cfg, printConfig, cfg.Validate()
+}
+
+// registerFlags adds the flags the server has always had. Anything else is only in the config.
+func registerFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "The server port")
+	fs.StringVar(&cfg.Log.Level, "loglevel", cfg.Log.Level, "Log Level: debug, info, warn, error")
+	fs.StringVar(&cfg.Storage.Backend, "backend", cfg.Storage.Backend, fmt.Sprintf("Storage backend: %s", strings.Join(storage.Backends(), ", ")))
+	fs.StringVar(&cfg.Storage.Path, "storepath", cfg.Storage.Path, "Path of storage location (if persist to local disk)")
+	fs.Var((*backendSettings)(&cfg.Storage.Options), "backendopt", "Backend specific setting as key=value (eg. sync=false for pebble or badger). Can be repeated")
+	fs.StringVar(&cfg.Signing.Keys, "keys", cfg.Signing.Keys, "File of client public keys (<clientID> <base64 ed25519 key> per line) used to verify signed changes")
+	fs.BoolVar(&cfg.Signing.RequireSigned, "requiresigned", cfg.Signing.RequireSigned, "Reject changes from clients without a registered key")
+	fs.StringVar(&cfg.Signing.Sequences, "sequences", cfg.Signing.Sequences, "File the last sequence of each signed client is kept in, so signed changes can't be replayed after a restart")
+	fs.IntVar(&cfg.Writer.MaxBatch, "maxbatch", cfg.Writer.MaxBatch, "Most changes written to storage in one commit")
+	fs.DurationVar(&cfg.Writer.MaxBatchLatency, "maxbatchlatency", cfg.Writer.MaxBatchLatency, "How long to wait for more changes before committing a batch (0 commits whatever is queued)")
+	fs.StringVar(&cfg.Storage.Compress, "compress", cfg.Storage.Compress, "Compress stored values: none, snappy, zstd")
+	fs.IntVar(&cfg.Storage.CompressMin, "compressmin", cfg.Storage.CompressMin, "Smallest value (in bytes) worth compressing")
+	fs.StringVar(&cfg.Storage.EncryptionKeys, "encryptionkeys", cfg.Storage.EncryptionKeys, "File of master keys (<keyID> <base64 256 bit key> per line, last is current) used to encrypt stored values")
+	fs.Int64Var(&cfg.Storage.CacheSize, "cachesize", cfg.Storage.CacheSize, "Memory (in MB) used to cache recently used objects, 0 to not cache")
+	fs.DurationVar(&cfg.Processor.IdleTimeout, "idletimeout", cfg.Processor.IdleTimeout, "How long objects with no clients are kept in memory")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdowntimeout", cfg.ShutdownTimeout, "How long to wait for changes to be stored when shutting down")
+	fs.StringVar(&cfg.Storage.WAL, "wal", cfg.Storage.WAL, "Directory for the write ahead log. Changes are acknowledged once in the log and replayed on startup if the server died before storing them")
+}
+
+func readConfigFile(filename string, cfg *Config) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to open config: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to read config %s: %w", filename, err)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv sets any field of v that has an environment variable. The name of the variable is the
+// prefix then the yaml names of the field (and the structs it's in), upper cased.
+func applyEnv(v reflect.Value, prefix string, getenv func(string) string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		name = prefix + "_" + strings.ToUpper(name)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name, getenv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value := getenv(name)
+		if value == "" {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case field.CanInt():
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case field.CanUint():
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case field.Type() == reflect.TypeOf(map[string]string{}):
+		settings := backendSettings{}
+		for _, kv := range strings.Split(value, ",") {
+			if err := settings.Set(strings.TrimSpace(kv)); err != nil {
+				return err
+			}
+		}
+		field.Set(reflect.ValueOf(map[string]string(settings)))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// Validate checks the config makes sense, so the server fails at startup rather than later.
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port < 65536, "port %d out of range", c.Port)
+	check(oneOf(c.Log.Level, "debug", "info", "warn", "error"), "unknown log level %q", c.Log.Level)
+	check(oneOf(c.Log.Format, "text", "json"), "unknown log format %q", c.Log.Format)
+
+	check(oneOf(c.Storage.Backend, storage.Backends()...), "unknown storage backend %q, have %s", c.Storage.Backend, strings.Join(storage.Backends(), ", "))
+	_, err := storage.ParseCodec(c.Storage.Compress)
+	check(err == nil, "%v", err)
+	check(c.Storage.CompressMin >= 0, "compressmin can't be negative")
+	check(c.Storage.CacheSize >= 0, "cachesize can't be negative")
+
+	check(c.Writer.MaxBatch > 0, "maxbatch must be at least 1")
+	check(c.Writer.MaxBatchLatency >= 0, "maxbatchlatency can't be negative")
+	check(c.Processor.IdleTimeout > 0, "idletimeout must be more than 0")
+	check(c.Processor.ChangeBuffer > 0, "changebuffer must be at least 1")
+	check(c.Processor.MaxPending > 0, "maxpending must be at least 1")
+	check(c.GRPC.MaxRecvMsgSize > 0, "maxrecvmsgsize must be more than 0")
+	check(c.ReloadInterval >= 0, "reloadinterval can't be negative")
+	check(c.ShutdownTimeout > 0, "shutdowntimeout must be more than 0")
+
+	check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls needs both cert and key")
+	check(c.TLS.ClientCA == "" || c.TLS.Cert != "", "tls clientca needs cert and key too")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// writeConfig writes the config out as YAML, in the same form as the config file.
+func writeConfig(w io.Writer, cfg Config) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLoadConfig(args []string, env map[string]string) (Config, bool, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	return loadConfig(fs, args, func(name string) string { return env[name] })
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, printConfig, err := testLoadConfig(nil, nil)
+	require.Nil(t, err)
+	assert.False(t, printConfig)
+	assert.EqualValues(t, defaultConfig(), cfg)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "server.yaml")
+	err := os.WriteFile(filename, []byte(`
+port: 6000
+storage:
+  backend: memory
+  options:
+    sync: "false"
+processor:
+  idletimeout: 30s
+  changebuffer: 10
+`), 0600)
+	require.Nil(t, err)
+
+	env := map[string]string{
+		"COLLABLITE_PORT":                      "7000",
+		"COLLABLITE_PROCESSOR_CHANGEBUFFER":    "20",
+		"COLLABLITE_GRPC_MAXCONCURRENTSTREAMS": "5",
+	}
+	cfg, _, err := testLoadConfig([]string{"-config", filename, "-port", "8000"}, env)
+	require.Nil(t, err)
+
+	assert.EqualValues(t, 8000, cfg.Port, "Flags should win")
+	assert.EqualValues(t, 20, cfg.Processor.ChangeBuffer, "Environment should override file")
+	assert.EqualValues(t, 5, cfg.GRPC.MaxConcurrentStreams)
+	assert.EqualValues(t, 30*time.Second, cfg.Processor.IdleTimeout, "File should override defaults")
+	assert.EqualValues(t, "memory", cfg.Storage.Backend)
+	assert.EqualValues(t, "false", cfg.Storage.Options["sync"])
+	assert.EqualValues(t, 100000, cfg.Processor.MaxPending, "Defaults should be kept")
+}
+
+func TestConfigInvalid(t *testing.T) {
+	_, _, err := testLoadConfig([]string{"-backend", "nope"}, nil)
+	assert.ErrorContains(t, err, "unknown storage backend")
+
+	_, _, err = testLoadConfig(nil, map[string]string{"COLLABLITE_PROCESSOR_IDLETIMEOUT": "soon"})
+	assert.ErrorContains(t, err, "COLLABLITE_PROCESSOR_IDLETIMEOUT")
+
+	_, _, err = testLoadConfig(nil, map[string]string{"COLLABLITE_TLS_CERT": "server.pem"})
+	assert.ErrorContains(t, err, "both cert and key")
+
+	filename := filepath.Join(t.TempDir(), "server.yaml")
+	require.Nil(t, os.WriteFile(filename, []byte("prot: 1\n"), 0600))
+	_, _, err = testLoadConfig([]string{"-config", filename}, nil)
+	assert.NotNil(t, err, "Misspelt settings shouldn't be ignored")
+}
+
+func TestPrintedConfigLoads(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Port = 1234
+	cfg.Writer.MaxBatchLatency = 5 * time.Millisecond
+
+	var buf bytes.Buffer
+	require.Nil(t, writeConfig(&buf, cfg))
+	filename := filepath.Join(t.TempDir(), "server.yaml")
+	require.Nil(t, os.WriteFile(filename, buf.Bytes(), 0600))
+
+	loaded, _, err := testLoadConfig([]string{"-config", filename}, nil)
+	require.Nil(t, err)
+	assert.EqualValues(t, cfg, loaded)
+}
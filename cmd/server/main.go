@@ -1,30 +1,45 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/kpfaulkner/collablite/cmd/common"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/kpfaulkner/collablite/pkg/server"
+	"github.com/kpfaulkner/collablite/pkg/signing"
 	"github.com/kpfaulkner/collablite/pkg/storage"
+	"github.com/kpfaulkner/collablite/pkg/wal"
 	"github.com/kpfaulkner/collablite/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
-	fmt.Printf("So it begins...\n")
-	port := flag.Int("port", 50051, "The server port")
-	logLevel := flag.String("loglevel", "info", "Log Level: debug, info, warn, error")
-	store := flag.Bool("store", false, "Store data to disk")
-	storePath := flag.String("storepath", ".", "Path of storage location (if persist to local disk)")
-
-	flag.Parse()
+	cfg, printConfig, err := loadConfig(flag.CommandLine, os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if printConfig {
+		if err := writeConfig(os.Stdout, cfg); err != nil {
+			log.Fatalf("unable to print config: %v", err)
+		}
+		return
+	}
 
-	common.SetLogLevel(*logLevel)
+	fmt.Printf("So it begins...\n")
+	setLogging(cfg.Log)
 
 	//defer profile.Start(profile.MemProfile, profile.MemProfileRate(1), profile.ProfilePath(".")).Stop()
 	//defer profile.Start(profile.CPUProfile, profile.ProfilePath(".")).Stop()
@@ -32,31 +47,222 @@ func main() {
 	//defer profile.Start(profile.MutexProfile, profile.ProfilePath(".")).Stop()
 	//defer profile.Start(profile.GoroutineProfile, profile.ProfilePath(".")).Stop()
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *port))
+	db, err := storage.Open(cfg.Storage.Backend, storage.Options{
+		Path:     backendPath(cfg.Storage.Backend, cfg.Storage.Path),
+		Settings: cfg.Storage.Options,
+	})
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		log.Fatalf("failed to create db: %v", err)
 	}
-	var opts []grpc.ServerOption
+	log.Infof("using %s storage backend", cfg.Storage.Backend)
 
-	var db storage.DB
+	if cfg.Storage.WAL != "" {
+		if sync, err := strconv.ParseBool(cfg.Storage.Options["sync"]); err == nil && !sync {
+			log.Warnf("backend sync is off, changes can still be lost if the machine dies")
+		}
 
-	if *store {
-		pebbleClient, err := storage.NewPebbleClient(path.Join(*storePath, "pebbledb"))
+		// replays anything not yet in the backend, has to happen before we take connections.
+		l, err := wal.Open(cfg.Storage.WAL, wal.Options{})
 		if err != nil {
-			log.Fatalf("unable to create pebble client: %v", err)
+			log.Fatalf("failed to open wal: %v", err)
 		}
-		db, err = storage.NewPebbleDB(pebbleClient)
+		db, err = wal.NewDB(db, l)
 		if err != nil {
-			log.Fatalf("failed to create db: %v", err)
+			log.Fatalf("failed to recover from wal: %v", err)
 		}
-	} else {
-		db, err = storage.NewNullDB()
+		log.Infof("using write ahead log in %s", cfg.Storage.WAL)
+	}
+
+	// outside the wal so the log is encrypted too.
+	if cfg.Storage.EncryptionKeys != "" {
+		master, err := storage.LoadMasterKeysFile(cfg.Storage.EncryptionKeys)
 		if err != nil {
-			log.Fatalf("failed to create nulldb: %v", err)
+			log.Fatalf("unable to load encryption keys: %v", err)
 		}
+		db = storage.NewEncryptedDB(db, master)
+		log.Infof("encrypting stored values")
+	}
+
+	// compression has to happen before encryption, encrypted data doesn't compress.
+	if codec, err := storage.ParseCodec(cfg.Storage.Compress); err != nil {
+		log.Fatalf("%v", err)
+	} else if codec != storage.CodecNone {
+		db, err = storage.NewCompressedDB(db, storage.CompressionOptions{Codec: codec, MinSize: cfg.Storage.CompressMin})
+		if err != nil {
+			log.Fatalf("failed to set up compression: %v", err)
+		}
+		log.Infof("compressing values of %d bytes or more with %s", cfg.Storage.CompressMin, codec)
+	}
+
+	// cached objects are already decompressed/decrypted.
+	if cfg.Storage.CacheSize > 0 {
+		db = storage.NewCachedDB(db, storage.CacheOptions{MaxBytes: cfg.Storage.CacheSize << 20})
+		log.Infof("caching up to %dMB of objects", cfg.Storage.CacheSize)
+	}
+
+	writerOpts, processorOpts := serverOptions(cfg)
+	cls := server.NewCollabLiteServer(db, writerOpts, processorOpts)
+	if cfg.Signing.Sequences != "" {
+		sequences, err := signing.OpenSequences(cfg.Signing.Sequences)
+		if err != nil {
+			log.Fatalf("unable to open sequences: %v", err)
+		}
+		defer sequences.Close()
+		cls.SetSequences(sequences)
+	}
+	keys, err := keyRegistry(cfg.Signing)
+	if err != nil {
+		log.Fatalf("unable to load keys: %v", err)
+	}
+	if keys != nil {
+		cls.SetKeyRegistry(keys)
+	}
+
+	// safe changes to the config are applied without a restart.
+	// done on SIGINT/SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	r := &reloader{cls: cls, args: os.Args[1:], getenv: os.Getenv, running: cfg}
+	go r.watch(ctx, flag.Lookup("config").Value.String(), cfg.ReloadInterval)
+
+	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", cfg.Port))
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(cfg.GRPC.MaxRecvMsgSize)}
+	if cfg.GRPC.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(cfg.GRPC.MaxConcurrentStreams))
+	}
+	if cfg.TLS.Cert != "" {
+		creds, err := serverCredentials(cfg.TLS)
+		if err != nil {
+			log.Fatalf("unable to set up tls: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+		log.Infof("using tls, client certificates required: %v", cfg.TLS.ClientCA != "")
 	}
 
 	grpcServer := grpc.NewServer(opts...)
-	proto.RegisterCollabLiteServer(grpcServer, server.NewCollabLiteServer(db))
-	grpcServer.Serve(lis)
+	proto.RegisterCollabLiteServer(grpcServer, cls)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(lis)
+	}()
+	select {
+	case err := <-served:
+		log.Fatalf("failed to serve: %v", err)
+	case <-ctx.Done():
+	}
+
+	// another signal kills it straight away.
+	stop()
+	if err := shutdown(grpcServer, cls, db, cfg.ShutdownTimeout); err != nil {
+		log.Errorf("unclean shutdown: %v", err)
+		os.Exit(1)
+	}
+	log.Infof("shut down")
+}
+
+// shutdown stops taking connections, tells clients to reconnect, stores every change already
+// received and closes storage. Gives up after the timeout, anything not stored by then is lost
+// (unless it's in the wal).
+func shutdown(grpcServer *grpc.Server, cls *server.CollabLiteServer, db storage.DB, timeout time.Duration) error {
+	log.Infof("shutting down, waiting up to %v for changes to be stored", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// stops listening straight away, then waits for the streams Shutdown ends.
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	err := cls.Shutdown(ctx)
+	if err == nil {
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		grpcServer.Stop()
+	}
+
+	// storage may have plenty still to flush, it gets whatever time is left too.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- db.Close()
+	}()
+	select {
+	case closeErr := <-closed:
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("closing storage: %w", closeErr)
+		}
+	case <-ctx.Done():
+		log.Errorf("storage still closing after %v, giving up", timeout)
+		if err == nil {
+			err = fmt.Errorf("closing storage: %w", ctx.Err())
+		}
+	}
+	return err
+}
+
+// serverCredentials loads the server's certificate and, if there's a client CA, requires clients
+// to present a certificate signed by it.
+func serverCredentials(cfg TLSConfig) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if cfg.ClientCA != "" {
+		pem, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// backendPath is where each backend keeps its data within the storepath.
+func backendPath(backend string, storePath string) string {
+	switch backend {
+	case "pebble":
+		return path.Join(storePath, "pebbledb")
+	case "badger":
+		return path.Join(storePath, "badgerdb")
+	case "sqlite":
+		return path.Join(storePath, "collablite.db")
+	}
+	return storePath
+}
+
+// backendSettings collects repeated -backendopt key=value flags.
+type backendSettings map[string]string
+
+func (b *backendSettings) String() string {
+	return fmt.Sprintf("%v", map[string]string(*b))
+}
+
+func (b *backendSettings) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	if *b == nil {
+		*b = make(backendSettings)
+	}
+	(*b)[k] = v
+	return nil
 }
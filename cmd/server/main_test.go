@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/server"
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// stuckDB doesn't finish closing until released.
+type stuckDB struct {
+	storage.DB
+	release chan struct{}
+}
+
+func (db *stuckDB) Close() error {
+	<-db.release
+	return db.DB.Close()
+}
+
+func TestShutdownTimesOutClosingStorage(t *testing.T) {
+	backend, _ := storage.NewMemoryDB()
+	db := &stuckDB{DB: backend, release: make(chan struct{})}
+	defer close(db.release)
+	cls := server.NewCollabLiteServer(db, server.WriterOptions{}, server.ProcessorOptions{})
+
+	start := time.Now()
+	err := shutdown(grpc.NewServer(), cls, db, 50*time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "Should report storage not closing in time")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
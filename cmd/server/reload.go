@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kpfaulkner/collablite/cmd/common"
+	"github.com/kpfaulkner/collablite/pkg/server"
+	"github.com/kpfaulkner/collablite/pkg/signing"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloader applies config changes to a running server. Only settings that can change without
+// disturbing connected clients are applied, anything else is logged as needing a restart.
+type reloader struct {
+	cls    *server.CollabLiteServer
+	args   []string
+	getenv func(string) string
+
+	// what the server is running with.
+	running Config
+}
+
+// watch reloads when the config file changes (checked every interval, 0 to not check) or the
+// process gets SIGHUP, until the context is done.
+func (r *reloader) watch(ctx context.Context, filename string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if filename != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last := fileVersion(filename)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Infof("got SIGHUP, reloading config")
+			last = fileVersion(filename)
+			r.reload()
+		case <-tick:
+			if v := fileVersion(filename); v != last {
+				log.Infof("config file %s changed, reloading", filename)
+				last = v
+				r.reload()
+			}
+		}
+	}
+}
+
+// fileVersion is enough to tell whether a file has been changed.
+func fileVersion(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%d %d", info.ModTime().UnixNano(), info.Size())
+}
+
+// reload reads the config again and applies what it can. If the new config is invalid nothing
+// changes.
+func (r *reloader) reload() {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	loaded, _, err := loadConfig(fs, r.args, r.getenv)
+	if err != nil {
+		log.Errorf("not reloading config: %v", err)
+		return
+	}
+
+	next, restart := liveConfig(r.running, loaded)
+	for _, change := range restart {
+		log.Warnf("config %s needs a restart to apply", change)
+	}
+
+	// key files are read every time, the keys in them may have changed even if the config hasn't.
+	// The new keys carry on from the sequences already seen (see SetKeyRegistry).
+	keys, err := keyRegistry(next.Signing)
+	if err != nil {
+		log.Errorf("unable to reload keys, keeping the old ones: %v", err)
+		next.Signing = r.running.Signing
+	} else {
+		r.cls.SetKeyRegistry(keys)
+	}
+
+	changes := configDiff(r.running, next)
+	for _, change := range changes {
+		log.Infof("config %s", change)
+	}
+	if len(changes) == 0 {
+		log.Infof("no config changes to apply")
+	}
+
+	setLogging(next.Log)
+	r.cls.SetOptions(serverOptions(next))
+	r.running = next
+}
+
+// liveConfig is the loaded config, apart from anything that can't change while running, which
+// stays as it is. Also returns the changes to those.
+func liveConfig(running Config, loaded Config) (Config, []string) {
+	next := loaded
+	next.Port = running.Port
+	next.Storage = running.Storage
+	next.Signing.Sequences = running.Signing.Sequences
+	next.GRPC = running.GRPC
+	next.TLS = running.TLS
+	next.ReloadInterval = running.ReloadInterval
+	next.ShutdownTimeout = running.ShutdownTimeout
+	return next, configDiff(next, loaded)
+}
+
+// configDiff describes each setting that's different, as "<setting>: <old> -> <new>".
+func configDiff(old Config, new Config) []string {
+	var changes []string
+	diffValues(reflect.ValueOf(old), reflect.ValueOf(new), "", &changes)
+	return changes
+}
+
+func diffValues(old reflect.Value, new reflect.Value, path string, changes *[]string) {
+	t := old.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if path != "" {
+			name = path + "." + name
+		}
+
+		o, n := old.Field(i), new.Field(i)
+		if o.Kind() == reflect.Struct && o.Type() != durationType {
+			diffValues(o, n, name, changes)
+			continue
+		}
+		if !reflect.DeepEqual(o.Interface(), n.Interface()) {
+			*changes = append(*changes, fmt.Sprintf("%s: %v -> %v", name, o.Interface(), n.Interface()))
+		}
+	}
+}
+
+// setLogging sets the log level and format.
+func setLogging(cfg LogConfig) {
+	common.SetLogLevel(cfg.Level)
+	if cfg.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
+	}
+}
+
+// keyRegistry loads the client keys, nil if signatures aren't checked.
+func keyRegistry(cfg SigningConfig) (*signing.KeyRegistry, error) {
+	if cfg.Keys == "" && !cfg.RequireSigned {
+		return nil, nil
+	}
+	keys := signing.NewKeyRegistry(cfg.RequireSigned)
+	if cfg.Keys != "" {
+		if err := keys.LoadKeysFile(cfg.Keys); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// serverOptions are the writer and processor options from the config.
+func serverOptions(cfg Config) (server.WriterOptions, server.ProcessorOptions) {
+	return server.WriterOptions{
+		MaxBatchSize: cfg.Writer.MaxBatch,
+		MaxLatency:   cfg.Writer.MaxBatchLatency,
+	}, server.ProcessorOptions{
+		IdleTimeout:  cfg.Processor.IdleTimeout,
+		MaxPending:   cfg.Processor.MaxPending,
+		ChangeBuffer: cfg.Processor.ChangeBuffer,
+	}
+}
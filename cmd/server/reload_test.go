@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigDiff(t *testing.T) {
+	old := defaultConfig()
+	new := defaultConfig()
+	assert.Empty(t, configDiff(old, new))
+
+	new.Log.Level = "debug"
+	new.Processor.IdleTimeout = 5 * time.Minute
+	new.Storage.Options = map[string]string{"sync": "false"}
+	assert.EqualValues(t, []string{
+		"log.level: info -> debug",
+		"storage.options: map[] -> map[sync:false]",
+		"processor.idletimeout: 1m0s -> 5m0s",
+	}, configDiff(old, new))
+}
+
+func TestLiveConfigKeepsRestartSettings(t *testing.T) {
+	running := defaultConfig()
+	loaded := defaultConfig()
+	loaded.Port = 6000
+	loaded.Storage.Backend = "memory"
+	loaded.Writer.MaxBatch = 10
+	loaded.Signing.Sequences = "sequences"
+
+	next, restart := liveConfig(running, loaded)
+	assert.EqualValues(t, running.Port, next.Port)
+	assert.EqualValues(t, running.Storage.Backend, next.Storage.Backend)
+	assert.EqualValues(t, running.Signing.Sequences, next.Signing.Sequences)
+	assert.EqualValues(t, 10, next.Writer.MaxBatch, "Safe changes should be applied")
+	assert.EqualValues(t, []string{"port: 50051 -> 6000", "storage.backend: null -> memory", "signing.sequences:  -> sequences"}, restart)
+}
+
+func TestReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "server.yaml")
+	require.Nil(t, os.WriteFile(filename, []byte("processor:\n  maxpending: 10\n"), 0600))
+
+	args := []string{"-config", filename}
+	cfg, _, err := testLoadConfig(args, nil)
+	require.Nil(t, err)
+
+	db, _ := server.NewFakeDB()
+	writerOpts, processorOpts := serverOptions(cfg)
+	r := &reloader{cls: server.NewCollabLiteServer(db, writerOpts, processorOpts), args: args, getenv: os.Getenv, running: cfg}
+
+	require.Nil(t, os.WriteFile(filename, []byte("port: 6000\nprocessor:\n  maxpending: 20\n"), 0600))
+	r.reload()
+	assert.EqualValues(t, 20, r.running.Processor.MaxPending)
+	assert.EqualValues(t, 50051, r.running.Port, "Port can't change without a restart")
+
+	require.Nil(t, os.WriteFile(filename, []byte("processor:\n  maxpending: -1\n"), 0600))
+	r.reload()
+	assert.EqualValues(t, 20, r.running.Processor.MaxPending, "Invalid config shouldn't be applied")
+}
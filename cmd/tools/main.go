@@ -1,34 +1,224 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"os"
 
 	"github.com/cockroachdb/pebble"
+	badger "github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/kpfaulkner/collablite/cmd/common"
+	"github.com/kpfaulkner/collablite/pkg/storage"
 )
 
+// offline tools for working with the server storage. The server must be stopped first.
+//
+//	tools get -backend pebble -path ./pebbledb -object obj1
+//	tools migratekeys -backend pebble -path ./pebbledb
+//	tools sqlitemigrate -path ./sqlite.db -apply
+//	tools newmasterkey -id k2 >> keys.txt
+//	tools rotatekeys -backend pebble -path ./pebbledb -keys keys.txt
 func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
 
-	keyStr := flag.String("key", "", "key")
-	flag.Parse()
+	var err error
+	switch os.Args[1] {
+	case "get":
+		err = get(os.Args[2:])
+	case "migratekeys":
+		err = migrateKeys(os.Args[2:])
+	case "sqlitemigrate":
+		err = sqliteMigrate(os.Args[2:])
+	case "newmasterkey":
+		err = newMasterKey(os.Args[2:])
+	case "rotatekeys":
+		err = rotateKeys(os.Args[2:])
+	default:
+		usage()
+	}
 
-	db, err := pebble.Open(`C:/Users/kenfa/projects/collablite/cmd/server/pebbledb`, &pebble.Options{})
 	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: tools <command> [flags]\n\ncommands:\n")
+	fmt.Fprintf(os.Stderr, "  get            print all properties of an object\n")
+	fmt.Fprintf(os.Stderr, "  migratekeys    rewrite pebble/badger keys from the old objectID:propertyID layout\n")
+	fmt.Fprintf(os.Stderr, "  sqlitemigrate  report (or with -apply, apply) pending sqlite schema migrations\n")
+	fmt.Fprintf(os.Stderr, "  newmasterkey   print a new master key line for the encryption keys file\n")
+	fmt.Fprintf(os.Stderr, "  rotatekeys     re-wrap data keys with the current (last) master key\n")
+	os.Exit(2)
+}
+
+// get prints all properties of an object.
+func get(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	backend := fs.String("backend", "pebble", "Storage backend")
+	path := fs.String("path", "", "Path of the storage (directory or file)")
+	objectID := fs.String("object", "", "Object ID")
+	keys := fs.String("keys", "", "Encryption master keys file, if the server uses -encryptionkeys")
+	logLevel := fs.String("loglevel", "info", "Log Level: debug, info, warn, error")
+	fs.Parse(args)
+	common.SetLogLevel(*logLevel)
 
-	key := []byte(*keyStr)
-	value, closer, err := db.Get(key)
+	var db storage.DB
+	db, err := storage.Open(*backend, storage.Options{Path: *path})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	fmt.Printf("%s %s\n", key, value)
-	if err := closer.Close(); err != nil {
-		log.Fatal(err)
+	if *keys != "" {
+		master, err := storage.LoadMasterKeysFile(*keys)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		db = storage.NewEncryptedDB(db, master)
 	}
-	if err := db.Close(); err != nil {
-		log.Fatal(err)
+	defer db.Close()
+
+	obj, err := db.Get(context.Background(), *objectID)
+	if err != nil {
+		return err
+	}
+	for k, v := range obj.Properties {
+		meta := obj.Metadata[k]
+		fmt.Printf("%s %s (%s %v)\n", k, v, meta.Author, meta.LastModified)
+	}
+	return nil
+}
+
+// migrateKeys rewrites keys in the old layout to the current one.
+func migrateKeys(args []string) error {
+	fs := flag.NewFlagSet("migratekeys", flag.ExitOnError)
+	backend := fs.String("backend", "pebble", "Storage backend: pebble or badger")
+	path := fs.String("path", "", "Path of the storage directory")
+	logLevel := fs.String("loglevel", "info", "Log Level: debug, info, warn, error")
+	fs.Parse(args)
+	common.SetLogLevel(*logLevel)
+
+	if *path == "" {
+		return fmt.Errorf("-path is required")
+	}
+
+	var count int
+	switch *backend {
+	case "pebble":
+		db, err := pebble.Open(*path, &pebble.Options{ErrorIfNotExists: true})
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if count, err = storage.MigratePebbleKeys(db); err != nil {
+			return err
+		}
+	case "badger":
+		db, err := badger.Open(badger.DefaultOptions(*path))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if count, err = storage.MigrateBadgerKeys(db); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("backend %s does not need key migration", *backend)
+	}
+
+	log.Infof("migrated %d keys", count)
+	return nil
+}
+
+// sqliteMigrate reports the schema version of a sqlite file and any pending migrations, applying
+// them if asked. The server applies them itself on start, this is for checking/doing it beforehand.
+func sqliteMigrate(args []string) error {
+	fs := flag.NewFlagSet("sqlitemigrate", flag.ExitOnError)
+	path := fs.String("path", "", "Path of the sqlite file")
+	apply := fs.Bool("apply", false, "Apply pending migrations")
+	logLevel := fs.String("loglevel", "info", "Log Level: debug, info, warn, error")
+	fs.Parse(args)
+	common.SetLogLevel(*logLevel)
+
+	if *path == "" {
+		return fmt.Errorf("-path is required")
+	}
+	// opening would otherwise create an empty file.
+	if _, err := os.Stat(*path); err != nil {
+		return err
 	}
 
+	version, pending, err := storage.PendingSQLiteMigrations(*path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d (latest %d)\n", version, storage.LatestSQLiteSchemaVersion())
+	for _, m := range pending {
+		fmt.Printf("pending %d: %s\n", m.Version, m.Name)
+	}
+	if !*apply || len(pending) == 0 {
+		return nil
+	}
+
+	applied, err := storage.MigrateSQLite(*path)
+	if err != nil {
+		return err
+	}
+	log.Infof("applied %d migrations", len(applied))
+	return nil
+}
+
+// newMasterKey prints a new key in the keys file format.
+func newMasterKey(args []string) error {
+	fs := flag.NewFlagSet("newmasterkey", flag.ExitOnError)
+	id := fs.String("id", "", "ID of the new key")
+	fs.Parse(args)
+
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+	key, err := storage.NewMasterKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", *id, key)
+	return nil
+}
+
+// rotateKeys re-wraps the data keys with the current master key, after which older master keys
+// can be removed from the keys file.
+func rotateKeys(args []string) error {
+	fs := flag.NewFlagSet("rotatekeys", flag.ExitOnError)
+	backend := fs.String("backend", "pebble", "Storage backend")
+	path := fs.String("path", "", "Path of the storage (directory or file)")
+	keys := fs.String("keys", "", "Encryption master keys file")
+	logLevel := fs.String("loglevel", "info", "Log Level: debug, info, warn, error")
+	fs.Parse(args)
+	common.SetLogLevel(*logLevel)
+
+	if *keys == "" {
+		return fmt.Errorf("-keys is required")
+	}
+	master, err := storage.LoadMasterKeysFile(*keys)
+	if err != nil {
+		return err
+	}
+	backendDB, err := storage.Open(*backend, storage.Options{Path: *path})
+	if err != nil {
+		return err
+	}
+	db := storage.NewEncryptedDB(backendDB, master)
+	defer db.Close()
+
+	count, err := db.RotateKeys(context.Background())
+	if err != nil {
+		return err
+	}
+	log.Infof("re-wrapped %d data keys", count)
+	return nil
 }
@@ -1,58 +1,109 @@
 package server
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"sync"
 
 	"github.com/kpfaulkner/collablite/pkg/storage"
 )
 
 type fakeDB struct {
+	// the processors and writer use it from different goroutines.
+	lock sync.Mutex
 	data map[string]map[string][]byte
+	meta map[string]map[string]storage.PropertyMetadata
+
+	// returned by every call if set
+	err error
+
+	// number of batches written
+	writes int
 }
 
 // NewFakeDB creates new NullDB
 func NewFakeDB() (*fakeDB, error) {
 	db := fakeDB{}
 	db.data = make(map[string]map[string][]byte)
+	db.meta = make(map[string]map[string]storage.PropertyMetadata)
 	return &db, nil
 }
 
-func (db *fakeDB) Add(objectID string, propertyID string, data []byte) error {
+func (db *fakeDB) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta storage.PropertyMetadata) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.add(objectID, propertyID, data, meta)
+}
+
+// add is called with the lock held.
+func (db *fakeDB) add(objectID string, propertyID string, data []byte, meta storage.PropertyMetadata) error {
+	if db.err != nil {
+		return db.err
+	}
 	if d, ok := db.data[objectID]; !ok {
 		db.data[objectID] = make(map[string][]byte)
 		db.data[objectID][propertyID] = data
+		db.meta[objectID] = make(map[string]storage.PropertyMetadata)
 	} else {
 		d[propertyID] = data
 	}
+	db.meta[objectID][propertyID] = meta
 
 	return nil
 }
 
 // Delete objectID/propertyID from table.
-func (db *fakeDB) Delete(objectID string, propertyID string) error {
-	return nil
+func (db *fakeDB) Delete(ctx context.Context, objectID string, propertyID string) error {
+	return db.err
 }
 
 // Update an existing objectID/propertyID with new data.
-// Given Add has become an upsert, this function can probably go.
-func (db *fakeDB) Update(objectID string, propertyID string, data []byte) error {
-	return nil
+func (db *fakeDB) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta storage.PropertyMetadata) error {
+	return db.err
 }
 
 // Import will take a map of property/data and store it as an object.
-func (db *fakeDB) Import(objectID string, properties map[string][]byte) (string, error) {
+func (db *fakeDB) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
 	panic("Not implemented")
-	return "", nil
 }
 
 // Get returns an object (id + property/data map)
-func (db *fakeDB) Get(objectID string) (*storage.Object, error) {
+func (db *fakeDB) Get(ctx context.Context, objectID string) (*storage.Object, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.err != nil {
+		return nil, db.err
+	}
 	if obj, ok := db.data[objectID]; ok {
 		object := storage.NewObject(objectID)
 		for prop, val := range obj {
 			object.Properties[prop] = val
+			object.Metadata[prop] = db.meta[objectID][prop]
 		}
 		return object, nil
 	}
-	return nil, errors.New("no object")
+	return nil, fmt.Errorf("no object: %w", storage.ErrNotFound)
+}
+
+func (db *fakeDB) Write(ctx context.Context, batch *storage.Batch) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.err != nil {
+		return db.err
+	}
+	db.writes++
+	for _, op := range batch.Ops() {
+		if !op.Delete {
+			db.add(op.ObjectID, op.PropertyID, op.Data, op.Meta)
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) Iterate(ctx context.Context, objectID string, fn storage.IterateFunc) error {
+	panic("Not implemented")
+}
+
+func (db *fakeDB) Close() error {
+	return nil
 }
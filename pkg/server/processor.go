@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
@@ -15,56 +16,139 @@ import (
 // Basically this ties incoming changes for an objectID and knows which channels to send
 // the results.
 type ObjectIDChannels struct {
-	inChannel chan *proto.ObjectChange
+	inChannel chan *IncomingChange
 
-	// map of unique id (related to client, somehow) and outgoing channel with results
-	outChannels map[string]chan *proto.ObjectConfirmation
+	// map of unique id (related to client, somehow) and outgoing queue with results
+	outChannels map[string]*ClientQueue
+
+	// current state of the object, kept while the object is active.
+	state *ObjectState
+
+	// running while there are no clients, the object is dropped when it fires.
+	idle *time.Timer
+}
+
+// IncomingChange is a change received from a client, plus what the server knows about who sent it.
+type IncomingChange struct {
+	*proto.ObjectChange
+
+	// Author is the authenticated principal of the client, or the client supplied UniqueId if not authenticated.
+	Author string
+}
+
+const (
+	defaultIdleTimeout  = time.Minute
+	defaultChangeBuffer = 100000
+)
+
+// ProcessorOptions controls how long objects are kept in memory and how much can queue up.
+type ProcessorOptions struct {
+	// IdleTimeout is how long an object's state is kept after its last client goes, so clients
+	// reconnecting or switching back don't need it loaded again. Defaults to 1 minute.
+	IdleTimeout time.Duration
+
+	// MaxPending is how many confirmations can be waiting for a client (after replacing older
+	// updates to the same property) before it's told to resync. Defaults to 100000.
+	MaxPending int
+
+	// ChangeBuffer is how many changes for an object can be waiting to be processed before
+	// clients sending more block. Defaults to 100000.
+	ChangeBuffer int
+}
+
+// ProcessorStats are the objects currently held by the processor.
+type ProcessorStats struct {
+	Objects int
+	Bytes   int64
 }
 
 // Processor takes the objectChange (from channel), stores to the DB and return objectConfirmation via channel
 type Processor struct {
+	opts ProcessorOptions
+
 	objectChannelLock sync.RWMutex
 
 	// map of object id to channels used for input and output.
 	objectChannels map[string]*ObjectIDChannels
 
-	// DB for storing objects
+	// all object goroutines write through the same writer so their changes share commits.
+	writer *BatchWriter
+
+	// objects are loaded from here when they become active.
 	db storage.DB
 
-	// db writer channel, all processors will write the same channel.
-	dbWriterChannel chan proto.ObjectChange
+	// one for each object goroutine, and no more are started once closed.
+	running sync.WaitGroup
+	closed  bool
 }
 
-// NewProcessor creates a new instance of Processor with the associated DB
-// There is a Processor per object being changed.
-func NewProcessor(db storage.DB, dbWriterChannel chan proto.ObjectChange) *Processor {
+// ErrProcessorClosed is returned when registering with a processor that's shutting down.
+var ErrProcessorClosed = errors.New("processor closed")
+
+// NewProcessor creates a new instance of Processor that loads objects from db and stores changes
+// via the writer. There is a goroutine per object being changed.
+func NewProcessor(db storage.DB, writer *BatchWriter, opts ProcessorOptions) *Processor {
 	p := Processor{}
+	p.opts = opts.withDefaults()
 	p.objectChannels = make(map[string]*ObjectIDChannels)
+	p.writer = writer
 	p.db = db
-	p.dbWriterChannel = dbWriterChannel
 	return &p
 }
 
+func (opts ProcessorOptions) withDefaults() ProcessorOptions {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultIdleTimeout
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultMaxPending
+	}
+	if opts.ChangeBuffer <= 0 {
+		opts.ChangeBuffer = defaultChangeBuffer
+	}
+	return opts
+}
+
+// SetOptions changes the options while running. Objects and clients already registered keep what
+// they were created with, except idle timeouts which use the new value from the next time they start.
+func (p *Processor) SetOptions(opts ProcessorOptions) {
+	p.objectChannelLock.Lock()
+	defer p.objectChannelLock.Unlock()
+	p.opts = opts.withDefaults()
+}
+
 // RegisterClientWithObject registers a clientID and objectID with the processor.
 // This is used when an object is processed... it will contain a list of clients/channels
 // that need to get the results of the processing of a given object.
-// Will return inChan (specific for object) and results channel (specific for object+clientid combination) to caller.
-func (p *Processor) RegisterClientWithObject(clientID string, objectID string) (chan *proto.ObjectChange, chan *proto.ObjectConfirmation, error) {
+// Will return inChan (specific for object) and results queue (specific for object+clientid combination) to caller.
+func (p *Processor) RegisterClientWithObject(clientID string, objectID string) (chan *IncomingChange, *ClientQueue, error) {
 	p.objectChannelLock.Lock()
 	defer p.objectChannelLock.Unlock()
+	if p.closed {
+		return nil, nil, ErrProcessorClosed
+	}
 
 	var oc *ObjectIDChannels
 	var ok bool
 	if oc, ok = p.objectChannels[objectID]; !ok {
 		oc = &ObjectIDChannels{}
-		oc.inChannel = make(chan *proto.ObjectChange, 100000) // FIXME(kpfaulkner) configure 100000
-		oc.outChannels = make(map[string]chan *proto.ObjectConfirmation)
+		oc.inChannel = make(chan *IncomingChange, p.opts.ChangeBuffer)
+		oc.outChannels = make(map[string]*ClientQueue)
+		oc.state = newObjectState(objectID)
 		p.objectChannels[objectID] = oc
 
 		log.Debugf("creating process goroutine %s\n", objectID)
 
 		// this is a new object being processed, so start a go routine to process it.
-		go p.ProcessObjectChanges(objectID, oc.inChannel)
+		p.running.Add(1)
+		go func() {
+			defer p.running.Done()
+			p.ProcessObjectChanges(objectID, oc.inChannel, oc.state)
+		}()
+	} else if oc.idle != nil {
+		// had no clients, but still in memory.
+		oc.idle.Stop()
+		oc.idle = nil
 	} else {
 
 		// already registered... BUT... will allow this to proceed and not return error.
@@ -72,20 +156,14 @@ func (p *Processor) RegisterClientWithObject(clientID string, objectID string) (
 		log.Warnf("ProcessObjectChanges for objectID %s but already exists\n", objectID)
 	}
 
-	var clientObjectChannel chan *proto.ObjectConfirmation
-	if clientObjectChannel, ok = oc.outChannels[clientID]; !ok {
-		// create an out channel specific for the client. This will be used to send results.
-		oc.outChannels[clientID] = make(chan *proto.ObjectConfirmation, 100000) // FIXME(kpfaulkner) configure 100000
-		clientObjectChannel = oc.outChannels[clientID]
+	var clientQueue *ClientQueue
+	if clientQueue, ok = oc.outChannels[clientID]; !ok {
+		// create an out queue specific for the client. This will be used to send results.
+		clientQueue = newClientQueue(p.opts.MaxPending)
+		oc.outChannels[clientID] = clientQueue
 	}
 
-	// new client... populate with current state of object.
-	// FIXME(kpfaulkner) This is a problem. If the number of properties for this object is greater than the channel
-	// buffer size, then the channel will block, populateDocIntoClientChannel wont return...  and we're stuck in
-	// a deadlock with the defer NOT unlocking the lock. Need to fix this.
-	//p.populateDocIntoClientChannel(objectID, clientObjectChannel)
-
-	return oc.inChannel, clientObjectChannel, nil
+	return oc.inChannel, clientQueue, nil
 }
 
 // UnregisterClientWithObject unregister the clientid/objectid against the server.
@@ -96,15 +174,14 @@ func (p *Processor) UnregisterClientWithObject(clientID string, objectID string)
 	//log.Debugf("Unregistering client %s against object %s", clientID, objectID)
 
 	if oc, ok := p.objectChannels[objectID]; ok {
-		if clientOutChan, ok := oc.outChannels[clientID]; ok {
-			close(clientOutChan)
+		if clientQueue, ok := oc.outChannels[clientID]; ok {
+			clientQueue.Close()
 			delete(oc.outChannels, clientID)
 		}
 
-		// if no clients listening to channel... then close it. This will also stop the goroutine processing it.
-		if len(oc.outChannels) == 0 {
-			close(oc.inChannel)
-			delete(p.objectChannels, objectID)
+		// if no clients listening, the object is dropped once it's been idle for a while.
+		if len(oc.outChannels) == 0 && oc.idle == nil {
+			oc.idle = time.AfterFunc(p.opts.IdleTimeout, func() { p.evict(objectID, oc) })
 		}
 	} else {
 		return errors.New("attempting to unregister clientID/objectID but not registered")
@@ -113,46 +190,149 @@ func (p *Processor) UnregisterClientWithObject(clientID string, objectID string)
 	return nil
 }
 
+// evict drops an object that still has no clients. Closing the channel also stops the goroutine
+// processing it.
+func (p *Processor) evict(objectID string, oc *ObjectIDChannels) {
+	p.objectChannelLock.Lock()
+	defer p.objectChannelLock.Unlock()
+
+	// a client may have turned up since the timer fired.
+	if p.objectChannels[objectID] != oc || len(oc.outChannels) > 0 {
+		return
+	}
+	log.Debugf("evicting object %s (%d bytes)", objectID, oc.state.Size())
+	close(oc.inChannel)
+	delete(p.objectChannels, objectID)
+}
+
+// fail drops an object whose changes can't be stored. Its clients are cut off, so they reconnect
+// and send again whatever wasn't confirmed, and the next client to register loads it afresh.
+// Nothing reads inChan after this, clients blocked sending to it give up when they're cut off.
+func (p *Processor) fail(objectID string, inChan chan *IncomingChange, err error) {
+	p.objectChannelLock.Lock()
+	defer p.objectChannelLock.Unlock()
+
+	oc, ok := p.objectChannels[objectID]
+	if !ok || oc.inChannel != inChan {
+		return
+	}
+	if oc.idle != nil {
+		oc.idle.Stop()
+	}
+	for _, queue := range oc.outChannels {
+		queue.Fail(err)
+	}
+	delete(p.objectChannels, objectID)
+}
+
+// Close stops every object, once whatever is waiting in its channel has been written. Nothing may
+// be sending changes to the processor by then (all clients have to be finished). Returns the
+// context's error if it's done before everything is written.
+func (p *Processor) Close(ctx context.Context) error {
+	p.objectChannelLock.Lock()
+	if !p.closed {
+		p.closed = true
+		for objectID, oc := range p.objectChannels {
+			if oc.idle != nil {
+				oc.idle.Stop()
+			}
+			for _, queue := range oc.outChannels {
+				queue.Close()
+			}
+			close(oc.inChannel)
+			delete(p.objectChannels, objectID)
+		}
+	}
+	p.objectChannelLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Snapshot returns the current state of the object if it's active, false if it isn't (or couldn't
+// be loaded) and has to be read from storage.
+func (p *Processor) Snapshot(ctx context.Context, objectID string) (*storage.Object, bool, error) {
+	p.objectChannelLock.RLock()
+	oc, ok := p.objectChannels[objectID]
+	p.objectChannelLock.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	return oc.state.Snapshot(ctx)
+}
+
+// Stats returns the number of objects in memory, and roughly how much memory they use.
+func (p *Processor) Stats() ProcessorStats {
+	p.objectChannelLock.RLock()
+	defer p.objectChannelLock.RUnlock()
+	stats := ProcessorStats{Objects: len(p.objectChannels)}
+	for _, oc := range p.objectChannels {
+		stats.Bytes += oc.state.Size()
+	}
+	return stats
+}
+
+// most changes for one object taken off its channel and written in one go.
+const maxChangeGroup = 256
+
 // ProcessObjectChanges is purely for reading the incoming changes for a specific object
 // writing it to storage and then sending the results to all clients that are listening
-func (p *Processor) ProcessObjectChanges(objectID string, inChan chan *proto.ObjectChange) error {
+// Whatever has queued up for the object is written together, and nothing is confirmed to clients
+// until the writer says it's durable. The state is loaded first, and updated after each commit.
+func (p *Processor) ProcessObjectChanges(objectID string, inChan chan *IncomingChange, state *ObjectState) error {
+	state.load(context.Background(), p.db)
+	if state.err != nil {
+		log.Errorf("Unable to load objectID %s, snapshots will come from storage: %v", objectID, state.err)
+	}
 
 	t := time.Now()
 	count := 0
+	changes := make([]*IncomingChange, 0, maxChangeGroup)
+	ops := make([]storage.BatchOp, 0, maxChangeGroup)
 	for objChange := range inChan {
+		changes = takeQueued(inChan, append(changes[:0], objChange))
 
-		// do stuff.... then return result.
-		err := p.db.Add(objChange.ObjectId, objChange.PropertyId, objChange.Data)
-		if err != nil {
+		meta := storage.PropertyMetadata{LastModified: time.Now().UTC()}
+		ops = ops[:0]
+		for _, c := range changes {
+			meta.Author = c.Author
+			ops = append(ops, storage.BatchOp{ObjectID: c.ObjectId, PropertyID: c.PropertyId, Data: c.Data, Meta: meta})
+		}
+
+		if err := p.writer.Write(context.Background(), ops...); err != nil {
 			log.Errorf("Unable to add to DB for objectID %s : %+v", objectID, err)
+			p.fail(objectID, inChan, err)
 			return err
 		}
 
-		res := proto.ObjectConfirmation{}
-		res.ObjectId = objChange.ObjectId
-		res.PropertyId = objChange.PropertyId
-		res.UniqueId = objChange.UniqueId
-		res.Data = objChange.Data
-
-		// do a check for the objectID since the objects/clients might be nuked
-		// This might be a point of optimisation. Constantly checking that map is going to be expensive (gut feel, NOT
-		// measured). Could have a flag to indicate IF the clients registered for this object have changed.
-		// IF there is a change, then we read from map, otherwise we used something we've cached.
-		// FIXME(kpfaulkner) major problem!
-
-		p.objectChannelLock.Lock()
-		for _, oc := range p.objectChannels[objectID].outChannels {
-			select {
-			case oc <- &res:
-				// nothing...  body required
-			case <-time.After(5 * time.Millisecond):
-				// if we cannot send the data to the client for some reason... just drop the message?
-				log.Warnf("Unable to send to client. Channel full? Dropping message")
-			}
+		// before the confirmations go out, so a client registering in between sees the change in
+		// its snapshot or its confirmation (or both).
+		state.apply(ops)
+
+		for i, c := range changes {
+			res := proto.ObjectConfirmation{}
+			res.ObjectId = c.ObjectId
+			res.PropertyId = c.PropertyId
+			res.UniqueId = c.UniqueId
+			res.Data = c.Data
+			res.Sequence = c.Sequence
+			res.Signature = c.Signature
+			res.LastModified = ops[i].Meta.LastModified.UnixNano()
+			res.Author = ops[i].Meta.Author
+			p.sendConfirmation(objectID, &res)
 		}
-		p.objectChannelLock.Unlock()
+
 		// generate RPS stats
-		count++
+		count += len(changes)
 		if time.Now().Sub(t).Seconds() > 1 {
 			log.Debugf("ObjectID %s : rps %d", objectID, count)
 			t = time.Now()
@@ -161,3 +341,43 @@ func (p *Processor) ProcessObjectChanges(objectID string, inChan chan *proto.Obj
 	}
 	return nil
 }
+
+// takeQueued appends changes already waiting on the channel, without blocking.
+func takeQueued(inChan chan *IncomingChange, changes []*IncomingChange) []*IncomingChange {
+	for len(changes) < maxChangeGroup {
+		select {
+		case c, ok := <-inChan:
+			if !ok {
+				return changes
+			}
+			changes = append(changes, c)
+		default:
+			return changes
+		}
+	}
+	return changes
+}
+
+// sendConfirmation queues the confirmation for every client listening to the object. Never
+// blocks, slow clients get their updates conflated (or are cut off), see ClientQueue.
+func (p *Processor) sendConfirmation(objectID string, res *proto.ObjectConfirmation) {
+
+	// do a check for the objectID since the objects/clients might be nuked
+	// This might be a point of optimisation. Constantly checking that map is going to be expensive (gut feel, NOT
+	// measured). Could have a flag to indicate IF the clients registered for this object have changed.
+	// IF there is a change, then we read from map, otherwise we used something we've cached.
+
+	p.objectChannelLock.RLock()
+	defer p.objectChannelLock.RUnlock()
+
+	// all clients may have gone while draining the channel.
+	oc, ok := p.objectChannels[objectID]
+	if !ok {
+		return
+	}
+	for clientID, queue := range oc.outChannels {
+		if !queue.Push(res) {
+			log.Debugf("client %s needs to resync %s, not queueing", clientID, objectID)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -13,8 +16,7 @@ func TestRegisterClientWithObject(t *testing.T) {
 
 	// dummy DB... does nothing
 	nullDB, _ := storage.NewNullDB()
-	ch := make(chan proto.ObjectChange)
-	processor := NewProcessor(nullDB, ch)
+	processor := NewProcessor(nullDB, NewBatchWriter(nullDB, WriterOptions{}), ProcessorOptions{})
 
 	changeChannel, confirmationChannel, err := processor.RegisterClientWithObject("client1", "object1")
 	assert.Nil(t, err, "Should not have error when registering")
@@ -27,8 +29,7 @@ func TestRegisterClientWithObjectMultiple(t *testing.T) {
 
 	// dummy DB... does nothing
 	nullDB, _ := storage.NewNullDB()
-	ch := make(chan proto.ObjectChange)
-	processor := NewProcessor(nullDB, ch)
+	processor := NewProcessor(nullDB, NewBatchWriter(nullDB, WriterOptions{}), ProcessorOptions{})
 
 	changeChannel, confirmationChannel, err := processor.RegisterClientWithObject("client1", "object1")
 	assert.Nil(t, err, "Should not have error when registering")
@@ -49,8 +50,7 @@ func TestRegisterClientWithObjectMultipleForSameObject(t *testing.T) {
 
 	// dummy DB... does nothing
 	nullDB, _ := storage.NewNullDB()
-	ch := make(chan proto.ObjectChange)
-	processor := NewProcessor(nullDB, ch)
+	processor := NewProcessor(nullDB, NewBatchWriter(nullDB, WriterOptions{}), ProcessorOptions{})
 
 	changeChannel, confirmationChannel, err := processor.RegisterClientWithObject("client1", "object1")
 	assert.Nil(t, err, "Should not have error when registering")
@@ -73,8 +73,7 @@ func TestRegisterClientWithObjectMultipleForSameObjectSameClient(t *testing.T) {
 
 	// dummy DB... does nothing
 	nullDB, _ := storage.NewNullDB()
-	ch := make(chan proto.ObjectChange)
-	processor := NewProcessor(nullDB, ch)
+	processor := NewProcessor(nullDB, NewBatchWriter(nullDB, WriterOptions{}), ProcessorOptions{})
 
 	changeChannel, confirmationChannel, err := processor.RegisterClientWithObject("client1", "object1")
 	assert.Nil(t, err, "Should not have error when registering")
@@ -97,8 +96,7 @@ func TestUnregisterClientWithObjectSingle(t *testing.T) {
 
 	// dummy DB... does nothing
 	nullDB, _ := storage.NewNullDB()
-	ch := make(chan proto.ObjectChange)
-	processor := NewProcessor(nullDB, ch)
+	processor := NewProcessor(nullDB, NewBatchWriter(nullDB, WriterOptions{}), ProcessorOptions{})
 
 	changeChannel, confirmationChannel, err := processor.RegisterClientWithObject("client1", "object1")
 	assert.Nil(t, err, "Should not have error when registering")
@@ -114,8 +112,7 @@ func TestUnregisterClientWithObjectButNotRegistered(t *testing.T) {
 
 	// dummy DB... does nothing
 	nullDB, _ := storage.NewNullDB()
-	ch := make(chan proto.ObjectChange)
-	processor := NewProcessor(nullDB, ch)
+	processor := NewProcessor(nullDB, NewBatchWriter(nullDB, WriterOptions{}), ProcessorOptions{})
 
 	err := processor.UnregisterClientWithObject("client1", "object1")
 	assert.NotNil(t, err, "Should throw error if not registered")
@@ -124,29 +121,104 @@ func TestUnregisterClientWithObjectButNotRegistered(t *testing.T) {
 
 func TestProcessObjectChanges(t *testing.T) {
 	db, _ := NewFakeDB()
-	ch := make(chan proto.ObjectChange)
-	processor := NewProcessor(db, ch)
+	processor := NewProcessor(db, NewBatchWriter(db, WriterOptions{}), ProcessorOptions{})
 
 	changeChannel, confirmationChannel, err := processor.RegisterClientWithObject("client1", "object1")
 	assert.Nil(t, err, "Should not have error when registering")
 	assert.NotNil(t, changeChannel, "Should have change channel")
 	assert.NotNil(t, confirmationChannel, "Should have confirmation channel")
-	assert.EqualValues(t, 0, len(confirmationChannel), "Should have no confirmation messages")
+	assert.EqualValues(t, 0, confirmationChannel.Len(), "Should have no confirmation messages")
 
 	testChange := proto.ObjectChange{
 		ObjectId:   "object1",
 		PropertyId: "prop1",
 		Data:       []byte("prop1value"),
 	}
-	changeChannel <- &testChange
+	changeChannel <- &IncomingChange{ObjectChange: &testChange, Author: "alice"}
 
 	//err = processor.ProcessObjectChanges("object1", changeChannel)
 	//assert.Nil(t, err, "Should not have error when sending object changes")
-	//assert.EqualValues(t, 1, len(confirmationChannel), "Should have one confirmation message")
+	//assert.EqualValues(t, 1, confirmationChannel.Len(), "Should have one confirmation message")
 
 	time.Sleep(2 * time.Second) // hack.. timing sucketh.
 
-	obj, err := db.Get("object1")
+	obj, err := db.Get(context.Background(), "object1")
 	assert.Nil(t, err, "Should not have error when getting object")
 	assert.EqualValues(t, "prop1value", string(obj.Properties["prop1"]), "Should have correct property value")
+	assert.EqualValues(t, "alice", obj.Metadata["prop1"].Author, "Should store author")
+	assert.False(t, obj.Metadata["prop1"].LastModified.IsZero(), "Should store last modified")
+
+	conf, err := confirmationChannel.Next(context.Background())
+	assert.Nil(t, err)
+	assert.EqualValues(t, "alice", conf.Author, "Confirmation should have author")
+	assert.EqualValues(t, obj.Metadata["prop1"].LastModified.UnixNano(), conf.LastModified, "Confirmation should have last modified")
+}
+
+func TestSetOptionsAppliesToNewClients(t *testing.T) {
+	nullDB, _ := storage.NewNullDB()
+	processor := NewProcessor(nullDB, NewBatchWriter(nullDB, WriterOptions{}), ProcessorOptions{})
+
+	_, before, _ := processor.RegisterClientWithObject("client1", "object1")
+	processor.SetOptions(ProcessorOptions{MaxPending: 1})
+	_, after, _ := processor.RegisterClientWithObject("client2", "object1")
+
+	for _, prop := range []string{"colour", "shape"} {
+		before.Push(&proto.ObjectConfirmation{ObjectId: "object1", PropertyId: prop})
+		after.Push(&proto.ObjectConfirmation{ObjectId: "object1", PropertyId: prop})
+	}
+	assert.EqualValues(t, 2, before.Len(), "Existing clients should keep their limit")
+	_, err := after.Next(context.Background())
+	assert.ErrorIs(t, err, ErrResyncRequired, "New clients should get the new limit")
+}
+
+func TestCloseWritesQueuedChanges(t *testing.T) {
+	db, _ := NewFakeDB()
+	writer := NewBatchWriter(db, WriterOptions{})
+	processor := NewProcessor(db, writer, ProcessorOptions{})
+
+	changeChannel, _, err := processor.RegisterClientWithObject("client1", "object1")
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		change := &proto.ObjectChange{ObjectId: "object1", PropertyId: fmt.Sprintf("prop%d", i), Data: []byte("x")}
+		changeChannel <- &IncomingChange{ObjectChange: change}
+	}
+
+	assert.Nil(t, processor.Close(context.Background()))
+	obj, err := db.Get(context.Background(), "object1")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1000, len(obj.Properties), "Everything queued should be written")
+
+	_, _, err = processor.RegisterClientWithObject("client1", "object1")
+	assert.ErrorIs(t, err, ErrProcessorClosed)
+}
+
+func TestWriteFailureCutsOffClients(t *testing.T) {
+	db, _ := NewFakeDB()
+	db.err = errors.New("disk on fire")
+	processor := NewProcessor(db, NewBatchWriter(db, WriterOptions{}), ProcessorOptions{})
+
+	changeChannel, queue1, err := processor.RegisterClientWithObject("client1", "object1")
+	assert.Nil(t, err)
+	_, queue2, err := processor.RegisterClientWithObject("client2", "object1")
+	assert.Nil(t, err)
+	changeChannel <- &IncomingChange{ObjectChange: &proto.ObjectChange{ObjectId: "object1", PropertyId: "prop1", Data: []byte("x")}}
+
+	for _, queue := range []*ClientQueue{queue1, queue2} {
+		select {
+		case <-queue.CutOff():
+		case <-time.After(5 * time.Second):
+			t.Fatal("client should be cut off")
+		}
+		_, err := queue.Next(context.Background())
+		assert.ErrorContains(t, err, "disk on fire")
+	}
+	assert.EqualValues(t, 0, processor.Stats().Objects, "Failed object should be dropped")
+
+	db.lock.Lock()
+	db.err = nil
+	db.lock.Unlock()
+	newChannel, _, err := processor.RegisterClientWithObject("client1", "object1")
+	assert.Nil(t, err)
+	assert.NotEqual(t, changeChannel, newChannel, "Should start the object again")
+	assert.Nil(t, processor.Close(context.Background()))
 }
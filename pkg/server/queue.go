@@ -0,0 +1,180 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/kpfaulkner/collablite/proto"
+)
+
+var (
+	// ErrResyncRequired means the client fell so far behind its confirmations were thrown away. It
+	// has to get the whole object again.
+	ErrResyncRequired = errors.New("resync required, client fell too far behind")
+
+	errQueueClosed = errors.New("queue closed")
+)
+
+const defaultMaxPending = 100000
+
+// ClientQueue holds the confirmations waiting to be sent to one client. It never blocks the
+// processor: if the client is behind and there's already an update waiting for a property, the
+// new one replaces it (the client only needs the latest value). Only if there are more than
+// maxPending waiting anyway does the client get cut off, with ErrResyncRequired.
+//
+// The client's own confirmations are never replaced, it counts them to know which of its changes
+// have been confirmed.
+type ClientQueue struct {
+	maxPending int
+
+	lock    sync.Mutex
+	pending *list.List               // of *proto.ObjectConfirmation, oldest first.
+	latest  map[string]*list.Element // property ID -> waiting update that can be replaced.
+	owner   string
+	closed  bool
+
+	// why the client was cut off, ErrResyncRequired or the error that stopped the object.
+	err error
+
+	// has something in it when there's something for Next.
+	ready chan struct{}
+
+	// closed when the client is cut off.
+	cutOff chan struct{}
+}
+
+func newClientQueue(maxPending int) *ClientQueue {
+	return &ClientQueue{
+		maxPending: maxPending,
+		pending:    list.New(),
+		latest:     make(map[string]*list.Element),
+		ready:      make(chan struct{}, 1),
+		cutOff:     make(chan struct{}),
+	}
+}
+
+// SetOwner sets the unique ID the client uses for its own changes.
+func (q *ClientQueue) SetOwner(uniqueID string) {
+	q.lock.Lock()
+	q.owner = uniqueID
+	q.lock.Unlock()
+}
+
+func (q *ClientQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Push queues a confirmation for the client. Returns false if the client has been cut off (or
+// the queue closed).
+func (q *ClientQueue) Push(conf *proto.ObjectConfirmation) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed || q.err != nil {
+		return false
+	}
+
+	// an older update still waiting is out of date now, whoever this one is from.
+	if elem, ok := q.latest[conf.PropertyId]; ok {
+		q.pending.Remove(elem)
+		delete(q.latest, conf.PropertyId)
+	}
+
+	elem := q.pending.PushBack(conf)
+	if conf.UniqueId != q.owner || q.owner == "" {
+		q.latest[conf.PropertyId] = elem
+	}
+
+	if q.pending.Len() > q.maxPending {
+		q.cut(ErrResyncRequired)
+	}
+	q.signal()
+	return q.err == nil
+}
+
+// Fail cuts the client off because the object it's working on has stopped, eg. its changes
+// couldn't be stored.
+func (q *ClientQueue) Fail(err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed || q.err != nil {
+		return
+	}
+	q.cut(err)
+	q.signal()
+}
+
+// cut throws away what's waiting, the client has to get the whole object again. Called with the
+// lock held.
+func (q *ClientQueue) cut(err error) {
+	q.err = err
+	q.pending.Init()
+	q.latest = make(map[string]*list.Element)
+	close(q.cutOff)
+}
+
+// Next waits for the next confirmation. Returns why if the client was cut off (see Err), or
+// errQueueClosed once closed and everything has been taken.
+func (q *ClientQueue) Next(ctx context.Context) (*proto.ObjectConfirmation, error) {
+	for {
+		q.lock.Lock()
+		if q.err != nil {
+			err := q.err
+			q.lock.Unlock()
+			return nil, err
+		}
+		if front := q.pending.Front(); front != nil {
+			conf := q.pending.Remove(front).(*proto.ObjectConfirmation)
+			if q.latest[conf.PropertyId] == front {
+				delete(q.latest, conf.PropertyId)
+			}
+			q.lock.Unlock()
+			return conf, nil
+		}
+		closed := q.closed
+		q.lock.Unlock()
+		if closed {
+			return nil, errQueueClosed
+		}
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// CutOff is closed when the client falls too far behind and has to resync, or the object fails.
+// The sender may well be stuck sending to the client, so this is how whoever owns the stream
+// finds out.
+func (q *ClientQueue) CutOff() <-chan struct{} {
+	return q.cutOff
+}
+
+// Err is why the client was cut off: ErrResyncRequired, or the error that stopped the object.
+// Nil if it hasn't been.
+func (q *ClientQueue) Err() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.err
+}
+
+// Len is how many confirmations are waiting.
+func (q *ClientQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.pending.Len()
+}
+
+// Close stops the queue taking more, Next returns what's left then errQueueClosed.
+func (q *ClientQueue) Close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+	q.signal()
+}
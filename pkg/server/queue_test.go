@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func confirmation(uniqueID string, propertyID string, data string) *proto.ObjectConfirmation {
+	return &proto.ObjectConfirmation{ObjectId: "object1", PropertyId: propertyID, Data: []byte(data), UniqueId: uniqueID}
+}
+
+// drain takes everything waiting, as "uniqueID property=data".
+func drain(t *testing.T, q *ClientQueue) []string {
+	var out []string
+	for q.Len() > 0 {
+		conf, err := q.Next(context.Background())
+		require.Nil(t, err)
+		out = append(out, fmt.Sprintf("%s %s=%s", conf.UniqueId, conf.PropertyId, conf.Data))
+	}
+	return out
+}
+
+func TestClientQueueConflates(t *testing.T) {
+	q := newClientQueue(100)
+	q.SetOwner("me")
+
+	q.Push(confirmation("other", "colour", "red"))
+	q.Push(confirmation("other", "size", "1"))
+	q.Push(confirmation("me", "colour", "green"))
+	q.Push(confirmation("me", "colour", "blue"))
+	q.Push(confirmation("other", "colour", "black"))
+	q.Push(confirmation("other", "size", "2"))
+
+	// the client's own confirmations all arrive, older values from others are replaced, and the
+	// last value for each property is the last one pushed.
+	assert.EqualValues(t, []string{"me colour=green", "me colour=blue", "other colour=black", "other size=2"}, drain(t, q))
+}
+
+func TestClientQueueCutsOffWhenFull(t *testing.T) {
+	q := newClientQueue(3)
+	q.SetOwner("me")
+
+	// updates to the same property never fill it up.
+	for i := 0; i < 10; i++ {
+		assert.True(t, q.Push(confirmation("other", "colour", fmt.Sprint(i))))
+	}
+	assert.EqualValues(t, 1, q.Len())
+
+	assert.True(t, q.Push(confirmation("other", "size", "1")))
+	assert.True(t, q.Push(confirmation("me", "colour", "mine")))
+	assert.True(t, q.Push(confirmation("me", "colour", "mine again")))
+	assert.EqualValues(t, 3, q.Len())
+	assert.False(t, q.Push(confirmation("other", "shape", "square")))
+
+	select {
+	case <-q.CutOff():
+	default:
+		t.Fatal("Should be cut off")
+	}
+	_, err := q.Next(context.Background())
+	assert.ErrorIs(t, err, ErrResyncRequired)
+}
+
+func TestClientQueueClose(t *testing.T) {
+	q := newClientQueue(10)
+	q.Push(confirmation("other", "colour", "red"))
+	q.Close()
+	assert.False(t, q.Push(confirmation("other", "size", "1")), "Closed queue should take nothing")
+
+	conf, err := q.Next(context.Background())
+	require.Nil(t, err, "Should get what was already queued")
+	assert.EqualValues(t, "red", conf.Data)
+	_, err = q.Next(context.Background())
+	assert.ErrorIs(t, err, errQueueClosed)
+}
+
+// blockingStream is a client that sends changes then never reads its confirmations.
+type blockingStream struct {
+	fakeServerStream
+	ctx context.Context
+}
+
+func (b *blockingStream) Context() context.Context {
+	return b.ctx
+}
+
+func (b *blockingStream) Recv() (*proto.ObjectChange, error) {
+	if len(b.changes) == 0 {
+		<-b.ctx.Done()
+		return nil, b.ctx.Err()
+	}
+	return b.fakeServerStream.Recv()
+}
+
+func (b *blockingStream) Send(confirmation *proto.ObjectConfirmation) error {
+	<-b.ctx.Done()
+	return b.ctx.Err()
+}
+
+func TestSlowClientToldToResync(t *testing.T) {
+	db, _ := NewFakeDB()
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{MaxPending: 5})
+	defer cls.Close()
+
+	var changes []*proto.ObjectChange
+	for i := 0; i < 20; i++ {
+		changes = append(changes, &proto.ObjectChange{ObjectId: "object1", PropertyId: fmt.Sprintf("prop%d", i), Data: []byte("x"), UniqueId: "client1"})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := cls.ProcessObjectChanges(&blockingStream{fakeServerStream: fakeServerStream{changes: changes}, ctx: ctx})
+	assert.EqualValues(t, codes.ResourceExhausted, status.Code(err), "Should be told to resync, got %v", err)
+}
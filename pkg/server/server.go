@@ -2,12 +2,20 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"sync"
 
 	"github.com/google/uuid"
+	"github.com/kpfaulkner/collablite/pkg/signing"
 	"github.com/kpfaulkner/collablite/pkg/storage"
 	"github.com/kpfaulkner/collablite/proto"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 // CollabLiteServer receives gRPC requests from clients and modifies the
@@ -18,34 +26,129 @@ type CollabLiteServer struct {
 
 	processor *Processor
 
-	// channel specifically for DB writing
-	// Will probably need to do something for sqlite multithreaded support, but
-	// will try this for now.
-	dbWriterChannel chan proto.ObjectChange
+	// all writes go through here, see BatchWriter.
+	writer *BatchWriter
+
+	// optional registry of client public keys. If set, signatures are checked before changes are stored.
+	keysLock sync.RWMutex
+	keys     *signing.KeyRegistry
+
+	// sequences seen from signed clients, kept while signing is turned off so they're still there
+	// if it's turned back on.
+	sequences *signing.Sequences
+
+	// closed when shutting down, streams stop taking changes and end.
+	shutdown     chan struct{}
+	streamsLock  sync.Mutex
+	shuttingDown bool
+	streams      sync.WaitGroup
 }
 
+// errShuttingDown is what clients are told when the server is shutting down. Unavailable, so they
+// know to reconnect (to this server once restarted, or another one).
+var errShuttingDown = status.Error(codes.Unavailable, "server shutting down, reconnect")
+
 // NewCollabLiteServer create instance of CollabLiteServer with supplied DB client
-func NewCollabLiteServer(db storage.DB) *CollabLiteServer {
+func NewCollabLiteServer(db storage.DB, writerOpts WriterOptions, processorOpts ProcessorOptions) *CollabLiteServer {
 	cls := CollabLiteServer{}
 	cls.db = db
+	cls.writer = NewBatchWriter(db, writerOpts)
+	cls.processor = NewProcessor(db, cls.writer, processorOpts)
+	cls.shutdown = make(chan struct{})
+	return &cls
+}
 
-	// can make buffered and solve lots of perf issues... BUT...  means possible loss of data.
-	cls.dbWriterChannel = make(chan proto.ObjectChange) // NOT A BUFFERED CHANNEL ON PURPOSE!
-	cls.processor = NewProcessor(db, cls.dbWriterChannel)
+// Close shuts down without a deadline, see Shutdown.
+func (cls *CollabLiteServer) Close() error {
+	return cls.Shutdown(context.Background())
+}
 
-	go cls.startDBWriter(cls.dbWriterChannel)
-	return &cls
+// Shutdown stops taking changes and tells every client to reconnect, then waits for what has
+// already been received to be written. The DB is left open, it belongs to the caller. Returns the
+// context's error if it's done first, in which case some changes may not have been written.
+func (cls *CollabLiteServer) Shutdown(ctx context.Context) error {
+	cls.streamsLock.Lock()
+	if !cls.shuttingDown {
+		cls.shuttingDown = true
+		close(cls.shutdown)
+	}
+	cls.streamsLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		cls.streams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for clients to finish: %w", ctx.Err())
+	}
+
+	// nothing is sending changes any more, so everything queued can be written.
+	if err := cls.processor.Close(ctx); err != nil {
+		return fmt.Errorf("writing queued changes: %w", err)
+	}
+	return cls.writer.Close()
+}
+
+// startStream records that a stream is running, false if shutting down.
+func (cls *CollabLiteServer) startStream() bool {
+	cls.streamsLock.Lock()
+	defer cls.streamsLock.Unlock()
+	if cls.shuttingDown {
+		return false
+	}
+	cls.streams.Add(1)
+	return true
 }
 
-// startDBWriter reads the change channel, writes to the DB.
-func (cls *CollabLiteServer) startDBWriter(changeCh chan proto.ObjectChange) error {
-	for change := range changeCh {
-		err := cls.db.Add(change.ObjectId, change.PropertyId, change.Data)
-		if err != nil {
-			log.Errorf("unable to add object %s : %s to db", change.ObjectId, change.PropertyId)
+// SetKeyRegistry enables signature verification of incoming changes, or disables it if nil. Can be
+// called while serving, changes received after it returns are checked against the new keys. The
+// new registry keeps the sequences seen by any before it, so replacing the keys (or turning
+// signing off and on again) doesn't let changes be replayed.
+func (cls *CollabLiteServer) SetKeyRegistry(keys *signing.KeyRegistry) {
+	cls.keysLock.Lock()
+	defer cls.keysLock.Unlock()
+	if keys != nil {
+		if cls.sequences == nil {
+			cls.sequences = keys.Sequences()
+		} else {
+			keys.UseSequences(cls.sequences)
 		}
 	}
-	return nil
+	cls.keys = keys
+}
+
+// SetSequences sets where the sequences of signed changes are kept, eg. a file from
+// signing.OpenSequences so they survive a restart. Should be called before serving, any already
+// seen are not carried over.
+func (cls *CollabLiteServer) SetSequences(sequences *signing.Sequences) {
+	cls.keysLock.Lock()
+	defer cls.keysLock.Unlock()
+	cls.sequences = sequences
+	if cls.keys != nil {
+		cls.keys.UseSequences(sequences)
+	}
+}
+
+func (cls *CollabLiteServer) keyRegistry() *signing.KeyRegistry {
+	cls.keysLock.RLock()
+	defer cls.keysLock.RUnlock()
+	return cls.keys
+}
+
+// SetOptions changes the writer and processor options while serving, see BatchWriter.SetOptions
+// and Processor.SetOptions for when they take effect. Existing streams carry on as they are.
+func (cls *CollabLiteServer) SetOptions(writerOpts WriterOptions, processorOpts ProcessorOptions) {
+	cls.writer.SetOptions(writerOpts)
+	cls.processor.SetOptions(processorOpts)
+}
+
+// received is a message (or error) from the client's stream.
+type received struct {
+	change *proto.ObjectChange
+	err    error
 }
 
 // ProcessObjectChanges main loop of processing object changes.
@@ -53,85 +156,241 @@ func (cls *CollabLiteServer) startDBWriter(changeCh chan proto.ObjectChange) err
 //   - Receive change from client
 //   - If new objectID, then register client against new Object
 //   - If new objectID unregister client from old object
-//   - If new objectID start a goroutine to read from client specific channel and send to client over gRPC
+//   - If new objectID start a goroutine to read from client specific queue and send to client over gRPC
 //   - Send the change to be processed via channel.
+//
+// If the client falls so far behind that its confirmations are thrown away, the stream ends with
+// ResourceExhausted and the client has to get the object again. When the server shuts down it ends
+// with Unavailable, the client should reconnect.
 func (cls *CollabLiteServer) ProcessObjectChanges(stream proto.CollabLite_ProcessObjectChangesServer) error {
+	if !cls.startStream() {
+		return errShuttingDown
+	}
+	defer cls.streams.Done()
 
 	incomingChangeCount := 0
 	clientID := uuid.New().String()
 
+	// if the client has authenticated (mTLS) then that's who the changes are from.
+	principal := principalFromContext(stream.Context())
+
 	// current* are used to push/receive changes from RPC stream to code that will
 	// actually process the changes and return the results.
 	var currentObjectID string
-	var currentResultChannel chan *proto.ObjectConfirmation
-	var currentProcessChannel chan *proto.ObjectChange
+	var currentResultQueue *ClientQueue
+	var currentProcessChannel chan *IncomingChange
 
+	// receiving happens in its own goroutine so a send goroutine can end the stream.
+	done := make(chan struct{})
+	defer close(done)
+	incoming := make(chan received)
+	go func() {
+		for {
+			objChange, err := stream.Recv()
+			select {
+			case incoming <- received{change: objChange, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
 	for {
 
-		objChange, err := stream.Recv()
-		if err == io.EOF {
-			// Change this to attempt reconnect (if server crashed). TODO(kpfaulkner)
-			cls.processor.UnregisterClientWithObject(clientID, currentObjectID)
-			return nil
+		// nil (so never ready) until registered with an object.
+		var cutOff <-chan struct{}
+		if currentResultQueue != nil {
+			cutOff = currentResultQueue.CutOff()
 		}
-		if err != nil {
-			// Change this to attempt reconnect (if server crashed). TODO(kpfaulkner)
+
+		var objChange *proto.ObjectChange
+		select {
+		case r := <-incoming:
+			if r.err == io.EOF {
+				// Change this to attempt reconnect (if server crashed). TODO(kpfaulkner)
+				cls.processor.UnregisterClientWithObject(clientID, currentObjectID)
+				return nil
+			}
+			if r.err != nil {
+				// Change this to attempt reconnect (if server crashed). TODO(kpfaulkner)
+				cls.processor.UnregisterClientWithObject(clientID, currentObjectID)
+				return r.err
+			}
+			objChange = r.change
+		case <-cutOff:
+			return cls.cutOff(clientID, currentObjectID, currentResultQueue)
+		case <-cls.shutdown:
 			cls.processor.UnregisterClientWithObject(clientID, currentObjectID)
-			return err
+			return errShuttingDown
 		}
 		incomingChangeCount++
 
+		if storage.IsReservedID(objChange.ObjectId) {
+			log.Warnf("rejecting change for reserved object ID %q from client %s", objChange.ObjectId, clientID)
+			cls.processor.UnregisterClientWithObject(clientID, currentObjectID)
+			return status.Error(codes.InvalidArgument, storage.ErrReservedID.Error())
+		}
+
+		// reject anything not signed by who it claims to be from, before it gets anywhere near the DB.
+		if keys := cls.keyRegistry(); keys != nil {
+			if err := keys.VerifyChange(objChange); err != nil {
+				log.Warnf("rejecting change for object %s: %v", objChange.ObjectId, err)
+				cls.processor.UnregisterClientWithObject(clientID, currentObjectID)
+				return status.Error(codes.PermissionDenied, err.Error())
+			}
+		}
+
 		// if not currentObjectID then go get channels for this objectID
 		if objChange.ObjectId != currentObjectID {
 
 			// Register this client against the ObjectID.
 			// RegisterClientWithObject also spins up a goroutine for processing changes associated with the object
 			// IF one does not already exist.
-			inChan, outChan, err := cls.processor.RegisterClientWithObject(clientID, objChange.ObjectId)
+			inChan, outQueue, err := cls.processor.RegisterClientWithObject(clientID, objChange.ObjectId)
+			if errors.Is(err, ErrProcessorClosed) {
+				cls.processor.UnregisterClientWithObject(clientID, currentObjectID)
+				return errShuttingDown
+			}
 			if err != nil {
 				return err
 			}
+			outQueue.SetOwner(objChange.UniqueId)
 
 			// unregister the old client/object
 			cls.processor.UnregisterClientWithObject(clientID, currentObjectID)
 
 			currentObjectID = objChange.ObjectId
-			currentResultChannel = outChan
+			currentResultQueue = outQueue
 			currentProcessChannel = inChan
 
-			// Goroutine is specific to this client. Read the outChan and send to client.
-			// Outchan is populated by ProcessObjectChanges
-			go func(outChan chan *proto.ObjectConfirmation, clientID string) {
-				log.Debugf("starting send goroutine for objectID %s", currentObjectID)
-				for msg := range outChan {
+			// Goroutine is specific to this client. Read the queue and send to client.
+			// The queue is populated by ProcessObjectChanges
+			go func(outQueue *ClientQueue, objectID string) {
+				log.Debugf("starting send goroutine for objectID %s", objectID)
+				for {
+					// closed, or the client has been cut off and the stream is ending.
+					msg, err := outQueue.Next(stream.Context())
+					if err != nil {
+						break
+					}
 					if err := stream.Send(msg); err != nil {
 						log.Errorf("unable to send message to client: %v", err)
 						return
 					}
 				}
-				log.Debugf("Sending send goroutine for objectID %s", currentObjectID)
-			}(currentResultChannel, clientID)
+				log.Debugf("Sending send goroutine for objectID %s", objectID)
+			}(currentResultQueue, currentObjectID)
 		}
 
 		// send change to be stored and processed.
 		// Potential blocking point. FIXME(kpfaulkner) investigate
-		currentProcessChannel <- objChange
+		author := principal
+		if author == "" {
+			author = objChange.UniqueId
+		}
+		select {
+		case currentProcessChannel <- &IncomingChange{ObjectChange: objChange, Author: author}:
+		case <-currentResultQueue.CutOff():
+			// the object may have stopped, nothing will take the change.
+			return cls.cutOff(clientID, currentObjectID, currentResultQueue)
+		case <-cls.shutdown:
+			// never confirmed, so the client still has it to send again.
+			cls.processor.UnregisterClientWithObject(clientID, currentObjectID)
+			return errShuttingDown
+		}
 	}
+}
 
-	return nil
+// cutOff ends the stream of a client whose queue has been cut off, with a status telling it why.
+func (cls *CollabLiteServer) cutOff(clientID string, objectID string, queue *ClientQueue) error {
+	cls.processor.UnregisterClientWithObject(clientID, objectID)
+	err := queue.Err()
+	if errors.Is(err, ErrResyncRequired) {
+		log.Warnf("client %s fell too far behind on object %s, telling it to resync", clientID, objectID)
+		return status.Error(codes.ResourceExhausted, ErrResyncRequired.Error())
+	}
+	log.Errorf("object %s stopped, ending stream for client %s: %v", objectID, clientID, err)
+	return status.Error(codes.Unavailable, fmt.Sprintf("object %s unavailable, reconnect", objectID))
 }
 
-// GetObject retrieves an entire object from the DB and returns it
-// via gRPC
+// GetObject retrieves an entire object and returns it via gRPC. Objects being edited come from
+// memory, anything else from the DB.
 func (cls *CollabLiteServer) GetObject(ctx context.Context, req *proto.GetRequest) (*proto.GetResponse, error) {
+	if storage.IsReservedID(req.ObjectId) {
+		return nil, status.Error(codes.InvalidArgument, storage.ErrReservedID.Error())
+	}
 
-	obj, err := cls.db.Get(req.ObjectId)
+	obj, ok, err := cls.processor.Snapshot(ctx, req.ObjectId)
 	if err != nil {
-		return nil, err
+		return nil, storageStatus(err)
+	}
+	if ok && len(obj.Properties) == 0 {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("object %s: %v", req.ObjectId, storage.ErrNotFound))
+	}
+	if !ok {
+		if obj, err = cls.db.Get(ctx, req.ObjectId); err != nil {
+			return nil, storageStatus(err)
+		}
 	}
 
 	resp := &proto.GetResponse{}
 	resp.ObjectId = obj.ObjectID
 	resp.Properties = obj.Properties
+	resp.Metadata = make(map[string]*proto.PropertyMetadata, len(obj.Metadata))
+	for k, meta := range obj.Metadata {
+		pm := &proto.PropertyMetadata{Author: meta.Author}
+		if !meta.LastModified.IsZero() {
+			pm.LastModified = meta.LastModified.UnixNano()
+		}
+		resp.Metadata[k] = pm
+	}
 	return resp, nil
 }
+
+// storageStatus converts storage errors into gRPC status errors so clients can tell a missing
+// object from a broken server.
+func storageStatus(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, storage.ErrConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, storage.ErrReservedID):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, storage.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	log.Errorf("storage error: %v", err)
+	return status.Error(codes.Internal, "storage error")
+}
+
+// principalFromContext returns the identity of the client from its verified TLS certificate.
+// Returns empty string if the client hasn't authenticated.
+func principalFromContext(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return ""
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	cert := tlsInfo.State.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
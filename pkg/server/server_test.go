@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/signing"
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	"github.com/kpfaulkner/collablite/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// fakeServerStream feeds the server a fixed list of changes then EOF.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	changes []*proto.ObjectChange
+}
+
+func (f *fakeServerStream) Context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+	return f.ctx
+}
+
+func (f *fakeServerStream) Recv() (*proto.ObjectChange, error) {
+	if len(f.changes) == 0 {
+		return nil, io.EOF
+	}
+	c := f.changes[0]
+	f.changes = f.changes[1:]
+	return c, nil
+}
+
+func (f *fakeServerStream) Send(confirmation *proto.ObjectConfirmation) error {
+	return nil
+}
+
+func TestRejectsInvalidSignature(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+	keys := signing.NewKeyRegistry(false)
+	keys.Register("client1", pub)
+
+	db, _ := NewFakeDB()
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{})
+	cls.SetKeyRegistry(keys)
+
+	forged := &proto.ObjectChange{ObjectId: "object1", PropertyId: "colour", Data: []byte("blue"), UniqueId: "client1"}
+	signing.Sign(otherPriv, forged, 1)
+
+	err := cls.ProcessObjectChanges(&fakeServerStream{changes: []*proto.ObjectChange{forged}})
+	assert.EqualValues(t, codes.PermissionDenied, status.Code(err), "Should reject forged change")
+
+	_, err = db.Get(context.Background(), "object1")
+	assert.NotNil(t, err, "Forged change should not be stored")
+}
+
+func TestConfirmationKeepsSignature(t *testing.T) {
+	db, _ := NewFakeDB()
+	processor := NewProcessor(db, NewBatchWriter(db, WriterOptions{}), ProcessorOptions{})
+	inChan, outChan, _ := processor.RegisterClientWithObject("client1", "object1")
+
+	_, priv, _ := ed25519.GenerateKey(nil)
+	change := &proto.ObjectChange{ObjectId: "object1", PropertyId: "colour", Data: []byte("red"), UniqueId: "client1"}
+	signing.Sign(priv, change, 7)
+	inChan <- &IncomingChange{ObjectChange: change, Author: "client1"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conf, err := outChan.Next(ctx)
+	if err != nil {
+		t.Fatal("Should have confirmation")
+	}
+	assert.EqualValues(t, change.Signature, conf.Signature, "Signature should be passed to clients")
+	assert.EqualValues(t, uint64(7), conf.Sequence)
+}
+
+func TestPrincipalFromContext(t *testing.T) {
+	assert.EqualValues(t, "", principalFromContext(context.Background()), "No peer should have no principal")
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+	assert.EqualValues(t, "alice", principalFromContext(ctx), "Should use verified certificate")
+
+	ctx = peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}})
+	assert.EqualValues(t, "", principalFromContext(ctx), "Unverified TLS should have no principal")
+}
+
+func TestRejectsReservedObjectIDs(t *testing.T) {
+	db, _ := NewFakeDB()
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{})
+	defer cls.Close()
+
+	change := &proto.ObjectChange{ObjectId: "\x00datakey:object1", PropertyId: "key", Data: []byte("attacker"), UniqueId: "client1"}
+	err := cls.ProcessObjectChanges(&fakeServerStream{changes: []*proto.ObjectChange{change}})
+	assert.EqualValues(t, codes.InvalidArgument, status.Code(err), "Should reject write to reserved ID")
+	_, err = db.Get(context.Background(), change.ObjectId)
+	assert.NotNil(t, err, "Reserved object should not be stored")
+
+	_, err = cls.GetObject(context.Background(), &proto.GetRequest{ObjectId: change.ObjectId})
+	assert.EqualValues(t, codes.InvalidArgument, status.Code(err), "Should reject read of reserved ID")
+}
+
+func TestGetObjectMetadata(t *testing.T) {
+	db, _ := NewFakeDB()
+	now := time.Now().UTC()
+	db.Add(context.Background(), "object1", "colour", []byte("red"), storage.PropertyMetadata{LastModified: now, Author: "alice"})
+
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{})
+	resp, err := cls.GetObject(context.Background(), &proto.GetRequest{ObjectId: "object1"})
+	assert.Nil(t, err)
+	assert.EqualValues(t, "alice", resp.Metadata["colour"].Author)
+	assert.EqualValues(t, now.UnixNano(), resp.Metadata["colour"].LastModified)
+}
+
+func TestGetObjectStatusCodes(t *testing.T) {
+	db, _ := NewFakeDB()
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{})
+
+	_, err := cls.GetObject(context.Background(), &proto.GetRequest{ObjectId: "missing"})
+	assert.EqualValues(t, codes.NotFound, status.Code(err))
+
+	db.err = fmt.Errorf("disk on fire: %w", storage.ErrClosed)
+	_, err = cls.GetObject(context.Background(), &proto.GetRequest{ObjectId: "missing"})
+	assert.EqualValues(t, codes.Unavailable, status.Code(err))
+
+	db.err = errors.New("disk on fire")
+	_, err = cls.GetObject(context.Background(), &proto.GetRequest{ObjectId: "missing"})
+	assert.EqualValues(t, codes.Internal, status.Code(err))
+	assert.NotContains(t, err.Error(), "disk on fire", "Internal details shouldn't leak to clients")
+}
+
+func TestShutdownTellsClientsToReconnect(t *testing.T) {
+	db, _ := NewFakeDB()
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	change := &proto.ObjectChange{ObjectId: "object1", PropertyId: "colour", Data: []byte("red"), UniqueId: "client1"}
+	ended := make(chan error, 1)
+	go func() {
+		ended <- cls.ProcessObjectChanges(&blockingStream{fakeServerStream: fakeServerStream{changes: []*proto.ObjectChange{change}}, ctx: ctx})
+	}()
+
+	// once it's been stored, so the client is registered with the object.
+	assert.Eventually(t, func() bool {
+		_, err := db.Get(context.Background(), "object1")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, cls.Shutdown(ctx))
+	assert.EqualValues(t, codes.Unavailable, status.Code(<-ended), "Client should be told to reconnect")
+
+	err := cls.ProcessObjectChanges(&fakeServerStream{changes: []*proto.ObjectChange{change}})
+	assert.EqualValues(t, codes.Unavailable, status.Code(err), "New clients should be turned away")
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	db, _ := NewFakeDB()
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{})
+
+	// a stream that never finishes holds up the shutdown.
+	cls.streams.Add(1)
+	defer cls.streams.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, cls.Shutdown(ctx), context.DeadlineExceeded)
+}
+
+func TestWriteFailureEndsStream(t *testing.T) {
+	db, _ := NewFakeDB()
+	db.err = errors.New("disk on fire")
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{})
+	defer cls.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	change := &proto.ObjectChange{ObjectId: "object1", PropertyId: "colour", Data: []byte("red"), UniqueId: "client1"}
+	err := cls.ProcessObjectChanges(&blockingStream{fakeServerStream: fakeServerStream{changes: []*proto.ObjectChange{change}}, ctx: ctx})
+	assert.EqualValues(t, codes.Unavailable, status.Code(err), "Client should be told to reconnect, got %v", err)
+	assert.NotContains(t, err.Error(), "disk on fire", "Internal details shouldn't leak to clients")
+}
+
+func TestSetKeyRegistryKeepsSequences(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	keys := signing.NewKeyRegistry(false)
+	keys.Register("client1", pub)
+
+	db, _ := NewFakeDB()
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{})
+	defer cls.Close()
+	cls.SetKeyRegistry(keys)
+
+	change := &proto.ObjectChange{ObjectId: "object1", PropertyId: "colour", Data: []byte("red"), UniqueId: "client1"}
+	signing.Sign(priv, change, 1)
+	assert.Nil(t, cls.ProcessObjectChanges(&fakeServerStream{changes: []*proto.ObjectChange{change}}))
+
+	// keys reloaded, the same change sent again.
+	reloaded := signing.NewKeyRegistry(false)
+	reloaded.Register("client1", pub)
+	cls.SetKeyRegistry(reloaded)
+	err := cls.ProcessObjectChanges(&fakeServerStream{changes: []*proto.ObjectChange{change}})
+	assert.EqualValues(t, codes.PermissionDenied, status.Code(err), "Replay should be rejected after reload")
+
+	// signing turned off and on again.
+	cls.SetKeyRegistry(nil)
+	enabled := signing.NewKeyRegistry(false)
+	enabled.Register("client1", pub)
+	cls.SetKeyRegistry(enabled)
+	err = cls.ProcessObjectChanges(&fakeServerStream{changes: []*proto.ObjectChange{change}})
+	assert.EqualValues(t, codes.PermissionDenied, status.Code(err), "Replay should be rejected after signing is turned back on")
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+)
+
+// rough per property overhead (map entries, slice headers, metadata) on top of the ID and data,
+// see BenchmarkObjectStateMemory.
+const statePropertyOverhead = 160
+
+// ObjectState is the current state of an object being processed. Its processor goroutine is the
+// only thing that changes it (after each commit), so it's always what's in storage and everything
+// confirmed to clients so far.
+type ObjectState struct {
+	lock   sync.RWMutex
+	object *storage.Object
+	size   int64
+
+	// closed once loaded. If loading failed, err is set and the state isn't used.
+	ready chan struct{}
+	err   error
+}
+
+func newObjectState(objectID string) *ObjectState {
+	return &ObjectState{object: storage.NewObject(objectID), ready: make(chan struct{})}
+}
+
+func statePropertySize(propertyID string, data []byte, meta storage.PropertyMetadata) int64 {
+	return int64(len(propertyID) + len(data) + len(meta.Author) + statePropertyOverhead)
+}
+
+// load reads the object from storage. Called once, by the processor goroutine before it takes
+// any changes.
+func (s *ObjectState) load(ctx context.Context, db storage.DB) {
+	defer close(s.ready)
+
+	obj, err := db.Get(ctx, s.object.ObjectID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, v := range obj.Properties {
+		s.set(k, v, obj.Metadata[k])
+	}
+}
+
+// set is called with the write lock held.
+func (s *ObjectState) set(propertyID string, data []byte, meta storage.PropertyMetadata) {
+	if old, ok := s.object.Properties[propertyID]; ok {
+		s.size -= statePropertySize(propertyID, old, s.object.Metadata[propertyID])
+	}
+	s.object.Properties[propertyID] = data
+	s.object.Metadata[propertyID] = meta
+	s.size += statePropertySize(propertyID, data, meta)
+}
+
+// apply updates the state with changes that have been committed.
+func (s *ObjectState) apply(ops []storage.BatchOp) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, op := range ops {
+		if op.Delete {
+			if old, ok := s.object.Properties[op.PropertyID]; ok {
+				s.size -= statePropertySize(op.PropertyID, old, s.object.Metadata[op.PropertyID])
+				delete(s.object.Properties, op.PropertyID)
+				delete(s.object.Metadata, op.PropertyID)
+			}
+			continue
+		}
+		// the data belongs to the change, which nothing modifies once it's received.
+		s.set(op.PropertyID, op.Data, op.Meta)
+	}
+}
+
+// wait waits for the state to be loaded. Returns false if loading failed.
+func (s *ObjectState) wait(ctx context.Context) (bool, error) {
+	select {
+	case <-s.ready:
+		return s.err == nil, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// Snapshot returns a copy of the whole object, the data itself is shared so mustn't be modified.
+// Returns false if the state couldn't be loaded, in which case storage is the only place to get it.
+func (s *ObjectState) Snapshot(ctx context.Context) (*storage.Object, bool, error) {
+	if ok, err := s.wait(ctx); !ok || err != nil {
+		return nil, false, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	obj := storage.NewObject(s.object.ObjectID)
+	for k, v := range s.object.Properties {
+		obj.Properties[k] = v
+		obj.Metadata[k] = s.object.Metadata[k]
+	}
+	return obj, true, nil
+}
+
+// Size is roughly how much memory the state uses.
+func (s *ObjectState) Size() int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.size
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	"github.com/kpfaulkner/collablite/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingDB counts the Gets that reach storage.
+type countingDB struct {
+	storage.DB
+	gets int
+}
+
+func (c *countingDB) Get(ctx context.Context, objectID string) (*storage.Object, error) {
+	c.gets++
+	return c.DB.Get(ctx, objectID)
+}
+
+func TestSnapshotFromMemory(t *testing.T) {
+	ctx := context.Background()
+	memory, _ := storage.NewMemoryDB()
+	require.Nil(t, memory.Add(ctx, "object1", "existing", []byte("old"), storage.PropertyMetadata{Author: "bob"}))
+	db := &countingDB{DB: memory}
+	cls := NewCollabLiteServer(db, WriterOptions{}, ProcessorOptions{})
+	defer cls.Close()
+
+	changeChannel, confirmationChannel, err := cls.processor.RegisterClientWithObject("client1", "object1")
+	require.Nil(t, err)
+	changeChannel <- &IncomingChange{ObjectChange: &proto.ObjectChange{ObjectId: "object1", PropertyId: "prop1", Data: []byte("new")}, Author: "alice"}
+	_, err = confirmationChannel.Next(ctx)
+	require.Nil(t, err)
+
+	resp, err := cls.GetObject(ctx, &proto.GetRequest{ObjectId: "object1"})
+	require.Nil(t, err)
+	assert.EqualValues(t, map[string][]byte{"existing": []byte("old"), "prop1": []byte("new")}, resp.Properties)
+	assert.EqualValues(t, "alice", resp.Metadata["prop1"].Author)
+	assert.EqualValues(t, "bob", resp.Metadata["existing"].Author)
+	assert.EqualValues(t, 1, db.gets, "Only the initial load should read storage")
+
+	// objects nobody is editing still come from storage.
+	_, err = cls.GetObject(ctx, &proto.GetRequest{ObjectId: "object2"})
+	assert.NotNil(t, err)
+	assert.EqualValues(t, 2, db.gets)
+
+	stats := cls.processor.Stats()
+	assert.EqualValues(t, 1, stats.Objects)
+	assert.True(t, stats.Bytes > 0)
+}
+
+func TestIdleObjectsEvicted(t *testing.T) {
+	db, _ := storage.NewMemoryDB()
+	processor := NewProcessor(db, NewBatchWriter(db, WriterOptions{}), ProcessorOptions{IdleTimeout: 100 * time.Millisecond})
+
+	processor.RegisterClientWithObject("client1", "object1")
+	state := processor.objectChannels["object1"].state
+	require.Nil(t, processor.UnregisterClientWithObject("client1", "object1"))
+	assert.EqualValues(t, 1, processor.Stats().Objects, "Should be kept while idle")
+
+	// coming back within the timeout keeps the same state.
+	processor.RegisterClientWithObject("client2", "object1")
+	time.Sleep(200 * time.Millisecond)
+	assert.Same(t, state, processor.objectChannels["object1"].state)
+
+	require.Nil(t, processor.UnregisterClientWithObject("client2", "object1"))
+	time.Sleep(200 * time.Millisecond)
+	assert.EqualValues(t, 0, processor.Stats().Objects, "Should be gone once idle")
+}
+
+// BenchmarkObjectStateMemory measures what the state costs per object, to check statePropertyOverhead.
+func BenchmarkObjectStateMemory(b *testing.B) {
+	const objects = 1000
+	const properties = 50
+	value := []byte("a typical property value of a few dozen bytes")
+	meta := storage.PropertyMetadata{LastModified: time.Now(), Author: "alice"}
+
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		states := make([]*ObjectState, objects)
+		var estimate int64
+		for o := range states {
+			states[o] = newObjectState(fmt.Sprintf("object%d", o))
+			ops := make([]storage.BatchOp, properties)
+			for p := range ops {
+				ops[p] = storage.BatchOp{ObjectID: states[o].object.ObjectID, PropertyID: fmt.Sprintf("property%d", p), Data: append([]byte{}, value...), Meta: meta}
+			}
+			states[o].apply(ops)
+			estimate += states[o].Size()
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/objects, "bytes/object")
+		b.ReportMetric(float64(estimate)/objects, "estimated-bytes/object")
+		runtime.KeepAlive(states)
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrWriterClosed = errors.New("writer closed")
+
+const defaultMaxBatchSize = 512
+
+// WriterOptions controls how the BatchWriter groups writes.
+type WriterOptions struct {
+	// MaxBatchSize is the most changes written in one commit. Defaults to 512.
+	// A single group bigger than this is still written in one commit.
+	MaxBatchSize int
+
+	// MaxLatency is how long to wait for more changes after the first one arrives. Zero means
+	// don't wait, just commit whatever queued up while the previous commit was running (which is
+	// where most of the batching comes from anyway).
+	MaxLatency time.Duration
+}
+
+// writeRequest is a group of changes that must be committed together, and where to say how it went.
+type writeRequest struct {
+	ops  []storage.BatchOp
+	done chan error
+}
+
+// BatchWriter does group commit. Processors hand it their changes and block, the writer collects
+// changes from all processors into one storage batch, commits it (one fsync) and then releases
+// all the waiting processors at once. This gets us far more changes per fsync than writing each
+// change on its own, without confirming anything before it's durable.
+type BatchWriter struct {
+	db storage.DB
+
+	optsLock sync.RWMutex
+	opts     WriterOptions
+
+	requests chan *writeRequest
+
+	// closeLock stops Write sending on requests after it's closed.
+	closeLock sync.RWMutex
+	closed    bool
+	done      chan struct{}
+}
+
+// NewBatchWriter creates a BatchWriter for the DB and starts it.
+func NewBatchWriter(db storage.DB, opts WriterOptions) *BatchWriter {
+	opts = opts.withDefaults()
+
+	w := BatchWriter{}
+	w.db = db
+	w.opts = opts
+	w.requests = make(chan *writeRequest, opts.MaxBatchSize)
+	w.done = make(chan struct{})
+	go w.run()
+	return &w
+}
+
+func (opts WriterOptions) withDefaults() WriterOptions {
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = defaultMaxBatchSize
+	}
+	return opts
+}
+
+// SetOptions changes the options while running, they're used from the next batch. The queue in
+// front of the writer stays the size it was created with.
+func (w *BatchWriter) SetOptions(opts WriterOptions) {
+	w.optsLock.Lock()
+	w.opts = opts.withDefaults()
+	w.optsLock.Unlock()
+}
+
+// Write queues the changes and waits until they've been committed. All the ops are committed in
+// the same batch.
+func (w *BatchWriter) Write(ctx context.Context, ops ...storage.BatchOp) error {
+	req := &writeRequest{ops: ops, done: make(chan error, 1)}
+
+	w.closeLock.RLock()
+	if w.closed {
+		w.closeLock.RUnlock()
+		return ErrWriterClosed
+	}
+	select {
+	case w.requests <- req:
+	case <-ctx.Done():
+		w.closeLock.RUnlock()
+		return ctx.Err()
+	}
+	w.closeLock.RUnlock()
+
+	// once queued it will be written, so wait for it even if the context goes.
+	return <-req.done
+}
+
+// Close writes anything still queued then stops the writer.
+func (w *BatchWriter) Close() error {
+	w.closeLock.Lock()
+	if w.closed {
+		w.closeLock.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.requests)
+	w.closeLock.Unlock()
+
+	<-w.done
+	return nil
+}
+
+// run is the writer loop.
+func (w *BatchWriter) run() {
+	defer close(w.done)
+
+	var pending []*writeRequest
+	batch := &storage.Batch{}
+	for req := range w.requests {
+		pending = append(pending[:0], req)
+		batch.Reset()
+		addOps(batch, req.ops)
+
+		w.collect(batch, &pending)
+
+		err := w.db.Write(context.Background(), batch)
+		if err != nil {
+			log.Errorf("unable to write batch of %d changes: %v", batch.Len(), err)
+		}
+		if err != nil && len(pending) > 1 {
+			// one bad change shouldn't fail every object in the batch, so each group is tried on
+			// its own and only the ones that still fail get the error.
+			w.writeEach(batch, pending)
+			continue
+		}
+		for _, p := range pending {
+			p.done <- err
+		}
+	}
+}
+
+// writeEach commits each request in its own batch, after the batch of them all failed.
+func (w *BatchWriter) writeEach(batch *storage.Batch, pending []*writeRequest) {
+	for _, p := range pending {
+		batch.Reset()
+		addOps(batch, p.ops)
+		err := w.db.Write(context.Background(), batch)
+		if err != nil {
+			log.Errorf("unable to write %d changes for %s: %v", batch.Len(), objectIDs(p.ops), err)
+		}
+		p.done <- err
+	}
+}
+
+// objectIDs lists the objects the ops are for, for logging.
+func objectIDs(ops []storage.BatchOp) string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, op := range ops {
+		if !seen[op.ObjectID] {
+			seen[op.ObjectID] = true
+			ids = append(ids, op.ObjectID)
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+// collect adds more requests to the batch until it's full, MaxLatency is up or (with no latency)
+// nothing else is queued.
+func (w *BatchWriter) collect(batch *storage.Batch, pending *[]*writeRequest) {
+	w.optsLock.RLock()
+	opts := w.opts
+	w.optsLock.RUnlock()
+
+	var timeout <-chan time.Time
+	if opts.MaxLatency > 0 {
+		timer := time.NewTimer(opts.MaxLatency)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for batch.Len() < opts.MaxBatchSize {
+		var req *writeRequest
+		var ok bool
+		if timeout == nil {
+			select {
+			case req, ok = <-w.requests:
+			default:
+				return
+			}
+		} else {
+			select {
+			case req, ok = <-w.requests:
+			case <-timeout:
+				return
+			}
+		}
+		if !ok {
+			return
+		}
+
+		*pending = append(*pending, req)
+		addOps(batch, req.ops)
+	}
+}
+
+func addOps(batch *storage.Batch, ops []storage.BatchOp) {
+	for _, op := range ops {
+		if op.Delete {
+			batch.Delete(op.ObjectID, op.PropertyID)
+		} else {
+			batch.Set(op.ObjectID, op.PropertyID, op.Data, op.Meta)
+		}
+	}
+}
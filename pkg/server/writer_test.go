@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedDB blocks every Write until told to carry on, so tests can queue changes behind a commit.
+type gatedDB struct {
+	*fakeDB
+	started chan struct{}
+	gate    chan struct{}
+	sizes   []int
+}
+
+func (db *gatedDB) Write(ctx context.Context, batch *storage.Batch) error {
+	db.started <- struct{}{}
+	<-db.gate
+	db.sizes = append(db.sizes, batch.Len())
+	return db.fakeDB.Write(ctx, batch)
+}
+
+func op(objectID string, propertyID string) storage.BatchOp {
+	return storage.BatchOp{ObjectID: objectID, PropertyID: propertyID, Data: []byte(propertyID)}
+}
+
+func TestBatchWriterGroupsQueuedWrites(t *testing.T) {
+	fake, _ := NewFakeDB()
+	db := &gatedDB{fakeDB: fake, started: make(chan struct{}, 10), gate: make(chan struct{})}
+	w := NewBatchWriter(db, WriterOptions{})
+
+	var wg sync.WaitGroup
+	write := func(objectID string, propertyID string) {
+		defer wg.Done()
+		assert.Nil(t, w.Write(context.Background(), op(objectID, propertyID)))
+	}
+
+	// first commit is held up...
+	wg.Add(1)
+	go write("object1", "first")
+	<-db.started
+
+	// ...while changes for several objects queue behind it.
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go write(fmt.Sprintf("object%d", i%3), fmt.Sprintf("prop%d", i))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	db.gate <- struct{}{}
+	<-db.started
+	db.gate <- struct{}{}
+	wg.Wait()
+
+	assert.EqualValues(t, []int{1, 10}, db.sizes, "Queued changes should share one commit")
+	assert.Nil(t, w.Close())
+}
+
+func TestBatchWriterMaxBatchSize(t *testing.T) {
+	fake, _ := NewFakeDB()
+	db := &gatedDB{fakeDB: fake, started: make(chan struct{}, 10), gate: make(chan struct{}, 10)}
+	w := NewBatchWriter(db, WriterOptions{MaxBatchSize: 4})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.Write(context.Background(), op("object1", "first"))
+	}()
+	<-db.started
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w.Write(context.Background(), op("object1", fmt.Sprint(i)))
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		db.gate <- struct{}{}
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, []int{1, 4, 4}, db.sizes)
+	w.Close()
+}
+
+func TestBatchWriterLatencyWaitsForMore(t *testing.T) {
+	db, _ := NewFakeDB()
+	w := NewBatchWriter(db, WriterOptions{MaxLatency: 100 * time.Millisecond})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 5 * time.Millisecond)
+			assert.Nil(t, w.Write(context.Background(), op("object1", fmt.Sprint(i))))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 1, db.writes, "Writes within MaxLatency should be one commit")
+	assert.Len(t, db.data["object1"], 5)
+	w.Close()
+}
+
+func TestBatchWriterErrorsGoToEveryWriter(t *testing.T) {
+	db, _ := NewFakeDB()
+	db.err = errors.New("disk full")
+	w := NewBatchWriter(db, WriterOptions{})
+
+	assert.EqualError(t, w.Write(context.Background(), op("object1", "a"), op("object1", "b")), "disk full")
+	w.Close()
+}
+
+// badObjectDB fails any batch with a change to the bad object.
+type badObjectDB struct {
+	*gatedDB
+}
+
+func (db *badObjectDB) Write(ctx context.Context, batch *storage.Batch) error {
+	for _, op := range batch.Ops() {
+		if op.ObjectID == "bad" {
+			return errors.New("bad change")
+		}
+	}
+	return db.gatedDB.Write(ctx, batch)
+}
+
+func TestBatchWriterErrorOnlyFailsItsOwnObject(t *testing.T) {
+	fake, _ := NewFakeDB()
+	db := &badObjectDB{&gatedDB{fakeDB: fake, started: make(chan struct{}, 10), gate: make(chan struct{}, 10)}}
+	w := NewBatchWriter(db, WriterOptions{})
+
+	// hold up the first commit so the rest share one batch.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Nil(t, w.Write(context.Background(), op("object1", "first")))
+	}()
+	<-db.started
+
+	errs := make(map[string]error)
+	var lock sync.Mutex
+	for _, objectID := range []string{"object1", "bad", "object2"} {
+		wg.Add(1)
+		go func(objectID string) {
+			defer wg.Done()
+			err := w.Write(context.Background(), op(objectID, "a"), op(objectID, "b"))
+			lock.Lock()
+			errs[objectID] = err
+			lock.Unlock()
+		}(objectID)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		db.gate <- struct{}{}
+	}
+	wg.Wait()
+
+	assert.Nil(t, errs["object1"])
+	assert.Nil(t, errs["object2"])
+	assert.EqualError(t, errs["bad"], "bad change")
+	assert.Len(t, fake.data["object1"], 3)
+	assert.Len(t, fake.data["object2"], 2)
+	assert.Nil(t, w.Close())
+}
+
+func TestBatchWriterClose(t *testing.T) {
+	fake, _ := NewFakeDB()
+	db := &gatedDB{fakeDB: fake, started: make(chan struct{}, 10), gate: make(chan struct{}, 10)}
+	w := NewBatchWriter(db, WriterOptions{})
+
+	var queued int32
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if w.Write(context.Background(), op("object1", fmt.Sprint(i))) == nil {
+				atomic.AddInt32(&queued, 1)
+			}
+		}(i)
+	}
+	<-db.started
+	time.Sleep(20 * time.Millisecond)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			db.gate <- struct{}{}
+		}
+	}()
+	assert.Nil(t, w.Close())
+	wg.Wait()
+
+	assert.EqualValues(t, 3, queued, "Close should flush queued writes")
+	assert.Len(t, fake.data["object1"], 3)
+	assert.ErrorIs(t, w.Write(context.Background(), op("object1", "late")), ErrWriterClosed)
+}
+
+// The benchmarks compare a durable write per change (what the processor used to do) with group
+// commit, with lots of concurrent writers (ie objects), on each on-disk backend.
+// Pebble already merges concurrent synced writes so gains little, SQLite (a transaction per
+// write) gains the most.
+//
+//	go test ./pkg/server -run XXX -bench Commit
+
+var benchBackends = []string{"pebble", "badger", "sqlite"}
+
+func openBenchDB(b *testing.B, backend string) storage.DB {
+	db, err := storage.Open(backend, storage.Options{Path: filepath.Join(b.TempDir(), backend)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+// runParallelWrites calls write from 16 goroutines per CPU, each for its own object.
+func runParallelWrites(b *testing.B, write func(objectID string, propertyID string) error) {
+	var n int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		objectID := fmt.Sprintf("object%d", atomic.AddInt64(&n, 1))
+		i := 0
+		for pb.Next() {
+			i++
+			if err := write(objectID, fmt.Sprint(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCommitPerChange(b *testing.B) {
+	for _, backend := range benchBackends {
+		b.Run(backend, func(b *testing.B) {
+			db := openBenchDB(b, backend)
+			defer db.Close()
+			runParallelWrites(b, func(objectID string, propertyID string) error {
+				return db.Add(context.Background(), objectID, propertyID, []byte("value"), storage.PropertyMetadata{})
+			})
+		})
+	}
+}
+
+func BenchmarkGroupCommit(b *testing.B) {
+	for _, backend := range benchBackends {
+		b.Run(backend, func(b *testing.B) {
+			db := openBenchDB(b, backend)
+			defer db.Close()
+			w := NewBatchWriter(db, WriterOptions{})
+			defer w.Close()
+			runParallelWrites(b, func(objectID string, propertyID string) error {
+				return w.Write(context.Background(), op(objectID, propertyID))
+			})
+		})
+	}
+}
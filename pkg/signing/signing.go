@@ -0,0 +1,297 @@
+package signing
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kpfaulkner/collablite/proto"
+)
+
+var (
+	ErrUnknownKey       = errors.New("no public key registered")
+	ErrMissingSignature = errors.New("change is not signed")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrReplay           = errors.New("sequence already used")
+)
+
+// Payload generates the bytes that are signed for a change. Every field is length prefixed so
+// different combinations of fields can't produce the same payload.
+func Payload(uniqueID string, objectID string, propertyID string, data []byte, sequence uint64) []byte {
+	out := make([]byte, 0, 8*5+len(uniqueID)+len(objectID)+len(propertyID)+len(data))
+	out = append(out, "collablite-change-v1"...)
+	for _, field := range [][]byte{[]byte(uniqueID), []byte(objectID), []byte(propertyID), data} {
+		out = binary.BigEndian.AppendUint64(out, uint64(len(field)))
+		out = append(out, field...)
+	}
+	return binary.BigEndian.AppendUint64(out, sequence)
+}
+
+// Sign sets the sequence and signature of the change.
+func Sign(privateKey ed25519.PrivateKey, change *proto.ObjectChange, sequence uint64) {
+	change.Sequence = sequence
+	change.Signature = ed25519.Sign(privateKey, Payload(change.UniqueId, change.ObjectId, change.PropertyId, change.Data, sequence))
+}
+
+// KeyRegistry holds the public keys of clients (by unique ID) and the last sequence seen for each.
+// Clients with a registered key must sign all their changes. If RequireSignatures is set then
+// clients without a key are rejected too.
+//
+// By default the last sequences are only kept in memory, so after the server restarts any change
+// signed before will be accepted (once) again, until the client sends something newer. Use
+// OpenSequences and UseSequences to keep them in a file instead. A registry replacing another
+// while running (eg. keys reloaded) keeps them with KeepSequences.
+type KeyRegistry struct {
+	RequireSignatures bool
+
+	lock         sync.Mutex
+	keys         map[string]ed25519.PublicKey
+	lastSequence *Sequences
+}
+
+// Sequences is the last sequence seen from each client, can be shared between registries.
+type Sequences struct {
+	lock sync.Mutex
+	last map[string]uint64
+
+	// if set, every new sequence is appended as "<uniqueID> <sequence>".
+	file *os.File
+}
+
+// NewSequences creates sequences that are only kept in memory.
+func NewSequences() *Sequences {
+	return &Sequences{last: make(map[string]uint64)}
+}
+
+// OpenSequences loads the sequences recorded in filename (created if it doesn't exist) and records
+// every new one there before the change is accepted. The file is rewritten with just the latest
+// sequence for each client when opened. Writes aren't synced, so they survive the server being
+// killed but maybe not the machine losing power.
+func OpenSequences(filename string) (*Sequences, error) {
+	s := NewSequences()
+	f, err := os.Open(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		err = s.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", filename, err)
+		}
+	}
+
+	// compact into a new file, so a crash part way through leaves the old one.
+	tmp := filename + ".tmp"
+	f, err = os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	for uniqueID, sequence := range s.last {
+		fmt.Fprintf(w, "%s %d\n", uniqueID, sequence)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return nil, err
+	}
+
+	s.file, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads "<uniqueID> <sequence>" lines, keeping the highest for each client. A line that can't
+// be read (eg. cut short by a crash) is skipped.
+func (s *Sequences) load(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sequence, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if sequence > s.last[fields[0]] {
+			s.last[fields[0]] = sequence
+		}
+	}
+	return scanner.Err()
+}
+
+// Close closes the file, if any. Nothing more can be recorded after.
+func (s *Sequences) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// next records sequence as the last seen from uniqueID, if it's higher than any before.
+func (s *Sequences) next(uniqueID string, sequence uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if last, seen := s.last[uniqueID]; seen && sequence <= last {
+		return fmt.Errorf("%w: %d from %s", ErrReplay, sequence, uniqueID)
+	}
+	if s.file != nil {
+		if _, err := fmt.Fprintf(s.file, "%s %d\n", uniqueID, sequence); err != nil {
+			return fmt.Errorf("unable to record sequence from %s: %w", uniqueID, err)
+		}
+	}
+	s.last[uniqueID] = sequence
+	return nil
+}
+
+// NewKeyRegistry creates an empty registry.
+func NewKeyRegistry(requireSignatures bool) *KeyRegistry {
+	return &KeyRegistry{
+		RequireSignatures: requireSignatures,
+		keys:              make(map[string]ed25519.PublicKey),
+		lastSequence:      NewSequences(),
+	}
+}
+
+// Sequences returns the sequences the registry checks changes against.
+func (r *KeyRegistry) Sequences() *Sequences {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastSequence
+}
+
+// UseSequences checks changes against (and records them in) s from now on.
+func (r *KeyRegistry) UseSequences(s *Sequences) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastSequence = s
+}
+
+// KeepSequences carries on from the sequences seen by old, which r is replacing, so changes
+// already accepted by old can't be replayed to r. The two share them from then on, so nothing
+// old accepts after this is missed either.
+func (r *KeyRegistry) KeepSequences(old *KeyRegistry) {
+	r.UseSequences(old.Sequences())
+}
+
+// Register adds (or replaces) the public key for a client.
+func (r *KeyRegistry) Register(uniqueID string, publicKey ed25519.PublicKey) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key for %s", uniqueID)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keys[uniqueID] = publicKey
+	return nil
+}
+
+// LoadKeys reads keys in the format "<uniqueID> <base64 public key>", one per line.
+// Blank lines and lines starting with # are ignored.
+func (r *KeyRegistry) LoadKeys(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected <uniqueID> <public key>", lineNo)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid public key: %w", lineNo, err)
+		}
+		if err := r.Register(fields[0], key); err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// LoadKeysFile loads keys from a file, see LoadKeys
+func (r *KeyRegistry) LoadKeysFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.LoadKeys(f)
+}
+
+// Verify checks the signature only. Used by clients, which may see the same change more than once.
+func (r *KeyRegistry) Verify(uniqueID string, objectID string, propertyID string, data []byte, sequence uint64, signature []byte) error {
+	r.lock.Lock()
+	key, ok := r.keys[uniqueID]
+	r.lock.Unlock()
+	return r.verify(key, ok, uniqueID, objectID, propertyID, data, sequence, signature)
+}
+
+func (r *KeyRegistry) verify(key ed25519.PublicKey, hasKey bool, uniqueID string, objectID string, propertyID string, data []byte, sequence uint64, signature []byte) error {
+	if !hasKey {
+		if r.RequireSignatures {
+			return fmt.Errorf("%w for %s", ErrUnknownKey, uniqueID)
+		}
+		// unknown clients can't be checked, allowed through.
+		return nil
+	}
+
+	if len(signature) == 0 {
+		return fmt.Errorf("%w by %s", ErrMissingSignature, uniqueID)
+	}
+	if !ed25519.Verify(key, Payload(uniqueID, objectID, propertyID, data, sequence), signature) {
+		return fmt.Errorf("%w from %s", ErrInvalidSignature, uniqueID)
+	}
+	return nil
+}
+
+// VerifyConfirmation checks the signature of a confirmation received by a client.
+func (r *KeyRegistry) VerifyConfirmation(confirmation *proto.ObjectConfirmation) error {
+	return r.Verify(confirmation.UniqueId, confirmation.ObjectId, confirmation.PropertyId, confirmation.Data, confirmation.Sequence, confirmation.Signature)
+}
+
+// VerifyChange checks the signature of a change received by the server, and that the sequence is
+// higher than any previous change from the same client (so changes can't be replayed).
+func (r *KeyRegistry) VerifyChange(change *proto.ObjectChange) error {
+	r.lock.Lock()
+	key, ok := r.keys[change.UniqueId]
+	seqs := r.lastSequence
+	r.lock.Unlock()
+
+	if err := r.verify(key, ok, change.UniqueId, change.ObjectId, change.PropertyId, change.Data, change.Sequence, change.Signature); err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	return seqs.next(change.UniqueId, change.Sequence)
+}
@@ -0,0 +1,149 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kpfaulkner/collablite/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func signedChange(priv ed25519.PrivateKey, sequence uint64) *proto.ObjectChange {
+	change := &proto.ObjectChange{ObjectId: "object1", PropertyId: "colour", Data: []byte("red"), UniqueId: "client1"}
+	Sign(priv, change, sequence)
+	return change
+}
+
+func TestVerifyChange(t *testing.T) {
+	pub, priv := newKey(t)
+	r := NewKeyRegistry(false)
+	assert.Nil(t, r.Register("client1", pub))
+
+	assert.Nil(t, r.VerifyChange(signedChange(priv, 1)), "Should accept signed change")
+	assert.Nil(t, r.VerifyChange(signedChange(priv, 5)), "Should accept higher sequence")
+	assert.True(t, errors.Is(r.VerifyChange(signedChange(priv, 5)), ErrReplay), "Should reject replay")
+	assert.True(t, errors.Is(r.VerifyChange(signedChange(priv, 2)), ErrReplay), "Should reject older sequence")
+
+	tampered := signedChange(priv, 10)
+	tampered.Data = []byte("blue")
+	assert.True(t, errors.Is(r.VerifyChange(tampered), ErrInvalidSignature), "Should reject modified data")
+
+	tampered = signedChange(priv, 11)
+	tampered.Sequence = 12
+	assert.True(t, errors.Is(r.VerifyChange(tampered), ErrInvalidSignature), "Should reject modified sequence")
+
+	unsigned := &proto.ObjectChange{ObjectId: "object1", PropertyId: "colour", Data: []byte("red"), UniqueId: "client1", Sequence: 20}
+	assert.True(t, errors.Is(r.VerifyChange(unsigned), ErrMissingSignature), "Should reject unsigned change from client with key")
+}
+
+func TestKeepSequences(t *testing.T) {
+	pub, priv := newKey(t)
+	old := NewKeyRegistry(false)
+	assert.Nil(t, old.Register("client1", pub))
+	assert.Nil(t, old.VerifyChange(signedChange(priv, 5)))
+
+	reloaded := NewKeyRegistry(false)
+	assert.Nil(t, reloaded.Register("client1", pub))
+	reloaded.KeepSequences(old)
+	assert.ErrorIs(t, reloaded.VerifyChange(signedChange(priv, 5)), ErrReplay, "Should reject change seen before reload")
+
+	// still in use by whoever got it before the swap.
+	assert.Nil(t, old.VerifyChange(signedChange(priv, 6)))
+	assert.ErrorIs(t, reloaded.VerifyChange(signedChange(priv, 6)), ErrReplay, "Should see sequences from the old registry")
+	assert.Nil(t, reloaded.VerifyChange(signedChange(priv, 7)))
+}
+
+func TestOpenSequences(t *testing.T) {
+	pub, priv := newKey(t)
+	filename := filepath.Join(t.TempDir(), "sequences")
+
+	seqs, err := OpenSequences(filename)
+	assert.Nil(t, err)
+	r := NewKeyRegistry(false)
+	assert.Nil(t, r.Register("client1", pub))
+	r.UseSequences(seqs)
+	assert.Nil(t, r.VerifyChange(signedChange(priv, 5)))
+	assert.Nil(t, r.VerifyChange(signedChange(priv, 6)))
+	assert.Nil(t, seqs.Close())
+
+	// restarted, with a line cut short by a crash.
+	f, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString("client1")
+	f.Close()
+
+	seqs, err = OpenSequences(filename)
+	assert.Nil(t, err)
+	defer seqs.Close()
+	restarted := NewKeyRegistry(false)
+	assert.Nil(t, restarted.Register("client1", pub))
+	restarted.UseSequences(seqs)
+	assert.ErrorIs(t, restarted.VerifyChange(signedChange(priv, 6)), ErrReplay, "Should reject change seen before restart")
+	assert.Nil(t, restarted.VerifyChange(signedChange(priv, 7)))
+
+	data, _ := os.ReadFile(filename)
+	assert.EqualValues(t, "client1 6\nclient1 7\n", string(data), "Should be compacted when opened")
+}
+
+func TestImpersonation(t *testing.T) {
+	pub, _ := newKey(t)
+	_, otherPriv := newKey(t)
+	r := NewKeyRegistry(false)
+	assert.Nil(t, r.Register("client1", pub))
+
+	// signed by someone else, claiming to be client1
+	assert.True(t, errors.Is(r.VerifyChange(signedChange(otherPriv, 1)), ErrInvalidSignature))
+}
+
+func TestUnknownClients(t *testing.T) {
+	_, priv := newKey(t)
+	change := signedChange(priv, 1)
+
+	assert.Nil(t, NewKeyRegistry(false).VerifyChange(change), "Should allow unknown clients when not required")
+	assert.True(t, errors.Is(NewKeyRegistry(true).VerifyChange(change), ErrUnknownKey), "Should reject unknown clients when required")
+}
+
+func TestVerifyConfirmation(t *testing.T) {
+	pub, priv := newKey(t)
+	r := NewKeyRegistry(true)
+	assert.Nil(t, r.Register("client1", pub))
+
+	change := signedChange(priv, 1)
+	conf := &proto.ObjectConfirmation{
+		ObjectId:   change.ObjectId,
+		PropertyId: change.PropertyId,
+		Data:       change.Data,
+		UniqueId:   change.UniqueId,
+		Sequence:   change.Sequence,
+		Signature:  change.Signature,
+	}
+	assert.Nil(t, r.VerifyConfirmation(conf))
+	assert.Nil(t, r.VerifyConfirmation(conf), "Clients can see the same confirmation twice")
+
+	conf.PropertyId = "size"
+	assert.NotNil(t, r.VerifyConfirmation(conf), "Should reject moved data")
+}
+
+func TestLoadKeys(t *testing.T) {
+	pub, priv := newKey(t)
+	r := NewKeyRegistry(true)
+	keys := "# comment\n\nclient1 " + base64.StdEncoding.EncodeToString(pub) + "\n"
+	assert.Nil(t, r.LoadKeys(strings.NewReader(keys)))
+	assert.Nil(t, r.VerifyChange(signedChange(priv, 1)))
+
+	assert.NotNil(t, r.LoadKeys(strings.NewReader("client1")), "Should reject missing key")
+	assert.NotNil(t, r.LoadKeys(strings.NewReader("client1 notbase64!")), "Should reject invalid base64")
+	assert.NotNil(t, r.LoadKeys(strings.NewReader("client1 AAAA")), "Should reject short key")
+}
@@ -2,29 +2,55 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
 	"time"
 
 	badger "github.com/dgraph-io/badger/v3"
 	log "github.com/sirupsen/logrus"
 )
 
+func init() {
+	// settings:
+	//   sync: fsync every write (default true)
+	Register("badger", func(opts Options) (DB, error) {
+		if err := opts.checkSettings("sync"); err != nil {
+			return nil, err
+		}
+		if err := opts.requirePath(); err != nil {
+			return nil, err
+		}
+		sync, err := opts.boolSetting("sync", true)
+		if err != nil {
+			return nil, err
+		}
+		return openBadgerDB(opts.Path, sync)
+	})
+}
+
 // BadgerDB implements the DB interface using BadgerDB
 type BadgerDB struct {
 	bdb *badger.DB
-	ctx context.Context
+
+	// stops the GC goroutine
+	stop chan struct{}
 }
 
-// NewBadgerDB creates new BadgerDB DB connection
+// NewBadgerDB creates new BadgerDB DB connection. Every write is synced to disk before it returns.
 func NewBadgerDB(dir string) (*BadgerDB, error) {
+	return openBadgerDB(dir, true)
+}
+
+// openBadgerDB opens the DB. Badger doesn't sync writes by default, without sync changes that
+// have been confirmed can be lost if the machine dies.
+func openBadgerDB(dir string, sync bool) (*BadgerDB, error) {
 	dbs := BadgerDB{}
-	db, err := badger.Open(badger.DefaultOptions(dir))
+	db, err := badger.Open(badger.DefaultOptions(dir).WithSyncWrites(sync))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("unable to open badger db %s: %w", dir, err)
 	}
 	dbs.bdb = db
-	dbs.ctx = context.Background()
+	dbs.stop = make(chan struct{})
 	go dbs.startGC()
 	return &dbs, nil
 }
@@ -32,80 +58,215 @@ func NewBadgerDB(dir string) (*BadgerDB, error) {
 func (db *BadgerDB) startGC() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-db.stop:
+			log.Debugf("GC stopped")
+			return
+		case <-ticker.C:
+		}
+
 		log.Debug("GC ticker")
-	again:
-		err := db.bdb.RunValueLogGC(0.7)
-		if err == nil {
-			goto again
+		for db.bdb.RunValueLogGC(0.7) == nil {
 		}
 	}
+}
 
-	log.Debugf("GC completed/failed")
+// badgerError converts badger errors to the storage ones.
+func badgerError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, badger.ErrConflict):
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	case errors.Is(err, badger.ErrDBClosed):
+		return ErrClosed
+	}
+	return err
 }
 
-func (db *BadgerDB) Add(objectID string, propertyID string, data []byte) error {
-	key := fmt.Sprintf("%s:%s", objectID, propertyID)
-	err := db.bdb.Update(func(txn *badger.Txn) error {
-		err := txn.Set([]byte(key), data)
+// update runs fn in a read/write transaction, checking the context first.
+func (db *BadgerDB) update(ctx context.Context, fn func(txn *badger.Txn) error) error {
+	if err := ctx.Err(); err != nil {
 		return err
+	}
+	return badgerError(db.bdb.Update(fn))
+}
+
+// mustExist returns ErrNotFound if the key isn't in the transaction.
+func mustExist(txn *badger.Txn, key []byte) error {
+	_, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (db *BadgerDB) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	err := db.update(ctx, func(txn *badger.Txn) error {
+		return txn.Set(encodeKey(objectID, propertyID), encodeValue(data, meta))
 	})
 	if err != nil {
-		log.Errorf("unable to add object %v", err)
-		return err
+		return fmt.Errorf("unable to add %s/%s: %w", objectID, propertyID, err)
 	}
-
 	return nil
 }
 
 // Delete objectID/propertyID from table.
-func (db *BadgerDB) Delete(objectID string, propertyID string) error {
-	panic("Not implemented")
+func (db *BadgerDB) Delete(ctx context.Context, objectID string, propertyID string) error {
+	err := db.update(ctx, func(txn *badger.Txn) error {
+		key := encodeKey(objectID, propertyID)
+		if err := mustExist(txn, key); err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete %s/%s: %w", objectID, propertyID, err)
+	}
 	return nil
 }
 
 // Update an existing objectID/propertyID with new data.
-// Given Add has become an upsert, this function can probably go.
-func (db *BadgerDB) Update(objectID string, propertyID string, data []byte) error {
-
-	// just do Add...
-	db.Add(objectID, propertyID, data)
+func (db *BadgerDB) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	err := db.update(ctx, func(txn *badger.Txn) error {
+		key := encodeKey(objectID, propertyID)
+		if err := mustExist(txn, key); err != nil {
+			return err
+		}
+		return txn.Set(key, encodeValue(data, meta))
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update %s/%s: %w", objectID, propertyID, err)
+	}
 	return nil
 }
 
 // Import will take a map of property/data and store it as an object.
-func (db *BadgerDB) Import(objectID string, properties map[string][]byte) (string, error) {
-	panic("Not implemented")
-	return "", nil
+// Done in a single transaction so the existence check and writes are atomic.
+func (db *BadgerDB) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
+	err := db.update(ctx, func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = objectPrefix(objectID)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		it.Seek(opts.Prefix)
+		exists := it.ValidForPrefix(opts.Prefix)
+		it.Close()
+		if exists {
+			return ErrConflict
+		}
+
+		for k, v := range properties {
+			if err := txn.Set(encodeKey(objectID, k), encodeValue(v, PropertyMetadata{})); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to import %s: %w", objectID, err)
+	}
+	return objectID, nil
 }
 
 // Get returns an object (id + property/data map)
-func (db *BadgerDB) Get(objectID string) (*Object, error) {
+func (db *BadgerDB) Get(ctx context.Context, objectID string) (*Object, error) {
+	// empty means every object to Iterate.
+	if objectID == "" {
+		return nil, fmt.Errorf("get %q: %w", objectID, ErrNotFound)
+	}
 
-	objectProperties := make(map[string][]byte)
+	object := NewObject(objectID)
+	err := db.Iterate(ctx, objectID, func(_ string, propertyID string, data []byte, meta PropertyMetadata) error {
+		object.Properties[propertyID] = append([]byte{}, data...)
+		object.Metadata[propertyID] = meta
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(object.Properties) == 0 {
+		return nil, fmt.Errorf("get %s: %w", objectID, ErrNotFound)
+	}
+	return object, nil
+}
 
-	db.bdb.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
+// Write applies the batch in a single transaction. Very large batches can fail with
+// badger.ErrTxnTooBig, callers should keep batches reasonably sized.
+func (db *BadgerDB) Write(ctx context.Context, batch *Batch) error {
+	err := db.update(ctx, func(txn *badger.Txn) error {
+		for _, op := range batch.Ops() {
+			var err error
+			if op.Delete {
+				err = txn.Delete(encodeKey(op.ObjectID, op.PropertyID))
+			} else {
+				err = txn.Set(encodeKey(op.ObjectID, op.PropertyID), encodeValue(op.Data, op.Meta))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write batch: %w", err)
+	}
+	return nil
+}
+
+// Iterate visits the object's keys, or all keys in the current layout if objectID is empty.
+func (db *BadgerDB) Iterate(ctx context.Context, objectID string, fn IterateFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := db.bdb.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte{keyFormat}
+		if objectID != "" {
+			opts.Prefix = objectPrefix(objectID)
+		}
+		it := txn.NewIterator(opts)
 		defer it.Close()
-		prefix := []byte(objectID)
-		var valCopy []byte
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		for it.Seek(opts.Prefix); it.ValidForPrefix(opts.Prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			item := it.Item()
-			k := item.Key()
-			err := item.Value(func(v []byte) error {
-				sp := strings.Split(string(k), ":")
-				valCopy = append([]byte{}, v...)
-				objectProperties[sp[1]] = valCopy
+			id, propertyID, err := decodeKey(item.Key())
+			if err != nil {
+				return err
+			}
+
+			var fnErr error
+			err = item.Value(func(v []byte) error {
+				data, meta := decodeValue(v)
+				fnErr = fn(id, propertyID, data, meta)
 				return nil
 			})
 			if err != nil {
-				log.Errorf("unable to get object %v", err)
+				return err
+			}
+			if stop, err := stopped(fnErr); stop {
 				return err
 			}
 		}
 		return nil
 	})
+	return badgerError(err)
+}
 
-	object := Object{ObjectID: objectID, Properties: objectProperties}
-	return &object, nil
+// Close stops GC and closes the underlying badger DB.
+func (db *BadgerDB) Close() error {
+	if db.stop != nil {
+		select {
+		case <-db.stop:
+			return nil
+		default:
+		}
+		close(db.stop)
+	}
+	return db.bdb.Close()
 }
@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// per property overhead (map entries, metadata) counted towards the cache size.
+const cachePropertyOverhead = 64
+
+// CacheOptions are the settings for NewCachedDB.
+type CacheOptions struct {
+	// MaxBytes is roughly how much memory cached objects can use. Defaults to 64MB.
+	MaxBytes int64
+}
+
+// CacheStats are counts since the DB was opened, plus what's currently cached.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+
+	Objects int
+	Bytes   int64
+}
+
+// cacheEntry is an object in the cache.
+type cacheEntry struct {
+	obj  *Object
+	size int64
+}
+
+// cacheLoad tracks a Get reading an object from the backend. Any write to the object while that
+// happens means what was read may be out of date, so isn't cached.
+type cacheLoad struct {
+	readers int
+	stale   bool
+}
+
+// CachedDB keeps recently used objects in memory in front of the DB it wraps. Writes go to the
+// backend and then update any cached copy, so the cache never has anything the backend doesn't.
+// Writes to the same object are expected to come one at a time (as they do from the processors),
+// otherwise the cache could end up with them in a different order to the backend.
+type CachedDB struct {
+	backend DB
+	opts    CacheOptions
+
+	lock    sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used at the front.
+	entries map[string]*list.Element
+	loads   map[string]*cacheLoad
+	bytes   int64
+	closed  bool
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// NewCachedDB wraps backend. The CachedDB owns the backend, Close closes both.
+func NewCachedDB(backend DB, opts CacheOptions) *CachedDB {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 64 << 20
+	}
+	return &CachedDB{
+		backend: backend,
+		opts:    opts,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		loads:   make(map[string]*cacheLoad),
+	}
+}
+
+func propertySize(propertyID string, data []byte, meta PropertyMetadata) int64 {
+	return int64(len(propertyID) + len(data) + len(meta.Author) + cachePropertyOverhead)
+}
+
+func copyObject(obj *Object) *Object {
+	c := NewObject(obj.ObjectID)
+	for k, v := range obj.Properties {
+		c.Properties[k] = append([]byte{}, v...)
+		c.Metadata[k] = obj.Metadata[k]
+	}
+	return c
+}
+
+// Stats returns the hit/miss counts and the size of the cache.
+func (db *CachedDB) Stats() CacheStats {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return CacheStats{
+		Hits:      db.hits,
+		Misses:    db.misses,
+		Evictions: db.evictions,
+		Objects:   len(db.entries),
+		Bytes:     db.bytes,
+	}
+}
+
+// evict is called with the lock held.
+func (db *CachedDB) evict() {
+	for db.bytes > db.opts.MaxBytes {
+		back := db.lru.Back()
+		if back == nil {
+			return
+		}
+		db.remove(back.Value.(*cacheEntry).obj.ObjectID)
+		db.evictions++
+	}
+}
+
+// remove is called with the lock held.
+func (db *CachedDB) remove(objectID string) {
+	if elem, ok := db.entries[objectID]; ok {
+		db.bytes -= elem.Value.(*cacheEntry).size
+		db.lru.Remove(elem)
+		delete(db.entries, objectID)
+	}
+}
+
+// written is called with the lock held whenever an object has changed in the backend.
+func (db *CachedDB) written(objectID string) {
+	if load, ok := db.loads[objectID]; ok {
+		load.stale = true
+	}
+}
+
+// set updates a property of a cached object, if it's cached. Called with the lock held.
+func (db *CachedDB) set(objectID string, propertyID string, data []byte, meta PropertyMetadata) {
+	db.written(objectID)
+	elem, ok := db.entries[objectID]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*cacheEntry)
+	if old, ok := entry.obj.Properties[propertyID]; ok {
+		entry.size -= propertySize(propertyID, old, entry.obj.Metadata[propertyID])
+		db.bytes -= propertySize(propertyID, old, entry.obj.Metadata[propertyID])
+	}
+	// callers may reuse the slice.
+	entry.obj.Properties[propertyID] = append([]byte{}, data...)
+	entry.obj.Metadata[propertyID] = meta
+	entry.size += propertySize(propertyID, data, meta)
+	db.bytes += propertySize(propertyID, data, meta)
+	db.lru.MoveToFront(elem)
+	db.evict()
+}
+
+// unset removes a property of a cached object. Called with the lock held.
+func (db *CachedDB) unset(objectID string, propertyID string) {
+	db.written(objectID)
+	elem, ok := db.entries[objectID]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*cacheEntry)
+	if old, ok := entry.obj.Properties[propertyID]; ok {
+		entry.size -= propertySize(propertyID, old, entry.obj.Metadata[propertyID])
+		db.bytes -= propertySize(propertyID, old, entry.obj.Metadata[propertyID])
+		delete(entry.obj.Properties, propertyID)
+		delete(entry.obj.Metadata, propertyID)
+	}
+	if len(entry.obj.Properties) == 0 {
+		db.remove(objectID)
+	}
+}
+
+// invalidate drops the object after a failed write, we don't know what the backend has now.
+func (db *CachedDB) invalidate(objectID string) {
+	db.lock.Lock()
+	db.written(objectID)
+	db.remove(objectID)
+	db.lock.Unlock()
+}
+
+func (db *CachedDB) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	if err := db.backend.Add(ctx, objectID, propertyID, data, meta); err != nil {
+		db.invalidate(objectID)
+		return err
+	}
+	db.lock.Lock()
+	db.set(objectID, propertyID, data, meta)
+	db.lock.Unlock()
+	return nil
+}
+
+func (db *CachedDB) Delete(ctx context.Context, objectID string, propertyID string) error {
+	if err := db.backend.Delete(ctx, objectID, propertyID); err != nil {
+		db.invalidate(objectID)
+		return err
+	}
+	db.lock.Lock()
+	db.unset(objectID, propertyID)
+	db.lock.Unlock()
+	return nil
+}
+
+func (db *CachedDB) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	if err := db.backend.Update(ctx, objectID, propertyID, data, meta); err != nil {
+		db.invalidate(objectID)
+		return err
+	}
+	db.lock.Lock()
+	db.set(objectID, propertyID, data, meta)
+	db.lock.Unlock()
+	return nil
+}
+
+// Import doesn't cache the object, it's loaded on the first Get.
+func (db *CachedDB) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
+	id, err := db.backend.Import(ctx, objectID, properties)
+	db.invalidate(objectID)
+	return id, err
+}
+
+func (db *CachedDB) Write(ctx context.Context, batch *Batch) error {
+	if err := db.backend.Write(ctx, batch); err != nil {
+		for _, op := range batch.Ops() {
+			db.invalidate(op.ObjectID)
+		}
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, op := range batch.Ops() {
+		if op.Delete {
+			db.unset(op.ObjectID, op.PropertyID)
+		} else {
+			db.set(op.ObjectID, op.PropertyID, op.Data, op.Meta)
+		}
+	}
+	return nil
+}
+
+// Get returns a copy of the cached object, loading it from the backend if it isn't cached.
+func (db *CachedDB) Get(ctx context.Context, objectID string) (*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.lock.Lock()
+	if db.closed {
+		db.lock.Unlock()
+		return nil, ErrClosed
+	}
+	if elem, ok := db.entries[objectID]; ok {
+		db.hits++
+		db.lru.MoveToFront(elem)
+		obj := copyObject(elem.Value.(*cacheEntry).obj)
+		db.lock.Unlock()
+		return obj, nil
+	}
+	db.misses++
+	load, ok := db.loads[objectID]
+	if !ok {
+		load = &cacheLoad{}
+		db.loads[objectID] = load
+	}
+	load.readers++
+	db.lock.Unlock()
+
+	obj, err := db.backend.Get(ctx, objectID)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if load.readers--; load.readers == 0 {
+		delete(db.loads, objectID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// another Get may have got there first.
+	if _, cached := db.entries[objectID]; !cached && !load.stale {
+		entry := &cacheEntry{obj: copyObject(obj)}
+		for k, v := range obj.Properties {
+			entry.size += propertySize(k, v, obj.Metadata[k])
+		}
+		// too big to ever fit, don't throw everything else out for it.
+		if entry.size <= db.opts.MaxBytes {
+			db.entries[objectID] = db.lru.PushFront(entry)
+			db.bytes += entry.size
+			db.evict()
+		}
+	}
+	return obj, nil
+}
+
+// Iterate always goes to the backend.
+func (db *CachedDB) Iterate(ctx context.Context, objectID string, fn IterateFunc) error {
+	return db.backend.Iterate(ctx, objectID, fn)
+}
+
+// Close logs the hit rate and closes the backend.
+func (db *CachedDB) Close() error {
+	if stats := db.Stats(); stats.Hits+stats.Misses > 0 {
+		log.Infof("cache: %d hits, %d misses, %d evictions", stats.Hits, stats.Misses, stats.Evictions)
+	}
+	db.lock.Lock()
+	db.closed = true
+	db.lru.Init()
+	db.entries = make(map[string]*list.Element)
+	db.bytes = 0
+	db.lock.Unlock()
+	return db.backend.Close()
+}
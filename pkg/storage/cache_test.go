@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingDB counts the Gets that reach the backend.
+type countingDB struct {
+	DB
+	gets int
+}
+
+func (c *countingDB) Get(ctx context.Context, objectID string) (*Object, error) {
+	c.gets++
+	return c.DB.Get(ctx, objectID)
+}
+
+func TestCachedDBWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	memory, _ := NewMemoryDB()
+	backend := &countingDB{DB: memory}
+	db := NewCachedDB(backend, CacheOptions{})
+	defer db.Close()
+
+	require.Nil(t, db.Add(ctx, "obj1", "prop1", []byte("1"), PropertyMetadata{Author: "alice"}))
+	obj, err := db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, "1", obj.Properties["prop1"])
+
+	// changes made through the cache are seen without going back to the backend.
+	require.Nil(t, db.Add(ctx, "obj1", "prop2", []byte("2"), PropertyMetadata{}))
+	require.Nil(t, db.Update(ctx, "obj1", "prop1", []byte("one"), PropertyMetadata{Author: "bob"}))
+	require.Nil(t, db.Delete(ctx, "obj1", "prop2"))
+	batch := &Batch{}
+	batch.Set("obj1", "prop3", []byte("3"), PropertyMetadata{})
+	require.Nil(t, db.Write(ctx, batch))
+
+	obj, err = db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, map[string][]byte{"prop1": []byte("one"), "prop3": []byte("3")}, obj.Properties)
+	assert.EqualValues(t, "bob", obj.Metadata["prop1"].Author)
+	assert.EqualValues(t, 1, backend.gets)
+
+	// callers get their own copy.
+	obj.Properties["prop1"][0] = 'X'
+	obj, _ = db.Get(ctx, "obj1")
+	assert.EqualValues(t, "one", obj.Properties["prop1"])
+
+	// a failed write drops the cached object.
+	assert.ErrorIs(t, db.Delete(ctx, "obj1", "missing"), ErrNotFound)
+	db.Get(ctx, "obj1")
+	assert.EqualValues(t, 2, backend.gets)
+
+	stats := db.Stats()
+	assert.EqualValues(t, 2, stats.Hits)
+	assert.EqualValues(t, 2, stats.Misses)
+	assert.EqualValues(t, 1, stats.Objects)
+}
+
+func TestCachedDBEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := NewMemoryDB()
+	value := make([]byte, 1000-cachePropertyOverhead-len("prop"))
+	for i := 0; i < 5; i++ {
+		require.Nil(t, backend.Add(ctx, fmt.Sprintf("obj%d", i), "prop", value, PropertyMetadata{}))
+	}
+
+	db := NewCachedDB(backend, CacheOptions{MaxBytes: 3000})
+	defer db.Close()
+	for _, id := range []string{"obj0", "obj1", "obj2", "obj0", "obj3"} {
+		_, err := db.Get(ctx, id)
+		require.Nil(t, err)
+	}
+
+	// obj1 was least recently used when obj3 needed room.
+	stats := db.Stats()
+	assert.EqualValues(t, 3, stats.Objects)
+	assert.EqualValues(t, 3000, stats.Bytes)
+	assert.EqualValues(t, 1, stats.Evictions)
+	assert.Contains(t, db.entries, "obj0")
+	assert.NotContains(t, db.entries, "obj1")
+
+	// growing an object can push others out too.
+	require.Nil(t, db.Add(ctx, "obj3", "prop2", []byte("x"), PropertyMetadata{}))
+	assert.EqualValues(t, 2, db.Stats().Evictions)
+	assert.NotContains(t, db.entries, "obj2")
+}
+
+// a write that lands while a Get is reading the backend means the Get's result isn't cached.
+type writeDuringGetDB struct {
+	DB
+	during func()
+}
+
+func (w *writeDuringGetDB) Get(ctx context.Context, objectID string) (*Object, error) {
+	obj, err := w.DB.Get(ctx, objectID)
+	if w.during != nil {
+		during := w.during
+		w.during = nil
+		during()
+	}
+	return obj, err
+}
+
+func TestCachedDBDoesNotCacheStaleLoad(t *testing.T) {
+	ctx := context.Background()
+	memory, _ := NewMemoryDB()
+	backend := &writeDuringGetDB{DB: memory}
+	db := NewCachedDB(backend, CacheOptions{})
+	defer db.Close()
+	require.Nil(t, memory.Add(ctx, "obj1", "prop1", []byte("old"), PropertyMetadata{}))
+
+	backend.during = func() {
+		require.Nil(t, db.Add(ctx, "obj1", "prop1", []byte("new"), PropertyMetadata{}))
+	}
+	obj, err := db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, "old", obj.Properties["prop1"])
+
+	obj, err = db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, "new", obj.Properties["prop1"])
+}
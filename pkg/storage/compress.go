@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Codec is how a value is compressed.
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	CodecSnappy
+	CodecZstd
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// ParseCodec returns the codec called name.
+func ParseCodec(name string) (Codec, error) {
+	for _, c := range []Codec{CodecNone, CodecSnappy, CodecZstd} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return CodecNone, fmt.Errorf("unknown compression %q (none, snappy, zstd)", name)
+}
+
+// Compressed values have a header saying how:
+//
+//	magic (3 bytes) | codec (1 byte) | data
+//
+// Anything without the magic was stored uncompressed (eg. before compression was turned on) and is
+// returned as is. Uncompressed values that happen to start with the magic get a CodecNone header so
+// they aren't mistaken for compressed ones.
+var compressMagic = []byte{0x00, 'C', 'Z'}
+
+const compressHeaderSize = 4
+
+// CompressionOptions are the settings for NewCompressedDB.
+type CompressionOptions struct {
+	// Codec used for new values. Existing values are read whatever they were written with.
+	Codec Codec
+
+	// MinSize is the smallest value worth compressing. Defaults to 512 bytes.
+	MinSize int
+}
+
+// CompressionStats are the sizes of the values written since the DB was opened.
+type CompressionStats struct {
+	Values           int64
+	CompressedValues int64
+
+	// RawBytes is the size the values would have been, StoredBytes what was actually stored.
+	RawBytes    int64
+	StoredBytes int64
+}
+
+// Ratio is stored/raw, so lower is better.
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.StoredBytes) / float64(s.RawBytes)
+}
+
+// CompressedDB compresses property values before passing them to the DB it wraps.
+type CompressedDB struct {
+	backend DB
+	opts    CompressionOptions
+
+	// both are safe for concurrent EncodeAll/DecodeAll.
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+
+	values           atomic.Int64
+	compressedValues atomic.Int64
+	rawBytes         atomic.Int64
+	storedBytes      atomic.Int64
+}
+
+// NewCompressedDB wraps backend. The CompressedDB owns the backend, Close closes both.
+func NewCompressedDB(backend DB, opts CompressionOptions) (*CompressedDB, error) {
+	if opts.MinSize <= 0 {
+		opts.MinSize = 512
+	}
+
+	db := CompressedDB{backend: backend, opts: opts}
+	var err error
+	if db.zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+		return nil, fmt.Errorf("unable to create zstd encoder: %w", err)
+	}
+	if db.zstdDecoder, err = zstd.NewReader(nil); err != nil {
+		return nil, fmt.Errorf("unable to create zstd decoder: %w", err)
+	}
+	return &db, nil
+}
+
+// compress returns what to store for data.
+func (db *CompressedDB) compress(data []byte) []byte {
+	stored := data
+	if len(data) >= db.opts.MinSize && db.opts.Codec != CodecNone {
+		header := append(append([]byte{}, compressMagic...), byte(db.opts.Codec))
+		var compressed []byte
+		switch db.opts.Codec {
+		case CodecSnappy:
+			compressed = append(header, snappy.Encode(nil, data)...)
+		case CodecZstd:
+			compressed = db.zstdEncoder.EncodeAll(data, header)
+		}
+
+		// not everything gets smaller.
+		if compressed != nil && len(compressed) < len(data) {
+			stored = compressed
+			db.compressedValues.Add(1)
+		}
+	}
+
+	if len(stored) == len(data) && bytes.HasPrefix(data, compressMagic) {
+		stored = append(append(append([]byte{}, compressMagic...), byte(CodecNone)), data...)
+	}
+
+	db.values.Add(1)
+	db.rawBytes.Add(int64(len(data)))
+	db.storedBytes.Add(int64(len(stored)))
+	return stored
+}
+
+// decompress returns the original data for a stored value.
+func (db *CompressedDB) decompress(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, compressMagic) || len(value) < compressHeaderSize {
+		return value, nil
+	}
+
+	codec := Codec(value[len(compressMagic)])
+	data := value[compressHeaderSize:]
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecSnappy:
+		return snappy.Decode(nil, data)
+	case CodecZstd:
+		return db.zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown compression codec %d", codec)
+}
+
+// Stats returns the sizes of everything written since the DB was opened.
+func (db *CompressedDB) Stats() CompressionStats {
+	return CompressionStats{
+		Values:           db.values.Load(),
+		CompressedValues: db.compressedValues.Load(),
+		RawBytes:         db.rawBytes.Load(),
+		StoredBytes:      db.storedBytes.Load(),
+	}
+}
+
+func (db *CompressedDB) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	return db.backend.Add(ctx, objectID, propertyID, db.compress(data), meta)
+}
+
+func (db *CompressedDB) Delete(ctx context.Context, objectID string, propertyID string) error {
+	return db.backend.Delete(ctx, objectID, propertyID)
+}
+
+func (db *CompressedDB) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	return db.backend.Update(ctx, objectID, propertyID, db.compress(data), meta)
+}
+
+func (db *CompressedDB) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
+	compressed := make(map[string][]byte, len(properties))
+	for k, v := range properties {
+		compressed[k] = db.compress(v)
+	}
+	return db.backend.Import(ctx, objectID, compressed)
+}
+
+func (db *CompressedDB) Get(ctx context.Context, objectID string) (*Object, error) {
+	obj, err := db.backend.Get(ctx, objectID)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range obj.Properties {
+		data, err := db.decompress(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", objectID, k, err)
+		}
+		obj.Properties[k] = data
+	}
+	return obj, nil
+}
+
+// Write compresses into a new batch, callers reuse theirs.
+func (db *CompressedDB) Write(ctx context.Context, batch *Batch) error {
+	compressed := &Batch{}
+	for _, op := range batch.Ops() {
+		if op.Delete {
+			compressed.Delete(op.ObjectID, op.PropertyID)
+		} else {
+			compressed.Set(op.ObjectID, op.PropertyID, db.compress(op.Data), op.Meta)
+		}
+	}
+	return db.backend.Write(ctx, compressed)
+}
+
+func (db *CompressedDB) Iterate(ctx context.Context, objectID string, fn IterateFunc) error {
+	return db.backend.Iterate(ctx, objectID, func(objectID string, propertyID string, value []byte, meta PropertyMetadata) error {
+		data, err := db.decompress(value)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", objectID, propertyID, err)
+		}
+		return fn(objectID, propertyID, data, meta)
+	})
+}
+
+// Close logs how much was saved and closes the backend.
+func (db *CompressedDB) Close() error {
+	if stats := db.Stats(); stats.Values > 0 {
+		log.Infof("compression: %d of %d values compressed, %d bytes stored for %d (%.2f)",
+			stats.CompressedValues, stats.Values, stats.StoredBytes, stats.RawBytes, stats.Ratio())
+	}
+	db.zstdEncoder.Close()
+	db.zstdDecoder.Close()
+	return db.backend.Close()
+}
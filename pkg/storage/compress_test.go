@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedDBMixedValues(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := NewMemoryDB()
+	db, err := NewCompressedDB(backend, CompressionOptions{Codec: CodecZstd, MinSize: 64})
+	require.Nil(t, err)
+	defer db.Close()
+
+	// stored before compression was turned on.
+	require.Nil(t, backend.Add(ctx, "obj1", "old", []byte("uncompressed"), PropertyMetadata{}))
+
+	jsonValue := bytes.Repeat([]byte(`{"name":"value","count":1},`), 100)
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	lookalike := append(append([]byte{}, compressMagic...), byte(CodecZstd), 'x')
+
+	require.Nil(t, db.Add(ctx, "obj1", "json", jsonValue, PropertyMetadata{Author: "alice"}))
+	require.Nil(t, db.Add(ctx, "obj1", "small", []byte("tiny"), PropertyMetadata{}))
+	require.Nil(t, db.Add(ctx, "obj1", "random", random, PropertyMetadata{}))
+	require.Nil(t, db.Add(ctx, "obj1", "lookalike", lookalike, PropertyMetadata{}))
+
+	raw, err := backend.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.True(t, len(raw.Properties["json"]) < len(jsonValue)/10, "JSON should compress")
+	assert.EqualValues(t, "tiny", raw.Properties["small"], "Small values should be stored as is")
+	assert.EqualValues(t, random, raw.Properties["random"], "Incompressible values should be stored as is")
+
+	obj, err := db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, "uncompressed", obj.Properties["old"])
+	assert.EqualValues(t, jsonValue, obj.Properties["json"])
+	assert.EqualValues(t, "tiny", obj.Properties["small"])
+	assert.EqualValues(t, random, obj.Properties["random"])
+	assert.EqualValues(t, lookalike, obj.Properties["lookalike"])
+	assert.EqualValues(t, "alice", obj.Metadata["json"].Author)
+
+	stats := db.Stats()
+	assert.EqualValues(t, 4, stats.Values)
+	assert.EqualValues(t, 1, stats.CompressedValues)
+	assert.EqualValues(t, len(jsonValue)+len("tiny")+len(random)+len(lookalike), stats.RawBytes)
+	assert.True(t, stats.Ratio() < 0.5)
+}
+
+// values written with one codec are still readable after switching to another.
+func TestCompressedDBSwitchCodec(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := NewMemoryDB()
+	value := bytes.Repeat([]byte("collablite "), 100)
+
+	snappyDB, err := NewCompressedDB(backend, CompressionOptions{Codec: CodecSnappy})
+	require.Nil(t, err)
+	require.Nil(t, snappyDB.Add(ctx, "obj1", "prop1", value, PropertyMetadata{}))
+
+	zstdDB, err := NewCompressedDB(backend, CompressionOptions{Codec: CodecZstd})
+	require.Nil(t, err)
+	defer zstdDB.Close()
+	obj, err := zstdDB.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, value, obj.Properties["prop1"])
+
+	_, err = ParseCodec("lz4")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,66 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	"github.com/kpfaulkner/collablite/pkg/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+// opener opens a registered backend with its data in the test's dir.
+func opener(backend string, file string, settings map[string]string) storagetest.Opener {
+	return func(t *testing.T, dir string) storage.DB {
+		db, err := storage.Open(backend, storage.Options{Path: filepath.Join(dir, file), Settings: settings})
+		require.Nil(t, err)
+		return db
+	}
+}
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.Run(t, opener("memory", "", nil), storagetest.Options{})
+}
+
+func TestPebbleConformance(t *testing.T) {
+	storagetest.Run(t, opener("pebble", "pebbledb", map[string]string{"sync": "false"}), storagetest.Options{Persistent: true})
+}
+
+func TestBadgerConformance(t *testing.T) {
+	storagetest.Run(t, opener("badger", "badgerdb", nil), storagetest.Options{Persistent: true})
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	storagetest.Run(t, opener("sqlite", "collablite.db", nil), storagetest.Options{Persistent: true})
+}
+
+func TestCompressedConformance(t *testing.T) {
+	for _, codec := range []storage.Codec{storage.CodecSnappy, storage.CodecZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T, dir string) storage.DB {
+				db, err := storage.NewCompressedDB(opener("pebble", "pebbledb", map[string]string{"sync": "false"})(t, dir), storage.CompressionOptions{Codec: codec, MinSize: 8})
+				require.Nil(t, err)
+				return db
+			}, storagetest.Options{Persistent: true})
+		})
+	}
+}
+
+func TestEncryptedConformance(t *testing.T) {
+	key, err := storage.NewMasterKey()
+	require.Nil(t, err)
+	master, err := storage.LoadMasterKeys(strings.NewReader("k1 " + key))
+	require.Nil(t, err)
+
+	storagetest.Run(t, func(t *testing.T, dir string) storage.DB {
+		return storage.NewEncryptedDB(opener("pebble", "pebbledb", map[string]string{"sync": "false"})(t, dir), master)
+	}, storagetest.Options{Persistent: true})
+}
+
+func TestCachedConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, dir string) storage.DB {
+		// small enough that the large value test doesn't fit.
+		return storage.NewCachedDB(opener("pebble", "pebbledb", map[string]string{"sync": "false"})(t, dir), storage.CacheOptions{MaxBytes: 1 << 20})
+	}, storagetest.Options{Persistent: true})
+}
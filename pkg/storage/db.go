@@ -1,5 +1,39 @@
 package storage
 
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the object (Get) or property (Update/Delete) doesn't exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when a write clashes with existing data (eg importing an object that
+	// already exists) or with a concurrent write.
+	ErrConflict = errors.New("conflict")
+
+	// ErrClosed is returned when the DB has been closed.
+	ErrClosed = errors.New("storage closed")
+
+	// ErrReservedID is returned for object IDs that are kept for storage's own use, see IsReservedID.
+	ErrReservedID = errors.New("reserved object ID")
+
+	// ErrStopIteration can be returned from an IterateFunc to stop iterating without Iterate returning an error.
+	ErrStopIteration = errors.New("stop iteration")
+)
+
+// reservedPrefix starts the IDs of objects storage keeps for itself (eg. the data keys of an
+// EncryptedDB). Clients can't read or write them.
+const reservedPrefix = "\x00"
+
+// IsReservedID is true for object IDs that are kept for storage's own use.
+func IsReservedID(objectID string) bool {
+	return strings.HasPrefix(objectID, reservedPrefix)
+}
+
 // Object represents an object in the system.
 // Its VERY basic.
 // ObjectID (unique identifier)
@@ -9,28 +43,123 @@ package storage
 type Object struct {
 	ObjectID   string
 	Properties map[string][]byte
+
+	// Metadata for each property (same keys as Properties)
+	Metadata map[string]PropertyMetadata
+}
+
+// PropertyMetadata is stored alongside each property.
+type PropertyMetadata struct {
+	// LastModified is when the server processed the last change to the property.
+	LastModified time.Time
+
+	// Author is the authenticated principal (or client ID if not authenticated) that made the last change.
+	Author string
 }
 
 func NewObject(objectID string) *Object {
 	o := &Object{
 		ObjectID:   objectID,
 		Properties: make(map[string][]byte),
+		Metadata:   make(map[string]PropertyMetadata),
 	}
 	return o
 }
 
+// BatchOp is a single write in a Batch.
+type BatchOp struct {
+	ObjectID   string
+	PropertyID string
+	Data       []byte
+	Meta       PropertyMetadata
+
+	// Delete the property instead of setting it. Data and Meta are ignored.
+	Delete bool
+}
+
+// Batch is a set of writes that are applied atomically by DB.Write. The zero value is ready to use.
+type Batch struct {
+	ops []BatchOp
+}
+
+// Set adds (or replaces) a property.
+func (b *Batch) Set(objectID string, propertyID string, data []byte, meta PropertyMetadata) {
+	b.ops = append(b.ops, BatchOp{ObjectID: objectID, PropertyID: propertyID, Data: data, Meta: meta})
+}
+
+// Delete removes a property. Deleting a property that doesn't exist isn't an error in a batch.
+func (b *Batch) Delete(objectID string, propertyID string) {
+	b.ops = append(b.ops, BatchOp{ObjectID: objectID, PropertyID: propertyID, Delete: true})
+}
+
+// Ops returns the writes in the order they were added.
+func (b *Batch) Ops() []BatchOp {
+	return b.ops
+}
+
+// Len is the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// IterateFunc is called for each property visited by DB.Iterate. The data is only valid for the
+// duration of the call. Return ErrStopIteration to stop early.
+type IterateFunc func(objectID string, propertyID string, data []byte, meta PropertyMetadata) error
+
 // DB interface used to store the data *somewhere*
+// All calls take a context and return one of the Err* errors above (wrapped) where it makes sense,
+// anything else is a backend failure.
 type DB interface {
 
-	// Add an object to the DB.
-	//
-	Add(objectID string, propertyID string, data []byte) error
-	Delete(objectID string, propertyID string) error
-	Update(objectID string, propertyID string, data []byte) error
+	// Add a property to the DB. Replaces the property if it already exists.
+	Add(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error
+
+	// Delete a property. Returns ErrNotFound if it doesn't exist.
+	Delete(ctx context.Context, objectID string, propertyID string) error
+
+	// Update an existing property. Returns ErrNotFound if it doesn't exist.
+	Update(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error
 
 	// Import imports an entire object (basically objectID and property collection)
-	Import(objectID string, properties map[string][]byte) (string, error)
+	// Returns ErrConflict if the object already exists.
+	Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error)
 
-	// Get entire object. Will return all properties for an object.
-	Get(objectID string) (*Object, error)
+	// Get entire object. Will return all properties for an object, ErrNotFound if it has none.
+	Get(ctx context.Context, objectID string) (*Object, error)
+
+	// Write applies all the writes in the batch atomically.
+	Write(ctx context.Context, batch *Batch) error
+
+	// Iterate calls fn for every property of the object, or every property of every object if
+	// objectID is empty. Order is backend specific.
+	Iterate(ctx context.Context, objectID string, fn IterateFunc) error
+
+	// Close releases the backend. Calls after Close return ErrClosed.
+	Close() error
+}
+
+// importBatch builds the batch for an Import.
+func importBatch(objectID string, properties map[string][]byte) *Batch {
+	batch := &Batch{}
+	for k, v := range properties {
+		batch.Set(objectID, k, v, PropertyMetadata{})
+	}
+	return batch
+}
+
+// stopped handles the result of an IterateFunc, returns true if iteration should stop and the
+// error (if any) Iterate should return.
+func stopped(err error) (bool, error) {
+	if err == nil {
+		return false, nil
+	}
+	if errors.Is(err, ErrStopIteration) {
+		return true, nil
+	}
+	return true, err
 }
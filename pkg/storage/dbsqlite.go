@@ -3,178 +3,433 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"net/url"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	_ "modernc.org/sqlite"
 )
 
+func init() {
+	// settings:
+	//   sync: full fsync on every commit (default true). Off is faster but the last commits can be
+	//         lost if the machine (not just the server) dies.
+	//   readers: max concurrent read connections (default 4)
+	Register("sqlite", func(opts Options) (DB, error) {
+		if err := opts.checkSettings("sync", "readers"); err != nil {
+			return nil, err
+		}
+		if err := opts.requirePath(); err != nil {
+			return nil, err
+		}
+		sync, err := opts.boolSetting("sync", true)
+		if err != nil {
+			return nil, err
+		}
+		readers, err := opts.intSetting("readers", defaultSQLiteReaders)
+		if err != nil {
+			return nil, err
+		}
+		return NewDBSQLite(opts.Path, SQLiteOptions{Sync: sync, Readers: readers})
+	})
+}
+
+const defaultSQLiteReaders = 4
+
+// SQLiteOptions for NewDBSQLite
+type SQLiteOptions struct {
+	// Sync uses synchronous=FULL, otherwise NORMAL.
+	Sync bool
+
+	// Readers is the size of the read connection pool. Defaults to 4.
+	Readers int
+}
+
 // DBSQLite implements the DB interface using SQLite
+// The DB is in WAL mode so reads don't block the writer (or each other). SQLite only allows one
+// writer at a time, so writes go through a pool of one connection, which serialises them without
+// any "database is locked" errors. Reads get their own pool.
 type DBSQLite struct {
-	conn *sql.Conn
-	ctx  context.Context
+	writer *sql.DB
+	reader *sql.DB
+
+	// prepared once, database/sql takes care of preparing them on each connection.
+	upsertStmt  *sql.Stmt
+	updateStmt  *sql.Stmt
+	deleteStmt  *sql.Stmt
+	existsStmt  *sql.Stmt
+	getStmt     *sql.Stmt
+	iterateStmt *sql.Stmt
+
+	closeLock sync.RWMutex
+	closed    bool
 }
 
-// NewDBSQLite creates new SQLite (modernc/sqlite) DB connection
-func NewDBSQLite(filename string) (*DBSQLite, error) {
+// sqliteDSN builds the DSN for modernc/sqlite, pragmas are applied to every new connection.
+func sqliteDSN(filename string, opts SQLiteOptions, readOnly bool) string {
+	synchronous := "NORMAL"
+	if opts.Sync {
+		synchronous = "FULL"
+	}
+
+	q := url.Values{}
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Add("_pragma", fmt.Sprintf("synchronous(%s)", synchronous))
+	if readOnly {
+		q.Add("_pragma", "query_only(1)")
+	}
+	return "file:" + filename + "?" + q.Encode()
+}
 
-	//sqlite3.Xsqlite3_config(nil, sqlite3.SQLITE_CONFIG_SERIALIZED, 1)
+// NewDBSQLite creates new SQLite (modernc/sqlite) DB
+func NewDBSQLite(filename string, opts SQLiteOptions) (*DBSQLite, error) {
+	if opts.Readers <= 0 {
+		opts.Readers = defaultSQLiteReaders
+	}
 
 	dbs := DBSQLite{}
-	db, err := sql.Open("sqlite", filename)
+	writer, err := sql.Open("sqlite", sqliteDSN(filename, opts, false))
 	if err != nil {
 		return nil, fmt.Errorf("new sqlitedb: %w", err)
 	}
+	writer.SetMaxOpenConns(1)
+	dbs.writer = writer
 
+	// the writer creates the file and brings the schema up to date before any reader looks at it.
 	ctx := context.Background()
-	conn, err := db.Conn(ctx)
+	if _, err := migrateSQLite(ctx, writer); err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("unable to migrate %s: %w", filename, err)
+	}
+
+	reader, err := sql.Open("sqlite", sqliteDSN(filename, opts, true))
 	if err != nil {
+		writer.Close()
 		return nil, fmt.Errorf("new sqlitedb: %w", err)
 	}
+	reader.SetMaxOpenConns(opts.Readers)
+	reader.SetMaxIdleConns(opts.Readers)
+	dbs.reader = reader
 
-	dbs.conn = conn
-	dbs.ctx = ctx
-
-	if err := createTables(ctx, conn); err != nil {
-		return nil, fmt.Errorf("unable to create table: %w", err)
+	if err := dbs.prepare(ctx); err != nil {
+		dbs.Close()
+		return nil, err
 	}
 	return &dbs, nil
 }
 
-// createTables creates the tables required for storing the objects.
-func createTables(ctx context.Context, conn *sql.Conn) error {
+const (
+	upsertObjectStatement  = `INSERT INTO object ( object_id, property_id, data, last_modified, author) VALUES(?, ?, ?, ?, ?) ON CONFLICT(object_id, property_id) DO UPDATE SET data=excluded.data, last_modified=excluded.last_modified, author=excluded.author`
+	updateObjectStatement  = `UPDATE object SET data = ?, last_modified = ?, author = ? where object_id = ? and property_id = ?`
+	deleteObjectStatement  = `DELETE FROM object WHERE object_id = ? AND property_id = ?`
+	existsObjectStatement  = `SELECT 1 FROM object WHERE object_id = ? LIMIT 1`
+	getObjectStatement     = `SELECT object_id, property_id, data, last_modified, author FROM object WHERE object_id = ?`
+	iterateObjectStatement = `SELECT object_id, property_id, data, last_modified, author FROM object`
+)
 
-	_, err := conn.ExecContext(ctx, `create table if not exists object (object_id varchar(50), property_id varchar(100), data BLOB, PRIMARY KEY (object_id, property_id))`)
-	if err != nil {
-		log.Printf("unable to create changes table: %v", err)
-		return err
+// prepare prepares all the statements.
+func (db *DBSQLite) prepare(ctx context.Context) error {
+	for _, s := range []struct {
+		conn  *sql.DB
+		query string
+		stmt  **sql.Stmt
+	}{
+		{db.writer, upsertObjectStatement, &db.upsertStmt},
+		{db.writer, updateObjectStatement, &db.updateStmt},
+		{db.writer, deleteObjectStatement, &db.deleteStmt},
+		{db.writer, existsObjectStatement, &db.existsStmt},
+		{db.reader, getObjectStatement, &db.getStmt},
+		{db.reader, iterateObjectStatement, &db.iterateStmt},
+	} {
+		stmt, err := s.conn.PrepareContext(ctx, s.query)
+		if err != nil {
+			return fmt.Errorf("unable to prepare statement: %w", err)
+		}
+		*s.stmt = stmt
 	}
 	return nil
 }
 
-// Add is really an upsert now. Might refactor update to be removed
-// Currently this is NOT thread safe...  so as soon as we're dealing with 2 different objects this will
-// blow up due to transaction within transaction.
-// Need to investigate modernc/sqlite threadsafety. If I be naive and throw a lock around this
-// then I can see definite lag on test clients and everything gets out of sync.
-//
-// Will probably move all writing out to a separate goroutine and have the various processors just dump their
-// changes onto a bufferless channel. Goroutine does write, signals back to caller (via another channel?) that
-// write is done. Investigate... FIXME(kpfaulkner)
-func (db *DBSQLite) Add(objectID string, propertyID string, data []byte) error {
-
-	//t := time.Now()
-	ctx := context.Background()
-	txn, err := db.conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: false})
+// addColumnIfMissing adds a column to an existing table. SQLite doesn't have ADD COLUMN IF NOT EXISTS.
+func addColumnIfMissing(ctx context.Context, conn *sql.Tx, table string, column string, definition string) error {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		return fmt.Errorf("unable to create transaction: %w", err)
+		return fmt.Errorf("unable to get columns for %s: %w", table, err)
 	}
 
-	defer txn.Rollback()
-	insertObjectStatement := `INSERT INTO object ( object_id, property_id,data) VALUES(?, ?, ?) ON CONFLICT(object_id, property_id) DO UPDATE SET data=?`
-	statement, err := txn.PrepareContext(ctx, insertObjectStatement)
-	if err != nil {
-		log.Errorf("unable to prepare statement: %v", err)
-		return fmt.Errorf("unable to prepare statement: %w", err)
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to get columns for %s: %w", table, err)
+		}
+		if name == column {
+			found = true
+		}
 	}
-	defer statement.Close()
-
-	_, err = statement.Exec(objectID, propertyID, data, data)
-	if err != nil {
-		log.Errorf("unable to insert object %v", err)
-		return fmt.Errorf("unable to insert object: %w", err)
+	rows.Close()
+	if found {
+		return nil
 	}
-	txn.Commit()
 
-	//log.Debugf("Add took %d ms", time.Since(t).Milliseconds())
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("unable to add column %s: %w", column, err)
+	}
 	return nil
 }
 
-// Delete objectID/propertyID from table.
-func (db *DBSQLite) Delete(objectID string, propertyID string) error {
-	ctx := context.Background()
-	txn, err := db.conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: false})
-	if err != nil {
-		return fmt.Errorf("unable to create transaction: %w", err)
+// unixNanos converts the time for storing, zero time is stored as 0.
+func unixNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
 	}
+	return t.UnixNano()
+}
 
-	if _, err := txn.ExecContext(ctx, "DELETE FROM object WHERE object_id = ? AND property_id = ?", objectID, propertyID); err != nil {
-		return fmt.Errorf("delete change: %w", err)
+// begin is called at the start of every call, if it returns nil the caller must call db.end()
+func (db *DBSQLite) begin(ctx context.Context) error {
+	// the driver doesn't always notice an already cancelled context.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.closeLock.RLock()
+	if db.closed {
+		db.closeLock.RUnlock()
+		return ErrClosed
 	}
-
 	return nil
 }
 
-// Update an existing objectID/propertyID with new data.
-// Given Add has become an upsert, this function can probably go.
-func (db *DBSQLite) Update(objectID string, propertyID string, data []byte) error {
-
-	t := time.Now()
+func (db *DBSQLite) end() {
+	db.closeLock.RUnlock()
+}
 
-	ctx := context.Background()
-	txn, err := db.conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: false})
+// inTx runs fn in a write transaction, committing if it returns nil.
+func (db *DBSQLite) inTx(ctx context.Context, fn func(txn *sql.Tx) error) error {
+	txn, err := db.writer.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("unable to create transaction: %w", err)
 	}
 	defer txn.Rollback()
 
-	updateObjectStatement := `UPDATE object SET data = ? where object_id = ? and property_id = ?`
-	statement, err := txn.PrepareContext(ctx, updateObjectStatement)
+	if err := fn(txn); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("unable to commit: %w", err)
+	}
+	return nil
+}
+
+// Add is an upsert.
+func (db *DBSQLite) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	if err := db.begin(ctx); err != nil {
+		return err
+	}
+	defer db.end()
+
+	_, err := db.upsertStmt.ExecContext(ctx, objectID, propertyID, data, unixNanos(meta.LastModified), meta.Author)
 	if err != nil {
-		log.Errorf("unable to prepare statement: %v", err)
-		return fmt.Errorf("unable to prepare statement: %w", err)
+		return fmt.Errorf("unable to insert %s/%s: %w", objectID, propertyID, err)
 	}
-	defer statement.Close()
+	return nil
+}
 
-	_, err = statement.Exec(data, objectID, propertyID)
+// checkAffected returns ErrNotFound if the statement didn't touch any rows.
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
 	if err != nil {
-		log.Errorf("unable to update object %v", err)
-		return fmt.Errorf("unable to update object: %w", err)
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
 	}
+	return nil
+}
 
-	txn.Commit()
+// Delete objectID/propertyID from table.
+func (db *DBSQLite) Delete(ctx context.Context, objectID string, propertyID string) error {
+	if err := db.begin(ctx); err != nil {
+		return err
+	}
+	defer db.end()
+
+	res, err := db.deleteStmt.ExecContext(ctx, objectID, propertyID)
+	if err == nil {
+		err = checkAffected(res)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to delete %s/%s: %w", objectID, propertyID, err)
+	}
+	return nil
+}
 
-	log.Debugf("Update took %d ms", time.Since(t).Milliseconds())
+// Update an existing objectID/propertyID with new data.
+func (db *DBSQLite) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	if err := db.begin(ctx); err != nil {
+		return err
+	}
+	defer db.end()
 
+	res, err := db.updateStmt.ExecContext(ctx, data, unixNanos(meta.LastModified), meta.Author, objectID, propertyID)
+	if err == nil {
+		err = checkAffected(res)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to update %s/%s: %w", objectID, propertyID, err)
+	}
 	return nil
 }
 
 // Import will take a map of property/data and store it as an object.
-func (db *DBSQLite) Import(objectID string, properties map[string][]byte) (string, error) {
-	panic("Not implemented")
-	return "", nil
+// The check and writes are in the same write transaction, so can't race another writer.
+func (db *DBSQLite) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
+	if err := db.begin(ctx); err != nil {
+		return "", err
+	}
+	defer db.end()
+
+	err := db.inTx(ctx, func(txn *sql.Tx) error {
+		var exists int
+		err := txn.StmtContext(ctx, db.existsStmt).QueryRowContext(ctx, objectID).Scan(&exists)
+		switch {
+		case err == nil:
+			return ErrConflict
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+		return db.writeBatch(ctx, txn, importBatch(objectID, properties))
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to import %s: %w", objectID, err)
+	}
+	return objectID, nil
+}
+
+// writeBatch does the writes of a batch within the transaction.
+func (db *DBSQLite) writeBatch(ctx context.Context, txn *sql.Tx, batch *Batch) error {
+	upsert := txn.StmtContext(ctx, db.upsertStmt)
+	del := txn.StmtContext(ctx, db.deleteStmt)
+
+	for _, op := range batch.Ops() {
+		var err error
+		if op.Delete {
+			_, err = del.ExecContext(ctx, op.ObjectID, op.PropertyID)
+		} else {
+			_, err = upsert.ExecContext(ctx, op.ObjectID, op.PropertyID, op.Data, unixNanos(op.Meta.LastModified), op.Meta.Author)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Get returns an object (id + property/data map)
-func (db *DBSQLite) Get(objectID string) (*Object, error) {
+func (db *DBSQLite) Get(ctx context.Context, objectID string) (*Object, error) {
+	// empty means every object to Iterate.
+	if objectID == "" {
+		return nil, fmt.Errorf("get %q: %w", objectID, ErrNotFound)
+	}
 
-	ctx := context.Background()
-	queryObjectStatement := `SELECT  property_id, data FROM object WHERE object_id = ?`
-	statement, err := db.conn.PrepareContext(ctx, queryObjectStatement)
+	object := NewObject(objectID)
+	err := db.Iterate(ctx, objectID, func(_ string, propertyID string, data []byte, meta PropertyMetadata) error {
+		object.Properties[propertyID] = data
+		object.Metadata[propertyID] = meta
+		return nil
+	})
 	if err != nil {
-		log.Errorf("unable to prepare statement: %v", err)
-		return nil, fmt.Errorf("unable to prepare statement: %w", err)
+		return nil, err
 	}
-	defer statement.Close()
+	if len(object.Properties) == 0 {
+		return nil, fmt.Errorf("get %s: %w", objectID, ErrNotFound)
+	}
+	return object, nil
+}
 
-	rows, err := statement.QueryContext(ctx, objectID)
-	if err != nil && err != sql.ErrNoRows {
-		return nil, fmt.Errorf("get object by object_id: %w", err)
+// Write applies the batch in a single transaction.
+func (db *DBSQLite) Write(ctx context.Context, batch *Batch) error {
+	if err := db.begin(ctx); err != nil {
+		return err
+	}
+	defer db.end()
+
+	err := db.inTx(ctx, func(txn *sql.Tx) error {
+		return db.writeBatch(ctx, txn, batch)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write batch: %w", err)
+	}
+	return nil
+}
+
+// Iterate visits the rows of the object, or all rows if objectID is empty.
+// Runs on a read connection, so fn can use the DB (including writing).
+func (db *DBSQLite) Iterate(ctx context.Context, objectID string, fn IterateFunc) error {
+	if err := db.begin(ctx); err != nil {
+		return err
 	}
+	defer db.end()
+
+	var rows *sql.Rows
+	var err error
+	if objectID != "" {
+		rows, err = db.getStmt.QueryContext(ctx, objectID)
+	} else {
+		rows, err = db.iterateStmt.QueryContext(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to query objects: %w", err)
+	}
+	defer rows.Close()
 
-	objectProperties := make(map[string][]byte)
 	for rows.Next() {
-		var propertyID string
+		var id, propertyID string
 		var data []byte
+		var lastModified sql.NullInt64
+		var author sql.NullString
 
-		err := rows.Scan(&propertyID, &data)
-		if err != nil {
-			return nil, err
+		if err := rows.Scan(&id, &propertyID, &data, &lastModified, &author); err != nil {
+			return err
+		}
+
+		var meta PropertyMetadata
+		if lastModified.Int64 != 0 {
+			meta.LastModified = time.Unix(0, lastModified.Int64).UTC()
+		}
+		meta.Author = author.String
+		if stop, err := stopped(fn(id, propertyID, data, meta)); stop {
+			return err
 		}
-		objectProperties[propertyID] = data
 	}
+	return rows.Err()
+}
+
+// Close closes the statements and both pools.
+func (db *DBSQLite) Close() error {
+	db.closeLock.Lock()
+	defer db.closeLock.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
 
-	object := Object{ObjectID: objectID, Properties: objectProperties}
-	return &object, nil
+	for _, stmt := range []*sql.Stmt{db.upsertStmt, db.updateStmt, db.deleteStmt, db.existsStmt, db.getStmt, db.iterateStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	if db.reader != nil {
+		if err := db.reader.Close(); err != nil {
+			log.Errorf("unable to close sqlite readers: %v", err)
+		}
+	}
+	return db.writer.Close()
 }
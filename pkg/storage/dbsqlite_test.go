@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteUsesWALMode(t *testing.T) {
+	db, err := NewDBSQLite(filepath.Join(t.TempDir(), "test.db"), SQLiteOptions{Sync: true})
+	require.Nil(t, err)
+	defer db.Close()
+
+	var mode string
+	require.Nil(t, db.writer.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.EqualValues(t, "wal", mode)
+	require.Nil(t, db.reader.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.EqualValues(t, "wal", mode)
+
+	_, err = db.reader.Exec("DELETE FROM object")
+	assert.NotNil(t, err, "Reader connections should be read only")
+}
+
+// lots of processors, each writing its own object at the same time, while others read.
+func TestSQLiteConcurrentObjects(t *testing.T) {
+	db, err := Open("sqlite", Options{Path: filepath.Join(t.TempDir(), "test.db"), Settings: map[string]string{"sync": "false", "readers": "8"}})
+	require.Nil(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	const processors = 32
+	const changes = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, processors*changes*2)
+	for p := 0; p < processors; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			objectID := fmt.Sprintf("object%d", p)
+			for i := 0; i < changes; i++ {
+				// mix of single writes and batches, like the processors and BatchWriter.
+				if i%2 == 0 {
+					if err := db.Add(ctx, objectID, fmt.Sprintf("prop%d", i), []byte("x"), PropertyMetadata{Author: objectID}); err != nil {
+						errs <- err
+					}
+				} else {
+					batch := &Batch{}
+					batch.Set(objectID, fmt.Sprintf("prop%d", i), []byte("y"), PropertyMetadata{Author: objectID})
+					if err := db.Write(ctx, batch); err != nil {
+						errs <- err
+					}
+				}
+
+				if _, err := db.Get(ctx, objectID); err != nil {
+					errs <- err
+				}
+			}
+		}(p)
+	}
+
+	// readers going over everything while the writes happen.
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := db.Iterate(ctx, "", func(objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+					return nil
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent use failed: %v", err)
+	}
+
+	for p := 0; p < processors; p++ {
+		obj, err := db.Get(ctx, fmt.Sprintf("object%d", p))
+		require.Nil(t, err)
+		assert.Len(t, obj.Properties, changes)
+		assert.EqualValues(t, fmt.Sprintf("object%d", p), obj.Metadata["prop1"].Author)
+	}
+}
@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrDecrypt = errors.New("unable to decrypt")
+
+// Every object has its own random data key which encrypts its values. Data keys are stored
+// wrapped (encrypted) by a master key, in an object of their own:
+//
+//	objectID "\x00datakey:<objectID>", property "key":
+//	uvarint len(master key ID) | master key ID | nonce | AES-GCM(master key, data key)
+//
+// These are reserved IDs (see IsReservedID), which can't be read or written through the
+// EncryptedDB, so a client can't overwrite or read another object's data key.
+//
+// Rotating the master key only means re-wrapping the data keys, the values stay as they are.
+//
+// Encrypted values have a header, anything without it was stored before encryption was turned on
+// and is returned as is:
+//
+//	magic (4 bytes) | nonce | AES-GCM(data key, data)
+//
+// The object and property IDs are authenticated with the data, so values can't be moved around.
+const (
+	dataKeyPrefix   = reservedPrefix + "datakey:"
+	dataKeyProperty = "key"
+	dataKeySize     = 32
+)
+
+var encryptMagic = []byte{0x00, 'C', 'E', 0x01}
+
+// MasterKeys are the keys that wrap the data keys. New data keys are wrapped with the current key,
+// the others are only kept to unwrap data keys that haven't been rotated yet.
+type MasterKeys struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewMasterKey generates a master key, base64 encoded for the keys file.
+func NewMasterKey() (string, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// LoadMasterKeys reads keys in the format "<keyID> <base64 256 bit key>", one per line. The last
+// key is the current one, so rotating is adding a new key to the end. Blank lines and lines
+// starting with # are ignored.
+func LoadMasterKeys(reader io.Reader) (*MasterKeys, error) {
+	mk := MasterKeys{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(reader)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected <keyID> <key>", lineNo)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid key: %w", lineNo, err)
+		}
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("line %d: key must be %d bytes", lineNo, dataKeySize)
+		}
+		if _, ok := mk.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: key %s listed twice", lineNo, fields[0])
+		}
+		if mk.keys[fields[0]], err = newAEAD(key); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		mk.current = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if mk.current == "" {
+		return nil, errors.New("no master keys")
+	}
+	return &mk, nil
+}
+
+// LoadMasterKeysFile loads keys from a file, see LoadMasterKeys
+func LoadMasterKeysFile(filename string) (*MasterKeys, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadMasterKeys(f)
+}
+
+// seal encrypts plaintext with a random nonce, appending nonce and ciphertext to out.
+func seal(aead cipher.AEAD, out []byte, plaintext []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, additional), nil
+}
+
+// unseal reverses seal.
+func unseal(aead cipher.AEAD, sealed []byte, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// wrap encrypts a data key with the current master key.
+func (mk *MasterKeys) wrap(objectID string, dataKey []byte) ([]byte, error) {
+	out := binary.AppendUvarint(nil, uint64(len(mk.current)))
+	out = append(out, mk.current...)
+	return seal(mk.keys[mk.current], out, dataKey, []byte(objectID))
+}
+
+// unwrap decrypts a wrapped data key, returning the ID of the master key it was wrapped with.
+func (mk *MasterKeys) unwrap(objectID string, wrapped []byte) ([]byte, string, error) {
+	length, n := binary.Uvarint(wrapped)
+	if n <= 0 || uint64(len(wrapped)-n) < length {
+		return nil, "", fmt.Errorf("data key for %s: %w", objectID, ErrDecrypt)
+	}
+	keyID := string(wrapped[n : n+int(length)])
+	master, ok := mk.keys[keyID]
+	if !ok {
+		return nil, keyID, fmt.Errorf("data key for %s is wrapped with unknown master key %q", objectID, keyID)
+	}
+	dataKey, err := unseal(master, wrapped[n+int(length):], []byte(objectID))
+	if err != nil {
+		return nil, keyID, fmt.Errorf("data key for %s: %w", objectID, err)
+	}
+	return dataKey, keyID, nil
+}
+
+// EncryptedDB encrypts property values before passing them to the DB it wraps.
+type EncryptedDB struct {
+	backend DB
+	master  *MasterKeys
+
+	// keysLock protects dataKeys, and makes sure only one data key is created per object.
+	keysLock sync.Mutex
+	dataKeys map[string]cipher.AEAD
+}
+
+// NewEncryptedDB wraps backend. The EncryptedDB owns the backend, Close closes both.
+func NewEncryptedDB(backend DB, master *MasterKeys) *EncryptedDB {
+	return &EncryptedDB{backend: backend, master: master, dataKeys: make(map[string]cipher.AEAD)}
+}
+
+// checkID rejects objects the caller isn't allowed to touch.
+func checkID(objectID string) error {
+	if IsReservedID(objectID) {
+		return fmt.Errorf("%q: %w", objectID, ErrReservedID)
+	}
+	return nil
+}
+
+func dataKeyObject(objectID string) string {
+	return dataKeyPrefix + objectID
+}
+
+// valueAD is the additional data authenticated with each value.
+func valueAD(objectID string, propertyID string) []byte {
+	ad := binary.AppendUvarint(nil, uint64(len(objectID)))
+	ad = append(ad, objectID...)
+	return append(ad, propertyID...)
+}
+
+// dataKey returns the data key for the object, nil if it doesn't have one and create is false.
+func (db *EncryptedDB) dataKey(ctx context.Context, objectID string, create bool) (cipher.AEAD, error) {
+	db.keysLock.Lock()
+	defer db.keysLock.Unlock()
+	if aead, ok := db.dataKeys[objectID]; ok {
+		return aead, nil
+	}
+
+	obj, err := db.backend.Get(ctx, dataKeyObject(objectID))
+	switch {
+	case err == nil:
+		return db.cacheDataKey(objectID, obj.Properties[dataKeyProperty])
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	case !create:
+		return nil, nil
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := db.master.wrap(objectID, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.backend.Add(ctx, dataKeyObject(objectID), dataKeyProperty, wrapped, PropertyMetadata{}); err != nil {
+		return nil, fmt.Errorf("unable to store data key for %s: %w", objectID, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	db.dataKeys[objectID] = aead
+	return aead, nil
+}
+
+// cacheDataKey is called with keysLock held.
+func (db *EncryptedDB) cacheDataKey(objectID string, wrapped []byte) (cipher.AEAD, error) {
+	key, _, err := db.master.unwrap(objectID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	db.dataKeys[objectID] = aead
+	return aead, nil
+}
+
+func (db *EncryptedDB) encrypt(aead cipher.AEAD, objectID string, propertyID string, data []byte) ([]byte, error) {
+	out := append(make([]byte, 0, len(encryptMagic)+aead.NonceSize()+len(data)+aead.Overhead()), encryptMagic...)
+	return seal(aead, out, data, valueAD(objectID, propertyID))
+}
+
+// decrypt returns the data for a stored value. aead is nil if the object has no data key.
+func (db *EncryptedDB) decrypt(aead cipher.AEAD, objectID string, propertyID string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, encryptMagic) {
+		return value, nil
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%s/%s: no data key: %w", objectID, propertyID, ErrDecrypt)
+	}
+	data, err := unseal(aead, value[len(encryptMagic):], valueAD(objectID, propertyID))
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %w", objectID, propertyID, err)
+	}
+	return data, nil
+}
+
+func (db *EncryptedDB) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	batch := &Batch{}
+	batch.Set(objectID, propertyID, data, meta)
+	return db.Write(ctx, batch)
+}
+
+func (db *EncryptedDB) Delete(ctx context.Context, objectID string, propertyID string) error {
+	if err := checkID(objectID); err != nil {
+		return err
+	}
+	return db.backend.Delete(ctx, objectID, propertyID)
+}
+
+func (db *EncryptedDB) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	if err := checkID(objectID); err != nil {
+		return err
+	}
+	aead, err := db.dataKey(ctx, objectID, true)
+	if err != nil {
+		return err
+	}
+	value, err := db.encrypt(aead, objectID, propertyID, data)
+	if err != nil {
+		return err
+	}
+	return db.backend.Update(ctx, objectID, propertyID, value, meta)
+}
+
+func (db *EncryptedDB) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
+	if err := checkID(objectID); err != nil {
+		return "", err
+	}
+	aead, err := db.dataKey(ctx, objectID, true)
+	if err != nil {
+		return "", err
+	}
+	encrypted := make(map[string][]byte, len(properties))
+	for k, v := range properties {
+		if encrypted[k], err = db.encrypt(aead, objectID, k, v); err != nil {
+			return "", err
+		}
+	}
+	return db.backend.Import(ctx, objectID, encrypted)
+}
+
+func (db *EncryptedDB) Get(ctx context.Context, objectID string) (*Object, error) {
+	if err := checkID(objectID); err != nil {
+		return nil, err
+	}
+	aead, err := db.dataKey(ctx, objectID, false)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := db.backend.Get(ctx, objectID)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range obj.Properties {
+		if obj.Properties[k], err = db.decrypt(aead, objectID, k, v); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// Write encrypts into a new batch, callers reuse theirs.
+func (db *EncryptedDB) Write(ctx context.Context, batch *Batch) error {
+	for _, op := range batch.Ops() {
+		if err := checkID(op.ObjectID); err != nil {
+			return err
+		}
+	}
+
+	encrypted := &Batch{}
+	for _, op := range batch.Ops() {
+		if op.Delete {
+			encrypted.Delete(op.ObjectID, op.PropertyID)
+			continue
+		}
+
+		aead, err := db.dataKey(ctx, op.ObjectID, true)
+		if err != nil {
+			return err
+		}
+		value, err := db.encrypt(aead, op.ObjectID, op.PropertyID, op.Data)
+		if err != nil {
+			return err
+		}
+		encrypted.Set(op.ObjectID, op.PropertyID, value, op.Meta)
+	}
+	return db.backend.Write(ctx, encrypted)
+}
+
+// Iterate decrypts as it goes. Data keys are looked up before iterating (the backend may not
+// allow reads during Iterate), which for all objects means going over everything twice.
+func (db *EncryptedDB) Iterate(ctx context.Context, objectID string, fn IterateFunc) error {
+	if objectID != "" {
+		if err := checkID(objectID); err != nil {
+			return err
+		}
+		aead, err := db.dataKey(ctx, objectID, false)
+		if err != nil {
+			return err
+		}
+		return db.backend.Iterate(ctx, objectID, func(objectID string, propertyID string, value []byte, meta PropertyMetadata) error {
+			data, err := db.decrypt(aead, objectID, propertyID, value)
+			if err != nil {
+				return err
+			}
+			return fn(objectID, propertyID, data, meta)
+		})
+	}
+
+	keys := make(map[string][]byte)
+	err := db.backend.Iterate(ctx, "", func(objectID string, propertyID string, value []byte, meta PropertyMetadata) error {
+		if strings.HasPrefix(objectID, dataKeyPrefix) && propertyID == dataKeyProperty {
+			keys[strings.TrimPrefix(objectID, dataKeyPrefix)] = append([]byte{}, value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	db.keysLock.Lock()
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for id, wrapped := range keys {
+		aead, ok := db.dataKeys[id]
+		if !ok {
+			if aead, err = db.cacheDataKey(id, wrapped); err != nil {
+				db.keysLock.Unlock()
+				return err
+			}
+		}
+		aeads[id] = aead
+	}
+	db.keysLock.Unlock()
+
+	return db.backend.Iterate(ctx, "", func(objectID string, propertyID string, value []byte, meta PropertyMetadata) error {
+		if IsReservedID(objectID) {
+			return nil
+		}
+		data, err := db.decrypt(aeads[objectID], objectID, propertyID, value)
+		if err != nil {
+			return err
+		}
+		return fn(objectID, propertyID, data, meta)
+	})
+}
+
+// RotateKeys re-wraps every data key not wrapped with the current master key. Once done, the old
+// master keys can be removed from the keys file. Returns the number of data keys re-wrapped.
+func (db *EncryptedDB) RotateKeys(ctx context.Context) (int, error) {
+	batch := &Batch{}
+	err := db.backend.Iterate(ctx, "", func(objectID string, propertyID string, value []byte, meta PropertyMetadata) error {
+		if !strings.HasPrefix(objectID, dataKeyPrefix) || propertyID != dataKeyProperty {
+			return nil
+		}
+		id := strings.TrimPrefix(objectID, dataKeyPrefix)
+		key, keyID, err := db.master.unwrap(id, value)
+		if err != nil {
+			return err
+		}
+		if keyID == db.master.current {
+			return nil
+		}
+		wrapped, err := db.master.wrap(id, key)
+		if err != nil {
+			return err
+		}
+		batch.Set(objectID, propertyID, wrapped, meta)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// the data keys themselves don't change, so the cache is still good.
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	if err := db.backend.Write(ctx, batch); err != nil {
+		return 0, err
+	}
+	return batch.Len(), nil
+}
+
+func (db *EncryptedDB) Close() error {
+	return db.backend.Close()
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func masterKeys(t *testing.T, ids ...string) *MasterKeys {
+	var lines []string
+	for _, id := range ids {
+		key, err := NewMasterKey()
+		require.Nil(t, err)
+		lines = append(lines, fmt.Sprintf("%s %s", id, key))
+	}
+	mk, err := LoadMasterKeys(strings.NewReader("# test keys\n" + strings.Join(lines, "\n")))
+	require.Nil(t, err)
+	return mk
+}
+
+func TestEncryptedDBStoresCiphertext(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := NewMemoryDB()
+	db := NewEncryptedDB(backend, masterKeys(t, "k1"))
+
+	// stored before encryption was turned on.
+	require.Nil(t, backend.Add(ctx, "obj1", "old", []byte("plaintext"), PropertyMetadata{}))
+
+	secret := []byte("top secret value")
+	require.Nil(t, db.Add(ctx, "obj1", "prop1", secret, PropertyMetadata{Author: "alice"}))
+	require.Nil(t, db.Add(ctx, "obj2", "prop1", secret, PropertyMetadata{}))
+
+	backend.Iterate(ctx, "", func(objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+		assert.False(t, bytes.Contains(data, secret), "%s/%s stored in plaintext", objectID, propertyID)
+		return nil
+	})
+
+	obj, err := db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, secret, obj.Properties["prop1"])
+	assert.EqualValues(t, "plaintext", obj.Properties["old"])
+	assert.EqualValues(t, "alice", obj.Metadata["prop1"].Author)
+
+	// values can't be moved to another property.
+	raw, _ := backend.Get(ctx, "obj1")
+	require.Nil(t, backend.Add(ctx, "obj1", "prop2", raw.Properties["prop1"], PropertyMetadata{}))
+	_, err = db.Get(ctx, "obj1")
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	// or read with the wrong master key.
+	other := NewEncryptedDB(backend, masterKeys(t, "k1"))
+	_, err = other.Get(ctx, "obj2")
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestEncryptedDBRejectsReservedIDs(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := NewMemoryDB()
+	db := NewEncryptedDB(backend, masterKeys(t, "k1"))
+	require.Nil(t, db.Add(ctx, "obj1", "prop1", []byte("secret"), PropertyMetadata{}))
+	wrapped, err := backend.Get(ctx, dataKeyObject("obj1"))
+	require.Nil(t, err)
+
+	// overwriting the victim's data key, or reading it.
+	id := dataKeyObject("obj1")
+	assert.ErrorIs(t, db.Add(ctx, id, dataKeyProperty, []byte("attacker"), PropertyMetadata{}), ErrReservedID)
+	assert.ErrorIs(t, db.Update(ctx, id, dataKeyProperty, []byte("attacker"), PropertyMetadata{}), ErrReservedID)
+	assert.ErrorIs(t, db.Delete(ctx, id, dataKeyProperty), ErrReservedID)
+	_, err = db.Import(ctx, id, map[string][]byte{dataKeyProperty: []byte("attacker")})
+	assert.ErrorIs(t, err, ErrReservedID)
+	_, err = db.Get(ctx, id)
+	assert.ErrorIs(t, err, ErrReservedID)
+	assert.ErrorIs(t, db.Iterate(ctx, id, func(string, string, []byte, PropertyMetadata) error { return nil }), ErrReservedID)
+
+	batch := &Batch{}
+	batch.Set("obj2", "prop1", []byte("fine"), PropertyMetadata{})
+	batch.Set(id, dataKeyProperty, []byte("attacker"), PropertyMetadata{})
+	assert.ErrorIs(t, db.Write(ctx, batch), ErrReservedID, "Whole batch should be rejected")
+	_, err = backend.Get(ctx, "obj2")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	after, _ := backend.Get(ctx, id)
+	assert.EqualValues(t, wrapped.Properties, after.Properties, "Data key should be untouched")
+
+	var ids []string
+	require.Nil(t, db.Iterate(ctx, "", func(objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+		ids = append(ids, objectID)
+		return nil
+	}))
+	assert.EqualValues(t, []string{"obj1"}, ids, "Data keys shouldn't be iterated")
+}
+
+func TestEncryptedDBRotateKeys(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := NewMemoryDB()
+	oldKeys := masterKeys(t, "k1", "k2")
+	require.Nil(t, NewEncryptedDB(backend, &MasterKeys{keys: oldKeys.keys, current: "k1"}).Add(ctx, "obj1", "prop1", []byte("value"), PropertyMetadata{}))
+
+	db := NewEncryptedDB(backend, oldKeys)
+	count, err := db.RotateKeys(ctx)
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, count)
+	count, err = db.RotateKeys(ctx)
+	require.Nil(t, err)
+	assert.EqualValues(t, 0, count, "Already rotated")
+
+	// k1 is no longer needed.
+	rotated := NewEncryptedDB(backend, &MasterKeys{keys: map[string]cipher.AEAD{"k2": oldKeys.keys["k2"]}, current: "k2"})
+	obj, err := rotated.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, "value", obj.Properties["prop1"])
+}
+
+func TestLoadMasterKeysErrors(t *testing.T) {
+	for _, keys := range []string{"", "k1", "k1 notbase64!", "k1 c2hvcnQ=", "k1 " + strings.Repeat("A", 43) + "= k2"} {
+		_, err := LoadMasterKeys(strings.NewReader(keys))
+		assert.NotNil(t, err, keys)
+	}
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// Key/value stores (Pebble, Badger) only have a single value per key, so the property metadata is
+// stored in an envelope around the data:
+//
+//	magic (4 bytes) | last modified unix nanos (8 bytes) | uvarint len(author) | author | data
+//
+// Values written before metadata existed don't have the magic prefix and are returned as is with
+// empty metadata.
+var envelopeMagic = []byte{0x00, 'C', 'L', 0x01}
+
+// encodeValue wraps the data and metadata into a single value.
+func encodeValue(data []byte, meta PropertyMetadata) []byte {
+	out := make([]byte, 0, len(envelopeMagic)+8+binary.MaxVarintLen64+len(meta.Author)+len(data))
+	out = append(out, envelopeMagic...)
+
+	var nanos int64
+	if !meta.LastModified.IsZero() {
+		nanos = meta.LastModified.UnixNano()
+	}
+	out = binary.BigEndian.AppendUint64(out, uint64(nanos))
+	out = binary.AppendUvarint(out, uint64(len(meta.Author)))
+	out = append(out, meta.Author...)
+	return append(out, data...)
+}
+
+// decodeValue unwraps a value written by encodeValue. The returned data shares memory with value.
+func decodeValue(value []byte) ([]byte, PropertyMetadata) {
+	var meta PropertyMetadata
+	if !bytes.HasPrefix(value, envelopeMagic) || len(value) < len(envelopeMagic)+8 {
+		// written before metadata.
+		return value, meta
+	}
+
+	rest := value[len(envelopeMagic):]
+	if nanos := int64(binary.BigEndian.Uint64(rest)); nanos != 0 {
+		meta.LastModified = time.Unix(0, nanos).UTC()
+	}
+	rest = rest[8:]
+
+	length, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < length {
+		return value, PropertyMetadata{}
+	}
+	meta.Author = string(rest[n : n+int(length)])
+	return rest[n+int(length):], meta
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	now := time.Date(2023, 5, 6, 7, 8, 9, 10, time.UTC)
+	for _, tc := range []struct {
+		data []byte
+		meta PropertyMetadata
+	}{
+		{[]byte("hello"), PropertyMetadata{LastModified: now, Author: "alice"}},
+		{[]byte{}, PropertyMetadata{LastModified: now}},
+		{[]byte("no meta"), PropertyMetadata{}},
+		{envelopeMagic, PropertyMetadata{Author: "data looks like envelope"}},
+	} {
+		data, meta := decodeValue(encodeValue(tc.data, tc.meta))
+		assert.EqualValues(t, tc.data, data)
+		assert.EqualValues(t, tc.meta, meta)
+	}
+}
+
+func TestEnvelopeLegacyValue(t *testing.T) {
+	data, meta := decodeValue([]byte("written before metadata"))
+	assert.EqualValues(t, "written before metadata", string(data), "Should return legacy value as is")
+	assert.EqualValues(t, PropertyMetadata{}, meta)
+}
+
+func TestSQLiteMetadata(t *testing.T) {
+	db, err := NewDBSQLite(filepath.Join(t.TempDir(), "test.db"), SQLiteOptions{})
+	assert.Nil(t, err)
+
+	now := time.Now().UTC()
+	assert.Nil(t, db.Add(context.Background(), "object1", "prop1", []byte("v1"), PropertyMetadata{LastModified: now, Author: "alice"}))
+	assert.Nil(t, db.Add(context.Background(), "object1", "prop1", []byte("v2"), PropertyMetadata{LastModified: now.Add(time.Second), Author: "bob"}))
+	assert.Nil(t, db.Add(context.Background(), "object1", "prop2", []byte("v3"), PropertyMetadata{}))
+
+	obj, err := db.Get(context.Background(), "object1")
+	assert.Nil(t, err)
+	assert.EqualValues(t, "v2", string(obj.Properties["prop1"]))
+	assert.EqualValues(t, "bob", obj.Metadata["prop1"].Author, "Upsert should replace author")
+	assert.True(t, now.Add(time.Second).Equal(obj.Metadata["prop1"].LastModified))
+	assert.True(t, obj.Metadata["prop2"].LastModified.IsZero())
+}
@@ -1,7 +1,7 @@
 package storage
 
 import (
-	"strings"
+	"io"
 
 	"github.com/cockroachdb/pebble"
 )
@@ -25,10 +25,10 @@ func NewFakePebble() *fakePebble {
 func (f *fakePebble) Set(key, value []byte, opts *pebble.WriteOptions) error {
 
 	// make an object if doesn't already exist.
-	objectPropertyID := string(key)
-	sp := strings.Split(objectPropertyID, ":")
-	objectID := sp[0]
-	propertyID := sp[1]
+	objectID, propertyID, err := decodeKey(key)
+	if err != nil {
+		return err
+	}
 	var obj Object
 	var ok bool
 	if obj, ok = f.Objects[objectID]; !ok {
@@ -40,6 +40,34 @@ func (f *fakePebble) Set(key, value []byte, opts *pebble.WriteOptions) error {
 	return nil
 }
 
+func (f *fakePebble) Get(key []byte) ([]byte, io.Closer, error) {
+	objectID, propertyID, err := decodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if v, ok := f.Objects[objectID].Properties[propertyID]; ok {
+		return v, io.NopCloser(nil), nil
+	}
+	return nil, nil, pebble.ErrNotFound
+}
+
+func (f *fakePebble) Delete(key []byte, opts *pebble.WriteOptions) error {
+	objectID, propertyID, err := decodeKey(key)
+	if err != nil {
+		return err
+	}
+	delete(f.Objects[objectID].Properties, propertyID)
+	return nil
+}
+
+func (f *fakePebble) NewBatch() *pebble.Batch {
+	panic("Not implemented")
+}
+
+func (f *fakePebble) Close() error {
+	return nil
+}
+
 func (f *fakePebble) NewIter(o *pebble.IterOptions) *pebble.Iterator {
 	return f.Iter
 }
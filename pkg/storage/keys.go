@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Key layout used by the key/value backends (Pebble, Badger):
+//
+//	keyFormat (1 byte) | uvarint len(objectID) | objectID | propertyID
+//
+// The object ID is length prefixed so every key for an object shares exactly the same prefix and
+// no other object's keys can (ie "obj1" doesn't match "obj10"). The property ID is whatever is left
+// so can contain anything, including ':'.
+//
+// The old layout was "objectID:propertyID". Those keys are text so never start with keyFormat
+// (unless the object ID started with \x01...), see MigrateKeys.
+const keyFormat byte = 0x01
+
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// encodeKey generates the key for the object/property.
+func encodeKey(objectID string, propertyID string) []byte {
+	key := objectPrefix(objectID)
+	return append(key, propertyID...)
+}
+
+// objectPrefix is the prefix of all keys for the object.
+func objectPrefix(objectID string) []byte {
+	key := make([]byte, 0, 1+binary.MaxVarintLen64+len(objectID)+32)
+	key = append(key, keyFormat)
+	key = binary.AppendUvarint(key, uint64(len(objectID)))
+	return append(key, objectID...)
+}
+
+// decodeKey splits a key into the object and property IDs.
+func decodeKey(key []byte) (string, string, error) {
+	if len(key) < 2 || key[0] != keyFormat {
+		return "", "", ErrInvalidKey
+	}
+	length, n := binary.Uvarint(key[1:])
+	if n <= 0 || uint64(len(key)-1-n) < length {
+		return "", "", ErrInvalidKey
+	}
+	start := 1 + n
+	end := start + int(length)
+	return string(key[start:end]), string(key[end:]), nil
+}
+
+// prefixUpperBound returns the smallest key greater than every key starting with prefix.
+// Returns nil if there isn't one (prefix is all 0xff), which means no upper bound.
+func prefixUpperBound(prefix []byte) []byte {
+	upper := append([]byte{}, prefix...)
+	for i := len(upper) - 1; i >= 0; i-- {
+		if upper[i] < 0xff {
+			upper[i]++
+			return upper[:i+1]
+		}
+	}
+	return nil
+}
+
+// isLegacyKey returns true if the key is in the old "objectID:propertyID" layout.
+func isLegacyKey(key []byte) bool {
+	return len(key) > 0 && key[0] != keyFormat
+}
+
+// migrateLegacyKey converts an old "objectID:propertyID" key to the new layout. The old layout is
+// ambiguous if the object ID contains ':', so the first ':' is assumed to be the separator.
+func migrateLegacyKey(key []byte) ([]byte, error) {
+	i := bytes.IndexByte(key, ':')
+	if i < 0 {
+		return nil, ErrInvalidKey
+	}
+	return encodeKey(string(key[:i]), string(key[i+1:])), nil
+}
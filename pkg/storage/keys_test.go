@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRoundTrip(t *testing.T) {
+	for _, ids := range [][2]string{
+		{"obj1", "prop1"},
+		{"obj1", "a:b:c"},
+		{"obj:1", "prop"},
+		{"", ""},
+		{"obj1", ""},
+		{string(make([]byte, 300)), "\xff\xff"},
+	} {
+		objectID, propertyID, err := decodeKey(encodeKey(ids[0], ids[1]))
+		assert.Nil(t, err)
+		assert.EqualValues(t, ids[0], objectID)
+		assert.EqualValues(t, ids[1], propertyID)
+	}
+
+	_, _, err := decodeKey([]byte("obj1:prop1"))
+	assert.NotNil(t, err, "Should reject legacy key")
+}
+
+func TestObjectPrefixIsExact(t *testing.T) {
+	prefix := objectPrefix("obj1")
+	assert.True(t, bytes.HasPrefix(encodeKey("obj1", "prop"), prefix))
+	assert.False(t, bytes.HasPrefix(encodeKey("obj10", "prop"), prefix), "obj10 should not match obj1")
+	assert.False(t, bytes.HasPrefix(encodeKey("obj", "1prop"), prefix), "obj + 1prop should not match obj1")
+
+	upper := prefixUpperBound(prefix)
+	assert.True(t, bytes.Compare(encodeKey("obj1", "\xff\xff\xff"), upper) < 0, "All keys for the object should be below the upper bound")
+	assert.Nil(t, prefixUpperBound([]byte{0xff, 0xff}))
+}
+
+func TestPebbleGetIsBoundedToObject(t *testing.T) {
+	db, err := Open("pebble", Options{Path: t.TempDir()})
+	assert.Nil(t, err)
+	db.Add(context.Background(), "obj1", "a:b", []byte("1"), PropertyMetadata{})
+	db.Add(context.Background(), "obj10", "c", []byte("2"), PropertyMetadata{})
+	db.Add(context.Background(), "obj", "1d", []byte("3"), PropertyMetadata{})
+
+	obj, err := db.Get(context.Background(), "obj1")
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string][]byte{"a:b": []byte("1")}, obj.Properties, "Should only get obj1 with full property ID")
+}
+
+func TestBadgerGetIsBoundedToObject(t *testing.T) {
+	db, err := Open("badger", Options{Path: t.TempDir()})
+	assert.Nil(t, err)
+	db.Add(context.Background(), "obj1", "a:b", []byte("1"), PropertyMetadata{})
+	db.Add(context.Background(), "obj10", "c", []byte("2"), PropertyMetadata{})
+
+	obj, err := db.Get(context.Background(), "obj1")
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string][]byte{"a:b": []byte("1")}, obj.Properties)
+}
+
+func TestMigratePebbleKeys(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pebble")
+	pdb, err := pebble.Open(dir, &pebble.Options{})
+	assert.Nil(t, err)
+
+	// old layout, plus a newer value already in the new layout.
+	pdb.Set([]byte("obj1:prop1"), []byte("old1"), pebble.Sync)
+	pdb.Set([]byte("obj1:a:b"), []byte("old2"), pebble.Sync)
+	pdb.Set([]byte("obj10:prop1"), []byte("old3"), pebble.Sync)
+	pdb.Set([]byte("obj1:newer"), []byte("stale"), pebble.Sync)
+	pdb.Set(encodeKey("obj1", "newer"), encodeValue([]byte("new"), PropertyMetadata{Author: "alice"}), pebble.Sync)
+
+	count, err := MigratePebbleKeys(pdb)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 4, count)
+
+	count, err = MigratePebbleKeys(pdb)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, count, "Second run should have nothing to do")
+
+	db, _ := NewPebbleDB(pdb)
+	obj, err := db.Get(context.Background(), "obj1")
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string][]byte{
+		"prop1": []byte("old1"),
+		"a:b":   []byte("old2"),
+		"newer": []byte("new"),
+	}, obj.Properties)
+	assert.Nil(t, pdb.Close())
+}
+
+func TestMigrateBadgerKeys(t *testing.T) {
+	bdb, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	assert.Nil(t, err)
+	defer bdb.Close()
+
+	bdb.Update(func(txn *badger.Txn) error {
+		txn.Set([]byte("obj1:prop1"), []byte("old1"))
+		txn.Set([]byte("obj1:a:b"), []byte("old2"))
+		txn.Set([]byte("obj10:prop1"), []byte("old3"))
+		return nil
+	})
+
+	count, err := MigrateBadgerKeys(bdb)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, count)
+
+	db := &BadgerDB{bdb: bdb}
+	obj, err := db.Get(context.Background(), "obj1")
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string][]byte{"prop1": []byte("old1"), "a:b": []byte("old2")}, obj.Properties)
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+func init() {
+	Register("memory", func(opts Options) (DB, error) {
+		if err := opts.checkSettings(); err != nil {
+			return nil, err
+		}
+		return NewMemoryDB()
+	})
+}
+
+// MemoryDB keeps everything in memory. Unlike NullDB it actually stores the data, so is useful for
+// tests and demos, but everything is lost when the server stops.
+type MemoryDB struct {
+	lock    sync.RWMutex
+	objects map[string]*Object
+	closed  bool
+}
+
+// NewMemoryDB creates an empty MemoryDB
+func NewMemoryDB() (*MemoryDB, error) {
+	db := MemoryDB{objects: make(map[string]*Object)}
+	return &db, nil
+}
+
+// check is called with the lock held.
+func (db *MemoryDB) check(ctx context.Context) error {
+	if db.closed {
+		return ErrClosed
+	}
+	return ctx.Err()
+}
+
+// set is called with the write lock held.
+func (db *MemoryDB) set(objectID string, propertyID string, data []byte, meta PropertyMetadata) {
+	obj, ok := db.objects[objectID]
+	if !ok {
+		obj = NewObject(objectID)
+		db.objects[objectID] = obj
+	}
+
+	// callers may reuse the slice.
+	obj.Properties[propertyID] = append([]byte{}, data...)
+	obj.Metadata[propertyID] = meta
+}
+
+// remove is called with the write lock held. Returns false if the property didn't exist.
+func (db *MemoryDB) remove(objectID string, propertyID string) bool {
+	obj, ok := db.objects[objectID]
+	if !ok {
+		return false
+	}
+	if _, ok := obj.Properties[propertyID]; !ok {
+		return false
+	}
+	delete(obj.Properties, propertyID)
+	delete(obj.Metadata, propertyID)
+	if len(obj.Properties) == 0 {
+		delete(db.objects, objectID)
+	}
+	return true
+}
+
+func (db *MemoryDB) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.check(ctx); err != nil {
+		return err
+	}
+	db.set(objectID, propertyID, data, meta)
+	return nil
+}
+
+// Delete objectID/propertyID from table.
+func (db *MemoryDB) Delete(ctx context.Context, objectID string, propertyID string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.check(ctx); err != nil {
+		return err
+	}
+	if !db.remove(objectID, propertyID) {
+		return fmt.Errorf("delete %s/%s: %w", objectID, propertyID, ErrNotFound)
+	}
+	return nil
+}
+
+// Update an existing objectID/propertyID with new data.
+func (db *MemoryDB) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.check(ctx); err != nil {
+		return err
+	}
+	obj, ok := db.objects[objectID]
+	if !ok {
+		return fmt.Errorf("update %s/%s: %w", objectID, propertyID, ErrNotFound)
+	}
+	if _, ok := obj.Properties[propertyID]; !ok {
+		return fmt.Errorf("update %s/%s: %w", objectID, propertyID, ErrNotFound)
+	}
+	db.set(objectID, propertyID, data, meta)
+	return nil
+}
+
+// Import will take a map of property/data and store it as an object.
+func (db *MemoryDB) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.check(ctx); err != nil {
+		return "", err
+	}
+	if _, ok := db.objects[objectID]; ok {
+		return "", fmt.Errorf("import %s: %w", objectID, ErrConflict)
+	}
+	for k, v := range properties {
+		db.set(objectID, k, v, PropertyMetadata{})
+	}
+	return objectID, nil
+}
+
+// Get returns a copy of the object.
+func (db *MemoryDB) Get(ctx context.Context, objectID string) (*Object, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if err := db.check(ctx); err != nil {
+		return nil, err
+	}
+	obj, ok := db.objects[objectID]
+	if !ok {
+		return nil, fmt.Errorf("get %s: %w", objectID, ErrNotFound)
+	}
+
+	object := NewObject(objectID)
+	for k, v := range obj.Properties {
+		object.Properties[k] = append([]byte{}, v...)
+		object.Metadata[k] = obj.Metadata[k]
+	}
+	return object, nil
+}
+
+// Write applies the batch while holding the lock, so readers never see part of it.
+func (db *MemoryDB) Write(ctx context.Context, batch *Batch) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.check(ctx); err != nil {
+		return err
+	}
+	for _, op := range batch.Ops() {
+		if op.Delete {
+			db.remove(op.ObjectID, op.PropertyID)
+		} else {
+			db.set(op.ObjectID, op.PropertyID, op.Data, op.Meta)
+		}
+	}
+	return nil
+}
+
+// Iterate holds the read lock for the duration, so fn must not call back into the DB to write.
+func (db *MemoryDB) Iterate(ctx context.Context, objectID string, fn IterateFunc) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if err := db.check(ctx); err != nil {
+		return err
+	}
+
+	objects := db.objects
+	if objectID != "" {
+		objects = map[string]*Object{}
+		if obj, ok := db.objects[objectID]; ok {
+			objects[objectID] = obj
+		}
+	}
+
+	for id, obj := range objects {
+		for k, v := range obj.Properties {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if stop, err := stopped(fn(id, k, v, obj.Metadata[k])); stop {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *MemoryDB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.closed = true
+	db.objects = nil
+	return nil
+}
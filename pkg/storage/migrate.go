@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	badger "github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// number of keys rewritten per batch/transaction when migrating.
+const migrateBatchSize = 1000
+
+// MigratePebbleKeys rewrites any keys in the old "objectID:propertyID" layout to the current layout.
+// Must be run with the server stopped. Safe to run more than once. If a key already exists in the new
+// layout it is newer than the old one, so the old one is just removed.
+// Returns the number of keys migrated.
+func MigratePebbleKeys(db *pebble.DB) (int, error) {
+	// pebble iterators see a snapshot of the DB, so batches written while iterating aren't visited.
+	iter := db.NewIter(&pebble.IterOptions{})
+	defer iter.Close()
+
+	count := 0
+	batch := db.NewBatch()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !isLegacyKey(key) {
+			continue
+		}
+
+		newKey, err := migrateLegacyKey(key)
+		if err != nil {
+			log.Warnf("skipping key %q: %v", key, err)
+			continue
+		}
+
+		_, closer, err := db.Get(newKey)
+		switch {
+		case errors.Is(err, pebble.ErrNotFound):
+			value, err := iter.ValueAndErr()
+			if err != nil {
+				return count, err
+			}
+			if err := batch.Set(newKey, value, nil); err != nil {
+				return count, err
+			}
+		case err != nil:
+			return count, err
+		default:
+			closer.Close()
+		}
+
+		if err := batch.Delete(key, nil); err != nil {
+			return count, err
+		}
+		count++
+
+		if count%migrateBatchSize == 0 {
+			if err := batch.Commit(pebble.Sync); err != nil {
+				return count, fmt.Errorf("unable to commit migration batch: %w", err)
+			}
+			batch = db.NewBatch()
+			log.Infof("migrated %d keys", count)
+		}
+	}
+
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return count, fmt.Errorf("unable to commit migration batch: %w", err)
+	}
+	return count, nil
+}
+
+// MigrateBadgerKeys is the same as MigratePebbleKeys but for Badger.
+func MigrateBadgerKeys(db *badger.DB) (int, error) {
+	type kv struct {
+		key   []byte
+		value []byte
+	}
+
+	count := 0
+	var start []byte
+	for {
+		// collect a batch of legacy keys, then rewrite them in a separate transaction.
+		var pending []kv
+		err := db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			for it.Seek(start); it.Valid() && len(pending) < migrateBatchSize; it.Next() {
+				item := it.Item()
+				if !isLegacyKey(item.Key()) {
+					continue
+				}
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				pending = append(pending, kv{key: item.KeyCopy(nil), value: value})
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+		if len(pending) == 0 {
+			return count, nil
+		}
+
+		err = db.Update(func(txn *badger.Txn) error {
+			for _, p := range pending {
+				newKey, err := migrateLegacyKey(p.key)
+				if err != nil {
+					log.Warnf("skipping key %q: %v", p.key, err)
+					continue
+				}
+
+				_, err = txn.Get(newKey)
+				switch {
+				case errors.Is(err, badger.ErrKeyNotFound):
+					if err := txn.Set(newKey, p.value); err != nil {
+						return err
+					}
+				case err != nil:
+					return err
+				}
+				if err := txn.Delete(p.key); err != nil {
+					return err
+				}
+				count++
+			}
+			return nil
+		})
+		if err != nil {
+			return count, fmt.Errorf("unable to commit migration batch: %w", err)
+		}
+
+		// carry on after the last key looked at (skipped keys are still there).
+		start = append(pending[len(pending)-1].key, 0)
+		log.Infof("migrated %d keys", count)
+	}
+}
@@ -1,9 +1,19 @@
 package storage
 
 import (
-	_ "modernc.org/sqlite"
+	"context"
+	"fmt"
 )
 
+func init() {
+	Register("null", func(opts Options) (DB, error) {
+		if err := opts.checkSettings(); err != nil {
+			return nil, err
+		}
+		return NewNullDB()
+	})
+}
+
 // Fake DB...  just for testing
 // wont do anything with the data.
 type NullDB struct {
@@ -15,29 +25,45 @@ func NewNullDB() (*NullDB, error) {
 	return &db, nil
 }
 
-func (db *NullDB) Add(objectID string, propertyID string, data []byte) error {
-	return nil
+func (db *NullDB) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	return ctx.Err()
 }
 
 // Delete objectID/propertyID from table.
-func (db *NullDB) Delete(objectID string, propertyID string) error {
-	return nil
+// Nothing is ever stored, but pretending it was deleted is more useful than ErrNotFound.
+func (db *NullDB) Delete(ctx context.Context, objectID string, propertyID string) error {
+	return ctx.Err()
 }
 
 // Update an existing objectID/propertyID with new data.
-// Given Add has become an upsert, this function can probably go.
-func (db *NullDB) Update(objectID string, propertyID string, data []byte) error {
-	return nil
+func (db *NullDB) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	return ctx.Err()
 }
 
 // Import will take a map of property/data and store it as an object.
-func (db *NullDB) Import(objectID string, properties map[string][]byte) (string, error) {
-	panic("Not implemented")
-	return "", nil
+func (db *NullDB) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return objectID, nil
+}
+
+// Get never finds anything.
+func (db *NullDB) Get(ctx context.Context, objectID string) (*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("get %s: %w", objectID, ErrNotFound)
+}
+
+func (db *NullDB) Write(ctx context.Context, batch *Batch) error {
+	return ctx.Err()
 }
 
-// Get returns an object (id + property/data map)
-func (db *NullDB) Get(objectID string) (*Object, error) {
-	object := Object{ObjectID: objectID}
-	return &object, nil
+func (db *NullDB) Iterate(ctx context.Context, objectID string, fn IterateFunc) error {
+	return ctx.Err()
+}
+
+func (db *NullDB) Close() error {
+	return nil
 }
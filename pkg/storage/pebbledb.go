@@ -2,11 +2,12 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"sync"
 
 	"github.com/cockroachdb/pebble"
-	log "github.com/sirupsen/logrus"
 )
 
 // PebbleIterator... used for mocking in tests
@@ -23,83 +24,288 @@ type PebbleIterator interface {
 // Interface to help mock this out for testing.
 type PebbleMinimal interface {
 	Set(key, value []byte, opts *pebble.WriteOptions) error
+	Get(key []byte) ([]byte, io.Closer, error)
+	Delete(key []byte, opts *pebble.WriteOptions) error
 	NewIter(o *pebble.IterOptions) *pebble.Iterator
+	NewBatch() *pebble.Batch
+	Close() error
 }
 
-// BadgerDB implements the DB interface using BadgerDB
+func init() {
+	// settings:
+	//   sync: fsync every write (default true)
+	Register("pebble", func(opts Options) (DB, error) {
+		if err := opts.checkSettings("sync"); err != nil {
+			return nil, err
+		}
+		if err := opts.requirePath(); err != nil {
+			return nil, err
+		}
+		sync, err := opts.boolSetting("sync", true)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := NewPebbleClient(opts.Path)
+		if err != nil {
+			return nil, err
+		}
+		db, err := NewPebbleDB(client)
+		if err != nil {
+			return nil, err
+		}
+		if !sync {
+			db.writeOptions = pebble.NoSync
+		}
+		return db, nil
+	})
+}
+
+// PebbleDB implements the DB interface using Pebble
 type PebbleDB struct {
 	pdb PebbleMinimal
-	ctx context.Context
+
+	// defaults to pebble.Sync
+	writeOptions *pebble.WriteOptions
+
+	// pebble panics if used after Close, so calls hold the read lock and Close takes the write lock.
+	closeLock sync.RWMutex
+	closed    bool
 }
 
 func NewPebbleClient(dir string) (*pebble.DB, error) {
 	db, err := pebble.Open(dir, &pebble.Options{})
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("unable to open pebble db %s: %w", dir, err)
 	}
 
 	return db, nil
 }
 
-// NewPebbleDB creates new BadgerDB DB connection
+// NewPebbleDB creates new PebbleDB DB connection
 func NewPebbleDB(pdb PebbleMinimal) (*PebbleDB, error) {
 	dbs := PebbleDB{}
 	dbs.pdb = pdb
-	dbs.ctx = context.Background()
+	dbs.writeOptions = pebble.Sync
 	return &dbs, nil
 }
 
-func (db *PebbleDB) Add(objectID string, propertyID string, data []byte) error {
-	key := fmt.Sprintf("%s:%s", objectID, propertyID)
-	if err := db.pdb.Set([]byte(key), data, pebble.Sync); err != nil {
-		log.Fatal(err)
+// begin is called at the start of every call, if it returns nil the caller must call db.end()
+func (db *PebbleDB) begin(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.closeLock.RLock()
+	if db.closed {
+		db.closeLock.RUnlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+func (db *PebbleDB) end() {
+	db.closeLock.RUnlock()
+}
+
+// exists returns true if the property is stored.
+func (db *PebbleDB) exists(key []byte) (bool, error) {
+	_, closer, err := db.pdb.Get(key)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	closer.Close()
+	return true, nil
+}
+
+func (db *PebbleDB) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	if err := db.begin(ctx); err != nil {
+		return err
 	}
+	defer db.end()
 
+	if err := db.pdb.Set(encodeKey(objectID, propertyID), encodeValue(data, meta), db.writeOptions); err != nil {
+		return fmt.Errorf("unable to add %s/%s: %w", objectID, propertyID, err)
+	}
 	return nil
 }
 
 // Delete objectID/propertyID from table.
-func (db *PebbleDB) Delete(objectID string, propertyID string) error {
-	panic("Not implemented")
+func (db *PebbleDB) Delete(ctx context.Context, objectID string, propertyID string) error {
+	if err := db.begin(ctx); err != nil {
+		return err
+	}
+	defer db.end()
+
+	key := encodeKey(objectID, propertyID)
+	found, err := db.exists(key)
+	if err != nil {
+		return fmt.Errorf("unable to delete %s/%s: %w", objectID, propertyID, err)
+	}
+	if !found {
+		return fmt.Errorf("delete %s/%s: %w", objectID, propertyID, ErrNotFound)
+	}
+	if err := db.pdb.Delete(key, db.writeOptions); err != nil {
+		return fmt.Errorf("unable to delete %s/%s: %w", objectID, propertyID, err)
+	}
 	return nil
 }
 
 // Update an existing objectID/propertyID with new data.
-// Given Add has become an upsert, this function can probably go.
-func (db *PebbleDB) Update(objectID string, propertyID string, data []byte) error {
+// The existence check and write aren't atomic, but all writes for an object come from its processor.
+func (db *PebbleDB) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+	if err := db.begin(ctx); err != nil {
+		return err
+	}
+	defer db.end()
 
-	// just do Add...
-	db.Add(objectID, propertyID, data)
+	key := encodeKey(objectID, propertyID)
+	found, err := db.exists(key)
+	if err != nil {
+		return fmt.Errorf("unable to update %s/%s: %w", objectID, propertyID, err)
+	}
+	if !found {
+		return fmt.Errorf("update %s/%s: %w", objectID, propertyID, ErrNotFound)
+	}
+	if err := db.pdb.Set(key, encodeValue(data, meta), db.writeOptions); err != nil {
+		return fmt.Errorf("unable to update %s/%s: %w", objectID, propertyID, err)
+	}
 	return nil
 }
 
 // Import will take a map of property/data and store it as an object.
-func (db *PebbleDB) Import(objectID string, properties map[string][]byte) (string, error) {
-	panic("Not implemented")
-	return "", nil
+func (db *PebbleDB) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
+	if err := db.begin(ctx); err != nil {
+		return "", err
+	}
+	found, err := db.hasObject(objectID)
+	db.end()
+	if err != nil {
+		return "", fmt.Errorf("unable to import %s: %w", objectID, err)
+	}
+	if found {
+		return "", fmt.Errorf("import %s: %w", objectID, ErrConflict)
+	}
+
+	if err := db.Write(ctx, importBatch(objectID, properties)); err != nil {
+		return "", err
+	}
+	return objectID, nil
 }
 
-// Get returns an object (id + property/data map)
-func (db *PebbleDB) Get(objectID string) (*Object, error) {
+// hasObject returns true if the object has any properties.
+func (db *PebbleDB) hasObject(objectID string) (bool, error) {
+	prefix := objectPrefix(objectID)
+	iter := db.pdb.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	found := iter.First()
+	if err := iter.Close(); err != nil {
+		return false, err
+	}
+	return found, nil
+}
 
-	objectProperties := make(map[string][]byte)
+// Get returns an object (id + property/data map)
+func (db *PebbleDB) Get(ctx context.Context, objectID string) (*Object, error) {
+	// empty means every object to Iterate.
+	if objectID == "" {
+		return nil, fmt.Errorf("get %q: %w", objectID, ErrNotFound)
+	}
 
-	iter := db.pdb.NewIter(&pebble.IterOptions{
-		LowerBound: []byte(objectID),
-		UpperBound: []byte(objectID + "\xff"),
+	object := NewObject(objectID)
+	err := db.Iterate(ctx, objectID, func(_ string, propertyID string, data []byte, meta PropertyMetadata) error {
+		// value is only valid until the iterator moves, so copy.
+		object.Properties[propertyID] = append([]byte{}, data...)
+		object.Metadata[propertyID] = meta
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if len(object.Properties) == 0 {
+		return nil, fmt.Errorf("get %s: %w", objectID, ErrNotFound)
+	}
+	return object, nil
+}
+
+// Write commits the batch as a single pebble batch.
+func (db *PebbleDB) Write(ctx context.Context, batch *Batch) error {
+	if err := db.begin(ctx); err != nil {
+		return err
+	}
+	defer db.end()
+
+	pb := db.pdb.NewBatch()
+	defer pb.Close()
+	for _, op := range batch.Ops() {
+		var err error
+		if op.Delete {
+			err = pb.Delete(encodeKey(op.ObjectID, op.PropertyID), nil)
+		} else {
+			err = pb.Set(encodeKey(op.ObjectID, op.PropertyID), encodeValue(op.Data, op.Meta), nil)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to build batch: %w", err)
+		}
+	}
+
+	if err := pb.Commit(db.writeOptions); err != nil {
+		return fmt.Errorf("unable to commit batch: %w", err)
+	}
+	return nil
+}
+
+// Iterate visits the object's keys, or all keys in the current layout if objectID is empty.
+func (db *PebbleDB) Iterate(ctx context.Context, objectID string, fn IterateFunc) error {
+	if err := db.begin(ctx); err != nil {
+		return err
+	}
+	defer db.end()
+
+	opts := &pebble.IterOptions{LowerBound: []byte{keyFormat}, UpperBound: []byte{keyFormat + 1}}
+	if objectID != "" {
+		prefix := objectPrefix(objectID)
+		opts = &pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)}
+	}
+	iter := db.pdb.NewIter(opts)
 
 	for iter.First(); iter.Valid(); iter.Next() {
-		// Only keys beginning with "prefix" will be visited.
-		key := iter.Key()
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return err
+		}
+
+		id, propertyID, err := decodeKey(iter.Key())
+		if err != nil {
+			iter.Close()
+			return err
+		}
 		v, err := iter.ValueAndErr()
 		if err != nil {
-			log.Fatal(err)
+			iter.Close()
+			return err
+		}
+
+		data, meta := decodeValue(v)
+		if stop, err := stopped(fn(id, propertyID, data, meta)); stop {
+			iter.Close()
+			return err
 		}
-		sp := strings.Split(string(key), ":")
-		objectProperties[sp[1]] = v
 	}
+	return iter.Close()
+}
 
-	object := Object{ObjectID: objectID, Properties: objectProperties}
-	return &object, nil
+// Close closes the underlying pebble DB.
+func (db *PebbleDB) Close() error {
+	db.closeLock.Lock()
+	defer db.closeLock.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return db.pdb.Close()
 }
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -32,8 +34,9 @@ func TestAdd(t *testing.T) {
 		t.Errorf(err.Error())
 	}
 
-	pdb.Add("test", "prop1", []byte("prop1"))
-	pdb.Add("test", "prop2", []byte("prop2"))
+	ctx := context.Background()
+	pdb.Add(ctx, "test", "prop1", []byte("prop1"), PropertyMetadata{})
+	pdb.Add(ctx, "test", "prop2", []byte("prop2"), PropertyMetadata{})
 
 	if len(pb.Objects) != 1 {
 		t.Errorf("Expected 1 object map, got %d", len(pb.Objects))
@@ -44,6 +47,28 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestDeleteUpdateMissing(t *testing.T) {
+	pb := NewFakePebble()
+	pdb, _ := NewPebbleDB(pb)
+	ctx := context.Background()
+
+	pdb.Add(ctx, "test", "prop1", []byte("prop1"), PropertyMetadata{})
+	if err := pdb.Update(ctx, "test", "prop2", []byte("x"), PropertyMetadata{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound updating missing property, got %v", err)
+	}
+	if err := pdb.Delete(ctx, "test", "prop1"); err != nil {
+		t.Errorf("Expected delete to succeed, got %v", err)
+	}
+	if err := pdb.Delete(ctx, "test", "prop1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+	}
+
+	pdb.Close()
+	if err := pdb.Add(ctx, "test", "prop1", nil, PropertyMetadata{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after close, got %v", err)
+	}
+}
+
 /*
 func TestGet(t *testing.T) {
 	assert := assert.New(t)
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Options are the settings used to open a backend.
+type Options struct {
+	// Path is the directory (or file for sqlite) the backend stores data in. Ignored by in memory backends.
+	Path string
+
+	// Settings are backend specific (eg. "sync=false" for pebble). Unknown settings are an error
+	// so typos don't go unnoticed.
+	Settings map[string]string
+}
+
+// Factory opens a backend with the given options.
+type Factory func(opts Options) (DB, error)
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]Factory)
+)
+
+// Register makes a backend available by name. Backends register themselves in init()
+// Registering the same name twice panics, same as database/sql.
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("storage backend %s registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Open opens the backend registered as name.
+func Open(name string, opts Options) (DB, error) {
+	registryLock.Lock()
+	factory, ok := registry[name]
+	registryLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q (available: %v)", name, Backends())
+	}
+
+	db, err := factory(opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s backend: %w", name, err)
+	}
+	return db, nil
+}
+
+// Backends returns the names of all registered backends.
+func Backends() []string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkSettings returns an error if there are any settings not in known.
+func (o Options) checkSettings(known ...string) error {
+	for k := range o.Settings {
+		found := false
+		for _, kk := range known {
+			if k == kk {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown setting %q", k)
+		}
+	}
+	return nil
+}
+
+// boolSetting returns the setting as a bool, or def if not set.
+func (o Options) boolSetting(name string, def bool) (bool, error) {
+	v, ok := o.Settings[name]
+	if !ok {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %q", name, v)
+	}
+	return b, nil
+}
+
+// intSetting returns the setting as an int, or def if not set.
+func (o Options) intSetting(name string, def int) (int, error) {
+	v, ok := o.Settings[name]
+	if !ok {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %q", name, v)
+	}
+	return i, nil
+}
+
+// requirePath returns an error if the backend needs a path and doesn't have one.
+func (o Options) requirePath() error {
+	if o.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	return nil
+}
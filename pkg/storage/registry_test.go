@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendsRegistered(t *testing.T) {
+	assert.EqualValues(t, []string{"badger", "memory", "null", "pebble", "sqlite"}, Backends())
+}
+
+func TestOpenUnknown(t *testing.T) {
+	_, err := Open("nosuchbackend", Options{})
+	assert.NotNil(t, err, "Should fail for unknown backend")
+
+	_, err = Open("memory", Options{Settings: map[string]string{"typo": "1"}})
+	assert.NotNil(t, err, "Should fail for unknown setting")
+
+	_, err = Open("pebble", Options{})
+	assert.NotNil(t, err, "Should require path")
+
+	_, err = Open("pebble", Options{Path: t.TempDir(), Settings: map[string]string{"sync": "maybe"}})
+	assert.NotNil(t, err, "Should fail for invalid setting")
+
+	_, err = Open("badger", Options{Path: t.TempDir(), Settings: map[string]string{"sync": "maybe"}})
+	assert.NotNil(t, err, "Should fail for invalid setting")
+}
+
+func TestBadgerSyncsByDefault(t *testing.T) {
+	db, err := Open("badger", Options{Path: t.TempDir()})
+	assert.Nil(t, err)
+	assert.True(t, db.(*BadgerDB).bdb.Opts().SyncWrites, "Should sync unless told not to")
+	assert.Nil(t, db.Close())
+
+	db, err = Open("badger", Options{Path: t.TempDir(), Settings: map[string]string{"sync": "false"}})
+	assert.Nil(t, err)
+	assert.False(t, db.(*BadgerDB).bdb.Opts().SyncWrites)
+	assert.Nil(t, db.Close())
+}
+
+func TestOpenStoresData(t *testing.T) {
+	dir := t.TempDir()
+	for name, opts := range map[string]Options{
+		"memory": {},
+		"pebble": {Path: filepath.Join(dir, "pebble"), Settings: map[string]string{"sync": "false"}},
+		"badger": {Path: filepath.Join(dir, "badger")},
+		"sqlite": {Path: filepath.Join(dir, "test.db")},
+	} {
+		db, err := Open(name, opts)
+		assert.Nil(t, err, "Should open %s", name)
+
+		assert.Nil(t, db.Add(context.Background(), "object1", "prop1", []byte("value1"), PropertyMetadata{Author: "alice"}))
+		obj, err := db.Get(context.Background(), "object1")
+		assert.Nil(t, err)
+		assert.EqualValues(t, "value1", string(obj.Properties["prop1"]), "%s should store data", name)
+		assert.EqualValues(t, "alice", obj.Metadata["prop1"].Author, "%s should store metadata", name)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	for name, opts := range map[string]Options{
+		"memory": {},
+		"pebble": {Path: filepath.Join(dir, "pebble"), Settings: map[string]string{"sync": "false"}},
+		"badger": {Path: filepath.Join(dir, "badger")},
+		"sqlite": {Path: filepath.Join(dir, "test.db")},
+	} {
+		db, err := Open(name, opts)
+		assert.Nil(t, err, "Should open %s", name)
+
+		_, err = db.Get(ctx, "object1")
+		assert.ErrorIs(t, err, ErrNotFound, "%s: get missing object", name)
+		assert.ErrorIs(t, db.Update(ctx, "object1", "prop1", nil, PropertyMetadata{}), ErrNotFound, "%s: update missing property", name)
+		assert.ErrorIs(t, db.Delete(ctx, "object1", "prop1"), ErrNotFound, "%s: delete missing property", name)
+
+		_, err = db.Import(ctx, "object1", map[string][]byte{"prop1": []byte("a"), "prop2": []byte("b")})
+		assert.Nil(t, err, "%s: import", name)
+		_, err = db.Import(ctx, "object1", map[string][]byte{"prop1": []byte("c")})
+		assert.ErrorIs(t, err, ErrConflict, "%s: import existing object", name)
+
+		batch := &Batch{}
+		batch.Set("object1", "prop3", []byte("c"), PropertyMetadata{})
+		batch.Delete("object1", "prop1")
+		assert.Nil(t, db.Write(ctx, batch), "%s: write batch", name)
+
+		seen := map[string]string{}
+		err = db.Iterate(ctx, "", func(objectID string, propertyID string, data []byte, meta PropertyMetadata) error {
+			seen[objectID+"/"+propertyID] = string(data)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.EqualValues(t, map[string]string{"object1/prop2": "b", "object1/prop3": "c"}, seen, "%s: iterate after batch", name)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		assert.ErrorIs(t, db.Add(cancelled, "object1", "prop1", nil, PropertyMetadata{}), context.Canceled, "%s: cancelled context", name)
+
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestMemoryDBCopies(t *testing.T) {
+	db, _ := NewMemoryDB()
+	data := []byte("value")
+	db.Add(context.Background(), "object1", "prop1", data, PropertyMetadata{})
+	data[0] = 'X'
+
+	obj, _ := db.Get(context.Background(), "object1")
+	assert.EqualValues(t, "value", string(obj.Properties["prop1"]), "Should not share caller's slice")
+
+	obj.Properties["prop1"][0] = 'Y'
+	obj, _ = db.Get(context.Background(), "object1")
+	assert.EqualValues(t, "value", string(obj.Properties["prop1"]), "Should return a copy")
+
+	db.Delete(context.Background(), "object1", "prop1")
+	_, err := db.Get(context.Background(), "object1")
+	assert.ErrorIs(t, err, ErrNotFound, "Object with no properties left should be gone")
+}
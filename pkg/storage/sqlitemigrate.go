@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SchemaMigration describes a change to the SQLite schema.
+type SchemaMigration struct {
+	Version int
+	Name    string
+}
+
+// sqliteMigration is a migration plus how to apply it. Migrations are only ever added to the end
+// of the list, never changed once released, since files out there have already had them applied.
+type sqliteMigration struct {
+	SchemaMigration
+	up func(ctx context.Context, tx *sql.Tx) error
+}
+
+// execMigration is a migration that is just some SQL.
+func execMigration(query string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	}
+}
+
+// Files created before there were migrations have no schema_version table but may already have
+// the object table (with or without the metadata columns), so the early migrations have to cope
+// with the change already being there.
+var sqliteMigrations = []sqliteMigration{
+	{
+		SchemaMigration{1, "create object table"},
+		// SQLite ignores the length in varchar(n) so old files with varchar(50) IDs are the same as TEXT.
+		execMigration(`create table if not exists object (object_id TEXT NOT NULL, property_id TEXT NOT NULL, data BLOB, PRIMARY KEY (object_id, property_id))`),
+	},
+	{
+		SchemaMigration{2, "add property metadata columns"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			for _, c := range [][2]string{{"last_modified", "INTEGER"}, {"author", "TEXT"}} {
+				if err := addColumnIfMissing(ctx, tx, "object", c[0], c[1]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		SchemaMigration{3, "add property sequence column"},
+		// not used yet, nothing reads or writes it (a count of writes would be inflated by wal
+		// replays). Kept so files that already have it are at the same version as new ones.
+		execMigration(`ALTER TABLE object ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0`),
+	},
+}
+
+// LatestSQLiteSchemaVersion is the schema version this build creates/migrates to.
+func LatestSQLiteSchemaVersion() int {
+	return sqliteMigrations[len(sqliteMigrations)-1].Version
+}
+
+const createSchemaVersionTable = `create table if not exists schema_version (version INTEGER NOT NULL PRIMARY KEY, name TEXT, applied_at INTEGER)`
+
+// sqliteSchemaVersion returns the current version of the schema, 0 if no migrations have run.
+// Only reads, so it works on a file opened read only.
+func sqliteSchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var tables int
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`).Scan(&tables); err != nil {
+		return 0, fmt.Errorf("unable to check for schema_version table: %w", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+
+	var version sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT max(version) FROM schema_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("unable to get schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// pendingSQLiteMigrations returns the migrations newer than version.
+func pendingSQLiteMigrations(version int) ([]sqliteMigration, error) {
+	if latest := LatestSQLiteSchemaVersion(); version > latest {
+		return nil, fmt.Errorf("sqlite schema version %d is newer than this server supports (%d)", version, latest)
+	}
+
+	var pending []sqliteMigration
+	for _, m := range sqliteMigrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrateSQLite brings the schema up to date, each migration in its own transaction.
+// Returns the migrations applied.
+func migrateSQLite(ctx context.Context, db *sql.DB) ([]SchemaMigration, error) {
+	if _, err := db.ExecContext(ctx, createSchemaVersionTable); err != nil {
+		return nil, fmt.Errorf("unable to create schema_version table: %w", err)
+	}
+	version, err := sqliteSchemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingSQLiteMigrations(version)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []SchemaMigration
+	for _, m := range pending {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return applied, fmt.Errorf("unable to start migration %d: %w", m.Version, err)
+		}
+
+		err = m.up(ctx, tx)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`, m.Version, m.Name, time.Now().Unix())
+		}
+		if err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("sqlite migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, fmt.Errorf("unable to commit migration %d: %w", m.Version, err)
+		}
+
+		log.Infof("applied sqlite migration %d: %s", m.Version, m.Name)
+		applied = append(applied, m.SchemaMigration)
+	}
+	return applied, nil
+}
+
+// openSQLiteForMigration opens the file with a single connection, for the tools.
+func openSQLiteForMigration(filename string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", sqliteDSN(filename, SQLiteOptions{Sync: true}, false))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", filename, err)
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// PendingSQLiteMigrations reports the schema version of the file and the migrations that would be
+// applied when it's next opened. The file is opened read only, so nothing is changed (or created)
+// by checking. The server must be stopped.
+func PendingSQLiteMigrations(filename string) (int, []SchemaMigration, error) {
+	q := url.Values{}
+	q.Add("mode", "ro")
+	q.Add("_pragma", "busy_timeout(5000)")
+	db, err := sql.Open("sqlite", "file:"+filename+"?"+q.Encode())
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to open %s: %w", filename, err)
+	}
+	defer db.Close()
+
+	version, err := sqliteSchemaVersion(context.Background(), db)
+	if err != nil {
+		return 0, nil, err
+	}
+	pending, err := pendingSQLiteMigrations(version)
+	if err != nil {
+		return version, nil, err
+	}
+
+	var migrations []SchemaMigration
+	for _, m := range pending {
+		migrations = append(migrations, m.SchemaMigration)
+	}
+	return version, migrations, nil
+}
+
+// MigrateSQLite applies any pending migrations to the file. The server does this itself when it
+// opens the file, this is for doing it ahead of time. The server must be stopped.
+func MigrateSQLite(filename string) ([]SchemaMigration, error) {
+	db, err := openSQLiteForMigration(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrateSQLite(context.Background(), db)
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createLegacySQLite makes a file the way the server did before migrations (and metadata).
+func createLegacySQLite(t *testing.T, filename string) {
+	db, err := sql.Open("sqlite", filename)
+	require.Nil(t, err)
+	defer db.Close()
+	_, err = db.Exec(`create table if not exists object (object_id varchar(50), property_id varchar(100), data BLOB, PRIMARY KEY (object_id, property_id))`)
+	require.Nil(t, err)
+	_, err = db.Exec(`INSERT INTO object (object_id, property_id, data) VALUES ('obj1', 'prop1', 'old')`)
+	require.Nil(t, err)
+}
+
+func TestSQLiteMigratesLegacyFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	createLegacySQLite(t, filename)
+
+	version, pending, err := PendingSQLiteMigrations(filename)
+	require.Nil(t, err)
+	assert.EqualValues(t, 0, version)
+	assert.Len(t, pending, len(sqliteMigrations))
+
+	db, err := NewDBSQLite(filename, SQLiteOptions{Sync: true})
+	require.Nil(t, err)
+	ctx := context.Background()
+	obj, err := db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, "old", obj.Properties["prop1"], "Existing data should survive migration")
+
+	require.Nil(t, db.Add(ctx, "obj1", "prop1", []byte("new"), PropertyMetadata{Author: "alice"}))
+	require.Nil(t, db.Update(ctx, "obj1", "prop1", []byte("newer"), PropertyMetadata{Author: "alice"}))
+	var sequence int
+	require.Nil(t, db.writer.QueryRow(`SELECT sequence FROM object WHERE object_id = 'obj1' AND property_id = 'prop1'`).Scan(&sequence))
+	assert.EqualValues(t, 0, sequence, "Added by migration 3 but not maintained")
+	require.Nil(t, db.Close())
+
+	version, pending, err = PendingSQLiteMigrations(filename)
+	require.Nil(t, err)
+	assert.EqualValues(t, LatestSQLiteSchemaVersion(), version)
+	assert.Len(t, pending, 0)
+
+	// nothing left to do second time around.
+	applied, err := MigrateSQLite(filename)
+	require.Nil(t, err)
+	assert.Len(t, applied, 0)
+}
+
+func TestSQLiteRejectsNewerSchema(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	_, err := MigrateSQLite(filename)
+	require.Nil(t, err)
+
+	db, err := sql.Open("sqlite", filename)
+	require.Nil(t, err)
+	_, err = db.Exec(`INSERT INTO schema_version (version, name) VALUES (?, 'from the future')`, LatestSQLiteSchemaVersion()+1)
+	require.Nil(t, err)
+	db.Close()
+
+	_, err = NewDBSQLite(filename, SQLiteOptions{Sync: true})
+	assert.NotNil(t, err, "Should refuse a schema it doesn't know")
+}
+
+func TestSQLiteFailedMigrationRollsBack(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	_, err := MigrateSQLite(filename)
+	require.Nil(t, err)
+
+	saved := sqliteMigrations
+	defer func() { sqliteMigrations = saved }()
+	sqliteMigrations = append(append([]sqliteMigration{}, saved...), sqliteMigration{
+		SchemaMigration{LatestSQLiteSchemaVersion() + 1, "half done"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `create table half (id INTEGER)`); err != nil {
+				return err
+			}
+			return errors.New("broken")
+		},
+	})
+
+	_, err = MigrateSQLite(filename)
+	assert.NotNil(t, err)
+
+	version, pending, err := PendingSQLiteMigrations(filename)
+	require.Nil(t, err)
+	assert.EqualValues(t, len(saved), version)
+	assert.Len(t, pending, 1)
+
+	db, err := sql.Open("sqlite", filename)
+	require.Nil(t, err)
+	defer db.Close()
+	var count int
+	require.Nil(t, db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'half'`).Scan(&count))
+	assert.EqualValues(t, 0, count, "Failed migration should leave nothing behind")
+}
+
+func TestSQLitePendingMigrationsReadOnly(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	createLegacySQLite(t, filename)
+
+	version, pending, err := PendingSQLiteMigrations(filename)
+	require.Nil(t, err)
+	assert.EqualValues(t, 0, version, "Missing schema_version should be version 0")
+	assert.Len(t, pending, len(sqliteMigrations))
+
+	db, err := sql.Open("sqlite", filename)
+	require.Nil(t, err)
+	defer db.Close()
+	var count int
+	require.Nil(t, db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'schema_version'`).Scan(&count))
+	assert.EqualValues(t, 0, count, "Checking shouldn't change the file")
+
+	_, _, err = PendingSQLiteMigrations(filepath.Join(t.TempDir(), "missing.db"))
+	assert.NotNil(t, err, "Shouldn't create a missing file")
+}
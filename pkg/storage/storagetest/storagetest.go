@@ -0,0 +1,379 @@
+// Package storagetest is a conformance suite for storage.DB implementations. Every backend (and
+// anything wrapping one) should pass it so they all behave the same way.
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T, dir string) storage.DB {
+//			db, err := storage.Open("pebble", storage.Options{Path: dir})
+//			...
+//			return db
+//		}, storagetest.Options{Persistent: true})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Opener opens the DB under test with its data in dir. Each test gets its own dir, and the
+// reopen tests call Opener again with the same dir after closing the first DB.
+type Opener func(t *testing.T, dir string) storage.DB
+
+// Options describe what the DB under test supports.
+type Options struct {
+	// Persistent DBs keep their data when closed and reopened.
+	Persistent bool
+
+	// LargeValueSize is the size of the value used by the large value test. Defaults to 4MB.
+	LargeValueSize int
+}
+
+// Run runs the whole suite against the DB.
+func Run(t *testing.T, open Opener, opts Options) {
+	if opts.LargeValueSize == 0 {
+		opts.LargeValueSize = 4 << 20
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, db storage.DB, opts Options)
+	}{
+		{"AddGet", testAddGet},
+		{"Overwrite", testOverwrite},
+		{"GetMissing", testGetMissing},
+		{"GetEmptyID", testGetEmptyID},
+		{"EmptyValue", testEmptyValue},
+		{"Delete", testDelete},
+		{"Update", testUpdate},
+		{"Import", testImport},
+		{"Batch", testBatch},
+		{"List", testList},
+		{"IterateStop", testIterateStop},
+		{"OddKeys", testOddKeys},
+		{"LargeValue", testLargeValue},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"Cancelled", testCancelled},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db := open(t, t.TempDir())
+			defer db.Close()
+			test.fn(t, db, opts)
+		})
+	}
+
+	t.Run("Close", func(t *testing.T) {
+		testClose(t, open(t, t.TempDir()))
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		if !opts.Persistent {
+			t.Skip("not persistent")
+		}
+		testReopen(t, open, t.TempDir())
+	})
+}
+
+// mustGet gets the object, failing the test if it isn't there.
+func mustGet(t *testing.T, db storage.DB, objectID string) *storage.Object {
+	t.Helper()
+	obj, err := db.Get(context.Background(), objectID)
+	require.Nil(t, err, "get %q", objectID)
+	require.NotNil(t, obj)
+	return obj
+}
+
+// list returns "objectID/propertyID" => data for everything Iterate visits.
+func list(t *testing.T, db storage.DB, objectID string) map[string]string {
+	t.Helper()
+	seen := map[string]string{}
+	err := db.Iterate(context.Background(), objectID, func(objectID string, propertyID string, data []byte, meta storage.PropertyMetadata) error {
+		seen[objectID+"/"+propertyID] = string(data)
+		return nil
+	})
+	require.Nil(t, err)
+	return seen
+}
+
+func testAddGet(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	require.Nil(t, db.Add(ctx, "object1", "prop1", []byte("value1"), storage.PropertyMetadata{LastModified: now, Author: "alice"}))
+	require.Nil(t, db.Add(ctx, "object1", "prop2", []byte("value2"), storage.PropertyMetadata{}))
+
+	obj := mustGet(t, db, "object1")
+	assert.EqualValues(t, "object1", obj.ObjectID)
+	assert.EqualValues(t, map[string][]byte{"prop1": []byte("value1"), "prop2": []byte("value2")}, obj.Properties)
+	assert.EqualValues(t, "alice", obj.Metadata["prop1"].Author)
+	assert.True(t, now.Equal(obj.Metadata["prop1"].LastModified), "Should keep last modified, got %v", obj.Metadata["prop1"].LastModified)
+	assert.True(t, obj.Metadata["prop2"].LastModified.IsZero(), "Zero time should stay zero")
+}
+
+func testOverwrite(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	require.Nil(t, db.Add(ctx, "object1", "prop1", []byte("a much longer first value"), storage.PropertyMetadata{Author: "alice"}))
+	require.Nil(t, db.Add(ctx, "object1", "prop1", []byte("short"), storage.PropertyMetadata{Author: "bob"}))
+
+	obj := mustGet(t, db, "object1")
+	assert.EqualValues(t, "short", string(obj.Properties["prop1"]))
+	assert.EqualValues(t, "bob", obj.Metadata["prop1"].Author)
+	assert.Len(t, obj.Properties, 1)
+}
+
+func testGetMissing(t *testing.T, db storage.DB, opts Options) {
+	_, err := db.Get(context.Background(), "nope")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+// an empty object ID means every object to Iterate, Get mustn't merge them all into one.
+func testGetEmptyID(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	require.Nil(t, db.Add(ctx, "object1", "colour", []byte("red"), storage.PropertyMetadata{}))
+	require.Nil(t, db.Add(ctx, "object2", "size", []byte("10"), storage.PropertyMetadata{}))
+
+	_, err := db.Get(ctx, "")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+// removals are stored as empty data, which must still come back as a property.
+func testEmptyValue(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	require.Nil(t, db.Add(ctx, "object1", "nil", nil, storage.PropertyMetadata{}))
+	require.Nil(t, db.Add(ctx, "object1", "empty", []byte{}, storage.PropertyMetadata{}))
+
+	obj := mustGet(t, db, "object1")
+	assert.Len(t, obj.Properties, 2)
+	assert.Empty(t, obj.Properties["nil"])
+	assert.Empty(t, obj.Properties["empty"])
+}
+
+func testDelete(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	require.Nil(t, db.Add(ctx, "object1", "prop1", []byte("1"), storage.PropertyMetadata{}))
+	require.Nil(t, db.Add(ctx, "object1", "prop2", []byte("2"), storage.PropertyMetadata{}))
+
+	assert.Nil(t, db.Delete(ctx, "object1", "prop1"))
+	assert.ErrorIs(t, db.Delete(ctx, "object1", "prop1"), storage.ErrNotFound, "Second delete")
+	assert.ErrorIs(t, db.Delete(ctx, "object2", "prop1"), storage.ErrNotFound, "Unknown object")
+	assert.EqualValues(t, map[string][]byte{"prop2": []byte("2")}, mustGet(t, db, "object1").Properties)
+
+	assert.Nil(t, db.Delete(ctx, "object1", "prop2"))
+	_, err := db.Get(ctx, "object1")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "Object with no properties")
+}
+
+func testUpdate(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	assert.ErrorIs(t, db.Update(ctx, "object1", "prop1", []byte("1"), storage.PropertyMetadata{}), storage.ErrNotFound)
+	_, err := db.Get(ctx, "object1")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "Failed update shouldn't create the property")
+
+	require.Nil(t, db.Add(ctx, "object1", "prop1", []byte("1"), storage.PropertyMetadata{}))
+	assert.Nil(t, db.Update(ctx, "object1", "prop1", []byte("2"), storage.PropertyMetadata{Author: "bob"}))
+	obj := mustGet(t, db, "object1")
+	assert.EqualValues(t, "2", string(obj.Properties["prop1"]))
+	assert.EqualValues(t, "bob", obj.Metadata["prop1"].Author)
+}
+
+func testImport(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	props := map[string][]byte{"prop1": []byte("1"), "prop2": []byte("2")}
+	id, err := db.Import(ctx, "object1", props)
+	require.Nil(t, err)
+	assert.EqualValues(t, "object1", id)
+	assert.EqualValues(t, props, mustGet(t, db, "object1").Properties)
+
+	_, err = db.Import(ctx, "object1", map[string][]byte{"prop3": []byte("3")})
+	assert.ErrorIs(t, err, storage.ErrConflict)
+	assert.EqualValues(t, props, mustGet(t, db, "object1").Properties, "Conflicting import shouldn't write anything")
+}
+
+func testBatch(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	require.Nil(t, db.Add(ctx, "object1", "prop1", []byte("1"), storage.PropertyMetadata{}))
+
+	batch := &storage.Batch{}
+	batch.Set("object1", "prop2", []byte("2"), storage.PropertyMetadata{Author: "alice"})
+	batch.Set("object2", "prop1", []byte("3"), storage.PropertyMetadata{})
+	batch.Delete("object1", "prop1")
+	batch.Delete("object1", "missing")
+	batch.Set("object2", "prop1", []byte("4"), storage.PropertyMetadata{})
+	require.Nil(t, db.Write(ctx, batch))
+
+	assert.EqualValues(t, map[string]string{
+		"object1/prop2": "2",
+		"object2/prop1": "4",
+	}, list(t, db, ""), "Later ops in a batch win")
+	assert.EqualValues(t, "alice", mustGet(t, db, "object1").Metadata["prop2"].Author)
+
+	assert.Nil(t, db.Write(ctx, &storage.Batch{}), "Empty batch")
+}
+
+func testList(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	for _, id := range []string{"obj", "obj1", "obj10", "obj2"} {
+		require.Nil(t, db.Add(ctx, id, "p", []byte(id), storage.PropertyMetadata{}))
+	}
+	require.Nil(t, db.Add(ctx, "obj1", "q", []byte("q"), storage.PropertyMetadata{}))
+
+	assert.EqualValues(t, map[string]string{"obj1/p": "obj1", "obj1/q": "q"}, list(t, db, "obj1"), "Should only visit obj1")
+	assert.Empty(t, list(t, db, "missing"))
+
+	all := list(t, db, "")
+	var objects []string
+	for k := range all {
+		objects = append(objects, k)
+	}
+	sort.Strings(objects)
+	assert.EqualValues(t, []string{"obj/p", "obj1/p", "obj1/q", "obj10/p", "obj2/p"}, objects)
+}
+
+func testIterateStop(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		require.Nil(t, db.Add(ctx, "object1", fmt.Sprintf("prop%d", i), []byte("x"), storage.PropertyMetadata{}))
+	}
+
+	count := 0
+	err := db.Iterate(ctx, "object1", func(objectID string, propertyID string, data []byte, meta storage.PropertyMetadata) error {
+		count++
+		if count == 3 {
+			return storage.ErrStopIteration
+		}
+		return nil
+	})
+	assert.Nil(t, err, "ErrStopIteration isn't an error")
+	assert.EqualValues(t, 3, count)
+
+	boom := fmt.Errorf("boom")
+	err = db.Iterate(ctx, "object1", func(objectID string, propertyID string, data []byte, meta storage.PropertyMetadata) error {
+		return boom
+	})
+	assert.ErrorIs(t, err, boom, "Errors from fn are returned")
+}
+
+// IDs are opaque to storage, so separators, prefixes of each other and binary all have to work.
+func testOddKeys(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	ids := [][2]string{
+		{"obj:1", "prop"},
+		{"obj", "1:prop"},
+		{"obj1", "a:b:c"},
+		{"obj1", ""},
+		{"ünïcødé 🙂", "ключ"},
+		{"with space", "and/slash"},
+		{"bin\x00ary", "\xff\x00\x01"},
+		{"'; drop table object; --", "%_"},
+	}
+	for i, id := range ids {
+		require.Nil(t, db.Add(ctx, id[0], id[1], []byte(fmt.Sprint(i)), storage.PropertyMetadata{}), "add %q", id)
+	}
+
+	for i, id := range ids {
+		obj := mustGet(t, db, id[0])
+		assert.EqualValues(t, fmt.Sprint(i), string(obj.Properties[id[1]]), "get %q", id)
+	}
+	assert.Len(t, mustGet(t, db, "obj1").Properties, 2)
+	assert.Len(t, mustGet(t, db, "obj").Properties, 1, "obj shouldn't see obj:1 or obj1")
+	assert.Len(t, list(t, db, ""), len(ids))
+}
+
+func testLargeValue(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	large := bytes.Repeat([]byte("0123456789abcdef"), opts.LargeValueSize/16)
+	require.Nil(t, db.Add(ctx, "object1", "large", large, storage.PropertyMetadata{}))
+
+	obj := mustGet(t, db, "object1")
+	assert.True(t, bytes.Equal(large, obj.Properties["large"]), "Large value should round trip")
+}
+
+func testConcurrentWriters(t *testing.T, db storage.DB, opts Options) {
+	ctx := context.Background()
+	const writers = 8
+	const writes = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*writes*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				// own object plus a shared one.
+				if err := db.Add(ctx, fmt.Sprintf("object%d", w), fmt.Sprintf("prop%d", i), []byte("x"), storage.PropertyMetadata{}); err != nil {
+					errs <- err
+				}
+				if err := db.Add(ctx, "shared", fmt.Sprintf("w%d-%d", w, i), []byte("y"), storage.PropertyMetadata{}); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent write failed: %v", err)
+	}
+
+	for w := 0; w < writers; w++ {
+		assert.Len(t, mustGet(t, db, fmt.Sprintf("object%d", w)).Properties, writes)
+	}
+	assert.Len(t, mustGet(t, db, "shared").Properties, writers*writes)
+}
+
+func testCancelled(t *testing.T, db storage.DB, opts Options) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.ErrorIs(t, db.Add(ctx, "object1", "prop1", []byte("1"), storage.PropertyMetadata{}), context.Canceled)
+	_, err := db.Get(ctx, "object1")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, db.Write(ctx, &storage.Batch{}), context.Canceled)
+
+	_, err = db.Get(context.Background(), "object1")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "Cancelled add shouldn't be stored")
+}
+
+func testClose(t *testing.T, db storage.DB) {
+	ctx := context.Background()
+	require.Nil(t, db.Add(ctx, "object1", "prop1", []byte("1"), storage.PropertyMetadata{}))
+	require.Nil(t, db.Close())
+
+	assert.ErrorIs(t, db.Add(ctx, "object1", "prop1", []byte("1"), storage.PropertyMetadata{}), storage.ErrClosed)
+	_, err := db.Get(ctx, "object1")
+	assert.ErrorIs(t, err, storage.ErrClosed)
+	assert.Nil(t, db.Close(), "Closing twice is fine")
+}
+
+func testReopen(t *testing.T, open Opener, dir string) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	db := open(t, dir)
+	require.Nil(t, db.Add(ctx, "object1", "prop1", []byte("1"), storage.PropertyMetadata{LastModified: now, Author: "alice"}))
+	require.Nil(t, db.Add(ctx, "object1", "prop2", []byte("2"), storage.PropertyMetadata{}))
+	require.Nil(t, db.Delete(ctx, "object1", "prop2"))
+	batch := &storage.Batch{}
+	batch.Set("object2", "prop1", []byte("3"), storage.PropertyMetadata{})
+	require.Nil(t, db.Write(ctx, batch))
+	require.Nil(t, db.Close())
+
+	db = open(t, dir)
+	defer db.Close()
+	obj := mustGet(t, db, "object1")
+	assert.EqualValues(t, map[string][]byte{"prop1": []byte("1")}, obj.Properties)
+	assert.EqualValues(t, "alice", obj.Metadata["prop1"].Author)
+	assert.True(t, now.Equal(obj.Metadata["prop1"].LastModified))
+	assert.EqualValues(t, "3", string(mustGet(t, db, "object2").Properties["prop1"]))
+}
@@ -0,0 +1,444 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// most queued records merged into one backend write.
+	maxApplyGroup = 256
+
+	// how many applied records between checkpoints.
+	checkpointEvery = 1024
+
+	maxApplyBackoff = 5 * time.Second
+
+	// a record that still can't be applied after this many tries stops the applier.
+	maxApplyAttempts = 15
+
+	// how long Close waits for the applier before leaving the rest in the log.
+	defaultCloseTimeout = 30 * time.Second
+
+	// size of the applier's queue.
+	maxPending = 1024
+)
+
+// applyRequest is a record that's in the log but not yet in the backend.
+type applyRequest struct {
+	lsn uint64
+	ops []storage.BatchOp
+}
+
+// DB puts the log in front of a storage.DB. Writes return as soon as they're in the log and are
+// applied to the backend by a background goroutine. Reads (and the writes that have to check
+// what's already stored) first wait for everything written so far to be applied, so callers
+// always see their own writes.
+//
+// The backend must be durable when its Write returns (eg. pebble with sync on), otherwise
+// checkpointing could drop records the backend hasn't really stored yet.
+type DB struct {
+	backend storage.DB
+	log     *Log
+
+	// appendLock keeps records going to the applier in LSN order.
+	appendLock sync.Mutex
+	closed     bool
+	appended   uint64
+	pending    chan applyRequest
+
+	// a slot is taken before appending, so once a record is in the log queueing it can't block.
+	slots chan struct{}
+
+	// appliedLock protects applied and applyErr. appliedCh is closed (and replaced) whenever
+	// either changes.
+	appliedLock sync.Mutex
+	applied     uint64
+	applyErr    error
+	appliedCh   chan struct{}
+
+	// ctx is cancelled to stop the applier.
+	ctx          context.Context
+	stop         context.CancelFunc
+	applierDone  chan struct{}
+	closeTimeout time.Duration
+}
+
+// NewDB replays anything in the log that may not have made it to the backend, then returns the
+// DB ready to use. The DB owns the log and backend, Close closes both.
+func NewDB(backend storage.DB, l *Log) (*DB, error) {
+	count := 0
+	err := l.Replay(func(lsn uint64, ops []storage.BatchOp) error {
+		// records up to the last checkpoint may already be applied, applying them again is harmless.
+		count++
+		return backend.Write(context.Background(), batchOf(ops))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to replay wal: %w", err)
+	}
+
+	last := l.LastLSN()
+	if err := l.Checkpoint(last); err != nil {
+		return nil, fmt.Errorf("unable to checkpoint wal: %w", err)
+	}
+	if count > 0 {
+		log.Infof("wal: replayed %d records", count)
+	}
+
+	db := DB{}
+	db.backend = backend
+	db.log = l
+	db.appended = last
+	db.applied = last
+	db.appliedCh = make(chan struct{})
+	db.pending = make(chan applyRequest, maxPending)
+	db.slots = make(chan struct{}, maxPending)
+	db.ctx, db.stop = context.WithCancel(context.Background())
+	db.applierDone = make(chan struct{})
+	db.closeTimeout = defaultCloseTimeout
+	go db.apply()
+	return &db, nil
+}
+
+func batchOf(ops []storage.BatchOp) *storage.Batch {
+	batch := &storage.Batch{}
+	addOps(batch, ops)
+	return batch
+}
+
+func addOps(batch *storage.Batch, ops []storage.BatchOp) {
+	for _, op := range ops {
+		if op.Delete {
+			batch.Delete(op.ObjectID, op.PropertyID)
+		} else {
+			batch.Set(op.ObjectID, op.PropertyID, op.Data, op.Meta)
+		}
+	}
+}
+
+// apply moves records from the log to the backend. Anything in the log has been acknowledged, so
+// backend failures are retried. A record that keeps failing stops the applier, it and everything
+// after it stay in the log for the next start to replay.
+func (db *DB) apply() {
+	defer close(db.applierDone)
+
+	batch := &storage.Batch{}
+	var reqs []applyRequest
+	var lastCheckpoint uint64
+	for req := range db.pending {
+		<-db.slots
+		reqs = append(reqs[:0], req)
+
+		// merge whatever else is waiting into the same backend write.
+	more:
+		for i := 1; i < maxApplyGroup; i++ {
+			select {
+			case next, ok := <-db.pending:
+				if !ok {
+					break more
+				}
+				<-db.slots
+				reqs = append(reqs, next)
+			default:
+				break more
+			}
+		}
+
+		if db.ctx.Err() != nil {
+			return
+		}
+		if db.err() != nil {
+			// already failed, just keep the queue moving until Close.
+			continue
+		}
+		if err := db.applyGroup(batch, reqs); err != nil {
+			if db.ctx.Err() == nil {
+				db.fail(err)
+			}
+			continue
+		}
+
+		last := reqs[len(reqs)-1].lsn
+		if last-lastCheckpoint >= checkpointEvery {
+			if err := db.log.Checkpoint(last); err != nil {
+				log.Errorf("wal: unable to checkpoint: %v", err)
+			} else {
+				lastCheckpoint = last
+			}
+		}
+	}
+}
+
+// applyGroup writes the records to the backend as one write. If that fails each record is
+// retried on its own, so one bad record can't keep failing the others with it.
+func (db *DB) applyGroup(batch *storage.Batch, reqs []applyRequest) error {
+	batch.Reset()
+	for _, req := range reqs {
+		addOps(batch, req.ops)
+	}
+	err := db.backend.Write(db.ctx, batch)
+	if err == nil {
+		db.setApplied(reqs[len(reqs)-1].lsn)
+		return nil
+	}
+	log.Errorf("wal: unable to apply records %d to %d, retrying one at a time: %v", reqs[0].lsn, reqs[len(reqs)-1].lsn, err)
+
+	for _, req := range reqs {
+		batch.Reset()
+		addOps(batch, req.ops)
+		if err := db.applyRecord(req.lsn, batch); err != nil {
+			return err
+		}
+		db.setApplied(req.lsn)
+	}
+	return nil
+}
+
+// applyRecord writes a single record, retrying errors that may go away (eg. the disk being full).
+func (db *DB) applyRecord(lsn uint64, batch *storage.Batch) error {
+	backoff := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := db.backend.Write(db.ctx, batch)
+		switch {
+		case err == nil:
+			return nil
+		case db.ctx.Err() != nil:
+			return db.ctx.Err()
+		case errors.Is(err, storage.ErrClosed) || attempt == maxApplyAttempts:
+			return fmt.Errorf("unable to apply record %d: %w", lsn, err)
+		}
+		log.Errorf("wal: unable to apply record %d, retrying: %v", lsn, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-db.ctx.Done():
+			return db.ctx.Err()
+		}
+		if backoff *= 2; backoff > maxApplyBackoff {
+			backoff = maxApplyBackoff
+		}
+	}
+}
+
+// fail stops anything more being applied. Reads and writes return err from now on.
+func (db *DB) fail(err error) {
+	log.Errorf("wal: %v, nothing more will be applied until restart", err)
+	db.appliedLock.Lock()
+	db.applyErr = err
+	close(db.appliedCh)
+	db.appliedCh = make(chan struct{})
+	db.appliedLock.Unlock()
+}
+
+// err is why the applier stopped, if it has.
+func (db *DB) err() error {
+	db.appliedLock.Lock()
+	defer db.appliedLock.Unlock()
+	return db.applyErr
+}
+
+func (db *DB) setApplied(lsn uint64) {
+	db.appliedLock.Lock()
+	db.applied = lsn
+	close(db.appliedCh)
+	db.appliedCh = make(chan struct{})
+	db.appliedLock.Unlock()
+}
+
+// waitApplied waits until everything appended so far is in the backend.
+func (db *DB) waitApplied(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.appendLock.Lock()
+	if db.closed {
+		db.appendLock.Unlock()
+		return storage.ErrClosed
+	}
+	target := db.appended
+	db.appendLock.Unlock()
+
+	for {
+		db.appliedLock.Lock()
+		applied, applyErr, ch := db.applied, db.applyErr, db.appliedCh
+		db.appliedLock.Unlock()
+		if applied >= target {
+			return nil
+		}
+		if applyErr != nil {
+			return fmt.Errorf("wal: %w", applyErr)
+		}
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Write appends the batch to the log and returns once it's durable there.
+func (db *DB) Write(ctx context.Context, batch *storage.Batch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	// callers reuse their batches (and slices), the applier needs its own copy.
+	ops := make([]storage.BatchOp, batch.Len())
+	for i, op := range batch.Ops() {
+		op.Data = append([]byte(nil), op.Data...)
+		ops[i] = op
+	}
+
+	if err := db.err(); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+
+	// wait for room in the applier's queue first, once the record is in the log it has to go there.
+	select {
+	case db.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.ctx.Done():
+		return storage.ErrClosed
+	}
+
+	db.appendLock.Lock()
+	defer db.appendLock.Unlock()
+	if db.closed {
+		<-db.slots
+		return storage.ErrClosed
+	}
+
+	lsn, err := db.log.Append(ops)
+	if err != nil {
+		<-db.slots
+		return err
+	}
+	db.appended = lsn
+	db.pending <- applyRequest{lsn: lsn, ops: ops}
+	return nil
+}
+
+func (db *DB) Add(ctx context.Context, objectID string, propertyID string, data []byte, meta storage.PropertyMetadata) error {
+	batch := &storage.Batch{}
+	batch.Set(objectID, propertyID, data, meta)
+	return db.Write(ctx, batch)
+}
+
+// hasProperty checks the backend, once it's caught up.
+func (db *DB) hasProperty(ctx context.Context, objectID string, propertyID string) error {
+	if err := db.waitApplied(ctx); err != nil {
+		return err
+	}
+	obj, err := db.backend.Get(ctx, objectID)
+	if err != nil {
+		return err
+	}
+	if _, ok := obj.Properties[propertyID]; !ok {
+		return fmt.Errorf("%s/%s: %w", objectID, propertyID, storage.ErrNotFound)
+	}
+	return nil
+}
+
+// Delete objectID/propertyID. The delete goes through the log like everything else so it can't
+// be overtaken by an earlier write being replayed.
+func (db *DB) Delete(ctx context.Context, objectID string, propertyID string) error {
+	if err := db.hasProperty(ctx, objectID, propertyID); err != nil {
+		return err
+	}
+	batch := &storage.Batch{}
+	batch.Delete(objectID, propertyID)
+	return db.Write(ctx, batch)
+}
+
+// Update an existing objectID/propertyID with new data.
+func (db *DB) Update(ctx context.Context, objectID string, propertyID string, data []byte, meta storage.PropertyMetadata) error {
+	if err := db.hasProperty(ctx, objectID, propertyID); err != nil {
+		return err
+	}
+	return db.Add(ctx, objectID, propertyID, data, meta)
+}
+
+// Import will take a map of property/data and store it as an object.
+func (db *DB) Import(ctx context.Context, objectID string, properties map[string][]byte) (string, error) {
+	if err := db.waitApplied(ctx); err != nil {
+		return "", err
+	}
+	_, err := db.backend.Get(ctx, objectID)
+	switch {
+	case err == nil:
+		return "", fmt.Errorf("import %s: %w", objectID, storage.ErrConflict)
+	case !errors.Is(err, storage.ErrNotFound):
+		return "", err
+	}
+
+	batch := &storage.Batch{}
+	for k, v := range properties {
+		batch.Set(objectID, k, v, storage.PropertyMetadata{})
+	}
+	if err := db.Write(ctx, batch); err != nil {
+		return "", err
+	}
+	return objectID, nil
+}
+
+// Get returns the object once the backend has caught up.
+func (db *DB) Get(ctx context.Context, objectID string) (*storage.Object, error) {
+	if err := db.waitApplied(ctx); err != nil {
+		return nil, err
+	}
+	return db.backend.Get(ctx, objectID)
+}
+
+// Iterate over the backend once it has caught up.
+func (db *DB) Iterate(ctx context.Context, objectID string, fn storage.IterateFunc) error {
+	if err := db.waitApplied(ctx); err != nil {
+		return err
+	}
+	return db.backend.Iterate(ctx, objectID, fn)
+}
+
+// Close applies everything in the log to the backend, then closes the log and backend. If the
+// backend can't keep up, whatever isn't applied within the close timeout is left in the log for
+// the next start to replay.
+func (db *DB) Close() error {
+	db.appendLock.Lock()
+	if db.closed {
+		db.appendLock.Unlock()
+		return nil
+	}
+	db.closed = true
+	close(db.pending)
+	db.appendLock.Unlock()
+
+	select {
+	case <-db.applierDone:
+	case <-time.After(db.closeTimeout):
+		log.Errorf("wal: records still not applied after %v, leaving them in the log", db.closeTimeout)
+		db.stop()
+		<-db.applierDone
+	}
+	db.stop()
+
+	db.appliedLock.Lock()
+	applied := db.applied
+	db.appliedLock.Unlock()
+	if err := db.log.Checkpoint(applied); err != nil {
+		log.Errorf("wal: unable to checkpoint on close: %v", err)
+	}
+	if err := db.log.Close(); err != nil {
+		return err
+	}
+	return db.backend.Close()
+}
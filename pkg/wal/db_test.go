@@ -0,0 +1,323 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	"github.com/kpfaulkner/collablite/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openDB opens pebble plus the log in dir. Pebble has to sync, it buffers its own log in memory
+// otherwise and checkpointing would drop records pebble hasn't really stored.
+func openDB(t testing.TB, dir string, opts Options) *DB {
+	backend, err := storage.Open("pebble", storage.Options{Path: filepath.Join(dir, "pebbledb")})
+	require.Nil(t, err)
+	l, err := Open(filepath.Join(dir, "wal"), opts)
+	require.Nil(t, err)
+	db, err := NewDB(backend, l)
+	require.Nil(t, err)
+	return db
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, dir string) storage.DB {
+		return openDB(t, dir, Options{})
+	}, storagetest.Options{Persistent: true})
+}
+
+// backend that has lost everything not yet applied, eg. process died between log and backend.
+type droppingDB struct {
+	storage.DB
+	drop bool
+}
+
+func (d *droppingDB) Write(ctx context.Context, batch *storage.Batch) error {
+	if d.drop {
+		return nil
+	}
+	return d.DB.Write(ctx, batch)
+}
+
+func TestReplayAppliesUnappliedRecords(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	backend, _ := storage.NewMemoryDB()
+	dropping := &droppingDB{DB: backend, drop: true}
+	l, err := Open(dir, Options{})
+	require.Nil(t, err)
+	db, err := NewDB(dropping, l)
+	require.Nil(t, err)
+	require.Nil(t, db.Add(ctx, "obj1", "prop1", []byte("1"), storage.PropertyMetadata{Author: "alice"}))
+	require.Nil(t, db.Add(ctx, "obj1", "prop2", []byte("2"), storage.PropertyMetadata{}))
+
+	// pretend we died: nothing reached the backend and the log wasn't checkpointed.
+	l.Close()
+	_, err = backend.Get(ctx, "obj1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	l, err = Open(dir, Options{})
+	require.Nil(t, err)
+	db, err = NewDB(backend, l)
+	require.Nil(t, err)
+	obj, err := db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, map[string][]byte{"prop1": []byte("1"), "prop2": []byte("2")}, obj.Properties)
+	assert.EqualValues(t, "alice", obj.Metadata["prop1"].Author)
+	db.Close()
+}
+
+// backend that fails writes of a property, or blocks all writes until release is closed.
+type failingDB struct {
+	storage.DB
+	failProperty string
+	release      chan struct{}
+}
+
+func (f *failingDB) Write(ctx context.Context, batch *storage.Batch) error {
+	for _, op := range batch.Ops() {
+		if op.PropertyID == f.failProperty {
+			return fmt.Errorf("refusing %s: %w", op.PropertyID, storage.ErrClosed)
+		}
+	}
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return f.DB.Write(ctx, batch)
+}
+
+func TestApplyFailureIsReported(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	backend, _ := storage.NewMemoryDB()
+	l, err := Open(dir, Options{})
+	require.Nil(t, err)
+	db, err := NewDB(&failingDB{DB: backend, failProperty: "bad"}, l)
+	require.Nil(t, err)
+	require.Nil(t, db.Add(ctx, "obj1", "good", []byte("1"), storage.PropertyMetadata{}))
+	require.Nil(t, db.Add(ctx, "obj1", "bad", []byte("2"), storage.PropertyMetadata{}))
+
+	// should give up rather than retry forever.
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err = db.Get(ctx, "obj1")
+	assert.ErrorIs(t, err, storage.ErrClosed)
+	assert.ErrorIs(t, db.Add(ctx, "obj1", "other", []byte("3"), storage.PropertyMetadata{}), storage.ErrClosed, "Should refuse writes once failed")
+	require.Nil(t, db.Close())
+
+	// the failed record is still there for next time.
+	backend, _ = storage.NewMemoryDB()
+	l, err = Open(dir, Options{})
+	require.Nil(t, err)
+	db, err = NewDB(backend, l)
+	require.Nil(t, err)
+	obj, err := db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, "2", string(obj.Properties["bad"]))
+	db.Close()
+}
+
+func TestWriteCancelledWhileQueueFull(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := storage.NewMemoryDB()
+	l, err := Open(t.TempDir(), Options{})
+	require.Nil(t, err)
+	release := make(chan struct{})
+	db, err := NewDB(&failingDB{DB: backend, release: release}, l)
+	require.Nil(t, err)
+
+	// the applier is stuck on the first group, keep writing until the queue behind it fills.
+	written := 0
+	for ; written <= maxPending+maxApplyGroup; written++ {
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		err = db.Add(timeout, "obj1", fmt.Sprintf("prop%d", written), []byte("1"), storage.PropertyMetadata{})
+		cancel()
+		if err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "Should give up waiting for the queue")
+
+	close(release)
+	obj, err := db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.Len(t, obj.Properties, written, "Cancelled write shouldn't be applied")
+	assert.Nil(t, db.Close())
+}
+
+func TestCloseTimesOut(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	backend, _ := storage.NewMemoryDB()
+	l, err := Open(dir, Options{})
+	require.Nil(t, err)
+	db, err := NewDB(&failingDB{DB: backend, release: make(chan struct{})}, l)
+	require.Nil(t, err)
+	db.closeTimeout = 50 * time.Millisecond
+	require.Nil(t, db.Add(ctx, "obj1", "prop1", []byte("1"), storage.PropertyMetadata{}))
+
+	start := time.Now()
+	assert.Nil(t, db.Close())
+	assert.Less(t, time.Since(start), 5*time.Second, "Close shouldn't wait for a stuck backend")
+
+	backend, _ = storage.NewMemoryDB()
+	l, err = Open(dir, Options{})
+	require.Nil(t, err)
+	db, err = NewDB(backend, l)
+	require.Nil(t, err)
+	obj, err := db.Get(ctx, "obj1")
+	require.Nil(t, err)
+	assert.EqualValues(t, "1", string(obj.Properties["prop1"]), "Unapplied record should be replayed")
+	db.Close()
+}
+
+// TestCrashChild is the writer for TestKilledWriterLosesNothing, it only runs in the child process.
+// It writes forever from a few goroutines, printing each change once Write has acknowledged it.
+func TestCrashChild(t *testing.T) {
+	dir := os.Getenv("WAL_CRASH_DIR")
+	if dir == "" {
+		t.Skip("only run by TestKilledWriterLosesNothing")
+	}
+	round := os.Getenv("WAL_CRASH_ROUND")
+
+	// tiny segments so the kill also lands during rotation/checkpointing.
+	db := openDB(t, dir, Options{SegmentSize: 16 << 10})
+	out := bufio.NewWriter(os.Stdout)
+	var outLock sync.Mutex
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			objectID := fmt.Sprintf("object%d", w)
+			deadline := time.Now().Add(10 * time.Second)
+			for i := 0; time.Now().Before(deadline); i++ {
+				batch := &storage.Batch{}
+				size := 1 + r.Intn(5)
+				var props []string
+				for j := 0; j < size; j++ {
+					propertyID := fmt.Sprintf("r%s-%d-%d", round, i, j)
+					batch.Set(objectID, propertyID, []byte(propertyID), storage.PropertyMetadata{})
+					props = append(props, propertyID)
+				}
+				// overwritten every time, must never go backwards.
+				batch.Set(objectID, "counter", []byte(fmt.Sprintf("%s %d", round, i)), storage.PropertyMetadata{})
+				if err := db.Write(context.Background(), batch); err != nil {
+					t.Errorf("write failed: %v", err)
+					return
+				}
+
+				outLock.Lock()
+				for _, p := range props {
+					fmt.Fprintf(out, "ack %s %s\n", objectID, p)
+				}
+				fmt.Fprintf(out, "counter %s %s %d\n", objectID, round, i)
+				out.Flush()
+				outLock.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// TestKilledWriterLosesNothing kills a writing process at random points, and checks every change
+// it acknowledged is there after replaying the log.
+func TestKilledWriterLosesNothing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	acked := map[string]map[string]bool{}
+	counters := map[string][2]int{}
+	for round := 0; round < 8; round++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCrashChild$")
+		cmd.Env = append(os.Environ(), "WAL_CRASH_DIR="+dir, fmt.Sprintf("WAL_CRASH_ROUND=%d", round))
+		stdout, err := cmd.StdoutPipe()
+		require.Nil(t, err)
+		require.Nil(t, cmd.Start())
+
+		started := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			scanner := bufio.NewScanner(stdout)
+			first := true
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				switch {
+				case len(fields) == 3 && fields[0] == "ack":
+					if acked[fields[1]] == nil {
+						acked[fields[1]] = map[string]bool{}
+					}
+					acked[fields[1]][fields[2]] = true
+				case len(fields) == 4 && fields[0] == "counter":
+					rnd, _ := strconv.Atoi(fields[2])
+					i, _ := strconv.Atoi(fields[3])
+					counters[fields[1]] = [2]int{rnd, i}
+				default:
+					continue
+				}
+				if first {
+					first = false
+					close(started)
+				}
+			}
+		}()
+
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+			t.Fatalf("round %d: child never acknowledged anything", round)
+		}
+		time.Sleep(time.Duration(r.Intn(150)) * time.Millisecond)
+		require.Nil(t, cmd.Process.Kill())
+		cmd.Wait()
+		<-done
+
+		// everything acknowledged so far (this round and earlier) must be there.
+		db := openDB(t, dir, Options{SegmentSize: 16 << 10})
+		total := 0
+		for objectID, props := range acked {
+			obj, err := db.Get(context.Background(), objectID)
+			require.Nil(t, err, "round %d: %s missing", round, objectID)
+			for p := range props {
+				total++
+				if !assert.EqualValues(t, p, string(obj.Properties[p]), "round %d: acknowledged %s/%s lost", round, objectID, p) {
+					break
+				}
+			}
+
+			var rnd, i int
+			fmt.Sscanf(string(obj.Properties["counter"]), "%d %d", &rnd, &i)
+			last := counters[objectID]
+			assert.True(t, rnd > last[0] || rnd == last[0] && i >= last[1], "round %d: %s counter went backwards, %d %d < %v", round, objectID, rnd, i, last)
+		}
+		require.Nil(t, db.Close())
+		t.Logf("round %d: %d acknowledged changes all present", round, total)
+	}
+}
@@ -0,0 +1,508 @@
+// Package wal is an append only write ahead log of storage writes. Changes are acknowledged to
+// clients once they're in the log, and applied to the real storage backend afterwards (see DB).
+// If the server dies before they're applied they're replayed from the log on startup.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// The log is a directory of segment files, each named after the LSN (log sequence number) of its
+// first record. Each record is:
+//
+//	uint32 length of payload | uint32 crc32c of lsn+payload | uint64 lsn | payload
+//
+// and the payload is the encoded ops of one batch. Records are only appended, a record that was
+// being written when the server died fails its length or crc check and is cut off when the log
+// is opened. It was never acknowledged, so nothing is lost.
+
+const (
+	headerSize         = 16
+	segmentSuffix      = ".wal"
+	defaultSegmentSize = 64 << 20
+
+	// sanity limit so a corrupt length can't make us allocate the world.
+	maxRecordSize = 1 << 30
+)
+
+var (
+	ErrClosed  = errors.New("wal closed")
+	ErrCorrupt = errors.New("wal corrupt")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Options for the log.
+type Options struct {
+	// SegmentSize is the size a segment grows to before a new one is started. Only whole segments
+	// are removed by Checkpoint. Defaults to 64MB.
+	SegmentSize int64
+}
+
+// Log is the write ahead log. Safe for concurrent use.
+type Log struct {
+	dir  string
+	opts Options
+
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	nextLSN uint64
+	closed  bool
+
+	// first LSN of every segment, in order. The last one is being appended to.
+	segments []uint64
+}
+
+// Open opens (or creates) the log in dir. A partly written record at the end of the log is
+// removed.
+func Open(dir string, opts Options) (*Log, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create wal dir %s: %w", dir, err)
+	}
+
+	l := Log{dir: dir, opts: opts, nextLSN: 1}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	l.segments = segments
+
+	if len(segments) == 0 {
+		if err := l.startSegment(); err != nil {
+			return nil, err
+		}
+		return &l, nil
+	}
+
+	// work out where the last segment really ends.
+	last := segments[len(segments)-1]
+	end, lastLSN, err := scanSegment(l.segmentPath(last), nil)
+	if err != nil && !errors.Is(err, errTornRecord) {
+		return nil, err
+	}
+	if errors.Is(err, errTornRecord) {
+		log.Warnf("wal: removing partly written record from segment %d at offset %d", last, end)
+	}
+
+	f, err := os.OpenFile(l.segmentPath(last), os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open wal segment: %w", err)
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to truncate wal segment: %w", err)
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l.file = f
+	l.size = end
+	l.nextLSN = last
+	if lastLSN != 0 {
+		l.nextLSN = lastLSN + 1
+	}
+	return &l, nil
+}
+
+func (l *Log) segmentPath(first uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", first, segmentSuffix))
+}
+
+// listSegments returns the first LSN of each segment in the dir, sorted.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read wal dir %s: %w", dir, err)
+	}
+
+	var segments []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			log.Warnf("wal: ignoring unexpected file %s", name)
+			continue
+		}
+		segments = append(segments, first)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// startSegment starts a new segment at nextLSN. Called with the lock held (or during Open).
+func (l *Log) startSegment() error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			return fmt.Errorf("unable to close wal segment: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(l.segmentPath(l.nextLSN), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to create wal segment: %w", err)
+	}
+	if err := syncDir(l.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = 0
+	if n := len(l.segments); n == 0 || l.segments[n-1] != l.nextLSN {
+		l.segments = append(l.segments, l.nextLSN)
+	}
+	return nil
+}
+
+// syncDir makes sure new/removed files in the dir are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open wal dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("unable to sync wal dir: %w", err)
+	}
+	return nil
+}
+
+// Append writes the ops as one record and fsyncs it. Once Append returns the ops are durable.
+// Returns the LSN of the record.
+func (l *Log) Append(ops []storage.BatchOp) (uint64, error) {
+	payload := encodeOps(ops)
+	if len(payload) > maxRecordSize {
+		return 0, fmt.Errorf("wal record too large (%d bytes)", len(payload))
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	if l.size >= l.opts.SegmentSize {
+		if err := l.startSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	lsn := l.nextLSN
+	record := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[8:16], lsn)
+	record = append(record, payload...)
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], crcTable))
+
+	if _, err := l.file.Write(record); err != nil {
+		l.rollback()
+		return 0, fmt.Errorf("unable to write wal record: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		l.rollback()
+		return 0, fmt.Errorf("unable to sync wal: %w", err)
+	}
+
+	l.size += int64(len(record))
+	l.nextLSN++
+	return lsn, nil
+}
+
+// rollback removes a failed record. We don't know how much of it made it to disk, so cut it off
+// so the next record isn't behind garbage. Called with the lock held.
+func (l *Log) rollback() {
+	if err := l.file.Truncate(l.size); err != nil {
+		log.Errorf("wal: unable to truncate after failed append: %v", err)
+	}
+	if _, err := l.file.Seek(l.size, io.SeekStart); err != nil {
+		log.Errorf("wal: unable to seek after failed append: %v", err)
+	}
+}
+
+// Replay calls fn for every record in the log, oldest first. Meant for startup, don't Append
+// at the same time.
+func (l *Log) Replay(fn func(lsn uint64, ops []storage.BatchOp) error) error {
+	l.lock.Lock()
+	segments := append([]uint64{}, l.segments...)
+	l.lock.Unlock()
+
+	for _, first := range segments {
+		_, _, err := scanSegment(l.segmentPath(first), fn)
+		if errors.Is(err, errTornRecord) {
+			// Open has already cut off the end of the last segment, so this is real damage.
+			return fmt.Errorf("%w: bad record in segment %d", ErrCorrupt, first)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LastLSN is the LSN of the last record appended, 0 if there are none.
+func (l *Log) LastLSN() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.nextLSN - 1
+}
+
+// Checkpoint tells the log everything up to and including lsn has been applied to storage, so
+// segments holding only those records can be removed.
+func (l *Log) Checkpoint(lsn uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+
+	// if everything is applied and the current segment is big enough, start a new one so it can go.
+	if lsn >= l.nextLSN-1 && l.size >= l.opts.SegmentSize {
+		if err := l.startSegment(); err != nil {
+			return err
+		}
+	}
+
+	// a segment can go once the one after it starts at or before the next unapplied record.
+	removed := 0
+	for len(l.segments) > 1 && l.segments[1] <= lsn+1 {
+		if err := os.Remove(l.segmentPath(l.segments[0])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove wal segment: %w", err)
+		}
+		l.segments = l.segments[1:]
+		removed++
+	}
+	if removed > 0 {
+		return syncDir(l.dir)
+	}
+	return nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.file.Close()
+}
+
+var errTornRecord = errors.New("torn wal record")
+
+// scanSegment reads the records in the segment, calling fn (if not nil) for each. Returns the
+// offset after the last good record and its LSN. If the segment ends with a partly written
+// record, errTornRecord is returned along with the good offset.
+func scanSegment(path string, fn func(lsn uint64, ops []storage.BatchOp) error) (int64, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to open wal segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	var offset int64
+	var lastLSN uint64
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return offset, lastLSN, nil
+			}
+			return offset, lastLSN, errTornRecord
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxRecordSize {
+			return offset, lastLSN, errTornRecord
+		}
+		body := make([]byte, 8+int(length))
+		copy(body, header[8:16])
+		if _, err := io.ReadFull(r, body[8:]); err != nil {
+			return offset, lastLSN, errTornRecord
+		}
+		if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, lastLSN, errTornRecord
+		}
+
+		lsn := binary.BigEndian.Uint64(header[8:16])
+		if fn != nil {
+			ops, err := decodeOps(body[8:])
+			if err != nil {
+				return offset, lastLSN, fmt.Errorf("%w: segment %s lsn %d: %v", ErrCorrupt, filepath.Base(path), lsn, err)
+			}
+			if err := fn(lsn, ops); err != nil {
+				return offset, lastLSN, err
+			}
+		}
+
+		offset += int64(headerSize) + int64(length)
+		lastLSN = lsn
+	}
+}
+
+// op flags
+const (
+	flagDelete byte = 1 << iota
+)
+
+// encodeOps encodes the ops of a batch:
+//
+//	uvarint count, then per op:
+//	flags | uvarint len objectID | objectID | uvarint len propertyID | propertyID |
+//	varint lastModified (unix nanos, 0 for zero time) | uvarint len author | author | uvarint len data | data
+func encodeOps(ops []storage.BatchOp) []byte {
+	size := binary.MaxVarintLen64
+	for _, op := range ops {
+		size += 1 + 4*binary.MaxVarintLen64 + len(op.ObjectID) + len(op.PropertyID) + len(op.Meta.Author) + len(op.Data)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = binary.AppendUvarint(buf, uint64(len(ops)))
+	for _, op := range ops {
+		var flags byte
+		if op.Delete {
+			flags |= flagDelete
+		}
+		buf = append(buf, flags)
+		buf = appendBytes(buf, []byte(op.ObjectID))
+		buf = appendBytes(buf, []byte(op.PropertyID))
+
+		var nanos int64
+		if !op.Meta.LastModified.IsZero() {
+			nanos = op.Meta.LastModified.UnixNano()
+		}
+		buf = binary.AppendVarint(buf, nanos)
+		buf = appendBytes(buf, []byte(op.Meta.Author))
+		buf = appendBytes(buf, op.Data)
+	}
+	return buf
+}
+
+func unixNanos(nanos int64) time.Time {
+	return time.Unix(0, nanos).UTC()
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// decodeOps is the reverse of encodeOps. The ops don't share memory with buf.
+func decodeOps(buf []byte) ([]storage.BatchOp, error) {
+	d := decoder{buf: buf}
+	count := d.uvarint()
+	if d.err != nil || count > uint64(len(buf)) {
+		return nil, errors.New("bad op count")
+	}
+
+	ops := make([]storage.BatchOp, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var op storage.BatchOp
+		flags := d.byte()
+		op.Delete = flags&flagDelete != 0
+		op.ObjectID = string(d.bytes())
+		op.PropertyID = string(d.bytes())
+		if nanos := d.varint(); nanos != 0 {
+			op.Meta.LastModified = unixNanos(nanos)
+		}
+		op.Meta.Author = string(d.bytes())
+		if data := d.bytes(); data != nil {
+			op.Data = append([]byte{}, data...)
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+		ops = append(ops, op)
+	}
+	if len(d.buf) != 0 {
+		return nil, errors.New("trailing bytes")
+	}
+	return ops, nil
+}
+
+// decoder reads the encoding, remembering the first error.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+var errShort = errors.New("short record")
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.err = errShort
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errShort
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errShort
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// bytes returns nil for an empty value.
+func (d *decoder) bytes() []byte {
+	length := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if length > uint64(len(d.buf)) {
+		d.err = errShort
+		return nil
+	}
+	b := d.buf[:length]
+	d.buf = d.buf[length:]
+	if length == 0 {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,141 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/collablite/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replayAll returns every record in the log.
+func replayAll(t *testing.T, l *Log) map[uint64][]storage.BatchOp {
+	records := map[uint64][]storage.BatchOp{}
+	require.Nil(t, l.Replay(func(lsn uint64, ops []storage.BatchOp) error {
+		records[lsn] = ops
+		return nil
+	}))
+	return records
+}
+
+func TestEncodeOpsRoundTrip(t *testing.T) {
+	now := time.Now().UTC()
+	ops := []storage.BatchOp{
+		{ObjectID: "obj1", PropertyID: "prop1", Data: []byte("value"), Meta: storage.PropertyMetadata{LastModified: now, Author: "alice"}},
+		{ObjectID: "obj:1", PropertyID: "", Data: nil},
+		{ObjectID: "obj1", PropertyID: "gone", Delete: true},
+	}
+
+	decoded, err := decodeOps(encodeOps(ops))
+	require.Nil(t, err)
+	require.Len(t, decoded, 3)
+	assert.EqualValues(t, ops[0].Data, decoded[0].Data)
+	assert.True(t, now.Equal(decoded[0].Meta.LastModified))
+	assert.EqualValues(t, "alice", decoded[0].Meta.Author)
+	assert.EqualValues(t, ops[1], decoded[1])
+	assert.EqualValues(t, ops[2], decoded[2])
+
+	_, err = decodeOps(encodeOps(ops)[:10])
+	assert.NotNil(t, err, "Should reject short record")
+}
+
+func TestAppendReplayReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	require.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		lsn, err := l.Append([]storage.BatchOp{{ObjectID: "obj1", PropertyID: "prop", Data: []byte{byte(i)}}})
+		require.Nil(t, err)
+		assert.EqualValues(t, i+1, lsn)
+	}
+	require.Nil(t, l.Close())
+
+	l, err = Open(dir, Options{})
+	require.Nil(t, err)
+	defer l.Close()
+	records := replayAll(t, l)
+	assert.Len(t, records, 3)
+	assert.EqualValues(t, []byte{2}, records[3][0].Data)
+
+	lsn, err := l.Append(nil)
+	require.Nil(t, err)
+	assert.EqualValues(t, 4, lsn, "Should carry on numbering after reopen")
+}
+
+func TestTornRecordIsRemoved(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	require.Nil(t, err)
+	l.Append([]storage.BatchOp{{ObjectID: "obj1", PropertyID: "a", Data: []byte("1")}})
+	l.Append([]storage.BatchOp{{ObjectID: "obj1", PropertyID: "b", Data: []byte("2")}})
+	l.Close()
+
+	// chop the last record in half, as if we died while writing it.
+	path := filepath.Join(dir, "00000000000000000001.wal")
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Nil(t, os.Truncate(path, info.Size()-3))
+
+	l, err = Open(dir, Options{})
+	require.Nil(t, err)
+	defer l.Close()
+	records := replayAll(t, l)
+	assert.Len(t, records, 1)
+	assert.EqualValues(t, "a", records[1][0].PropertyID)
+
+	lsn, err := l.Append([]storage.BatchOp{{ObjectID: "obj1", PropertyID: "c"}})
+	require.Nil(t, err)
+	assert.EqualValues(t, 2, lsn, "Torn record's LSN is reused")
+	assert.Len(t, replayAll(t, l), 2)
+}
+
+func TestCorruptRecordInOldSegment(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{SegmentSize: 1})
+	require.Nil(t, err)
+	l.Append([]storage.BatchOp{{ObjectID: "obj1", PropertyID: "a", Data: []byte("1")}})
+	l.Append([]storage.BatchOp{{ObjectID: "obj1", PropertyID: "b", Data: []byte("2")}})
+	l.Close()
+
+	// flip a byte in the payload of the first (not last) segment.
+	path := filepath.Join(dir, "00000000000000000001.wal")
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	require.Nil(t, os.WriteFile(path, data, 0o644))
+
+	l, err = Open(dir, Options{SegmentSize: 1})
+	require.Nil(t, err)
+	defer l.Close()
+	err = l.Replay(func(lsn uint64, ops []storage.BatchOp) error { return nil })
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestCheckpointRemovesAppliedSegments(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{SegmentSize: 1})
+	require.Nil(t, err)
+	defer l.Close()
+
+	// segment size of 1 means a segment per record.
+	for i := 0; i < 5; i++ {
+		_, err := l.Append([]storage.BatchOp{{ObjectID: "obj1", PropertyID: "prop"}})
+		require.Nil(t, err)
+	}
+	segments, _ := listSegments(dir)
+	assert.EqualValues(t, []uint64{1, 2, 3, 4, 5}, segments)
+
+	require.Nil(t, l.Checkpoint(3))
+	segments, _ = listSegments(dir)
+	assert.EqualValues(t, []uint64{4, 5}, segments, "Segments with only applied records should go")
+	assert.Len(t, replayAll(t, l), 2)
+
+	require.Nil(t, l.Checkpoint(5))
+	segments, _ = listSegments(dir)
+	assert.EqualValues(t, []uint64{6}, segments, "Full segment should be rolled over and removed")
+	assert.Len(t, replayAll(t, l), 0)
+}